@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/charmbracelet/x/term"
+)
+
+// How many ports above a taken one we try when offering another
+const adjacentPorts = 10
+
+// What to do about a failed bind, or "" if there's nothing more useful to say
+// than the error itself. flag is the one that picks the port.
+func bindHint(localAddr *net.UDPAddr, err error, flag string) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Sprintf("Port %d is already in use, maybe by another p2p that's still running. Stop it, or pick another port with %s.", localAddr.Port, flag)
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fmt.Sprintf("Not allowed to bind to port %d. Ports below 1024 need root, so pick one above 1023 with %s.", localAddr.Port, flag)
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return fmt.Sprintf("%s isn't one of this machine's addresses. Check -bind and -iface.", localAddr.IP)
+	}
+	return ""
+}
+
+// Says why binding failed and exits
+func bindFailed(w io.Writer, localAddr *net.UDPAddr, err error, flag string) {
+	fmt.Fprintf(w, "Failed to bind to %s: %v\n", localAddr, err)
+	if hint := bindHint(localAddr, err, flag); hint != "" {
+		fmt.Fprintln(w, hint)
+	}
+	os.Exit(1)
+}
+
+// Offers to bind to one of the ports just above a taken one instead, when
+// there's someone at the terminal to ask
+func bindAdjacent(localAddr *net.UDPAddr, err error) (*net.UDPConn, error) {
+	if !errors.Is(err, syscall.EADDRINUSE) || localAddr.Port == 0 || !isTerminal(os.Stdin) {
+		return nil, err
+	}
+	fmt.Printf("Port %d is already in use. Try the next free port instead? [Y/n] ", localAddr.Port)
+	answer, readErr := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); readErr != nil || (answer != "" && answer != "y" && answer != "yes") {
+		return nil, err
+	}
+
+	for port := localAddr.Port + 1; port <= min(localAddr.Port+adjacentPorts, 65535); port++ {
+		conn, portErr := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Port: port})
+		if portErr == nil {
+			fmt.Printf("Using port %d, so give peers that one\n", port)
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Whether f is a terminal rather than a pipe, a file or /dev/null
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(f.Fd())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"p2p"
+	"p2p/internal/irc"
+)
+
+// Mirrors the conversation into an IRC channel and back, for `p2p bridge`,
+// so someone can chat from their IRC client
+func bridge(args []string) {
+	flags := flag.NewFlagSet("bridge", flag.ExitOnError)
+	localPort := flags.Int("lport", 0, "Local port to bind to, any free port if 0")
+	var remoteAddrs peerFlags
+	flags.Var(&remoteAddrs, "peer", "Remote peer as ip:port, repeat for a group chat")
+	server := flags.String("irc", "", "IRC server as host:port, e.g. irc.libera.chat:6697")
+	useTLS := flags.Bool("tls", false, "Connect to the IRC server over TLS")
+	nick := flags.String("nick", "p2pbridge", "Nick to join the IRC channel as")
+	channel := flags.String("channel", "", "IRC channel to mirror the conversation into, e.g. #p2p")
+	logLevel := flags.String("log-level", "info", "How much to log: debug, info, warn or error")
+	configPath := flags.String("config", defaultConfigPath(), "Config file, overridden by flags")
+	_ = flags.Parse(args)
+
+	if *server == "" || *channel == "" {
+		fmt.Println("Error: -irc and -channel are required")
+		fmt.Println("Usage:")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to read config file %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	if *localPort == 0 {
+		*localPort = cfg.LocalPort
+	}
+	if len(remoteAddrs) == 0 {
+		for _, peer := range cfg.Peers {
+			if err := remoteAddrs.Set(peer); err != nil {
+				fmt.Printf("Invalid peer in config file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if err := setupLogging(os.Stderr, *logLevel); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	session, err := p2p.Listen(fmt.Sprintf(":%d", *localPort))
+	if err != nil {
+		bindFailed(os.Stdout, &net.UDPAddr{Port: *localPort}, err, "-lport")
+	}
+	defer session.Close()
+	for _, addr := range remoteAddrs {
+		_ = session.AddPeer(addr.String())
+	}
+
+	client, err := irc.Dial(*server, *nick, *channel, *useTLS)
+	if err != nil {
+		fmt.Printf("Failed to connect to %s: %v\n", *server, err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	session.OnPeerStateChange(func(peer *net.UDPAddr, state p2p.PeerState) {
+		slog.Info("peer state changed", "peer", peer, "state", state)
+		client.Say(fmt.Sprintf("* %s is %s", peer, state))
+	})
+	go func() {
+		for message := range session.Receive() {
+			client.Say(fmt.Sprintf("<%s> %s", message.From, message.Text))
+		}
+	}()
+
+	fmt.Printf("Bridging %s to %s on %s\n", session.LocalAddr(), *channel, *server)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case message, ok := <-client.Messages():
+			if !ok {
+				fmt.Println("Lost the connection to the IRC server")
+				return
+			}
+			if err := session.Send(fmt.Sprintf("<%s> %s", message.Nick, message.Text)); err != nil {
+				slog.Warn("sending to peers failed", "err", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Every subcommand and its flags, for shell completion. Keep this in sync
+// with the flags each subcommand defines.
+var completions = map[string][]string{
+	"chat":       {"-lport", "-rip", "-rport", "-peer", "-room", "-log", "-log-level", "-trace", "-pcap", "-bind", "-iface", "-read-buffer", "-write-buffer", "-preflight", "-simulate-loss", "-simulate-latency", "-simulate-reorder", "-fec", "-punch-interval", "-no-color", "-history", "-api", "-config", "-profile", "-discovery"},
+	"serve":      {"-port", "-log-level", "-metrics", "-relay-rate", "-request-rate", "-require-token", "-key", "-mailbox", "-status", "-status-token"},
+	"probe":      {"-lport", "-config", "-discovery", "-timeout", "-bind", "-iface", "-full"},
+	"send":       {"-lport", "-peer", "-config", "-timeout", "-bind", "-iface"},
+	"pipe":       {"-lport", "-peer", "-config", "-timeout", "-bind", "-iface", "-read-buffer", "-write-buffer", "-log-level"},
+	"daemon":     {"-lport", "-peer", "-socket", "-history", "-log-level", "-config", "-discovery", "-punch-interval", "-tray"},
+	"open":       {"-socket"},
+	"bridge":     {"-lport", "-peer", "-irc", "-tls", "-nick", "-channel", "-log-level", "-config"},
+	"version":    {},
+	"completion": {"bash", "zsh", "fish", "powershell"},
+}
+
+// Prints a completion script for the given shell, for `p2p completion`.
+// `p2p completion profiles` lists the saved profiles, which the scripts call.
+func completion(args []string) {
+	flags := flag.NewFlagSet("completion", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath(), "Config file to read profiles from")
+	_ = flags.Parse(args)
+
+	switch flags.Arg(0) {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	case "powershell":
+		fmt.Print(powershellCompletion())
+	case "profiles":
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			os.Exit(1)
+		}
+		for _, name := range sortedKeys(cfg.Profiles) {
+			fmt.Println(name)
+		}
+	default:
+		fmt.Println("Usage: p2p completion bash|zsh|fish|powershell")
+		os.Exit(1)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func bashCompletion() string {
+	var cases string
+	for _, command := range sortedKeys(completions) {
+		cases += fmt.Sprintf("    %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", command, strings.Join(completions[command], " "))
+	}
+
+	return fmt.Sprintf(`# p2p bash completion, load with: source <(p2p completion bash)
+_p2p() {
+  local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+  if [[ "$prev" == -profile || "$prev" == --profile ]]; then
+    COMPREPLY=($(compgen -W "$(p2p completion profiles 2>/dev/null)" -- "$cur"))
+    return
+  fi
+  if [[ $COMP_CWORD -eq 1 && "$cur" != -* ]]; then
+    COMPREPLY=($(compgen -W %q -- "$cur"))
+    return
+  fi
+  local command="${COMP_WORDS[1]}"
+  [[ "$command" == -* ]] && command=chat
+  case "$command" in
+%s  esac
+}
+complete -F _p2p p2p
+`, strings.Join(sortedKeys(completions), " "), cases)
+}
+
+func zshCompletion() string {
+	var cases string
+	for _, command := range sortedKeys(completions) {
+		cases += fmt.Sprintf("    %s) compadd -- %s ;;\n", command, strings.Join(completions[command], " "))
+	}
+
+	return fmt.Sprintf(`#compdef p2p
+# p2p zsh completion, load with: source <(p2p completion zsh)
+_p2p() {
+  if [[ ${words[CURRENT-1]} == -profile || ${words[CURRENT-1]} == --profile ]]; then
+    compadd -- ${(f)"$(p2p completion profiles 2>/dev/null)"}
+    return
+  fi
+  if (( CURRENT == 2 )) && [[ ${words[CURRENT]} != -* ]]; then
+    compadd -- %s
+    return
+  fi
+  local command=${words[2]}
+  [[ $command == -* ]] && command=chat
+  case $command in
+%s  esac
+}
+compdef _p2p p2p
+`, strings.Join(sortedKeys(completions), " "), cases)
+}
+
+func fishCompletion() string {
+	output := "# p2p fish completion, load with: p2p completion fish | source\n"
+	output += "complete -c p2p -f\n"
+	output += fmt.Sprintf("complete -c p2p -n __fish_use_subcommand -a %q\n", strings.Join(sortedKeys(completions), " "))
+	for _, command := range sortedKeys(completions) {
+		for _, word := range completions[command] {
+			if strings.HasPrefix(word, "-") {
+				output += fmt.Sprintf("complete -c p2p -n '__fish_seen_subcommand_from %s' -o %s\n", command, strings.TrimPrefix(word, "-"))
+			} else {
+				output += fmt.Sprintf("complete -c p2p -n '__fish_seen_subcommand_from %s' -a %s\n", command, word)
+			}
+		}
+	}
+	output += "complete -c p2p -o profile -x -a '(p2p completion profiles 2>/dev/null)'\n"
+	return output
+}
+
+func powershellCompletion() string {
+	var cases string
+	for _, command := range sortedKeys(completions) {
+		quoted := make([]string, len(completions[command]))
+		for i, word := range completions[command] {
+			quoted[i] = "'" + word + "'"
+		}
+		cases += fmt.Sprintf("        '%s' { $candidates = @(%s) }\n", command, strings.Join(quoted, ", "))
+	}
+
+	return fmt.Sprintf(`# p2p PowerShell completion, load with: p2p completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName p2p -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    if ($wordToComplete -eq '') { $words += '' }
+    $previous = $words[$words.Count - 2]
+    if ($previous -eq '-profile' -or $previous -eq '--profile') {
+        $candidates = @(p2p completion profiles 2>$null)
+    } elseif ($words.Count -eq 2 -and -not $wordToComplete.StartsWith('-')) {
+        $candidates = '%s' -split ' '
+    } else {
+        $command = $words[1]
+        if ($command.StartsWith('-')) { $command = 'chat' }
+        $candidates = @()
+        switch ($command) {
+%s        }
+    }
+    $candidates | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`, strings.Join(sortedKeys(completions), " "), cases)
+}
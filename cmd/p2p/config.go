@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"p2p/internal/hooks"
+	"p2p/internal/media"
+	"p2p/internal/ui"
+)
+
+// Settings read from the config file. Flags and environment variables take
+// precedence over anything set here.
+type config struct {
+	LocalPort     int            `toml:"local_port,omitempty"`
+	Peers         []string       `toml:"peers,omitempty"` // Peers to chat with when none are given as flags
+	Room          string         `toml:"room,omitempty"`
+	Discovery     string         `toml:"discovery,omitempty"`     // Discovery server as host:port, the port defaulting to 50000, or several separated by commas to use the closest
+	DiscoveryKey  string         `toml:"discovery_key,omitempty"` // The key `p2p serve -key` prints, to ignore answers the server didn't sign, or one for each discovery server separated by commas
+	HistoryPath   string         `toml:"history_path,omitempty"`  // Where the transcript is kept between sessions, off when empty
+	MaxMessages   int            `toml:"max_messages,omitempty"`  // How many messages the chat keeps in memory, 1000 by default
+	IdentityKey   string         `toml:"identity_key,omitempty"`  // Path to our identity key
+	LogPath       string         `toml:"log_path,omitempty"`
+	LogLevel      string         `toml:"log_level,omitempty"`      // debug, info, warn or error
+	FEC           bool           `toml:"fec,omitempty"`            // Send parity frames peers can rebuild lost frames from, for lossy links
+	PunchInterval time.Duration  `toml:"punch_interval,omitempty"` // How often to send each peer a keepalive, like "5s"
+	Theme         ui.Theme       `toml:"theme,omitempty"`
+	Keymap        ui.Keymap      `toml:"keymap,omitempty"`
+	Audio         media.Settings `toml:"audio,omitempty"`        // Microphone and speakers for calls and voice notes
+	Hooks         []hooks.Hook   `toml:"hooks,omitempty"`        // Commands to run on every message from a peer
+	PluginsDir    string         `toml:"plugins_dir,omitempty"`  // Where plugins are loaded from
+	Nick          string         `toml:"nick,omitempty"`         // The name peers see us by, which /nick sets
+	QuitAtOnce    bool           `toml:"quit_at_once,omitempty"` // Quit on the first ctrl+c rather than asking for another
+	AwayAfter     time.Duration  `toml:"away_after,omitempty"`   // How long without typing before we're away, like "10m", which it is by default, or never if negative
+
+	Profiles map[string]profile `toml:"profiles,omitempty"`
+}
+
+// Everything needed to chat with the same people again, picked with -profile
+type profile struct {
+	Peers        []string `toml:"peers,omitempty"`
+	Room         string   `toml:"room,omitempty"`
+	Discovery    string   `toml:"discovery,omitempty"`
+	DiscoveryKey string   `toml:"discovery_key,omitempty"`
+	IdentityKey  string   `toml:"identity_key,omitempty"`
+	Nick         string   `toml:"nick,omitempty"`
+}
+
+// Where the config file lives unless -config says otherwise
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "p2p", "config.toml")
+}
+
+// Reads the config file, which doesn't have to exist
+func loadConfig(path string) (config, error) {
+	var cfg config
+	if path == "" {
+		return cfg, nil
+	}
+	if _, err := toml.DecodeFile(path, &cfg); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Overrides the config with a profile's settings
+func (c config) withProfile(name string) (config, error) {
+	if name == "" {
+		return c, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return c, fmt.Errorf("no profile named %q", name)
+	}
+
+	if len(p.Peers) > 0 {
+		c.Peers = p.Peers
+	}
+	if p.Room != "" {
+		c.Room = p.Room
+	}
+	if p.Discovery != "" {
+		c.Discovery = p.Discovery
+		c.DiscoveryKey = p.DiscoveryKey
+	}
+	if p.IdentityKey != "" {
+		c.IdentityKey = p.IdentityKey
+	}
+	if p.Nick != "" {
+		c.Nick = p.Nick
+	}
+	return c, nil
+}
+
+// Keeps the name /nick set in the config file, in the profile we chatted
+// with if any. The file is written anew, so comments in it are lost.
+func saveNick(path, profileName, nick string) error {
+	if path == "" {
+		return errors.New("no config file")
+	}
+	// edited as it's written rather than as a config, so nothing else changes
+	file := map[string]any{}
+	if _, err := toml.DecodeFile(path, &file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	profiles, _ := file["profiles"].(map[string]any)
+	if p, ok := profiles[profileName].(map[string]any); ok && profileName != "" {
+		p["nick"] = nick
+	} else {
+		file["nick"] = nick
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".config-*.toml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := toml.NewEncoder(f).Encode(file); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"p2p"
+	"p2p/internal/history"
+	"p2p/internal/hooks"
+	"p2p/internal/transport"
+	"p2p/internal/ui"
+)
+
+// Where the daemon listens for frontends unless -socket says otherwise
+func defaultSocketPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "p2p", "daemon.sock")
+}
+
+// Keeps the conversation going without the TUI, for `p2p daemon`. Frontends
+// talk to it with JSON-RPC over a unix socket, see daemonService.
+func daemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	localPort := flags.Int("lport", 0, "Local port to bind to, any free port if 0")
+	var remoteAddrs peerFlags
+	flags.Var(&remoteAddrs, "peer", "Remote peer as ip:port, repeat for a group chat")
+	socketPath := flags.String("socket", defaultSocketPath(), "Unix socket to serve the control API on")
+	historyPath := flags.String("history", "", "File to keep the transcript in between sessions")
+	logLevel := flags.String("log-level", "info", "How much to log: debug, info, warn or error")
+	configPath := flags.String("config", defaultConfigPath(), "Config file, overridden by flags")
+	discoveryFlag := flags.String("discovery", "", "Discovery servers, separated by commas, to hand back to the chat when it takes over")
+	room := flags.String("room", "", "Room to hand back to the chat when it takes over")
+	fecFlag := flags.Bool("fec", false, "Send parity frames so peers rebuild a lost message without it being resent")
+	bind := flags.String("bind", "", "Local IP address to bind to, any if empty")
+	iface := flags.String("iface", "", "Network interface to bind to, e.g. eth0 or a VPN's tun0")
+	profileName := flags.String("profile", "", "Profile from the config file to connect with")
+	punchInterval := flags.Duration("punch-interval", transport.PunchInterval, "How often to send each peer a keepalive, from 100ms to 15s")
+	trayFlag := flags.Bool("tray", false, "Show a tray icon counting unread messages, which brings the chat back when clicked")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to read config file %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	cfg, err = cfg.withProfile(*profileName)
+	if err != nil {
+		fmt.Printf("Invalid profile: %v\n", err)
+		os.Exit(1)
+	}
+	if *localPort == 0 {
+		*localPort = cfg.LocalPort
+	}
+	if *historyPath == "" {
+		*historyPath = cfg.HistoryPath
+	}
+	if *punchInterval == transport.PunchInterval && cfg.PunchInterval != 0 {
+		*punchInterval = cfg.PunchInterval
+	}
+	if err := transport.SetPunchInterval(*punchInterval); err != nil {
+		fmt.Printf("Invalid punch interval: %v\n", err)
+		os.Exit(1)
+	}
+	if len(remoteAddrs) == 0 {
+		for _, peer := range cfg.Peers {
+			if err := remoteAddrs.Set(peer); err != nil {
+				fmt.Printf("Invalid peer in config file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if err := setupLogging(os.Stderr, *logLevel); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	transport.FEC = *fecFlag
+
+	// what the chat was started with, which it gets back along with the port
+	// and peers. The daemon doesn't keep up our room membership itself, but
+	// everyone in the room is among the peers.
+	chatArgs := carriedArgs(*discoveryFlag, *room, *bind, *iface, *profileName, *fecFlag)
+
+	localAddr := fmt.Sprintf(":%d", *localPort)
+	if *bind != "" || *iface != "" {
+		localAddr = net.JoinHostPort(resolveBind(*bind, *iface).String(), strconv.Itoa(*localPort))
+	}
+	session, err := p2p.Listen(localAddr)
+	if err != nil {
+		bindFailed(os.Stdout, &net.UDPAddr{IP: resolveBind(*bind, *iface), Port: *localPort}, err, "-lport")
+	}
+	defer session.Close()
+	for _, addr := range remoteAddrs {
+		_ = session.AddPeer(addr.String())
+	}
+	session.OnPeerStateChange(func(peer *net.UDPAddr, state p2p.PeerState) {
+		slog.Info("peer state changed", "peer", peer, "state", state)
+	})
+
+	listener, err := listenControl(*socketPath)
+	if err != nil {
+		fmt.Printf("Failed to listen on %s: %v\n", *socketPath, err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+
+	service := &daemonService{
+		session:     session,
+		historyPath: *historyPath,
+		configPath:  *configPath,
+		chatArgs:    chatArgs,
+		hooks:       cfg.Hooks,
+		maxMessages: cfg.MaxMessages,
+		changed:     make(chan struct{}),
+		handedOver:  make(chan struct{}),
+	}
+	if service.maxMessages <= 0 {
+		service.maxMessages = ui.DefaultMaxMessages
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("P2P", service); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	// keep going when the terminal we were started from closes, and so does
+	// the tray icon, which inherits this
+	signal.Ignore(syscall.SIGHUP)
+	if *trayFlag {
+		exe, err := os.Executable()
+		if err == nil {
+			service.tray, err = startTray([]string{exe, "open", "-socket", *socketPath})
+		}
+		if err != nil {
+			slog.Warn("running without a tray icon", "err", err)
+		} else {
+			defer service.tray.Close()
+		}
+	}
+	go service.receive()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+
+	fmt.Printf("Chatting from %s, control socket %s\n", session.LocalAddr(), *socketPath)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-stop:
+	case <-service.handedOver:
+		// give the handover's reply time to go out before we exit
+		time.Sleep(handoverGrace)
+	}
+}
+
+// How long the daemon lingers after handing the conversation over
+const handoverGrace = 200 * time.Millisecond
+
+// Listens on a unix socket, clearing away one left behind by a daemon that
+// didn't exit cleanly, but not one that's still in use
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another daemon is already listening")
+	}
+	_ = os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// The daemon's JSON-RPC API, served as P2P.Send, P2P.Receive, P2P.Status and
+// P2P.Handover
+type daemonService struct {
+	session     *p2p.Session
+	historyPath string
+	configPath  string
+	chatArgs    []string // Flags the chat gets back on Handover, besides the port, peers and history
+	hooks       []hooks.Hook
+	tray        *trayIcon     // Counts unread messages, if we have one
+	handedOver  chan struct{} // Closed once the chat has taken the conversation back
+	handover    sync.Once
+
+	mu          sync.Mutex
+	messages    []DaemonMessage // The latest messages, older ones only live in the history file
+	maxMessages int
+	seq         int           // Seq of the latest message
+	changed     chan struct{} // Closed and replaced whenever a message arrives
+	unread      int           // Messages from peers, for the tray icon
+}
+
+// A message in the daemon's transcript
+type DaemonMessage struct {
+	Seq    int       `json:"seq"` // Position in the transcript, for Receive's After
+	Time   time.Time `json:"time"`
+	From   string    `json:"from,omitempty"` // ip:port of the sender, empty for our own messages
+	Via    string    `json:"via,omitempty"`
+	Text   string    `json:"text"`
+	Direct bool      `json:"direct,omitempty"`
+}
+
+type SendArgs struct {
+	Text string `json:"text"`
+}
+
+type SendReply struct {
+	Seq int `json:"seq"`
+}
+
+type ReceiveArgs struct {
+	After int `json:"after"` // Only messages with a higher seq
+	Wait  int `json:"wait"`  // Milliseconds to wait for one if there are none yet
+}
+
+type ReceiveReply struct {
+	Messages []DaemonMessage `json:"messages"`
+}
+
+type StatusArgs struct{}
+
+type StatusReply struct {
+	LocalAddr string       `json:"local_addr"`
+	Peers     []PeerStatus `json:"peers"`
+	Messages  int          `json:"messages"` // Sent and received since the daemon started
+}
+
+type PeerStatus struct {
+	Addr  string `json:"addr"`
+	State string `json:"state"`
+}
+
+type HandoverArgs struct{}
+
+type HandoverReply struct {
+	Args []string `json:"args"` // Flags for p2p chat to carry on with the conversation
+}
+
+// Sends a message to every peer
+func (d *daemonService) Send(args SendArgs, reply *SendReply) error {
+	if args.Text == "" {
+		return fmt.Errorf("nothing to send")
+	}
+	if err := d.session.Send(args.Text); err != nil {
+		return err
+	}
+	reply.Seq = d.add(DaemonMessage{Time: time.Now(), Text: args.Text}, true)
+	return nil
+}
+
+// Sends a hook's output, like Send
+func (d *daemonService) reply(text string) {
+	if err := d.Send(SendArgs{Text: text}, &SendReply{}); err != nil {
+		slog.Warn("sending hook output failed", "err", err)
+	}
+}
+
+// Returns the messages after the given seq, waiting up to Wait for one
+func (d *daemonService) Receive(args ReceiveArgs, reply *ReceiveReply) error {
+	deadline := time.After(time.Duration(args.Wait) * time.Millisecond)
+	for {
+		d.mu.Lock()
+		for _, message := range d.messages {
+			if message.Seq > args.After {
+				reply.Messages = append(reply.Messages, message)
+			}
+		}
+		changed := d.changed
+		d.mu.Unlock()
+
+		if len(reply.Messages) > 0 || args.Wait <= 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// Reports our address and how reachable each peer is
+func (d *daemonService) Status(_ StatusArgs, reply *StatusReply) error {
+	reply.LocalAddr = d.session.LocalAddr().String()
+	for _, peer := range d.session.Peers() {
+		reply.Peers = append(reply.Peers, PeerStatus{Addr: peer.String(), State: d.session.PeerState(peer).String()})
+	}
+	d.mu.Lock()
+	reply.Messages = d.seq
+	d.mu.Unlock()
+	return nil
+}
+
+// Stops the daemon so the chat can carry on with its port, peers and
+// history, for `p2p open`
+func (d *daemonService) Handover(_ HandoverArgs, reply *HandoverReply) error {
+	reply.Args = []string{"-lport", strconv.Itoa(d.session.LocalAddr().Port), "-config", d.configPath}
+	if d.historyPath != "" {
+		reply.Args = append(reply.Args, "-history", d.historyPath)
+	}
+	reply.Args = append(reply.Args, d.chatArgs...)
+	for _, peer := range d.session.Peers() {
+		reply.Args = append(reply.Args, "-peer", peer.String())
+	}
+	// free the port before the chat binds it
+	if err := d.session.Close(); err != nil {
+		slog.Warn("closing the session failed", "err", err)
+	}
+	d.handover.Do(func() { close(d.handedOver) })
+	return nil
+}
+
+// Collects messages from our peers until the session closes
+func (d *daemonService) receive() {
+	for message := range d.session.Receive() {
+		received := DaemonMessage{Time: message.Time, From: message.From.String(), Text: message.Text, Direct: message.Direct}
+		if message.Via != nil {
+			received.Via = message.Via.String()
+		}
+		d.add(received, false)
+	}
+}
+
+// Adds a message to the transcript and the history file, waking up anyone
+// waiting in Receive and running hooks on messages from peers
+func (d *daemonService) add(message DaemonMessage, self bool) int {
+	d.mu.Lock()
+	d.seq++
+	message.Seq = d.seq
+	d.messages = append(d.messages, message)
+	if excess := len(d.messages) - d.maxMessages; excess > 0 {
+		d.messages = slices.Delete(d.messages, 0, excess)
+	}
+	close(d.changed)
+	d.changed = make(chan struct{})
+	if !self && d.tray != nil {
+		d.unread++
+		d.tray.unread(d.unread)
+	}
+	d.mu.Unlock()
+
+	record := history.Record{Time: message.Time, Text: message.Text, Self: self, Direct: message.Direct, Via: message.Via}
+	if self {
+		record.Sender = "(You) localhost"
+		record.Port = d.session.LocalAddr().Port
+	} else if from, err := net.ResolveUDPAddr("udp", message.From); err == nil {
+		record.Sender, record.Port, record.Peer = from.IP.String(), from.Port, from.String()
+		hooks.Run(d.hooks, record, d.reply)
+	}
+	if d.historyPath != "" {
+		if err := history.Append(d.historyPath, record); err != nil {
+			slog.Error("writing history failed", "path", d.historyPath, "err", err)
+		}
+	}
+	return message.Seq
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+
+	"p2p/internal/history"
+	"p2p/internal/transport"
+)
+
+// How long /detach waits for the daemon to start listening
+const detachTimeout = 5 * time.Second
+
+// Where the transcript is kept while the daemon holds the conversation, when
+// the chat wasn't keeping one
+func detachedHistoryPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "p2p", "detached.jsonl")
+}
+
+// Hands the chat's port, peers and transcript over to a daemon with a tray
+// icon, for /detach, so the conversation carries on once the terminal is
+// closed. `p2p open` brings it back, with the rest of the flags the chat was
+// started with, which the daemon keeps for it.
+func detach(localPort int, peers []*net.UDPAddr, chatArgs []string, historyPath, configPath, logPath string, transcript []history.Record) error {
+	socketPath := defaultSocketPath()
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return errors.New("a daemon is already running")
+	}
+
+	if historyPath == "" {
+		historyPath = detachedHistoryPath()
+		_ = os.Remove(historyPath)
+		for _, record := range transcript {
+			if err := history.Append(historyPath, record); err != nil {
+				return fmt.Errorf("keeping the transcript in %s: %w", historyPath, err)
+			}
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"daemon", "-tray", "-lport", strconv.Itoa(localPort), "-history", historyPath, "-config", configPath, "-punch-interval", transport.PunchInterval.String()}
+	args = append(args, chatArgs...)
+	for _, peer := range peers {
+		args = append(args, "-peer", peer.String())
+	}
+	log, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = log, log
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	deadline := time.After(detachTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("the daemon stopped (%v), see %s", err, logPath)
+		case <-deadline:
+			return fmt.Errorf("the daemon didn't start listening on %s, see %s", socketPath, logPath)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+}
+
+// The flags, besides the port, peers and history, that the daemon is started
+// with and hands back to the chat, so it carries on the way it started
+func carriedArgs(discovery, room, bind, iface, profile string, fec bool) []string {
+	var args []string
+	for _, flag := range []struct{ name, value string }{
+		{"-discovery", discovery},
+		{"-room", room},
+		{"-bind", bind},
+		{"-iface", iface},
+		{"-profile", profile},
+	} {
+		if flag.value != "" {
+			args = append(args, flag.name, flag.value)
+		}
+	}
+	if fec {
+		args = append(args, "-fec")
+	}
+	return args
+}
+
+// Takes the conversation back from the daemon and carries on with it in the
+// chat, for `p2p open`. Run from somewhere other than a terminal, like the
+// tray icon, it opens a terminal window for the chat.
+func open(args []string) {
+	flags := flag.NewFlagSet("open", flag.ExitOnError)
+	socketPath := flags.String("socket", defaultSocketPath(), "Unix socket the daemon serves its control API on")
+	_ = flags.Parse(args)
+
+	inTerminal := term.IsTerminal(os.Stdin.Fd())
+	var terminal []string
+	if !inTerminal {
+		var err error
+		if terminal, err = findTerminal(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	client, err := jsonrpc.Dial("unix", *socketPath)
+	if err != nil {
+		fmt.Printf("Failed to reach the daemon on %s: %v\n", *socketPath, err)
+		os.Exit(1)
+	}
+	var reply HandoverReply
+	err = client.Call("P2P.Handover", HandoverArgs{}, &reply)
+	client.Close()
+	if err != nil {
+		fmt.Printf("The daemon wouldn't hand over the conversation: %v\n", err)
+		os.Exit(1)
+	}
+
+	if inTerminal {
+		chat(reply.Args)
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	window := exec.Command(terminal[0], append(append(terminal[1:], exe, "chat"), reply.Args...)...)
+	if err := window.Start(); err != nil {
+		fmt.Printf("Failed to open a terminal: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Terminal emulators and how each is told to run a command, the first one
+// installed being used. $TERMINAL comes first when it's set.
+var terminals = [][]string{
+	{"x-terminal-emulator", "-e"},
+	{"gnome-terminal", "--"},
+	{"konsole", "-e"},
+	{"xfce4-terminal", "-x"},
+	{"alacritty", "-e"},
+	{"kitty"},
+	{"xterm", "-e"},
+}
+
+var errNoTerminal = errors.New("no terminal emulator found, set $TERMINAL or run p2p open from a terminal")
+
+func findTerminal() ([]string, error) {
+	candidates := terminals
+	if env := strings.Fields(os.Getenv("TERMINAL")); len(env) > 0 {
+		candidates = append([][]string{append(env, "-e")}, terminals...)
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err == nil {
+			return candidate, nil
+		}
+	}
+	return nil, errNoTerminal
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Peers given on the command line with repeated -peer ip:port flags
+type peerFlags []*net.UDPAddr
+
+func (p *peerFlags) String() string {
+	addrs := make([]string, len(*p))
+	for i, addr := range *p {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (p *peerFlags) Set(value string) error {
+	addr, err := net.ResolveUDPAddr("udp", value)
+	if err != nil {
+		return fmt.Errorf("invalid peer address %q: %w", value, err)
+	}
+	*p = append(*p, addr)
+	return nil
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/api"
+	"p2p/internal/crash"
+	"p2p/internal/discovery"
+	"p2p/internal/history"
+	"p2p/internal/hooks"
+	"p2p/internal/transport"
+	"p2p/internal/ui"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func main() {
+	crash.Version = version
+
+	// without a subcommand we chat, like before subcommands existed
+	command, args := "chat", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "chat":
+		chat(args)
+	case "serve":
+		serve(args)
+	case "probe":
+		probe(args)
+	case "send":
+		send(args)
+	case "daemon":
+		daemon(args)
+	case "bridge":
+		bridge(args)
+	case "pipe":
+		pipe(args)
+	case "open":
+		open(args)
+	case "version":
+		fmt.Printf("p2p %s\n", version)
+	case "completion":
+		completion(args)
+	default:
+		fmt.Printf("Error: unknown command %q\n", command)
+		fmt.Println("Usage: p2p [chat|serve|probe|send|pipe|daemon|open|bridge|version|completion] [flags]")
+		os.Exit(1)
+	}
+}
+
+// Resolves the discovery servers given as a flag, falling back to the
+// discovery_ip environment variable and then the config file. Several can be
+// given separated by commas, for the closest to be used. Hostnames are
+// resolved and the port is optional. With discovery_key in the config, only
+// answers the servers signed with it are believed.
+func resolveDiscovery(flagValue string, cfg config) []*net.UDPAddr {
+	list := flagValue
+	if list == "" {
+		list = os.Getenv("discovery_ip")
+	}
+	if list == "" {
+		list = cfg.Discovery
+	}
+	if list == "" {
+		fmt.Println("Error: no discovery server, pass -discovery host:port or set discovery_ip")
+		os.Exit(1)
+	}
+
+	var servers []*net.UDPAddr
+	for _, server := range strings.Split(list, ",") {
+		server = strings.TrimSpace(server)
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, strconv.Itoa(discovery.DefaultPort))
+		}
+		discoveryAddr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			fmt.Printf("Invalid discovery server %s: %v\n", server, err)
+			os.Exit(1)
+		}
+		servers = append(servers, discoveryAddr)
+	}
+	pinDiscoveryKeys(servers, cfg.DiscoveryKey)
+	return servers
+}
+
+// Pins the keys discovery_key gives, one for every server in the order they
+// were given, separated by commas, or one for them all. A server whose key is
+// left empty is believed whatever it answers.
+func pinDiscoveryKeys(servers []*net.UDPAddr, keys string) {
+	if keys == "" {
+		return
+	}
+	list := strings.Split(keys, ",")
+	if len(list) != 1 && len(list) != len(servers) {
+		fmt.Printf("Invalid discovery_key: %d keys for %d discovery servers\n", len(list), len(servers))
+		os.Exit(1)
+	}
+	for i, server := range servers {
+		text := list[min(i, len(list)-1)]
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		key, err := discovery.ParseServerKey(text)
+		if err != nil {
+			fmt.Printf("Invalid discovery_key for %s: %v\n", server, err)
+			os.Exit(1)
+		}
+		discovery.PinServerKey(server, key)
+	}
+}
+
+// Starts out with the closest of several discovery servers, measuring the
+// round trip to each from ip, the one we'll chat from
+func closestDiscovery(all []*net.UDPAddr, ip net.IP) *discovery.Servers {
+	servers := discovery.NewServers(all)
+	if len(all) < 2 {
+		return servers
+	}
+	rtts := discovery.Measure(all, ip, preflightTimeout)
+	if closest, rtt, ok := discovery.Closest(all, rtts); ok {
+		servers.Use(closest)
+		fmt.Printf("Using discovery server %s, the closest at %s\n", closest, rtt.Round(time.Millisecond))
+	} else {
+		fmt.Printf("No discovery server answered within %s, trying %s\n", preflightTimeout, all[0])
+	}
+	return servers
+}
+
+// Sizes the kernel's socket buffers from -read-buffer and -write-buffer, so
+// bursts aren't dropped before we get to read them. Zero leaves the OS default.
+func tuneBuffers(conn *net.UDPConn, read, write int) error {
+	if read > 0 {
+		if err := conn.SetReadBuffer(read); err != nil {
+			return fmt.Errorf("setting the read buffer to %d bytes: %w", read, err)
+		}
+	}
+	if write > 0 {
+		if err := conn.SetWriteBuffer(write); err != nil {
+			return fmt.Errorf("setting the write buffer to %d bytes: %w", write, err)
+		}
+	}
+	return nil
+}
+
+// Picks the local address to bind to from -bind or -iface, so multi-homed
+// hosts send from the address the discovery server sees. Without either the
+// OS picks, per destination.
+func resolveBind(bind, iface string) net.IP {
+	switch {
+	case bind != "" && iface != "":
+		fmt.Println("Error: pass either -bind or -iface, not both")
+		os.Exit(1)
+	case bind != "":
+		ip := net.ParseIP(bind)
+		if ip == nil {
+			fmt.Printf("Invalid bind address: %s\n", bind)
+			os.Exit(1)
+		}
+		return ip
+	case iface != "":
+		ip, err := transport.InterfaceIP(iface)
+		if err != nil {
+			fmt.Printf("Invalid interface %s: %v\n", iface, err)
+			os.Exit(1)
+		}
+		return ip
+	}
+	return net.ParseIP("0.0.0.0")
+}
+
+// Runs the chat TUI, for `p2p chat`
+func chat(args []string) {
+	flags := flag.NewFlagSet("chat", flag.ExitOnError)
+	localPort := flags.Int("lport", 0, "Local port to bind to, any free port if 0")
+	remoteIP := flags.String("rip", "", "Remote IP address")
+	remotePort := flags.Int("rport", 0, "Remote port")
+	var remoteAddrs peerFlags
+	flags.Var(&remoteAddrs, "peer", "Remote peer as ip:port, repeat for a group chat")
+	room := flags.String("room", "", "Room on the discovery server to find peers in")
+	logPath := flags.String("log", "", "File to log to, rotated as it grows")
+	logLevel := flags.String("log-level", "", "How much to log: debug, info, warn or error")
+	trace := flags.Bool("trace", false, "Log every datagram sent and received")
+	pcapPath := flags.String("pcap", "", "Write every datagram sent and received to this pcap file")
+	bind := flags.String("bind", "", "Local IP address to bind to, any if empty")
+	iface := flags.String("iface", "", "Network interface to bind to, e.g. eth0 or a VPN's tun0")
+	readBuffer := flags.Int("read-buffer", 0, "Socket receive buffer size in bytes, the OS default if 0")
+	writeBuffer := flags.Int("write-buffer", 0, "Socket send buffer size in bytes, the OS default if 0")
+	preflightFlag := flags.Bool("preflight", false, "Check the discovery server answers before starting, and explain what's wrong if not")
+	simulateLoss := flags.Float64("simulate-loss", 0, "Fraction of datagrams to drop on purpose, e.g. 0.1")
+	simulateLatency := flags.Duration("simulate-latency", 0, "Delay to add to every datagram sent, e.g. 200ms")
+	simulateReorder := flags.Float64("simulate-reorder", 0, "Fraction of sent datagrams to deliver out of order, e.g. 0.05")
+	punchInterval := flags.Duration("punch-interval", transport.PunchInterval, "How often to send each peer a keepalive, from 100ms to 15s, less often to save data and battery")
+	fecFlag := flags.Bool("fec", false, "Send parity frames so peers rebuild a lost message or chunk without it being resent, for lossy links")
+	noColorFlag := flags.Bool("no-color", false, "Render without colors or styling, also enabled by NO_COLOR")
+	historyPath := flags.String("history", "", "File to keep the transcript in between sessions")
+	apiAddr := flags.String("api", "", "Address to serve the HTTP and WebSocket API on, e.g. 127.0.0.1:7777")
+	configPath := flags.String("config", defaultConfigPath(), "Config file, overridden by flags")
+	profileName := flags.String("profile", "", "Profile from the config file to connect with")
+	discoveryFlag := flags.String("discovery", "", "Discovery server as host:port, or several separated by commas to use the closest, overrides the discovery_ip environment variable")
+
+	_ = flags.Parse(args)
+
+	// On the first run, set up a config file instead of demanding flags
+	if _, err := os.Stat(*configPath); os.IsNotExist(err) && len(remoteAddrs) == 0 && *room == "" && *remoteIP == "" {
+		if !runWizard(*configPath) {
+			os.Exit(1)
+		}
+		chat(args)
+		return
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to read config file %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	cfg, err = cfg.withProfile(*profileName)
+	if err != nil {
+		fmt.Printf("Invalid profile: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Fill in whatever wasn't given as a flag from the config file
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["lport"] {
+		*localPort = cfg.LocalPort
+	}
+	if !set["room"] {
+		*room = cfg.Room
+	}
+	if !set["history"] {
+		*historyPath = cfg.HistoryPath
+	}
+	if !set["log"] {
+		*logPath = cfg.LogPath
+	}
+	if !set["log-level"] {
+		*logLevel = cfg.LogLevel
+	}
+	if !set["fec"] {
+		*fecFlag = cfg.FEC
+	}
+	if !set["punch-interval"] && cfg.PunchInterval != 0 {
+		*punchInterval = cfg.PunchInterval
+	}
+	if err := transport.SetPunchInterval(*punchInterval); err != nil {
+		fmt.Printf("Invalid punch interval: %v\n", err)
+		os.Exit(1)
+	}
+	if len(remoteAddrs) == 0 && *remoteIP == "" {
+		for _, peer := range cfg.Peers {
+			if err := remoteAddrs.Set(peer); err != nil {
+				fmt.Printf("Invalid peer in config file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if *logPath == "" {
+		*logPath = defaultLogPath()
+	}
+	if *logLevel == "" {
+		*logLevel = "info"
+	}
+	logFile, err := openRotatingFile(*logPath)
+	if err != nil {
+		fmt.Printf("Failed to open log file %s: %v\n", *logPath, err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+	if err := setupLogging(logFile, *logLevel); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg.Theme.Apply()
+	cfg.Audio.Apply()
+	transport.FEC = *fecFlag
+	if *noColorFlag || os.Getenv("NO_COLOR") != "" {
+		ui.DisableColor()
+	}
+
+	identityPath := cfg.IdentityKey
+	if identityPath == "" {
+		identityPath = defaultIdentityPath()
+	}
+	identity, err := loadIdentity(identityPath)
+	if err != nil {
+		fmt.Printf("Failed to load identity key %s: %v\n", identityPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Your identity is %s\n", transport.Fingerprint(identity.Public().(ed25519.PublicKey)))
+
+	// Validate flags
+	if *remoteIP != "" && *remotePort == 0 {
+		fmt.Println("Error: -rport is required with -rip")
+		fmt.Println("Usage:")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	if len(*room) > discovery.MaxRoomName {
+		fmt.Printf("Error: room names are at most %d bytes\n", discovery.MaxRoomName)
+		os.Exit(1)
+	}
+
+	localAddr := &net.UDPAddr{
+		IP:   resolveBind(*bind, *iface),
+		Port: *localPort,
+	}
+	servers := closestDiscovery(resolveDiscovery(*discoveryFlag, cfg), localAddr.IP)
+	discoveryAddr := servers.Current()
+
+	socket, err := net.ListenUDP("udp", localAddr)
+	if err != nil && *preflightFlag {
+		preflightBindFailed(localAddr, err)
+	}
+	if err != nil {
+		socket, err = bindAdjacent(localAddr, err)
+	}
+	if err != nil {
+		bindFailed(os.Stdout, localAddr, err, "-lport")
+	}
+	if err := tuneBuffers(socket, *readBuffer, *writeBuffer); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// so a socket that died while the machine slept can be replaced
+	rebindable := transport.NewRebindable(socket)
+	defer rebindable.Close()
+	// innermost, so what's urgent jumps ahead of whatever's waiting for the
+	// socket
+	var conn transport.Conn = transport.NewPrioritized(rebindable)
+	if *trace {
+		conn = transport.Traced{Conn: conn}
+	}
+	if *pcapPath != "" {
+		captured, err := transport.NewPcap(conn, *pcapPath)
+		if err != nil {
+			fmt.Printf("Failed to create pcap file %s: %v\n", *pcapPath, err)
+			os.Exit(1)
+		}
+		defer captured.Close()
+		conn = captured
+	}
+	// outermost, so -trace and -pcap only see what really went over the wire
+	if *simulateLoss > 0 || *simulateLatency > 0 || *simulateReorder > 0 {
+		conn = transport.Simulated{Conn: conn, Loss: *simulateLoss, Latency: *simulateLatency, Reorder: *simulateReorder}
+	}
+
+	// the OS picks a port when we ask for port 0
+	*localPort = conn.LocalAddr().(*net.UDPAddr).Port
+
+	var externalAddr string
+	if *preflightFlag {
+		externalAddr = preflight(conn, discoveryAddr).String()
+	}
+
+	if *remoteIP != "" {
+		remoteAddr := &net.UDPAddr{
+			IP:   net.ParseIP(*remoteIP),
+			Port: *remotePort,
+		}
+
+		if remoteAddr.IP == nil {
+			fmt.Printf("Invalid remote IP address: %s\n", *remoteIP)
+			os.Exit(1)
+		}
+		remoteAddrs = append(remoteAddrs, remoteAddr)
+	}
+
+	// the program is made once the model is, but hooks and the API only send
+	// once it's running
+	var p *tea.Program
+	send := func(text string) { p.Send(ui.Outgoing{Text: text}) }
+
+	// Let scripts and dashboards in on the conversation
+	var gateway *api.Gateway
+	var apiListener net.Listener
+	if *apiAddr != "" {
+		apiListener, err = net.Listen("tcp", *apiAddr)
+		if err != nil {
+			fmt.Printf("Failed to serve the API on %s: %v\n", *apiAddr, err)
+			os.Exit(1)
+		}
+		defer apiListener.Close()
+		gateway = &api.Gateway{Send: send}
+	}
+	pluginsDir := cfg.PluginsDir
+	if pluginsDir == "" {
+		pluginsDir = defaultPluginsDir()
+	}
+	plugins, err := loadPlugins(pluginsDir)
+	if err != nil {
+		fmt.Printf("Failed to load plugins: %v\n", err)
+		os.Exit(1)
+	}
+	host := &pluginHost{program: &p, commands: map[string]ui.Command{}}
+	for _, plugin := range plugins {
+		if err := plugin.Init(host); err != nil {
+			fmt.Printf("Failed to start a plugin: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	onMessage := func(record history.Record) {
+		if gateway != nil {
+			gateway.Publish(record)
+		}
+		if !record.Self && record.Peer != "" {
+			hooks.Run(cfg.Hooks, record, send)
+			pluginsReceived(plugins, record)
+		}
+	}
+
+	done := make(chan struct{})
+
+	// Have the discovery server tell us when our NAT moves us
+	go discovery.KeepWatching(conn, servers, done)
+
+	// Let the discovery server introduce us to everyone in our room
+	leaveRoom := make(chan struct{})
+	if *room != "" {
+		go discovery.JoinRoom(conn, servers, *room, identity, done, leaveRoom)
+	}
+
+	// Start punching UDP holes in our router towards our peers
+	peers := &transport.Roster{}
+	for _, remoteAddr := range remoteAddrs {
+		peers.Add(conn, remoteAddr, done)
+	}
+	if *room != "" {
+		// room members can relay through the server if it lets them
+		peers.SetServerRelay(discoveryAddr)
+	}
+
+	model, err := ui.New(ui.Config{
+		Conn: conn,
+		Rebind: func() error {
+			return rebindable.Rebind(func(socket *net.UDPConn) error {
+				return tuneBuffers(socket, *readBuffer, *writeBuffer)
+			})
+		},
+		Peers:        peers,
+		LocalPort:    *localPort,
+		ExternalAddr: externalAddr,
+		Discovery:    servers,
+		Room:         *room,
+		LeaveRoom:    leaveRoom,
+		Done:         done,
+		Identity:     identity,
+		HistoryPath:  *historyPath,
+		MaxMessages:  cfg.MaxMessages,
+		OnMessage:    onMessage,
+		Commands:     host.commands,
+		BeforeSend:   pluginsBeforeSend(plugins),
+		Keymap:       cfg.Keymap,
+		Nick:         cfg.Nick,
+		AwayAfter:    cfg.AwayAfter,
+		ConfirmQuit:  !cfg.QuitAtOnce,
+		SaveNick: func(nick string) error {
+			return saveNick(*configPath, *profileName, nick)
+		},
+	})
+	if err != nil {
+		fmt.Printf("Failed to read history file %s: %v\n", *historyPath, err)
+		os.Exit(1)
+	}
+	if len(remoteAddrs) == 0 && *room == "" {
+		model.Notify("Nobody to chat with yet, add a peer with /add ip:port")
+	}
+
+	// we recover panics ourselves, to leave a crash file behind
+	// 30 frames a second is plenty for a chat, and keeps floods of messages cheap
+	p = tea.NewProgram(model, tea.WithoutCatchPanics(), tea.WithFPS(30))
+	crash.Program.Store(p)
+	defer crash.Recover()
+
+	// closed once the program stopped, so nothing waits on it after
+	stopped := make(chan struct{})
+	if gateway != nil {
+		gateway.Transcript = func() ([]history.Record, error) {
+			// buffered so the model never waits on us
+			reply := make(chan []history.Record, 1)
+			p.Send(ui.TranscriptRequest{Reply: reply})
+			select {
+			case transcript := <-reply:
+				return transcript, nil
+			case <-stopped:
+				return nil, errors.New("the chat has stopped")
+			}
+		}
+		go gateway.Serve(apiListener)
+	}
+
+	// start polling the console's rows and columns
+	// go pollConsoleSize(p)
+
+	_, err = p.Run()
+	close(stopped)
+	if err != nil {
+		fmt.Printf("Uh oh, there was an error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if model.Detached() {
+		// the daemon binds our port next
+		rebindable.Close()
+		// every discovery server, the one we use first
+		list := []string{servers.Current().String()}
+		for _, server := range servers.All() {
+			if !transport.SameAddr(server, servers.Current()) {
+				list = append(list, server.String())
+			}
+		}
+		chatArgs := carriedArgs(strings.Join(list, ","), model.QuitRoom(), *bind, *iface, *profileName, *fecFlag)
+		if err := detach(*localPort, peers.Addrs(), chatArgs, *historyPath, *configPath, *logPath, model.Transcript()); err != nil {
+			fmt.Printf("Failed to detach: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Detached, the conversation carries on in the background. Run p2p open to come back to it.")
+	}
+}
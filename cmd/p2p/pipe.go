@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+const (
+	pipeChunk  = 960 // Bytes per data frame, which stays under a typical MTU once encoded
+	pipeWindow = 64  // Data frames in flight before we wait for acks
+	pipeRTO    = 300 * time.Millisecond
+	pipeLinger = 2 * time.Second // How long to keep acking the peer after we're done
+)
+
+// Shuttles stdin to a peer and the peer's data to stdout, for `p2p pipe`, so
+// `tar c dir | p2p pipe` on one side and `p2p pipe | tar x` on the other
+// copies a directory. Both sides send at once, like netcat.
+func pipe(args []string) {
+	flags := flag.NewFlagSet("pipe", flag.ExitOnError)
+	localPort := flags.Int("lport", 0, "Local port to bind to")
+	var remoteAddrs peerFlags
+	flags.Var(&remoteAddrs, "peer", "Remote peer as ip:port")
+	configPath := flags.String("config", defaultConfigPath(), "Config file, overridden by flags")
+	timeout := flags.Duration("timeout", 30*time.Second, "How long to wait for the peer before giving up")
+	bind := flags.String("bind", "", "Local IP address to bind to, any if empty")
+	iface := flags.String("iface", "", "Network interface to bind to, e.g. eth0 or a VPN's tun0")
+	readBuffer := flags.Int("read-buffer", 0, "Socket receive buffer size in bytes, the OS default if 0")
+	writeBuffer := flags.Int("write-buffer", 0, "Socket send buffer size in bytes, the OS default if 0")
+	logLevel := flags.String("log-level", "warn", "How much to log to stderr: debug, info, warn or error")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read config file %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	if *localPort == 0 {
+		*localPort = cfg.LocalPort
+	}
+	if len(remoteAddrs) == 0 && len(cfg.Peers) > 0 {
+		if err := remoteAddrs.Set(cfg.Peers[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid peer in config file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *localPort == 0 || len(remoteAddrs) != 1 {
+		fmt.Fprintln(os.Stderr, "Error: -lport and exactly one -peer are required")
+		fmt.Fprintln(os.Stderr, "Usage: p2p pipe [flags]")
+		flags.SetOutput(os.Stderr)
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	// stdout carries the data, so everything else goes to stderr
+	if err := setupLogging(os.Stderr, *logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	localAddr := &net.UDPAddr{IP: resolveBind(*bind, *iface), Port: *localPort}
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		bindFailed(os.Stderr, localAddr, err, "-lport")
+	}
+	defer conn.Close()
+	if err := tuneBuffers(conn, *readBuffer, *writeBuffer); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	p := &pipeStream{conn: conn, peer: remoteAddrs[0], out: bufio.NewWriter(os.Stdout), next: 1, expected: 1, early: map[int64]protocol.Frame{}}
+	p.interactive = isTerminal(os.Stdin)
+	if err := p.run(readChunks(os.Stdin), *timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Reads r a chunk at a time until it ends
+func readChunks(r io.Reader) <-chan []byte {
+	chunks := make(chan []byte, pipeWindow)
+	go func() {
+		defer close(chunks)
+		for {
+			chunk := make([]byte, pipeChunk)
+			n, err := r.Read(chunk)
+			if n > 0 {
+				chunks <- chunk[:n]
+			}
+			if err != nil {
+				if err != io.EOF {
+					slog.Error("reading stdin failed", "err", err)
+				}
+				return
+			}
+		}
+	}()
+	return chunks
+}
+
+// Both directions of a pipe. The receiver acks the next seq it expects, and the
+// sender resends everything unacknowledged when acks stop coming, or just the
+// oldest frame when acks repeat.
+type pipeStream struct {
+	conn transport.Conn
+	peer *net.UDPAddr
+	out  *bufio.Writer
+
+	interactive bool // Stdin is a terminal rather than something that ends
+
+	// sending
+	unacked   []protocol.Frame // Frames not acknowledged yet, in order
+	next      int64            // Seq for the next frame read from stdin
+	lastSent  time.Time        // When we last sent the whole window
+	lastAcked time.Time        // When the window last moved on
+	finSent   bool             // Our stream ended, with a fin frame
+	finAcked  bool
+	dupAcks   int // Acks in a row for the oldest frame in the window
+
+	// receiving
+	expected  int64                    // Next seq we'll take from the peer
+	early     map[int64]protocol.Frame // Frames after a gap, by seq
+	finRecvd  bool
+	lastHeard time.Time // Zero until the peer gets through to us
+}
+
+func (p *pipeStream) run(chunks <-chan []byte, timeout time.Duration) error {
+	start := time.Now()
+	lastPing := time.Time{}
+	buffer := make([]byte, transport.MaxDatagram)
+
+	for {
+		if p.lastHeard.IsZero() && time.Since(start) > timeout {
+			return fmt.Errorf("no answer from %s within %s", p.peer, timeout)
+		}
+		if !p.lastHeard.IsZero() && time.Since(p.lastHeard) > timeout {
+			return fmt.Errorf("lost %s, nothing heard for %s", p.peer, timeout)
+		}
+		// keep the hole open
+		if time.Since(lastPing) >= transport.PunchInterval {
+			_ = transport.SendKeepalive(p.conn, p.peer)
+			lastPing = time.Now()
+		}
+
+		chunks = p.fill(chunks)
+		// nobody is going to close a terminal, so we're done when the peer is
+		if p.finRecvd && !p.finSent && p.interactive {
+			p.queue(protocol.Frame{Type: protocol.Data, Seq: p.next, Fin: true})
+			chunks = nil
+		}
+		if !p.lastHeard.IsZero() && len(p.unacked) > 0 && time.Since(p.lastSent) >= pipeRTO && time.Since(p.lastAcked) >= pipeRTO {
+			p.sendWindow()
+		}
+
+		if p.finRecvd && p.finAcked {
+			return p.out.Flush()
+		}
+		// the peer may have left as soon as it had everything, without our
+		// last acks getting through
+		if p.finRecvd && time.Since(p.lastAcked) > pipeLinger {
+			return p.out.Flush()
+		}
+
+		p.conn.SetReadDeadline(time.Now().Add(pipeRTO / 6))
+		n, addr, err := p.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if err := p.out.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if !transport.SameAddr(addr, p.peer) {
+			continue
+		}
+		if p.lastHeard.IsZero() {
+			slog.Info("peer connected", "peer", p.peer)
+		}
+		p.lastHeard = time.Now()
+		if err := p.handle(buffer[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// Queues chunks from stdin while there's room in the window, returning nil
+// once stdin ended and the fin frame is queued
+func (p *pipeStream) fill(chunks <-chan []byte) <-chan []byte {
+	for chunks != nil && len(p.unacked) < pipeWindow {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				p.queue(protocol.Frame{Type: protocol.Data, Seq: p.next, Fin: true})
+				return nil
+			}
+			p.queue(protocol.Frame{Type: protocol.Data, Seq: p.next, Data: chunk})
+		default:
+			return chunks
+		}
+	}
+	return chunks
+}
+
+// Adds a frame to the window and sends it straight away if we can
+func (p *pipeStream) queue(f protocol.Frame) {
+	if len(p.unacked) == 0 {
+		p.lastAcked = time.Now()
+	}
+	p.unacked = append(p.unacked, f)
+	p.next++
+	if f.Fin {
+		p.finSent = true
+	}
+	if !p.lastHeard.IsZero() {
+		p.write(f)
+	}
+}
+
+func (p *pipeStream) sendWindow() {
+	for _, f := range p.unacked {
+		p.write(f)
+	}
+	p.lastSent = time.Now()
+}
+
+func (p *pipeStream) write(f protocol.Frame) {
+	if _, err := p.conn.WriteToUDP(protocol.Encode(f), p.peer); err != nil {
+		slog.Warn("sending frame failed", "type", f.Type, "seq", f.Seq, "err", err)
+	}
+}
+
+func (p *pipeStream) handle(data []byte) error {
+	f, ok := protocol.Decode(data)
+	if !ok {
+		return nil
+	}
+
+	switch f.Type {
+	case protocol.Data:
+		// hold on to frames that overtook a lost one, so resending the window
+		// fills the gaps in one go
+		if f.Seq > p.expected && f.Seq < p.expected+2*pipeWindow {
+			p.early[f.Seq] = f
+		}
+		for !p.finRecvd && f.Seq == p.expected {
+			if _, err := p.out.Write(f.Data); err != nil {
+				return err
+			}
+			delete(p.early, p.expected)
+			p.expected++
+			p.finRecvd = f.Fin
+			f, ok = p.early[p.expected]
+			if !ok {
+				break
+			}
+		}
+		// ack everything up to what we expect, including frames we already had
+		p.write(protocol.Frame{Type: protocol.Ack, Seq: p.expected})
+
+	case protocol.Ack:
+		if len(p.unacked) > 0 && f.Seq == p.unacked[0].Seq {
+			// the peer is still missing our oldest frame, resend it after a
+			// few of these rather than waiting out the timeout
+			p.dupAcks++
+			if p.dupAcks == 3 {
+				p.write(p.unacked[0])
+			}
+		}
+		for len(p.unacked) > 0 && p.unacked[0].Seq < f.Seq {
+			if p.unacked[0].Fin {
+				p.finAcked = true
+			}
+			p.unacked = p.unacked[1:]
+			p.lastAcked = time.Now()
+			p.dupAcks = 0
+		}
+	}
+	return nil
+}
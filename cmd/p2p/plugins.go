@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	goplugin "plugin"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/history"
+	"p2p/internal/ui"
+	"p2p/plugin"
+)
+
+// Where plugins are loaded from unless the config file says otherwise
+func defaultPluginsDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "p2p", "plugins")
+}
+
+// Opens every .so file in the plugins directory, which doesn't have to exist
+func loadPlugins(dir string) ([]plugin.Plugin, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+
+	var plugins []plugin.Plugin
+	for _, path := range paths {
+		p, err := goplugin.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+		symbol, err := p.Lookup("New")
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+		newPlugin, ok := symbol.(func() plugin.Plugin)
+		if !ok {
+			return nil, fmt.Errorf("loading %s: New is a %T, not a func() plugin.Plugin", path, symbol)
+		}
+		plugins = append(plugins, newPlugin())
+	}
+	return plugins, nil
+}
+
+// The chat as plugins see it
+type pluginHost struct {
+	program  **tea.Program // Set once the model is made, before anything can call Send or Notify
+	commands map[string]ui.Command
+}
+
+func (h *pluginHost) Send(text string) {
+	go (*h.program).Send(ui.Outgoing{Text: text})
+}
+
+func (h *pluginHost) Notify(text string) {
+	go (*h.program).Send(ui.Notice{Text: text})
+}
+
+func (h *pluginHost) RegisterCommand(name, usage string, run func(args string)) {
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	h.commands[name] = ui.Command{Usage: usage, Run: run}
+}
+
+// Hands a message from a peer to every plugin
+func pluginsReceived(plugins []plugin.Plugin, record history.Record) {
+	message := plugin.Message{From: record.Peer, Via: record.Via, Text: record.Text, Direct: record.Direct, Time: record.Time}
+	for _, p := range plugins {
+		p.OnMessageReceived(message)
+	}
+}
+
+// Lets every plugin in turn rewrite or stop a message we're sending
+func pluginsBeforeSend(plugins []plugin.Plugin) func(text string) (string, bool) {
+	return func(text string) (string, bool) {
+		for _, p := range plugins {
+			var ok bool
+			if text, ok = p.OnBeforeSend(text); !ok {
+				return "", false
+			}
+		}
+		return text, true
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"p2p/internal/discovery"
+	"p2p/internal/transport"
+)
+
+// How long the preflight waits for the discovery server
+var preflightTimeout = 3 * time.Second
+
+// Prints the outcome of one preflight check, and how to fix it if it failed
+func preflightCheck(ok bool, result, hint string) {
+	if ok {
+		fmt.Printf("  ✓ %s\n", result)
+		return
+	}
+	fmt.Printf("  ✗ %s\n    %s\n", result, hint)
+}
+
+// Explains why binding failed before the preflight gives up
+func preflightBindFailed(localAddr *net.UDPAddr, err error) {
+	fmt.Println("Preflight:")
+	hint := bindHint(localAddr, err, "-lport")
+	if hint == "" {
+		hint = fmt.Sprintf("%v", err)
+	}
+	preflightCheck(false, fmt.Sprintf("couldn't bind to %s", localAddr), hint)
+	os.Exit(1)
+}
+
+// Checks we can reach the discovery server and learn our external address
+// before starting the chat, for -preflight. It exits if anything fails.
+func preflight(conn transport.Conn, discoveryAddr *net.UDPAddr) *net.UDPAddr {
+	fmt.Println("Preflight:")
+	preflightCheck(true, fmt.Sprintf("bound to %s", conn.LocalAddr()), "")
+
+	external, err := discovery.Whoami(conn, discoveryAddr, preflightTimeout)
+	if err != nil {
+		preflightCheck(false,
+			fmt.Sprintf("discovery server %s didn't answer: %v", discoveryAddr, err),
+			"Check it is running and reachable, that a firewall isn't blocking UDP, or pass another with -discovery.")
+		os.Exit(1)
+	}
+	preflightCheck(true, fmt.Sprintf("discovery server %s answered", discoveryAddr), "")
+
+	preflightCheck(true, fmt.Sprintf("external address is %s", external), "")
+	if external.Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		fmt.Println("    Your NAT changed the port, so give peers this address rather than your local port.")
+	}
+	return external
+}
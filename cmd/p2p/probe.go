@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"p2p/internal/discovery"
+)
+
+// Asks the discovery server how it sees us, for `p2p probe`
+func probe(args []string) {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	localPort := flags.Int("lport", 0, "Local port to probe from, any free port if 0")
+	configPath := flags.String("config", defaultConfigPath(), "Config file, overridden by flags")
+	discoveryFlag := flags.String("discovery", "", "Discovery server as host:port, or several separated by commas to use the closest, overrides the discovery_ip environment variable")
+	timeout := flags.Duration("timeout", 3*time.Second, "How long to wait for the discovery server")
+	bind := flags.String("bind", "", "Local IP address to probe from, any if empty")
+	iface := flags.String("iface", "", "Network interface to probe from, e.g. eth0 or a VPN's tun0")
+	full := flags.Bool("full", false, "Also test NAT mapping, filtering, hairpinning and UPnP, and say which connection strategies will work")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to read config file %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	localAddr := &net.UDPAddr{IP: resolveBind(*bind, *iface), Port: *localPort}
+	discoveryAddr := closestDiscovery(resolveDiscovery(*discoveryFlag, cfg), localAddr.IP).Current()
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		bindFailed(os.Stdout, localAddr, err, "-lport")
+	}
+	defer conn.Close()
+
+	fmt.Printf("Local address:    %s\n", conn.LocalAddr())
+
+	external, err := discovery.Whoami(conn, discoveryAddr, *timeout)
+	if err != nil {
+		fmt.Printf("Discovery server %s did not answer: %v\n", discoveryAddr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("External address: %s\n", external)
+
+	if external.Port == conn.LocalAddr().(*net.UDPAddr).Port {
+		fmt.Println("Your NAT kept the local port, so peers can usually punch through to it")
+	} else {
+		fmt.Println("Your NAT changed the local port, so give peers the external address")
+	}
+
+	if *full {
+		printNATReport(discovery.DiagnoseNAT(conn, discoveryAddr, external, *timeout), discoveryAddr)
+	}
+}
+
+// Prints what the full probe found out, for people
+func printNATReport(report discovery.NATReport, discoveryAddr *net.UDPAddr) {
+	fmt.Println()
+	for i, mapped := range report.Mapped {
+		server := discoveryAddr.String() + " (discovery)"
+		if i > 0 {
+			server = "STUN server " + fmt.Sprint(i)
+		}
+		fmt.Printf("Seen by %-28s %s\n", server+":", mapped)
+	}
+	for _, mapping := range report.Probed {
+		fmt.Printf("Local port %-26d %s\n", mapping.Local, mapping.External)
+	}
+	fmt.Println()
+	fmt.Printf("Mapping:     %s\n", report.Mapping)
+	fmt.Printf("Allocation:  %s\n", report.Allocation)
+	fmt.Printf("Filtering:   %s\n", report.Filtering)
+	fmt.Printf("Hairpinning: %s\n", report.Hairpin)
+	fmt.Printf("UPnP:        %s\n", report.UPnP)
+	fmt.Println()
+	fmt.Println("Connection strategies:")
+	fmt.Printf("  direct:    %s\n", report.Direct)
+	fmt.Printf("  predicted: %s\n", report.Predicted)
+	fmt.Printf("  relay:     %s\n", report.Relay)
+}
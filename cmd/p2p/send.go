@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// Sends a single message without the TUI, for `p2p send`. The message is
+// taken from the arguments, or from stdin when there are none.
+func send(args []string) {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	localPort := flags.Int("lport", 0, "Local port to bind to")
+	var remoteAddrs peerFlags
+	flags.Var(&remoteAddrs, "peer", "Remote peer as ip:port, repeat to send to several")
+	configPath := flags.String("config", defaultConfigPath(), "Config file, overridden by flags")
+	timeout := flags.Duration("timeout", 10*time.Second, "How long to wait for peers to receive the message")
+	bind := flags.String("bind", "", "Local IP address to bind to, any if empty")
+	iface := flags.String("iface", "", "Network interface to bind to, e.g. eth0 or a VPN's tun0")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to read config file %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+	if *localPort == 0 {
+		*localPort = cfg.LocalPort
+	}
+	if len(remoteAddrs) == 0 {
+		for _, peer := range cfg.Peers {
+			if err := remoteAddrs.Set(peer); err != nil {
+				fmt.Printf("Invalid peer in config file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if *localPort == 0 || len(remoteAddrs) == 0 {
+		fmt.Println("Error: -lport and at least one -peer are required")
+		fmt.Println("Usage: p2p send [flags] [message]")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	text := strings.Join(flags.Args(), " ")
+	if text == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Printf("Failed to read message from stdin: %v\n", err)
+			os.Exit(1)
+		}
+		text = strings.TrimSpace(string(data))
+	}
+	if text == "" {
+		fmt.Println("Error: nothing to send")
+		os.Exit(1)
+	}
+
+	localAddr := &net.UDPAddr{IP: resolveBind(*bind, *iface), Port: *localPort}
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		bindFailed(os.Stdout, localAddr, err, "-lport")
+	}
+	defer conn.Close()
+
+	message := protocol.Encode(protocol.Frame{Type: protocol.Message, ID: protocol.NewMessageID(), Text: text})
+	pending := map[string]*net.UDPAddr{}
+	for _, addr := range remoteAddrs {
+		pending[addr.String()] = addr
+	}
+
+	// keep punching and resending until every peer acknowledges the message
+	deadline := time.Now().Add(*timeout)
+	buffer := make([]byte, transport.MaxDatagram)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		for _, addr := range pending {
+			slog.Debug("sending message", "peer", addr)
+			_ = transport.SendKeepalive(conn, addr)
+			_, _ = conn.WriteToUDP(message, addr)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(transport.PunchInterval))
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			if f, ok := protocol.Decode(buffer[:n]); ok && f.Type == protocol.Ack && pending[addr.String()] != nil {
+				delete(pending, addr.String())
+				fmt.Printf("Delivered to %s\n", addr)
+			}
+		}
+	}
+
+	if len(pending) > 0 {
+		for peer := range pending {
+			fmt.Printf("Not delivered to %s\n", peer)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"p2p/internal/discovery"
+)
+
+// Runs the discovery server, for `p2p serve`
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := flags.Int("port", discovery.DefaultPort, "Port to serve discovery on")
+	logLevel := flags.String("log-level", "info", "How much to log: debug, info, warn or error")
+	metricsAddr := flags.String("metrics", "", "Address to serve Prometheus metrics on, e.g. :9100")
+	relayRate := flags.Int("relay-rate", 0, "Bytes per second to relay between each pair of clients in a room that can't reach each other directly, 0 to not relay")
+	requestRate := flags.Float64("request-rate", discovery.DefaultRequestRate, "Requests a second to answer from each IP, 0 for no limit")
+	requireToken := flags.Bool("require-token", false, "Only answer clients that show the token the server gave their IP, so a public server can't be made to send to spoofed addresses at all. Without it, clients that show none are answered with no more than they sent")
+	mailboxSize := flags.Int("mailbox", 0, "Letters to hold for each peer that's offline until it's back, in memory, 0 to not hold any")
+	statusAddr := flags.String("status", "", "Address to serve the status of clients, rooms and relaying on as JSON, e.g. 127.0.0.1:8080")
+	statusToken := flags.String("status-token", os.Getenv("P2P_STATUS_TOKEN"), "Token to ask for -status with, as a bearer token or ?token=, made up and printed if empty")
+	keyPath := flags.String("key", "", "Key to sign answers with, created if missing, so clients with its public key as discovery_key know they're ours")
+	_ = flags.Parse(args)
+
+	if err := setupLogging(os.Stderr, *logLevel); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: *port})
+	if err != nil {
+		bindFailed(os.Stdout, &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: *port}, err, "-port")
+	}
+	defer conn.Close()
+
+	fmt.Printf("Serving discovery on %s\n", conn.LocalAddr())
+
+	s := discovery.NewServer(conn)
+	s.RelayRate = *relayRate
+	s.RequestRate = *requestRate
+	s.RequireToken = *requireToken
+	s.MailboxSize = *mailboxSize
+	if *keyPath != "" {
+		key, err := loadIdentity(*keyPath)
+		if err != nil {
+			fmt.Printf("Failed to load key %s: %v\n", *keyPath, err)
+			os.Exit(1)
+		}
+		s.Key = key
+		fmt.Printf("Signing answers, clients can check them with discovery_key = %q\n", discovery.FormatServerKey(key.Public().(ed25519.PublicKey)))
+	}
+	if *relayRate > 0 {
+		fmt.Printf("Relaying up to %d bytes per second between each pair of clients\n", *relayRate)
+	}
+	if *metricsAddr != "" {
+		discovery.ServeMetrics(*metricsAddr, s.Metrics)
+		fmt.Printf("Serving metrics on %s/metrics\n", *metricsAddr)
+	}
+	if *statusAddr != "" {
+		if *statusToken == "" {
+			b := make([]byte, 16)
+			_, _ = rand.Read(b)
+			*statusToken = hex.EncodeToString(b)
+		}
+		discovery.ServeStatus(*statusAddr, *statusToken, s)
+		fmt.Printf("Serving status on %s/status?token=%s\n", *statusAddr, *statusToken)
+	}
+	s.Run()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var errNoTray = errors.New("no tray icon without yad, install it to get one")
+
+// A tray icon for the detached daemon, shown with yad, counting the messages
+// that came in since we detached. Clicking it runs open, which brings the
+// chat back.
+type trayIcon struct {
+	cmd   *exec.Cmd
+	mu    sync.Mutex
+	stdin io.WriteCloser
+}
+
+// Shows the tray icon, which runs open when clicked
+func startTray(open []string) (*trayIcon, error) {
+	if _, err := exec.LookPath("yad"); err != nil {
+		return nil, errNoTray
+	}
+	// yad splits the command up like a shell would
+	quoted := make([]string, len(open))
+	for i, arg := range open {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	command := strings.Join(quoted, " ")
+	cmd := exec.Command("yad", "--notification", "--listen",
+		"--image=mail-read", "--text=p2p",
+		"--command="+command,
+		"--menu=Open chat!"+command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting yad: %w", err)
+	}
+	return &trayIcon{cmd: cmd, stdin: stdin}, nil
+}
+
+// Shows how many messages are waiting to be read
+func (t *trayIcon) unread(n int) {
+	image, text := "mail-read", "p2p"
+	if n > 0 {
+		image, text = "mail-unread", fmt.Sprintf("p2p, %d unread", n)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.stdin, "icon:%s\ntooltip:%s\n", image, text)
+}
+
+// Takes the icon away
+func (t *trayIcon) Close() {
+	t.mu.Lock()
+	fmt.Fprintln(t.stdin, "quit")
+	t.stdin.Close()
+	t.mu.Unlock()
+	if err := t.cmd.Wait(); err != nil {
+		slog.Debug("tray icon exited", "err", err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/discovery"
+	"p2p/internal/transport"
+	"p2p/internal/ui"
+)
+
+type wizardStep int
+
+const (
+	stepPort wizardStep = iota
+	stepDiscovery
+	stepTesting
+	stepPeer
+	stepDone
+)
+
+// The result of asking the discovery server for our external address
+type discoveryTested struct {
+	external *net.UDPAddr
+	err      error
+}
+
+// Walks a first time user through writing a config file
+type wizard struct {
+	step       wizardStep
+	input      textinput.Model
+	cfg        config
+	configPath string
+	status     string // What happened at the last step
+	cancelled  bool
+}
+
+// Runs the first-run setup, reporting whether a config file was written
+func runWizard(configPath string) bool {
+	ti := ui.NewTextInput()
+
+	// suggest a random port from the dynamic range
+	ti.SetValue(strconv.Itoa(49152 + rand.IntN(16384)))
+
+	w := &wizard{input: ti, configPath: configPath}
+	if _, err := tea.NewProgram(w).Run(); err != nil {
+		fmt.Printf("Uh oh, there was an error: %v\n", err)
+		return false
+	}
+	return !w.cancelled
+}
+
+// A command that checks the discovery server answers us from our chosen port
+func testDiscovery(port int, server string) tea.Cmd {
+	return func() tea.Msg {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, strconv.Itoa(discovery.DefaultPort))
+		}
+		discoveryAddr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			return discoveryTested{err: err}
+		}
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: port})
+		if err != nil {
+			return discoveryTested{err: err}
+		}
+		defer conn.Close()
+
+		external, err := discovery.Whoami(conn, discoveryAddr, 3*time.Second)
+		return discoveryTested{external: external, err: err}
+	}
+}
+
+func (w *wizard) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (w *wizard) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlC, tea.KeyEsc:
+			w.cancelled = true
+			return w, tea.Quit
+		case tea.KeyEnter:
+			return w.next()
+		}
+
+	case discoveryTested:
+		if msg.err != nil {
+			w.status = fmt.Sprintf("The discovery server didn't answer: %v", msg.err)
+			w.step = stepDiscovery
+			w.input.SetValue(w.cfg.Discovery)
+			return w, nil
+		}
+		w.status = fmt.Sprintf("The discovery server sees you as %s, give this to your peers", msg.external)
+		w.step = stepPeer
+		w.input.Reset()
+		return w, nil
+	}
+
+	var cmd tea.Cmd
+	w.input, cmd = w.input.Update(msg)
+	return w, cmd
+}
+
+// Takes the answer to the current step and moves on to the next one
+func (w *wizard) next() (tea.Model, tea.Cmd) {
+	value := strings.TrimSpace(w.input.Value())
+
+	switch w.step {
+	case stepPort:
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			w.status = "Pick a port between 0 and 65535, or 0 for any free port"
+			return w, nil
+		}
+		w.cfg.LocalPort = port
+		w.status = ""
+		w.step = stepDiscovery
+		w.input.SetValue(os.Getenv("discovery_ip"))
+
+	case stepDiscovery:
+		if value == "" {
+			w.status = "A discovery server is needed to find out your external address"
+			return w, nil
+		}
+		w.cfg.Discovery = value
+		w.status = "Asking " + value + " for your external address..."
+		w.step = stepTesting
+		return w, testDiscovery(w.cfg.LocalPort, value)
+
+	case stepPeer:
+		if value != "" {
+			if _, err := net.ResolveUDPAddr("udp", value); err != nil {
+				w.status = fmt.Sprintf("That isn't an ip:port: %v", err)
+				return w, nil
+			}
+			w.cfg.Peers = []string{value}
+		}
+		if err := w.save(); err != nil {
+			w.status = fmt.Sprintf("Failed to save: %v", err)
+			return w, nil
+		}
+		w.step = stepDone
+		return w, tea.Quit
+	}
+
+	return w, nil
+}
+
+// Generates our identity key and writes the config file
+func (w *wizard) save() error {
+	identity, err := loadIdentity(defaultIdentityPath())
+	if err != nil {
+		return err
+	}
+	w.status = "Your identity is " + transport.Fingerprint(identity.Public().(ed25519.PublicKey))
+
+	if err := os.MkdirAll(filepath.Dir(w.configPath), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.configPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return toml.NewEncoder(f).Encode(w.cfg)
+}
+
+func (w *wizard) View() string {
+	var question string
+	switch w.step {
+	case stepPort:
+		question = "Which local port should p2p use? (0 picks any free port)"
+	case stepDiscovery, stepTesting:
+		question = "Which discovery server should p2p use? (host or host:port)"
+	case stepPeer:
+		question = "Who do you want to chat with? (ip:port, leave empty to /add them later)"
+	case stepDone:
+		return fmt.Sprintf("%s\nSaved %s\n\n", w.status, w.configPath)
+	}
+
+	output := ui.AccentStyle().Render("Welcome to p2p! Let's set things up.") + "\n\n"
+	output += question + "\n"
+	output += w.input.View() + "\n\n"
+	if w.status != "" {
+		output += w.status + "\n"
+	}
+	output += "\n(enter to continue, esc to cancel)"
+	return output
+}
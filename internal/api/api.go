@@ -0,0 +1,186 @@
+// Package api lets scripts and browser dashboards ride along on the chat's
+// connection over local HTTP: the transcript, a send endpoint and a WebSocket
+// stream of new messages.
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"p2p/internal/history"
+)
+
+// How many messages a slow WebSocket client can fall behind before it's dropped
+const eventBuffer = 64
+
+// Serves GET /messages, POST /send and GET /events (a WebSocket)
+type Gateway struct {
+	Transcript func() ([]history.Record, error) // Every message so far, oldest first, or an error once the chat stopped
+	Send       func(text string)                // Sends a message to everyone in the conversation
+
+	upgrader websocket.Upgrader
+
+	mu          sync.Mutex
+	subscribers map[chan history.Record]struct{}
+}
+
+// Tells every WebSocket client about a new message, without blocking
+func (g *Gateway) Publish(record history.Record) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for events := range g.subscribers {
+		select {
+		case events <- record:
+		default:
+			// too far behind, the client can fetch /messages when it reconnects
+			delete(g.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Serves the gateway on a listener until it's closed
+func (g *Gateway) Serve(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /messages", g.messages)
+	mux.HandleFunc("POST /send", g.send)
+	mux.HandleFunc("GET /events", g.events)
+	if err := http.Serve(listener, local(mux)); err != nil {
+		slog.Debug("api gateway stopped", "addr", listener.Addr(), "err", err)
+	}
+}
+
+// Only lets in requests made to us by address or as localhost, from no web
+// page or one served locally. Web pages elsewhere could otherwise post
+// messages as us, as browsers send simple POSTs anywhere, or read the
+// transcript by pointing a name of theirs at 127.0.0.1.
+func local(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !localHost(r.Host) {
+			http.Error(w, "the API is only served by address or as localhost", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !loopback(u.Host) {
+				http.Error(w, "cross-origin requests aren't allowed", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Whether a Host header names us by IP address or as localhost, rather than
+// by a name someone else controls
+func localHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == "localhost" || net.ParseIP(host) != nil
+}
+
+// Whether a host, with or without a port, is this machine
+func loopback(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+func (g *Gateway) messages(w http.ResponseWriter, r *http.Request) {
+	transcript, err := g.Transcript()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(transcript)
+}
+
+// Takes {"text": "..."} and sends it. Asking for JSON keeps browsers from
+// sending it from a form or a no-cors fetch without asking us first.
+func (g *Gateway) send(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "expected Content-Type: application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Text == "" {
+		http.Error(w, `expected {"text": "..."}`, http.StatusBadRequest)
+		return
+	}
+	g.Send(body.Text)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Streams every new message as a JSON text frame
+func (g *Gateway) events(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered with an error
+		return
+	}
+	defer conn.Close()
+
+	events := g.subscribe()
+	defer g.unsubscribe(events)
+
+	// notice the client going away, we don't expect anything from it
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case record, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(record); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (g *Gateway) subscribe() chan history.Record {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.subscribers == nil {
+		g.subscribers = map[chan history.Record]struct{}{}
+	}
+	events := make(chan history.Record, eventBuffer)
+	g.subscribers[events] = struct{}{}
+	return events
+}
+
+func (g *Gateway) unsubscribe(events chan history.Record) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.subscribers[events]; ok {
+		delete(g.subscribers, events)
+		close(events)
+	}
+}
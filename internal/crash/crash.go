@@ -0,0 +1,95 @@
+// Package crash turns panics into a crash file instead of a corrupted terminal.
+package crash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// How many of the latest log lines go into a crash file
+const crashLogLines = 200
+
+// The running TUI, so a crash can hand the terminal back before reporting
+var Program atomic.Pointer[tea.Program]
+
+// The build that crashed, set by main
+var Version = "dev"
+
+// The latest log lines, kept in memory for crash files. Tee the log into it.
+var Logs = &logTail{}
+
+type logTail struct {
+	mu    sync.Mutex
+	lines [][]byte
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		t.lines = append(t.lines, append([]byte(nil), line...))
+	}
+	if len(t.lines) > crashLogLines {
+		t.lines = t.lines[len(t.lines)-crashLogLines:]
+	}
+	return len(p), nil
+}
+
+func (t *logTail) contents() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return bytes.Join(t.lines, nil)
+}
+
+// Recovers a panic in the calling goroutine, restores the terminal, writes
+// what we know to a crash file and exits. Defer it first thing in every
+// goroutine that runs for the whole session.
+func Recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+
+	if p := Program.Load(); p != nil {
+		p.Kill()
+	}
+
+	fmt.Printf("p2p crashed: %v\n", r)
+	path, err := writeCrashFile(r, stack)
+	if err != nil {
+		fmt.Printf("Failed to write crash file: %v\n\n%s", err, stack)
+	} else {
+		fmt.Printf("Details are in %s, please attach it when reporting this\n", path)
+	}
+	os.Exit(2)
+}
+
+func writeCrashFile(r any, stack []byte) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "p2p")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, "crash-"+time.Now().Format("20060102-150405")+".txt")
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "p2p %s crashed at %s\n\npanic: %v\n\n%s\n", Version, time.Now().Format(time.RFC3339), r, stack)
+	fmt.Fprintf(&report, "Recent log lines:\n%s", Logs.contents())
+	return path, os.WriteFile(path, report.Bytes(), 0o600)
+}
@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p/internal/crash"
+	"p2p/internal/transport"
+)
+
+// Keeps our room membership on whichever discovery server we use alive until
+// done or leave is closed
+func JoinRoom(conn transport.Conn, servers *Servers, room string, identity ed25519.PrivateKey, done, leave chan struct{}) {
+	defer crash.Recover()
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		_ = RefreshRoom(conn, servers.Current(), room, identity)
+
+		select {
+		case <-done:
+			return
+		case <-leave:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Joins a room, or refreshes our membership, which makes the discovery
+// server send us everyone in it. It's as our identity, so the room's owner
+// can ban us without banning everyone behind our NAT.
+func RefreshRoom(conn transport.Conn, discoveryAddr *net.UDPAddr, room string, identity ed25519.PrivateKey) error {
+	if identity == nil {
+		return request(conn, discoveryAddr, "join:"+room)
+	}
+	key := identity.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(identity, joinMessage(room))
+	return request(conn, discoveryAddr, "join:"+room+" "+base64.StdEncoding.EncodeToString(key)+" "+base64.StdEncoding.EncodeToString(sig))
+}
+
+// Tells the discovery server we're leaving a room
+func LeaveRoom(conn transport.Conn, discoveryAddr *net.UDPAddr, room string) error {
+	return request(conn, discoveryAddr, "leave:"+room)
+}
+
+// Asks the discovery server to kick or ban a member of a room we own
+func Moderate(conn transport.Conn, discoveryAddr *net.UDPAddr, command, room string, target *net.UDPAddr) error {
+	return request(conn, discoveryAddr, fmt.Sprintf("%s:%s %s", command, room, target))
+}
+
+// Asks the discovery server for our external address, without waiting for
+// the answer
+func RequestAddress(conn transport.Conn, discoveryAddr *net.UDPAddr) error {
+	slog.Debug("asking discovery server for our address", "server", discoveryAddr)
+	// before anything else, so the server knows how to answer
+	if err := SayHello(conn, discoveryAddr); err != nil {
+		return err
+	}
+	return request(conn, discoveryAddr, "whoami")
+}
+
+// The tokens discovery servers gave us, by their ip:port
+var tokens sync.Map
+
+// How small a request we pad to, big enough for the server to fit a signed
+// token in its answer when it doesn't take the token we show, or we show none
+const minRequest = 128
+
+// Sends a request to the discovery server, with its token if it gave us one
+// and asking it to sign its answers if we know its key
+func request(conn transport.Conn, discoveryAddr *net.UDPAddr, text string) error {
+	var prefix string
+	if token, ok := tokens.Load(discoveryAddr.String()); ok {
+		prefix = "token:" + token.(string) + " "
+	}
+	if serverKey(discoveryAddr) != nil {
+		prefix += "sign:" + nonce + " "
+	}
+	if n := minRequest - len(prefix) - len(text) - len("pad: "); n > 0 {
+		text = "pad:" + strings.Repeat("0", n) + " " + text
+	}
+	text = prefix + text
+	_, err := conn.WriteToUDP([]byte(text), discoveryAddr)
+	return err
+}
+
+// Keeps the token in a discovery server's answer, if it's one, reporting
+// whether it was and whether it's new. The server ignored the request it
+// answers, so whatever it was has to be asked again, which with several
+// requests in flight only needs doing for the first.
+func TakeToken(discoveryAddr *net.UDPAddr, text string) (bool, bool) {
+	token, ok := strings.CutPrefix(text, "token:")
+	if !ok || token == "" {
+		return false, false
+	}
+	previous, _ := tokens.Swap(discoveryAddr.String(), token)
+	if previous == token {
+		return true, false
+	}
+	slog.Debug("discovery server gave us a token", "server", discoveryAddr)
+	return true, true
+}
+
+// Asks the discovery server for our external address, retrying until it
+// answers or the timeout passes
+func Whoami(conn transport.Conn, discoveryAddr *net.UDPAddr, timeout time.Duration) (*net.UDPAddr, error) {
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, 1024)
+
+	for time.Now().Before(deadline) {
+		if err := RequestAddress(conn, discoveryAddr); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(transport.PunchInterval))
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil || !transport.SameAddr(addr, discoveryAddr) {
+			// try again
+			continue
+		}
+		text, ok := Verify(discoveryAddr, string(buffer[:n]))
+		if !ok {
+			slog.Warn("ignoring an answer the discovery server didn't sign", "text", text)
+			continue
+		}
+		if token, _ := TakeToken(discoveryAddr, text); token {
+			// ask again with it straight away
+			continue
+		}
+		if m, ok := ParseMessage(text); ok && m.Type == Binding {
+			return net.ResolveUDPAddr("udp", m.Addr)
+		}
+	}
+	return nil, fmt.Errorf("no reply within %s", timeout)
+}
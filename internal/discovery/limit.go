@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Requests a second the server answers from any one IP, and how many it can
+// send in a burst, unless told otherwise. Clients ask for their address and
+// refresh their rooms every few seconds at most, so this only stops floods,
+// and as a spoofed request's answer goes to whoever's IP it claims, it also
+// caps how much the server can be made to send someone else.
+const (
+	DefaultRequestRate = 20.0
+	requestBurst       = 2
+)
+
+// The most the server sends in answer to a request, which a big room's
+// member list would otherwise go over. It's about what fits in a datagram on
+// any path.
+const MaxReplySize = 1200
+
+// Relayed frames a second the server takes from any one IP before looking at
+// them, which a file's chunks need far more of than requests. What actually
+// goes through is still limited by each pair's relay rate.
+const relayFrameRate = 1000.0
+
+// A token bucket per source IP. Relayed frames count against one of their
+// own, so a transfer doesn't crowd out its sender's room refreshes.
+type requestLimiter struct {
+	rate      float64
+	buckets   map[netip.Addr]*requestBucket
+	lastSweep time.Time
+}
+
+type requestBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRequestLimiter(rate float64) *requestLimiter {
+	return &requestLimiter{rate: rate, buckets: map[netip.Addr]*requestBucket{}, lastSweep: time.Now()}
+}
+
+// Whether to answer a request from addr rather than drop it
+func (l *requestLimiter) allow(addr *net.UDPAddr) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	burst := requestBurst * l.rate
+	if now.Sub(l.lastSweep) > time.Minute {
+		// forget IPs whose buckets are full again, so spoofed ones can't
+		// grow the map forever
+		l.lastSweep = now
+		for key, b := range l.buckets {
+			if now.Sub(b.last).Seconds()*l.rate >= burst {
+				delete(l.buckets, key)
+			}
+		}
+	}
+
+	key := addr.AddrPort().Addr().Unmap()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &requestBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Signs the tokens the server hands out, so it doesn't have to remember them
+var tokenSecret = func() []byte {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret
+}()
+
+// The token a client at addr has to show when the server requires one, which
+// only a client that can receive at that IP gets to see
+func tokenFor(addr *net.UDPAddr) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(addr.IP.String()))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// What's left to answer a request that showed no token with, which is no
+// more than the request, so spoofing someone's address can't have us send
+// them more than was spoofed
+type answerCap struct {
+	addr    *net.UDPAddr
+	size    int // How big the request was
+	left    int
+	dropped bool // An answer didn't fit
+}
+
+// Finishes answering a request that showed no token, sending the token in
+// place of whatever answer didn't fit, so the client can ask again with it,
+// as long as the token fits where the answer didn't
+func (s *Server) uncap() {
+	c := s.capped
+	s.capped = nil
+	if !c.dropped {
+		return
+	}
+	token := s.sign(c.addr, "token:"+tokenFor(c.addr))
+	if len(token) > c.size {
+		slog.Debug("request too small to answer without a token", "addr", c.addr, "size", c.size)
+		return
+	}
+	s.Metrics.tokens.Add(1)
+	s.send(c.addr, []byte(token))
+}
+
+// Splits the padding off a request, which clients add so it's big enough to
+// be answered with a token
+func takePadding(request string) string {
+	rest, ok := strings.CutPrefix(request, "pad:")
+	if !ok {
+		return request
+	}
+	_, rest, _ = strings.Cut(rest, " ")
+	return rest
+}
+
+// Splits the token off a request that starts with one, reporting whether it
+// was the right one for addr
+func checkToken(request string, addr *net.UDPAddr) (string, bool) {
+	rest, ok := strings.CutPrefix(request, "token:")
+	if !ok {
+		return request, false
+	}
+	token, rest, _ := strings.Cut(rest, " ")
+	return rest, hmac.Equal([]byte(token), []byte(tokenFor(addr)))
+}
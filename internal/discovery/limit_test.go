@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	aAgain := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6}
+	b := &net.UDPAddr{IP: net.IPv4(6, 7, 8, 9), Port: 10}
+
+	// requests from addr, after its bucket was last touched ago, of which
+	// allowed get through
+	type step struct {
+		addr    *net.UDPAddr
+		ago     time.Duration
+		send    int
+		allowed int
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		steps []step
+	}{
+		{"no limit", 0, []step{{a, 0, 1000, 1000}}},
+		{"a burst, then nothing", 10, []step{{a, 0, 30, 20}}},
+		{"each IP on its own", 10, []step{{a, 0, 30, 20}, {b, 0, 30, 20}}},
+		{"every port of an IP together", 10, []step{{a, 0, 15, 15}, {aAgain, 0, 15, 5}}},
+		{"refills at the rate", 10, []step{{a, 0, 30, 20}, {a, time.Second, 30, 10}}},
+		{"refills no further than a burst", 10, []step{{a, 0, 30, 20}, {a, time.Minute, 30, 20}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRequestLimiter(tt.rate)
+			for i, s := range tt.steps {
+				if bucket, ok := l.buckets[s.addr.AddrPort().Addr().Unmap()]; ok {
+					bucket.last = bucket.last.Add(-s.ago)
+				}
+				allowed := 0
+				for range s.send {
+					if l.allow(s.addr) {
+						allowed++
+					}
+				}
+				if allowed != s.allowed {
+					t.Errorf("step %d: allowed %d of %d from %s, want %d", i, allowed, s.send, s.addr, s.allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestAnswerCap(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+
+	tests := []struct {
+		name         string
+		requireToken bool
+		signed       bool
+		text         string
+		wantAnswer   bool // Whether what the request asked for comes back before it has a token
+	}{
+		{"whoami", false, false, "whoami", true},
+		{"whoami, signed", false, true, "whoami", true},
+		{"join a big room", false, false, "join:r", false},
+		{"join a big room, signed", false, true, "join:r", false},
+		{"whoami to a server requiring a token", true, true, "whoami", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(tokens.Clear)
+			t.Cleanup(serverKeys.Clear)
+			serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer serverConn.Close()
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			serverAddr := serverConn.LocalAddr().(*net.UDPAddr)
+			s := NewServer(serverConn)
+			s.RequireToken = tt.requireToken
+			if tt.signed {
+				s.Key = private
+				PinServerKey(serverAddr, public)
+			}
+			for i := range 20 {
+				s.join("r", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + i})
+			}
+
+			// sends text the way a client does and collects the answers
+			ask := func() (answers []string) {
+				t.Helper()
+				if err := request(conn, serverAddr, tt.text); err != nil {
+					t.Fatal(err)
+				}
+				buffer := make([]byte, 65536)
+				n, addr, err := serverConn.ReadFromUDP(buffer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.handle(buffer[:n], addr, newRequestLimiter(0), newRequestLimiter(0))
+				for {
+					conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+					n, _, err := conn.ReadFromUDP(buffer)
+					if err != nil {
+						return answers
+					}
+					answers = append(answers, string(buffer[:n]))
+				}
+			}
+
+			answers := ask()
+			size := 0
+			var token, answered bool
+			for _, answer := range answers {
+				size += len(answer)
+				if ok, _ := TakeToken(serverAddr, strings.Split(answer, "\n")[0]); ok {
+					token = true
+				} else {
+					answered = true
+				}
+			}
+			if size > minRequest {
+				t.Errorf("answered %d bytes without a token, more than the %d asked with: %q", size, minRequest, answers)
+			}
+			if answered != tt.wantAnswer {
+				t.Errorf("answered = %t, want %t: %q", answered, tt.wantAnswer, answers)
+			}
+			if !token && !answered {
+				t.Fatalf("answered with neither the token nor the answer")
+			}
+
+			if answers := ask(); len(answers) == 0 || strings.HasPrefix(answers[0], "token:") {
+				t.Errorf("with the token, answered %q", answers)
+			}
+		})
+	}
+}
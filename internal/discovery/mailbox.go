@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"p2p/internal/mailbox"
+	"p2p/internal/transport"
+)
+
+// How long the server holds a letter for a peer that doesn't come back for it
+var LetterTimeout = 7 * 24 * time.Hour
+
+// A sealed message held for a peer, which only that peer can open
+type letter struct {
+	sealed []byte
+	stored time.Time
+}
+
+// Holds a letter a room member left for a peer that's offline, by its
+// identity, until the peer collects it. Only members can leave letters, so
+// the server isn't a free store for anyone, and a peer holds at most
+// MailboxSize of them.
+func (s *Server) deposit(request string, addr *net.UDPAddr) {
+	to, encoded, _ := strings.Cut(request, " ")
+	if s.MailboxSize <= 0 || !s.member(addr) {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(to)
+	sealed, err2 := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || err2 != nil || len(key) != ed25519.PublicKeySize || len(sealed) > mailbox.MaxSealedSize {
+		return
+	}
+	if len(s.mailboxes[to]) >= s.MailboxSize {
+		s.reply(addr, "mailfull:"+to)
+		return
+	}
+	s.mailboxes[to] = append(s.mailboxes[to], letter{sealed: sealed, stored: time.Now()})
+	s.Metrics.letters.Add(1)
+	slog.Debug("holding letter", "from", addr, "letters", len(s.mailboxes[to]))
+	s.reply(addr, "mailed:"+to)
+}
+
+// What a peer signs to collect its letters, which only works from the
+// address it signed
+func collectMessage(addr string) []byte {
+	return []byte("p2p mailbox collect " + addr)
+}
+
+// Hands a peer the letters held for it, once it shows it has the identity
+// they're for, and forgets them
+func (s *Server) collect(request string, addr *net.UDPAddr) {
+	encodedKey, encodedSig, _ := strings.Cut(request, " ")
+	letters := s.mailboxes[encodedKey]
+	if len(letters) == 0 {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	sig, err2 := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil || err2 != nil || len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, collectMessage(addr.String()), sig) {
+		slog.Warn("refused to hand over letters without proof", "addr", addr)
+		return
+	}
+	slog.Info("handing over letters", "addr", addr, "letters", len(letters))
+	for _, l := range letters {
+		s.reply(addr, "mail:"+base64.StdEncoding.EncodeToString(l.sealed))
+	}
+	delete(s.mailboxes, encodedKey)
+	s.Metrics.letters.Add(-int64(len(letters)))
+}
+
+// Whether someone's a member of any room
+func (s *Server) member(addr *net.UDPAddr) bool {
+	for _, r := range s.rooms {
+		if _, ok := r.members[addr.String()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Throws away letters nobody came for
+func (s *Server) expireLetters() {
+	for key, letters := range s.mailboxes {
+		kept := letters[:0]
+		for _, l := range letters {
+			if time.Since(l.stored) <= LetterTimeout {
+				kept = append(kept, l)
+			}
+		}
+		s.Metrics.letters.Add(-int64(len(letters) - len(kept)))
+		if len(kept) == 0 {
+			delete(s.mailboxes, key)
+		} else {
+			s.mailboxes[key] = kept
+		}
+	}
+}
+
+// Leaves a sealed letter with the discovery server for the peer with the
+// given identity
+func LeaveLetter(conn transport.Conn, discoveryAddr *net.UDPAddr, to ed25519.PublicKey, sealed []byte) error {
+	return request(conn, discoveryAddr, "mail:"+base64.StdEncoding.EncodeToString(to)+" "+base64.StdEncoding.EncodeToString(sealed))
+}
+
+// Asks the discovery server for any letters held for us, proving who we are
+// for the address it sees us at
+func CollectLetters(conn transport.Conn, discoveryAddr *net.UDPAddr, identity ed25519.PrivateKey, external string) error {
+	key := identity.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(identity, collectMessage(external))
+	return request(conn, discoveryAddr, "collect:"+base64.StdEncoding.EncodeToString(key)+" "+base64.StdEncoding.EncodeToString(sig))
+}
+
+// The sealed letter in the discovery server's delivery, or whose identity a
+// letter we left was held for, or couldn't be as their mailbox was full
+func ParseMail(text string) (kind string, data []byte, ok bool) {
+	kind, rest, ok := strings.Cut(text, ":")
+	switch kind {
+	case "mail", "mailed", "mailfull":
+	default:
+		return "", nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(rest)
+	return kind, data, ok && err == nil
+}
@@ -0,0 +1,188 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// The mapping probe has a client send to the server from several local ports
+// in turn, and the server answer each with every mapping it saw under the
+// probe's id so far, in the order they arrived. How the NAT hands out those
+// ports says whether a peer can guess the one it'll use for them next, which
+// is all hole punching through a symmetric NAT has to go on.
+
+// How many local ports the mapping probe sends from
+const MappingProbes = 6
+
+// The most mappings the server keeps for a probe, and how long it keeps them
+const (
+	maxProbeMappings = 16
+	probeTimeout     = time.Minute
+)
+
+// The external address a probe from one of the client's local ports came from
+type PortMapping struct {
+	Local    int
+	External *net.UDPAddr
+}
+
+// The mappings the server saw under a probe's id
+type probe struct {
+	mappings []probeMapping
+	started  time.Time
+}
+
+type probeMapping struct {
+	seq  int
+	addr *net.UDPAddr
+}
+
+// Records the mapping a probe came from and answers with all of them so far
+func (s *Server) probe(request string, addr *net.UDPAddr) {
+	id, field, _ := strings.Cut(request, " ")
+	seq, err := strconv.Atoi(field)
+	if id == "" || len(id) > 64 || err != nil || seq < 0 || seq >= maxProbeMappings {
+		return
+	}
+	p, ok := s.probes[id]
+	if !ok {
+		p = &probe{started: time.Now()}
+		s.probes[id] = p
+	}
+	if !slices.ContainsFunc(p.mappings, func(m probeMapping) bool { return m.seq == seq }) {
+		p.mappings = append(p.mappings, probeMapping{seq: seq, addr: addr})
+	}
+
+	reply := "mappings:" + id
+	for _, m := range p.mappings {
+		reply += fmt.Sprintf(" %d=%s", m.seq, m.addr)
+	}
+	s.reply(addr, reply)
+}
+
+// Forgets probes that finished
+func (s *Server) expireProbes() {
+	for id, p := range s.probes {
+		if time.Since(p.started) > probeTimeout {
+			delete(s.probes, id)
+		}
+	}
+}
+
+// Sends a mapping probe from MappingProbes fresh local ports on ip, one after
+// the other so the NAT hands out their mappings in order, and returns what the
+// server saw each come from, in that order
+func ProbeMappings(discoveryAddr *net.UDPAddr, ip net.IP, timeout time.Duration) ([]PortMapping, error) {
+	id := protocol.NewMessageID()
+	locals := make([]int, MappingProbes)
+	var last string
+	for i := range MappingProbes {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, err
+		}
+		locals[i] = conn.LocalAddr().(*net.UDPAddr).Port
+		last, err = probeFrom(conn, discoveryAddr, id, i, timeout)
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mappings []PortMapping
+	for _, field := range strings.Fields(last)[1:] {
+		seq, mapped, _ := strings.Cut(field, "=")
+		i, err := strconv.Atoi(seq)
+		if err != nil || i < 0 || i >= MappingProbes {
+			continue
+		}
+		if external, err := net.ResolveUDPAddr("udp", mapped); err == nil {
+			mappings = append(mappings, PortMapping{Local: locals[i], External: external})
+		}
+	}
+	return mappings, nil
+}
+
+// Sends one probe, retrying until the server answers it, and returns the
+// answer without its "mappings:"
+func probeFrom(conn *net.UDPConn, discoveryAddr *net.UDPAddr, id string, seq int, timeout time.Duration) (string, error) {
+	buffer := make([]byte, 1024)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := request(conn, discoveryAddr, fmt.Sprintf("probe:%s %d", id, seq)); err != nil {
+			return "", err
+		}
+		conn.SetReadDeadline(time.Now().Add(transport.PunchInterval))
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil || !transport.SameAddr(addr, discoveryAddr) {
+			// try again
+			continue
+		}
+		text, ok := Verify(discoveryAddr, string(buffer[:n]))
+		if !ok {
+			continue
+		}
+		if token, _ := TakeToken(discoveryAddr, text); token {
+			continue
+		}
+		rest, ok := strings.CutPrefix(text, "mappings:")
+		if ok && strings.HasPrefix(rest, id+" ") && strings.Contains(rest, fmt.Sprintf(" %d=", seq)) {
+			return rest, nil
+		}
+	}
+	return "", fmt.Errorf("no reply within %s", timeout)
+}
+
+// How a NAT hands out external ports to new local ports, as a sentence for
+// people, and the step between consecutive ones if it's regular
+func ClassifyAllocation(mappings []PortMapping) (string, int, bool) {
+	if len(mappings) < 2 {
+		return "unknown, too few probes were answered", 0, false
+	}
+	preserved := true
+	for _, m := range mappings {
+		if m.External.Port != m.Local {
+			preserved = false
+		}
+	}
+	if preserved {
+		return "port preserving, the external port is the local one", 0, false
+	}
+
+	stride := mappings[1].External.Port - mappings[0].External.Port
+	for i := 2; i < len(mappings); i++ {
+		if mappings[i].External.Port-mappings[i-1].External.Port != stride {
+			return "random, external ports don't follow each other", 0, false
+		}
+	}
+	if stride == 0 {
+		return "reused, every local port got the same external port", 0, false
+	}
+	return fmt.Sprintf("sequential, each new mapping is %+d from the last", stride), stride, true
+}
+
+// The external ports a NAT that hands them out in sequence will likely use
+// for the next count mappings
+func PredictPorts(mappings []PortMapping, count int) []int {
+	_, stride, ok := ClassifyAllocation(mappings)
+	if !ok {
+		return nil
+	}
+	next := mappings[len(mappings)-1].External.Port
+	var ports []int
+	for range count {
+		next += stride
+		if next < 1 || next > 65535 {
+			break
+		}
+		ports = append(ports, next)
+	}
+	return ports
+}
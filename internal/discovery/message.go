@@ -0,0 +1,173 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p/internal/transport"
+)
+
+// The discovery server's answers started out as text like "addr:1.2.3.4:5"
+// that each caller picked apart. Clients now say which version of typed
+// answers they understand with a hello, and the server answers them with
+// "v:<version> " and a JSON Message, so new fields and kinds can be added
+// without older clients misreading them. Clients that never said hello, and
+// servers that don't know it, keep to the text, which ParseMessage reads too.
+
+// The version of typed answers this build understands
+const ProtocolVersion = 1
+
+// Kinds of typed answer
+const (
+	Binding    = "binding" // Where the server sees the client
+	Offer      = "offer"   // Who's in a room, or a change to it
+	RelayGrant = "relay"   // Whether the server relays between the client and its room
+)
+
+// An answer from the discovery server
+type Message struct {
+	Type    string   `json:"type"`
+	Addr    string   `json:"addr,omitempty"`     // Binding: the client's external address
+	Event   string   `json:"event,omitempty"`    // Offer: members, joined, left, kicked, banned, denied or punch
+	Room    string   `json:"room,omitempty"`     // Offer and RelayGrant
+	Members []string `json:"members,omitempty"`  // Offer: who it's about, as ip:port
+	Delay   int64    `json:"delay_ms,omitempty"` // Offer to punch: how many milliseconds from now to start
+	Rate    int      `json:"rate,omitempty"`     // RelayGrant: bytes per second relayed for each pair, 0 when not relaying
+}
+
+// The answer as it's sent to clients that asked for typed answers
+func (m Message) encode() string {
+	data, _ := json.Marshal(m)
+	return fmt.Sprintf("v:%d %s", ProtocolVersion, data)
+}
+
+// The answer as it was sent before typed answers, or "" if there was no such
+// answer
+func (m Message) text() string {
+	switch m.Type {
+	case Binding:
+		return "addr:" + m.Addr
+	case Offer:
+		text := m.Event + ":" + m.Room
+		if m.Event == "punch" {
+			text += " " + strconv.FormatInt(m.Delay, 10)
+		}
+		for _, member := range m.Members {
+			text += " " + member
+		}
+		return text
+	}
+	return ""
+}
+
+// Sends a client an answer in whichever form it understands
+func (s *Server) answer(addr *net.UDPAddr, m Message) {
+	if _, ok := s.versions[addr.String()]; ok {
+		s.reply(addr, m.encode())
+	} else if text := m.text(); text != "" {
+		s.reply(addr, text)
+	}
+}
+
+// The version of typed answers a client said it understands
+type clientVersion struct {
+	version  int
+	lastSeen time.Time
+}
+
+// Remembers a client understands typed answers, up to the version we speak
+func (s *Server) hello(request string, addr *net.UDPAddr) {
+	version, err := strconv.Atoi(request)
+	if err != nil || version < 1 {
+		return
+	}
+	s.versions[addr.String()] = clientVersion{version: min(version, ProtocolVersion), lastSeen: time.Now()}
+}
+
+// Keeps remembering what a client understands for as long as it's around
+func (s *Server) seen(addr *net.UDPAddr) {
+	if v, ok := s.versions[addr.String()]; ok {
+		v.lastSeen = time.Now()
+		s.versions[addr.String()] = v
+	}
+}
+
+// Forgets what clients we stopped hearing from understand
+func (s *Server) expireVersions() {
+	for key, v := range s.versions {
+		if time.Since(v.lastSeen) > MemberTimeout {
+			delete(s.versions, key)
+		}
+	}
+}
+
+// Tells the discovery server we understand typed answers
+func SayHello(conn transport.Conn, discoveryAddr *net.UDPAddr) error {
+	return request(conn, discoveryAddr, fmt.Sprintf("hello:%d", ProtocolVersion))
+}
+
+// Reads an answer from the discovery server, typed or text, reporting
+// whether it was one that has a Message form
+func ParseMessage(text string) (Message, bool) {
+	if rest, ok := strings.CutPrefix(text, "v:"); ok {
+		version, data, _ := strings.Cut(rest, " ")
+		var m Message
+		if v, err := strconv.Atoi(version); err != nil || v > ProtocolVersion {
+			slog.Debug("ignoring answer in an unknown version", "version", version)
+			return Message{}, false
+		}
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return Message{}, false
+		}
+		return m, true
+	}
+
+	kind, rest, ok := strings.Cut(text, ":")
+	if !ok {
+		return Message{}, false
+	}
+	switch kind {
+	case "addr":
+		return Message{Type: Binding, Addr: rest}, true
+	case "members", "joined", "left", "kicked", "banned", "denied", "punch":
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return Message{}, false
+		}
+		m := Message{Type: Offer, Event: kind, Room: fields[0], Members: fields[1:]}
+		if kind == "punch" {
+			if len(fields) < 2 {
+				return Message{}, false
+			}
+			delay, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return Message{}, false
+			}
+			m.Delay, m.Members = delay, fields[2:]
+		}
+		return m, true
+	}
+	return Message{}, false
+}
+
+// The members an offer is about that are valid addresses
+func (m Message) Addrs() []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	for _, member := range m.Members {
+		if addr, err := net.ResolveUDPAddr("udp", member); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// How long from now an offer to punch says to start, if it's sensible
+func (m Message) PunchDelay() (time.Duration, bool) {
+	delay := time.Duration(m.Delay) * time.Millisecond
+	return delay, m.Delay >= 0 && delay <= time.Minute
+}
@@ -0,0 +1,52 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		want   Message
+		wantOK bool
+	}{
+		{"typed binding", `v:1 {"type":"binding","addr":"1.2.3.4:5"}`, Message{Type: Binding, Addr: "1.2.3.4:5"}, true},
+		{"typed members", `v:1 {"type":"offer","event":"members","room":"r","members":["1.2.3.4:5","6.7.8.9:10"]}`, Message{Type: Offer, Event: "members", Room: "r", Members: []string{"1.2.3.4:5", "6.7.8.9:10"}}, true},
+		{"typed from a newer version", `v:2 {"type":"binding","addr":"1.2.3.4:5"}`, Message{}, false},
+		{"typed garbage", `v:1 {"type":`, Message{}, false},
+		{"text binding", "addr:1.2.3.4:5", Message{Type: Binding, Addr: "1.2.3.4:5"}, true},
+		{"text members", "members:r 1.2.3.4:5 6.7.8.9:10", Message{Type: Offer, Event: "members", Room: "r", Members: []string{"1.2.3.4:5", "6.7.8.9:10"}}, true},
+		{"text members of an empty room", "members:r", Message{Type: Offer, Event: "members", Room: "r", Members: []string{}}, true},
+		{"text kicked", "kicked:r", Message{Type: Offer, Event: "kicked", Room: "r", Members: []string{}}, true},
+		{"text punch", "punch:r 250 1.2.3.4:5", Message{Type: Offer, Event: "punch", Room: "r", Delay: 250, Members: []string{"1.2.3.4:5"}}, true},
+		{"text punch without a delay", "punch:r", Message{}, false},
+		{"text punch with a bad delay", "punch:r soon 1.2.3.4:5", Message{}, false},
+		{"text without a room", "joined:", Message{}, false},
+		{"unknown kind", "mappings:abc", Message{}, false},
+		{"not an answer", "hello", Message{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseMessage(tt.text)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMessage(%q) = %+v, %t, want %+v, %t", tt.text, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, m := range []Message{
+		{Type: Binding, Addr: "1.2.3.4:5"},
+		{Type: Offer, Event: "joined", Room: "r", Members: []string{"1.2.3.4:5"}},
+		{Type: Offer, Event: "punch", Room: "r", Delay: 100, Members: []string{"1.2.3.4:5", "6.7.8.9:10"}},
+	} {
+		for _, text := range []string{m.encode(), m.text()} {
+			if got, ok := ParseMessage(text); !ok || !reflect.DeepEqual(got, m) {
+				t.Errorf("%q came back as %+v, %t, want %+v", text, got, ok, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// Counters and gauges for the discovery server, exposed in the Prometheus
+// text format on /metrics
+type Metrics struct {
+	requests      [requestKinds]atomic.Int64 // Requests received, by kind
+	registrations atomic.Int64               // Clients that joined a room they weren't in
+	rooms         atomic.Int64               // Rooms with at least one member
+	members       atomic.Int64               // Members across all rooms
+	relayedBytes  atomic.Int64               // Bytes forwarded between clients
+	relayRefused  atomic.Int64               // Frames not relayed, being between strangers or over the pair's rate
+	letters       atomic.Int64               // Letters held for peers that were offline
+	limited       atomic.Int64               // Requests dropped for coming too fast from one IP
+	tokens        atomic.Int64               // Requests answered with a token for lack of one
+	moves         atomic.Int64               // Clients whose session was refreshed from a new address
+	readErrors    atomic.Int64
+	writeErrors   atomic.Int64
+}
+
+// Kinds of request the discovery server counts
+const (
+	requestWhoami = iota
+	requestJoin
+	requestLeave
+	requestKick
+	requestBan
+	requestRelay
+	requestPunch
+	requestMail
+	requestCollect
+	requestWatch
+	requestProbe
+	requestHello
+	requestUnknown
+	requestKinds
+)
+
+var requestKindNames = [requestKinds]string{"whoami", "join", "leave", "kick", "ban", "relay", "punch", "mail", "collect", "watch", "probe", "hello", "unknown"}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP p2p_requests_total Requests received by the discovery server.")
+	fmt.Fprintln(w, "# TYPE p2p_requests_total counter")
+	for kind, name := range requestKindNames {
+		fmt.Fprintf(w, "p2p_requests_total{type=%q} %d\n", name, m.requests[kind].Load())
+	}
+
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("p2p_registrations_total", "counter", "Clients that joined a room.", m.registrations.Load())
+	metric("p2p_rooms_active", "gauge", "Rooms with at least one member.", m.rooms.Load())
+	metric("p2p_room_members", "gauge", "Members across all rooms.", m.members.Load())
+	metric("p2p_relayed_bytes_total", "counter", "Bytes relayed between clients.", m.relayedBytes.Load())
+	metric("p2p_requests_limited_total", "counter", "Requests dropped for coming too fast from one IP.", m.limited.Load())
+	metric("p2p_tokens_issued_total", "counter", "Requests answered with a token for lack of one.", m.tokens.Load())
+	metric("p2p_letters_held", "gauge", "Letters held for peers that were offline.", m.letters.Load())
+	metric("p2p_client_moves_total", "counter", "Clients whose NAT moved them to a new address.", m.moves.Load())
+	metric("p2p_relay_refused_total", "counter", "Frames not relayed, being between strangers or over the rate.", m.relayRefused.Load())
+
+	fmt.Fprintln(w, "# HELP p2p_errors_total Socket errors on the discovery server.")
+	fmt.Fprintln(w, "# TYPE p2p_errors_total counter")
+	fmt.Fprintf(w, "p2p_errors_total{op=\"read\"} %d\n", m.readErrors.Load())
+	fmt.Fprintf(w, "p2p_errors_total{op=\"write\"} %d\n", m.writeErrors.Load())
+}
+
+// Serves /metrics on addr in the background
+func ServeMetrics(addr string, metrics *Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("serving metrics failed", "addr", addr, "err", err)
+		}
+	}()
+}
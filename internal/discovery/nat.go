@@ -0,0 +1,277 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/stun/v3"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// Public STUN servers the full probe compares the discovery server's answer against
+var StunServers = []string{"stun.l.google.com:19302", "stun1.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+// What the full probe found out about our NAT, each as a sentence for people
+type NATReport struct {
+	Mapped    []*net.UDPAddr // Our external address as the discovery server, then each STUN server, saw it
+	Mapping   string
+	Filtering string
+	Hairpin   string
+	UPnP      string
+
+	Probed     []PortMapping // What the discovery server saw the mapping probe's local ports come from
+	Allocation string
+	NextPorts  []int // The external ports the NAT will likely hand out next, if they can be guessed
+
+	// Whether each way of connecting will work
+	Direct    string
+	Predicted string
+	Relay     string
+
+	sequential    bool // Whether differing mappings were close enough to guess the next
+	independentEP bool
+}
+
+// Works out how our NAT behaves from the external address the discovery
+// server saw, and which ways of connecting will work, for `p2p probe -full`
+func DiagnoseNAT(conn *net.UDPConn, discoveryAddr, external *net.UDPAddr, timeout time.Duration) NATReport {
+	report := NATReport{Mapped: []*net.UDPAddr{external}}
+
+	var stunAddr *net.UDPAddr
+	for _, server := range StunServers {
+		addr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			continue
+		}
+		mapped, _, err := stunBinding(conn, addr, false, timeout)
+		if err != nil {
+			continue
+		}
+		report.Mapped = append(report.Mapped, mapped)
+		if stunAddr == nil {
+			stunAddr = addr
+		}
+	}
+
+	report.classifyMapping()
+	report.probeAllocation(conn, discoveryAddr, timeout)
+	report.Filtering = testFiltering(conn, stunAddr, timeout)
+	report.Hairpin = testHairpin(conn, external, timeout)
+	report.UPnP = testUPnP(timeout)
+	report.verdict()
+	return report
+}
+
+// Compares the external addresses different servers saw us at
+func (r *NATReport) classifyMapping() {
+	if len(r.Mapped) < 2 {
+		r.Mapping = "unknown, no STUN server answered to compare against"
+		return
+	}
+
+	first := r.Mapped[0]
+	r.independentEP, r.sequential = true, true
+	for i, mapped := range r.Mapped[1:] {
+		if !mapped.IP.Equal(first.IP) {
+			r.Mapping = fmt.Sprintf("unknown, servers saw different IPs (%s and %s), you may be behind several NATs", first.IP, mapped.IP)
+			r.independentEP, r.sequential = false, false
+			return
+		}
+		if mapped.Port != first.Port {
+			r.independentEP = false
+		}
+		if delta := mapped.Port - r.Mapped[i].Port; delta < -10 || delta > 10 {
+			r.sequential = false
+		}
+	}
+
+	switch {
+	case r.independentEP:
+		r.Mapping = "endpoint-independent, every server saw the same address"
+	case r.sequential:
+		r.Mapping = "endpoint-dependent (symmetric), but ports are handed out in sequence"
+	default:
+		r.Mapping = "endpoint-dependent (symmetric), with unpredictable ports"
+	}
+}
+
+// Has the discovery server watch new mappings come from several local ports,
+// to see how the NAT hands out external ones and guess the next. Without
+// STUN servers to compare against, it's also all we know of the mapping.
+func (r *NATReport) probeAllocation(conn *net.UDPConn, discoveryAddr *net.UDPAddr, timeout time.Duration) {
+	mappings, err := ProbeMappings(discoveryAddr, conn.LocalAddr().(*net.UDPAddr).IP, timeout)
+	if err != nil {
+		r.Allocation = fmt.Sprintf("unknown, the discovery server didn't answer the mapping probe: %v", err)
+		return
+	}
+	r.Probed = mappings
+	var sequential bool
+	r.Allocation, _, sequential = ClassifyAllocation(mappings)
+	r.NextPorts = PredictPorts(mappings, 3)
+	if len(r.Mapped) < 2 {
+		r.sequential = sequential
+	}
+}
+
+// Asks a STUN server to answer from a different address and port, which only
+// gets through if our NAT lets in packets from addresses we never sent to
+func testFiltering(conn *net.UDPConn, stunAddr *net.UDPAddr, timeout time.Duration) string {
+	if stunAddr == nil {
+		return "unknown, no STUN server answered"
+	}
+	_, from, err := stunBinding(conn, stunAddr, true, timeout)
+	switch {
+	case err == errChangeUnsupported:
+		return "unknown, the STUN server can't answer from another address"
+	case err != nil:
+		return "address-dependent or stricter, an answer from another address didn't get through"
+	case from.IP.Equal(stunAddr.IP):
+		return "unknown, the STUN server ignored the request to answer from elsewhere"
+	default:
+		return "endpoint-independent, an answer from an address we never sent to got through"
+	}
+}
+
+// Sends a packet from a second socket to our own external address and checks
+// whether the NAT loops it back to us
+func testHairpin(conn *net.UDPConn, external *net.UDPAddr, timeout time.Duration) string {
+	other, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return fmt.Sprintf("unknown, couldn't open a second socket: %v", err)
+	}
+	defer other.Close()
+
+	token := []byte("hairpin:" + protocol.NewMessageID())
+	buffer := make([]byte, 1024)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := other.WriteToUDP(token, external); err != nil {
+			return fmt.Sprintf("unknown, sending failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(transport.PunchInterval))
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err == nil && bytes.Equal(buffer[:n], token) {
+			return "supported, peers behind the same NAT can reach you at your external address"
+		}
+	}
+	return "not supported, peers behind the same NAT should use your local address"
+}
+
+// Looks for an Internet Gateway Device on the LAN that could open ports for us
+func testUPnP(timeout time.Duration) string {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return fmt.Sprintf("unknown, couldn't open a socket: %v", err)
+	}
+	defer conn.Close()
+
+	ssdp := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), ssdp); err != nil {
+		return fmt.Sprintf("unknown, searching failed: %v", err)
+	}
+
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		return "not found"
+	}
+	for _, line := range strings.Split(string(buffer[:n]), "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(key, "SERVER") {
+			return fmt.Sprintf("available, gateway at %s (%s)", addr.IP, strings.TrimSpace(value))
+		}
+	}
+	return fmt.Sprintf("available, gateway at %s", addr.IP)
+}
+
+// Decides which ways of connecting are worth trying given what we found
+func (r *NATReport) verdict() {
+	switch {
+	case r.independentEP:
+		r.Direct = "will work, hole punching to your external address should succeed"
+	case r.UPnP != "not found" && !strings.HasPrefix(r.UPnP, "unknown"):
+		r.Direct = "may work if the gateway is asked to forward your port with UPnP"
+	case len(r.Mapped) < 2:
+		r.Direct = "unknown, try it and fall back to a relay"
+	default:
+		r.Direct = "unlikely, peers can't know which port your NAT will use for them"
+	}
+
+	switch {
+	case r.independentEP:
+		r.Predicted = "not needed"
+	case r.sequential && len(r.NextPorts) > 0:
+		r.Predicted = fmt.Sprintf("may work, peers can guess the next port your NAT hands out, likely %s", joinPorts(r.NextPorts))
+	case len(r.Mapped) < 2:
+		r.Predicted = "unknown"
+	case r.sequential:
+		r.Predicted = "may work, peers can guess the next port your NAT hands out"
+	default:
+		r.Predicted = "won't work"
+	}
+
+	r.Relay = "will work whenever another peer can reach both of you"
+}
+
+func joinPorts(ports []int) string {
+	text := make([]string, len(ports))
+	for i, port := range ports {
+		text[i] = fmt.Sprint(port)
+	}
+	return strings.Join(text, ", ")
+}
+
+var errChangeUnsupported = fmt.Errorf("the STUN server doesn't support CHANGE-REQUEST")
+
+// Sends a STUN binding request, optionally asking for the answer to come from
+// another IP and port, and returns the mapped address and who answered
+func stunBinding(conn *net.UDPConn, server *net.UDPAddr, change bool, timeout time.Duration) (*net.UDPAddr, *net.UDPAddr, error) {
+	setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if change {
+		// change IP and change port flags
+		setters = append(setters, stun.RawAttribute{Type: stun.AttrChangeRequest, Value: []byte{0, 0, 0, 6}})
+	}
+	request, err := stun.Build(setters...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buffer := make([]byte, 1024)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteToUDP(request.Raw, server); err != nil {
+			return nil, nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(transport.PunchInterval))
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil || !stun.IsMessage(buffer[:n]) {
+			// try again
+			continue
+		}
+		response := &stun.Message{Raw: append([]byte(nil), buffer[:n]...)}
+		if response.Decode() != nil || response.TransactionID != request.TransactionID {
+			continue
+		}
+		if response.Type.Class == stun.ClassErrorResponse {
+			return nil, nil, errChangeUnsupported
+		}
+
+		var mapped stun.XORMappedAddress
+		if err := mapped.GetFrom(response); err != nil {
+			return nil, nil, err
+		}
+		return &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}, from, nil
+	}
+	return nil, nil, fmt.Errorf("no reply within %s", timeout)
+}
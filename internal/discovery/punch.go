@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"p2p/internal/transport"
+)
+
+// How long after hearing from the server both sides of a coordinated punch
+// start. As the server tells both at once, they start within the difference
+// of their delays from it rather than whenever each happened to launch, so
+// their keepalives cross while both NATs' mappings are fresh, which is what
+// gets through port restricted NATs.
+const PunchDelay = 200 * time.Millisecond
+
+// Tells a member that asked, and whichever of the members it asked about
+// asked for coordinated punches themselves, to punch towards each other
+// PunchDelay from now. Members that never asked are left alone, as older
+// builds would show the server's word as a message.
+func (s *Server) coordinate(request string, addr *net.UDPAddr) {
+	fields := strings.Fields(request)
+	if len(fields) == 0 {
+		return
+	}
+	r, ok := s.rooms[fields[0]]
+	if !ok {
+		return
+	}
+	requester, ok := r.members[addr.String()]
+	if !ok {
+		return
+	}
+	requester.punches = true
+
+	var targets []string
+	for _, target := range fields[1:] {
+		member, ok := r.members[target]
+		if !ok || !member.punches || target == addr.String() {
+			continue
+		}
+		targets = append(targets, target)
+	}
+	targets = fit(targets, len(fields[0]))
+	for _, target := range targets {
+		s.answer(r.members[target].addr, Message{Type: Offer, Event: "punch", Room: fields[0], Delay: PunchDelay.Milliseconds(), Members: []string{addr.String()}})
+	}
+	if len(targets) > 0 {
+		slog.Debug("coordinating punch", "room", fields[0], "addr", addr, "with", targets)
+		s.answer(addr, Message{Type: Offer, Event: "punch", Room: fields[0], Delay: PunchDelay.Milliseconds(), Members: targets})
+	}
+}
+
+// Asks the discovery server to have us and the given members of our room
+// punch towards each other at the same time
+func RequestPunch(conn transport.Conn, discoveryAddr *net.UDPAddr, room string, members []*net.UDPAddr) error {
+	text := "punch:" + room
+	for _, member := range members {
+		text += " " + member.String()
+	}
+	return request(conn, discoveryAddr, text)
+}
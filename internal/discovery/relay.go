@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"p2p/internal/protocol"
+)
+
+// How many bytes a pair of members can burst past their relay rate, so a
+// whole message or chunk gets through even at a low rate
+const relayBurst = 64 * 1024
+
+// What's left of a pair of members' relay allowance
+type relayBudget struct {
+	bytes   float64
+	updated time.Time
+}
+
+// Forwards a relay frame from a member that can't reach a peer in one of its
+// rooms directly, as peers relay for each other, within the pair's share of
+// RelayRate. Frames to anyone who isn't in a room with the sender are
+// dropped, so the server can't be used to send to arbitrary addresses.
+func (s *Server) relay(data []byte, from *net.UDPAddr) {
+	if s.RelayRate <= 0 {
+		return
+	}
+	f, ok := protocol.Decode(data)
+	if !ok || f.Type != protocol.Relay || f.Frame == nil {
+		return
+	}
+	to, err := net.ResolveUDPAddr("udp", f.To)
+	if err != nil || !s.together(from, to) {
+		slog.Debug("refused to relay between strangers", "from", from, "to", f.To)
+		s.Metrics.relayRefused.Add(1)
+		return
+	}
+
+	relayed := *f.Frame
+	relayed.From = from.String()
+	encoded := protocol.Encode(relayed)
+	if !s.spend(from, to, len(encoded)) {
+		slog.Debug("relay rate exceeded", "from", from, "to", to)
+		s.Metrics.relayRefused.Add(1)
+		return
+	}
+	s.send(to, encoded)
+	s.Metrics.relayedBytes.Add(int64(len(encoded)))
+	s.relayed.add(len(encoded))
+}
+
+// Whether two addresses are members of the same room
+func (s *Server) together(a, b *net.UDPAddr) bool {
+	for _, r := range s.rooms {
+		_, hasA := r.members[a.String()]
+		_, hasB := r.members[b.String()]
+		if hasA && hasB {
+			return true
+		}
+	}
+	return false
+}
+
+// Takes n bytes from what a pair of members may still relay, whichever way
+// they go, reporting whether there were enough
+func (s *Server) spend(a, b *net.UDPAddr, n int) bool {
+	key := a.String() + " " + b.String()
+	if b.String() < a.String() {
+		key = b.String() + " " + a.String()
+	}
+	budget, ok := s.budgets[key]
+	if !ok {
+		budget = &relayBudget{bytes: relayBurst, updated: time.Now()}
+		s.budgets[key] = budget
+	}
+	now := time.Now()
+	budget.bytes = min(relayBurst, budget.bytes+now.Sub(budget.updated).Seconds()*float64(s.RelayRate))
+	budget.updated = now
+	if budget.bytes < float64(n) {
+		return false
+	}
+	budget.bytes -= float64(n)
+	return true
+}
+
+// Forgets the budgets of pairs that stopped relaying
+func (s *Server) expireBudgets() {
+	for key, budget := range s.budgets {
+		if time.Since(budget.updated) > MemberTimeout {
+			delete(s.budgets, key)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayBudget(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	b := &net.UDPAddr{IP: net.IPv4(6, 7, 8, 9), Port: 10}
+	c := &net.UDPAddr{IP: net.IPv4(11, 12, 13, 14), Port: 15}
+
+	// bytes relayed between a pair, after their budget was last touched ago
+	type step struct {
+		from, to *net.UDPAddr
+		ago      time.Duration
+		bytes    int
+		want     bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"a burst", []step{{a, b, 0, relayBurst, true}}},
+		{"past a burst", []step{{a, b, 0, relayBurst, true}, {a, b, 0, 1000, false}}},
+		{"both ways share it", []step{{a, b, 0, relayBurst, true}, {b, a, 0, 1000, false}}},
+		{"each pair on its own", []step{{a, b, 0, relayBurst, true}, {a, c, 0, 1000, true}}},
+		{"more than a burst at once", []step{{a, b, 0, relayBurst + 1, false}}},
+		{"refills at the rate", []step{{a, b, 0, relayBurst, true}, {a, b, time.Second, 1000, true}, {a, b, 0, 1000, false}}},
+		{"refills no further than a burst", []step{{a, b, 0, relayBurst, true}, {a, b, time.Hour, relayBurst + 1, false}, {a, b, 0, relayBurst, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{RelayRate: 1000, budgets: map[string]*relayBudget{}}
+			for i, step := range tt.steps {
+				for _, budget := range s.budgets {
+					budget.updated = budget.updated.Add(-step.ago)
+				}
+				if got := s.spend(step.from, step.to, step.bytes); got != step.want {
+					t.Errorf("step %d: relaying %d bytes from %s to %s = %t, want %t", i, step.bytes, step.from, step.to, got, step.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+// Package discovery is the rendezvous server that tells clients their
+// external address and introduces room members, and the client side of it.
+package discovery
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p/internal/transport"
+)
+
+// Port the discovery server listens on unless told otherwise
+const DefaultPort = 50000
+
+// The longest room name the server accepts, in bytes, so a room's answers
+// stay small whatever it's called
+const MaxRoomName = 64
+
+// How often the server forgets members, budgets and the rest that have gone
+// quiet
+const sweepInterval = time.Second
+
+var (
+	// How long a room member stays listed without refreshing its membership
+	MemberTimeout = 30 * time.Second
+	// How often clients refresh their room membership
+	RefreshInterval = 10 * time.Second
+	// How long a kicked member is turned away, so a refresh that crossed the
+	// kick, or one the kick never reached, doesn't just let it back in
+	KickTimeout = time.Minute
+)
+
+// A discovery server that tells clients their external address and introduces
+// the members of a room to each other
+type Server struct {
+	mu        sync.Mutex // Guards everything below, which Run changes and Status reads
+	conn      *net.UDPConn
+	started   time.Time
+	rooms     map[string]*room
+	budgets   map[string]*relayBudget  // What each pair of members may still relay, by both their ip:port
+	nonces    map[string]clientNonce   // What each client asked us to sign answers with, by ip:port
+	mailboxes map[string][]letter      // Letters held for peers that were offline, by their base64 identity
+	sessions  map[string]session       // Where each client last refreshed its session from, by session id
+	probes    map[string]*probe        // Mappings seen by each mapping probe, by its id
+	versions  map[string]clientVersion // The typed answers each client understands, by ip:port, if it said
+	relayed   throughput
+	capped    *answerCap // What's left to answer the request we're handling with, while it showed no token
+	Metrics   *Metrics
+
+	// Signs answers for clients that ask, so they know they're ours
+	Key ed25519.PrivateKey
+
+	// Bytes per second the server relays between each pair of room members
+	// that can't reach each other directly, or 0 to not relay at all
+	RelayRate int
+	// Requests a second answered from each IP, or 0 for no limit
+	RequestRate float64
+	// Only answer requests carrying the token the server gave their IP, so
+	// nobody can have the server send a room's member list, or relay, to an
+	// IP they spoofed. Clients too old to show tokens can't use the server.
+	// Without it, requests that don't carry one are answered with no more
+	// than they are.
+	RequireToken bool
+	// How many letters to hold for each peer that's offline, or 0 to not
+	// hold any
+	MailboxSize int
+}
+
+type room struct {
+	owner   string                 // ip:port of the member allowed to kick and ban, initially the creator
+	members map[string]*roomMember // ip:port -> member
+	banned  map[string]bool        // Identities, and the addresses they were at, that may not join
+	kicked  map[string]time.Time   // Identities, and the addresses they were at, kicked out, and when
+}
+
+type roomMember struct {
+	addr     *net.UDPAddr
+	identity string // The base64 key it proved it has, or its ip:port if it didn't
+	lastSeen time.Time
+	punches  bool // Asked us to coordinate punches, so knows what to do when told to punch
+}
+
+// A discovery server answering on conn
+func NewServer(conn *net.UDPConn) *Server {
+	return &Server{
+		conn:      conn,
+		started:   time.Now(),
+		rooms:     map[string]*room{},
+		budgets:   map[string]*relayBudget{},
+		nonces:    map[string]clientNonce{},
+		mailboxes: map[string][]letter{},
+		sessions:  map[string]session{},
+		probes:    map[string]*probe{},
+		versions:  map[string]clientVersion{},
+		Metrics:   &Metrics{},
+
+		RequestRate: DefaultRequestRate,
+	}
+}
+
+// Answers requests until the socket is closed
+func (s *Server) Run() {
+	limiter := newRequestLimiter(s.RequestRate)
+	frames := newRequestLimiter(relayFrameRate)
+	sweep := time.NewTicker(sweepInterval)
+	defer sweep.Stop()
+	// big enough for relayed chunks, not just requests
+	buffer := make([]byte, 65536)
+	for {
+		// the deadline makes sure the sweep still happens when nothing comes in
+		s.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := s.conn.ReadFromUDP(buffer)
+
+		s.mu.Lock()
+		select {
+		case <-sweep.C:
+			s.expire()
+		default:
+		}
+		if err == nil {
+			s.handle(buffer[:n], addr, limiter, frames)
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				slog.Error("reading from socket failed", "err", err)
+				s.Metrics.readErrors.Add(1)
+			}
+		}
+	}
+}
+
+// Forgets whatever has gone quiet for long enough
+func (s *Server) expire() {
+	s.expireMembers()
+	s.expireBudgets()
+	s.expireNonces()
+	s.expireLetters()
+	s.expireSessions()
+	s.expireProbes()
+	s.expireVersions()
+}
+
+// Answers a request, or relays a frame, if its IP hasn't sent too many of
+// either lately
+func (s *Server) handle(data []byte, addr *net.UDPAddr, limiter, frames *requestLimiter) {
+	request := string(data)
+	slog.Debug("request", "addr", addr, "request", request)
+	relayed := strings.HasPrefix(request, "{")
+	if relayed && !frames.allow(addr) || !relayed && !limiter.allow(addr) {
+		s.Metrics.limited.Add(1)
+		return
+	}
+	if relayed {
+		s.Metrics.requests[requestRelay].Add(1)
+		s.relay(data, addr)
+		return
+	}
+	request, valid := checkToken(request, addr)
+	request = takePadding(s.takeNonce(request, addr))
+	s.seen(addr)
+	if !valid {
+		// addr may not have sent it, so it gets no more than was sent
+		s.capped = &answerCap{addr: addr, size: len(data), left: len(data)}
+		defer s.uncap()
+		if s.RequireToken {
+			s.capped.dropped = true
+			return
+		}
+	}
+
+	switch {
+	case request == "whoami":
+		s.Metrics.requests[requestWhoami].Add(1)
+		s.answer(addr, Message{Type: Binding, Addr: addr.String()})
+	case strings.HasPrefix(request, "join:"):
+		s.Metrics.requests[requestJoin].Add(1)
+		s.join(strings.TrimPrefix(request, "join:"), addr)
+	case strings.HasPrefix(request, "leave:"):
+		s.Metrics.requests[requestLeave].Add(1)
+		s.leave(strings.TrimPrefix(request, "leave:"), addr)
+	case strings.HasPrefix(request, "kick:"):
+		s.Metrics.requests[requestKick].Add(1)
+		s.moderate(strings.TrimPrefix(request, "kick:"), addr, false)
+	case strings.HasPrefix(request, "punch:"):
+		s.Metrics.requests[requestPunch].Add(1)
+		s.coordinate(strings.TrimPrefix(request, "punch:"), addr)
+	case strings.HasPrefix(request, "mail:"):
+		s.Metrics.requests[requestMail].Add(1)
+		s.deposit(strings.TrimPrefix(request, "mail:"), addr)
+	case strings.HasPrefix(request, "collect:"):
+		s.Metrics.requests[requestCollect].Add(1)
+		s.collect(strings.TrimPrefix(request, "collect:"), addr)
+	case strings.HasPrefix(request, "watch:"):
+		s.Metrics.requests[requestWatch].Add(1)
+		s.watch(strings.TrimPrefix(request, "watch:"), addr)
+	case strings.HasPrefix(request, "probe:"):
+		s.Metrics.requests[requestProbe].Add(1)
+		s.probe(strings.TrimPrefix(request, "probe:"), addr)
+	case strings.HasPrefix(request, "hello:"):
+		s.Metrics.requests[requestHello].Add(1)
+		s.hello(strings.TrimPrefix(request, "hello:"), addr)
+	case strings.HasPrefix(request, "ban:"):
+		s.Metrics.requests[requestBan].Add(1)
+		s.moderate(strings.TrimPrefix(request, "ban:"), addr, true)
+	default:
+		s.Metrics.requests[requestUnknown].Add(1)
+	}
+}
+
+func (s *Server) reply(addr *net.UDPAddr, message string) {
+	s.send(addr, []byte(s.sign(addr, message)))
+}
+
+func (s *Server) send(addr *net.UDPAddr, data []byte) {
+	if c := s.capped; c != nil && transport.SameAddr(addr, c.addr) {
+		if len(data) > c.left {
+			c.dropped = true
+			return
+		}
+		c.left -= len(data)
+	}
+	if _, err := s.conn.WriteToUDP(data, addr); err != nil {
+		slog.Error("replying failed", "addr", addr, "err", err)
+		s.Metrics.writeErrors.Add(1)
+	}
+}
+
+// What a client signs to show which identity joins a room
+func joinMessage(room string) []byte {
+	return []byte("p2p room join " + room)
+}
+
+// The identity a join proves, or the joiner's ip:port when it didn't try,
+// reporting whether a proof it did send holds up
+func identify(room, proof string, addr *net.UDPAddr) (string, bool) {
+	if proof == "" {
+		return addr.String(), true
+	}
+	encodedKey, encodedSig, _ := strings.Cut(proof, " ")
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	sig, err2 := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil || err2 != nil || len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, joinMessage(room), sig) {
+		return "", false
+	}
+	return encodedKey, true
+}
+
+// Adds the client to a room, or refreshes its membership, and sends it
+// everyone else in the room. Existing members are told about new joiners.
+func (s *Server) join(request string, addr *net.UDPAddr) {
+	name, proof, _ := strings.Cut(request, " ")
+	if name == "" || len(name) > MaxRoomName {
+		slog.Debug("refused room name", "addr", addr, "length", len(name))
+		return
+	}
+	identity, ok := identify(name, proof, addr)
+	if !ok {
+		slog.Warn("refused join without proof of identity", "room", name, "addr", addr)
+		return
+	}
+	r, ok := s.rooms[name]
+	if !ok {
+		r = &room{
+			owner:   addr.String(),
+			members: map[string]*roomMember{},
+			banned:  map[string]bool{},
+			kicked:  map[string]time.Time{},
+		}
+		s.rooms[name] = r
+		s.Metrics.rooms.Add(1)
+	}
+
+	if addr.String() != r.owner {
+		if r.banned[identity] || r.banned[addr.String()] {
+			slog.Info("refused banned member", "room", name, "addr", addr)
+			s.answer(addr, Message{Type: Offer, Event: "banned", Room: name})
+			return
+		}
+		if proof == "" && len(r.banned) > 0 {
+			// or a banned member would only have to stop signing, from
+			// somewhere else, to get back in
+			slog.Info("refused unsigned join to a room with bans", "room", name, "addr", addr)
+			return
+		}
+		if r.kickedOut(identity) || r.kickedOut(addr.String()) {
+			// telling it again, in case it missed the kick
+			slog.Info("refused kicked member", "room", name, "addr", addr)
+			s.answer(addr, Message{Type: Offer, Event: "kicked", Room: name})
+			return
+		}
+	}
+
+	if _, ok := r.members[addr.String()]; !ok {
+		slog.Info("member joined", "room", name, "addr", addr)
+		s.Metrics.registrations.Add(1)
+		s.Metrics.members.Add(1)
+		for _, member := range r.members {
+			s.answer(member.addr, Message{Type: Offer, Event: "joined", Room: name, Members: []string{addr.String()}})
+		}
+	}
+	if member, ok := r.members[addr.String()]; ok {
+		member.lastSeen = time.Now()
+	} else {
+		r.members[addr.String()] = &roomMember{addr: addr, identity: identity, lastSeen: time.Now()}
+	}
+
+	var others []string
+	for key := range r.members {
+		if key != addr.String() {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	// as many as fit, which is plenty for the group chats rooms are for
+	fitting := fit(others, len(name))
+	if len(fitting) < len(others) {
+		slog.Debug("member list cut short", "room", name, "members", len(r.members))
+	}
+	s.answer(addr, Message{Type: Offer, Event: "members", Room: name, Members: fitting})
+	s.answer(addr, Message{Type: RelayGrant, Room: name, Rate: s.RelayRate})
+}
+
+// As many of the given addresses as fit in an answer alongside used bytes of
+// other fields, in either form
+func fit(addrs []string, used int) []string {
+	// room for the rest of a typed answer, and each address's quotes and comma
+	size := used + 128
+	for i, addr := range addrs {
+		size += len(addr) + 3
+		if size > MaxReplySize {
+			return addrs[:i]
+		}
+	}
+	return addrs
+}
+
+// Removes the client from a room and tells everyone left in it
+func (s *Server) leave(name string, addr *net.UDPAddr) {
+	r, ok := s.rooms[name]
+	if !ok {
+		return
+	}
+	if _, ok := r.members[addr.String()]; !ok {
+		return
+	}
+	slog.Info("member left", "room", name, "addr", addr)
+	delete(r.members, addr.String())
+	s.Metrics.members.Add(-1)
+	if len(r.members) == 0 {
+		delete(s.rooms, name)
+		s.Metrics.rooms.Add(-1)
+		return
+	}
+
+	// hand the room over to whoever is left
+	if r.owner == addr.String() {
+		var remaining []string
+		for key := range r.members {
+			remaining = append(remaining, key)
+		}
+		sort.Strings(remaining)
+		r.owner = remaining[0]
+	}
+
+	for _, member := range r.members {
+		s.answer(member.addr, Message{Type: Offer, Event: "left", Room: name, Members: []string{addr.String()}})
+	}
+}
+
+// Kicks a member out of a room for a while, or bans their identity and the
+// ip:port they joined from for good if asked to, rather than their IP, which
+// everyone behind the same NAT shares. Only the room's owner may do this.
+func (s *Server) moderate(request string, addr *net.UDPAddr, ban bool) {
+	name, target, _ := strings.Cut(request, " ")
+	r, ok := s.rooms[name]
+	if !ok || r.owner != addr.String() {
+		slog.Warn("refused moderation from non-owner", "room", name, "addr", addr)
+		s.answer(addr, Message{Type: Offer, Event: "denied", Room: name})
+		return
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return
+	}
+	member, ok := r.members[targetAddr.String()]
+	if !ok || targetAddr.String() == r.owner {
+		return
+	}
+
+	event := "kicked"
+	if ban {
+		event = "banned"
+		r.banned[member.identity] = true
+		r.banned[member.addr.String()] = true
+	} else {
+		r.kicked[member.identity] = time.Now()
+		r.kicked[member.addr.String()] = time.Now()
+	}
+	// everywhere the identity is in the room, if it joined more than once
+	for _, other := range r.members {
+		if other.identity == member.identity && other.addr.String() != r.owner {
+			s.answer(other.addr, Message{Type: Offer, Event: event, Room: name})
+			s.leave(name, other.addr)
+		}
+	}
+}
+
+// Whether an identity or address was kicked out of the room too recently to
+// come back yet
+func (r *room) kickedOut(who string) bool {
+	kicked, ok := r.kicked[who]
+	return ok && time.Since(kicked) < KickTimeout
+}
+
+// Drops members that stopped refreshing their membership, and lets kicked
+// ones back in once they've been out long enough
+func (s *Server) expireMembers() {
+	for name, r := range s.rooms {
+		for identity, kicked := range r.kicked {
+			if time.Since(kicked) > KickTimeout {
+				delete(r.kicked, identity)
+			}
+		}
+		for _, member := range r.members {
+			if time.Since(member.lastSeen) > MemberTimeout {
+				s.leave(name, member.addr)
+			}
+		}
+	}
+}
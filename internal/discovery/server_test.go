@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"testing"
+)
+
+func TestIdentify(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	key := base64.StdEncoding.EncodeToString(public)
+	proof := func(room string) string {
+		return key + " " + base64.StdEncoding.EncodeToString(ed25519.Sign(private, joinMessage(room)))
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+
+	tests := []struct {
+		name   string
+		proof  string
+		want   string
+		wantOK bool
+	}{
+		{"proves its key", proof("r"), key, true},
+		{"doesn't try", "", addr.String(), true},
+		{"proof for another room", proof("other"), "", false},
+		{"someone else's key", base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize)) + " " + base64.StdEncoding.EncodeToString(ed25519.Sign(private, joinMessage("r"))), "", false},
+		{"no signature", key, "", false},
+		{"garbled", "%%% %%%", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := identify("r", tt.proof, addr)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("identify(%q) = %q, %t, want %q, %t", tt.proof, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestModerate(t *testing.T) {
+	_, banned, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	// a join for the room, signed with key unless it's nil
+	join := func(key ed25519.PrivateKey) string {
+		if key == nil {
+			return "r"
+		}
+		return "r " + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)) + " " + base64.StdEncoding.EncodeToString(ed25519.Sign(key, joinMessage("r")))
+	}
+	owner := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	member := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	elsewhere := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3}
+
+	tests := []struct {
+		name string
+		ban  bool
+		key  ed25519.PrivateKey // What the moderated member rejoins signed with
+		addr *net.UDPAddr       // Where it rejoins from
+		want bool
+	}{
+		{"banned, the same key from elsewhere", true, banned, elsewhere, false},
+		{"banned, unsigned from the same address", true, nil, member, false},
+		{"banned, unsigned from elsewhere", true, nil, elsewhere, false},
+		{"banned, another key from elsewhere", true, other, elsewhere, true},
+		{"kicked, the same key from elsewhere", false, banned, elsewhere, false},
+		{"kicked, unsigned from the same address", false, nil, member, false},
+		{"kicked, another key from elsewhere", false, other, elsewhere, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			s := NewServer(conn)
+			s.join(join(nil), owner)
+			s.join(join(banned), member)
+			s.moderate("r "+member.String(), owner, tt.ban)
+			if _, ok := s.rooms["r"].members[member.String()]; ok {
+				t.Fatal("the member is still in the room")
+			}
+
+			s.join(join(tt.key), tt.addr)
+			if _, ok := s.rooms["r"].members[tt.addr.String()]; ok != tt.want {
+				t.Errorf("got back in = %t, want %t", ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"p2p/internal/transport"
+)
+
+// How much closer another discovery server has to be before we move to it,
+// so we don't flap between servers that are about as far
+const closerBy = 0.8
+
+// The discovery servers we were given and the one we use, which the chat
+// moves to another when it turns out closer
+type Servers struct {
+	all     []*net.UDPAddr
+	current atomic.Pointer[net.UDPAddr]
+}
+
+// Servers that start out using the first of all
+func NewServers(all []*net.UDPAddr) *Servers {
+	s := &Servers{all: all}
+	s.current.Store(all[0])
+	return s
+}
+
+// The server we use
+func (s *Servers) Current() *net.UDPAddr {
+	return s.current.Load()
+}
+
+// Every server we were given
+func (s *Servers) All() []*net.UDPAddr {
+	return s.all
+}
+
+// Whether addr is one of the servers we were given, whether we use it or not
+func (s *Servers) Has(addr *net.UDPAddr) bool {
+	if s == nil {
+		return false
+	}
+	for _, server := range s.all {
+		if transport.SameAddr(server, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves to another of the servers
+func (s *Servers) Use(addr *net.UDPAddr) {
+	s.current.Store(addr)
+}
+
+// The round trip to each server, 0 for those that didn't answer within
+// timeout. It asks from a socket of its own on ip, which is the chat's, so it
+// can run while the chat's socket is busy and takes the same path out.
+func Measure(servers []*net.UDPAddr, ip net.IP, timeout time.Duration) []time.Duration {
+	rtts := make([]time.Duration, len(servers))
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return rtts
+	}
+	defer conn.Close()
+
+	sent := time.Now()
+	for _, server := range servers {
+		_ = request(conn, server, "whoami")
+	}
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(sent.Add(timeout))
+	for answered := 0; answered < len(servers); {
+		_, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+		// whatever it answers, even asking for a token, took a round trip
+		for i, server := range servers {
+			if rtts[i] == 0 && transport.SameAddr(server, addr) {
+				rtts[i] = time.Since(sent)
+				answered++
+			}
+		}
+	}
+	return rtts
+}
+
+// The closest of the servers that answered, if any did
+func Closest(servers []*net.UDPAddr, rtts []time.Duration) (*net.UDPAddr, time.Duration, bool) {
+	var best *net.UDPAddr
+	var bestRTT time.Duration
+	for i, rtt := range rtts {
+		if rtt > 0 && (best == nil || rtt < bestRTT) {
+			best, bestRTT = servers[i], rtt
+		}
+	}
+	return best, bestRTT, best != nil
+}
+
+// The server to move to, if one is enough closer than the one we use, which
+// is any that answered when ours didn't
+func (s *Servers) Better(rtts []time.Duration) (*net.UDPAddr, time.Duration, bool) {
+	best, bestRTT, ok := Closest(s.all, rtts)
+	if !ok || transport.SameAddr(best, s.Current()) {
+		return nil, 0, false
+	}
+	for i, server := range s.all {
+		if transport.SameAddr(server, s.Current()) && rtts[i] > 0 && float64(bestRTT) > closerBy*float64(rtts[i]) {
+			return nil, 0, false
+		}
+	}
+	return best, bestRTT, true
+}
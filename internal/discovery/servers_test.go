@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMeasure(t *testing.T) {
+	// a second loopback address, so where a request came from tells
+	// whether Measure asked from the IP it was given
+	ip := net.IPv4(127, 0, 0, 2)
+	if conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip}); err != nil {
+		t.Skipf("can't bind %s: %v", ip, err)
+	} else {
+		conn.Close()
+	}
+
+	// a server that answers anything, and tells us who asked
+	answering := func() (*net.UDPAddr, <-chan net.IP) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		from := make(chan net.IP, 1)
+		go func() {
+			buffer := make([]byte, 1024)
+			_, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			from <- addr.IP
+			conn.WriteToUDP([]byte("addr:"+addr.String()), addr)
+		}()
+		return conn.LocalAddr().(*net.UDPAddr), from
+	}
+	first, firstFrom := answering()
+	second, secondFrom := answering()
+	quiet, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quiet.Close()
+
+	rtts := Measure([]*net.UDPAddr{first, quiet.LocalAddr().(*net.UDPAddr), second}, ip, 200*time.Millisecond)
+	if rtts[0] == 0 || rtts[1] != 0 || rtts[2] == 0 {
+		t.Errorf("round trips %v, want the first and last to have answered", rtts)
+	}
+	for _, from := range []<-chan net.IP{firstFrom, secondFrom} {
+		if got := <-from; !got.Equal(ip) {
+			t.Errorf("asked from %s, want %s", got, ip)
+		}
+	}
+}
+
+func TestBetter(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	b := &net.UDPAddr{IP: net.IPv4(6, 7, 8, 9), Port: 10}
+	ms := time.Millisecond
+
+	tests := []struct {
+		name   string
+		rtts   []time.Duration // To a, which we use, and b
+		want   *net.UDPAddr
+		wantOK bool
+	}{
+		{"ours is closest", []time.Duration{10 * ms, 20 * ms}, nil, false},
+		{"the other is much closer", []time.Duration{100 * ms, 10 * ms}, b, true},
+		{"the other is only a little closer", []time.Duration{100 * ms, 90 * ms}, nil, false},
+		{"ours didn't answer", []time.Duration{0, 90 * ms}, b, true},
+		{"neither answered", []time.Duration{0, 0}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, ok := NewServers([]*net.UDPAddr{a, b}).Better(tt.rtts)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("Better(%v) = %v, %t, want %v, %t", tt.rtts, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients that know the discovery server's key ask it to sign its answers,
+// naming a nonce of theirs the signature covers so an answer can't be
+// replayed to them later, and ignore any that don't check out. Otherwise
+// anyone who can send us a datagram from the server's address could tell us
+// where we are or who's in our room, and have us punch towards them.
+
+// The discovery servers' public keys, by their ip:port, to only believe
+// answers they signed. Answers from a server without one are believed
+// whatever they say.
+var serverKeys sync.Map
+
+// Only believes answers from the discovery server at addr that it signed with
+// key
+func PinServerKey(addr *net.UDPAddr, key ed25519.PublicKey) {
+	serverKeys.Store(addr.String(), key)
+}
+
+// The key the discovery server at addr signs with, nil if we don't know it
+func serverKey(addr *net.UDPAddr) ed25519.PublicKey {
+	key, _ := serverKeys.Load(addr.String())
+	k, _ := key.(ed25519.PublicKey)
+	return k
+}
+
+// The nonce our requests ask the server to sign its answers with, which is
+// the same for the whole session so it covers announcements about our room
+// too
+var nonce = func() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// What a signature covers, so it can't be mistaken for anything else
+func signedMessage(nonce, text string) []byte {
+	return []byte("p2p discovery " + nonce + " " + text)
+}
+
+// Reads a key as printed by `p2p serve -key`
+func ParseServerKey(text string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("not a discovery server key")
+	}
+	return key, nil
+}
+
+// How a server key is written down for clients
+func FormatServerKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// An answer from the discovery server at addr without its signature, and
+// whether we believe it, which we only don't if we know that server's key and
+// it's unsigned or signed with another
+func Verify(addr *net.UDPAddr, text string) (string, bool) {
+	key := serverKey(addr)
+	if key == nil {
+		return text, true
+	}
+	body, sig, ok := strings.Cut(text, "\nsig:")
+	if !ok {
+		return body, false
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return body, false
+	}
+	return body, ed25519.Verify(key, signedMessage(nonce, body), signature)
+}
+
+// The nonce a client last asked us to sign with, which stays as long as it
+// would in a room
+type clientNonce struct {
+	nonce string
+	seen  time.Time
+}
+
+// Splits the nonce off a request that asks for signed answers, remembering
+// it for whatever we send addr
+func (s *Server) takeNonce(request string, addr *net.UDPAddr) string {
+	rest, ok := strings.CutPrefix(request, "sign:")
+	if !ok {
+		return request
+	}
+	n, rest, _ := strings.Cut(rest, " ")
+	if n != "" && len(n) <= 64 {
+		s.nonces[addr.String()] = clientNonce{nonce: n, seen: time.Now()}
+	}
+	return rest
+}
+
+// Signs an answer to addr, if we have a key and it asked us to
+func (s *Server) sign(addr *net.UDPAddr, message string) string {
+	n, ok := s.nonces[addr.String()]
+	if s.Key == nil || !ok {
+		return message
+	}
+	return message + "\nsig:" + base64.StdEncoding.EncodeToString(ed25519.Sign(s.Key, signedMessage(n.nonce, message)))
+}
+
+// Forgets the nonces of clients we stopped hearing from
+func (s *Server) expireNonces() {
+	for key, n := range s.nonces {
+		if time.Since(n.seen) > MemberTimeout {
+			delete(s.nonces, key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	secondPublic, second, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	us := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	them := &net.UDPAddr{IP: net.IPv4(6, 7, 8, 9), Port: 10}
+	pinned := &net.UDPAddr{IP: net.IPv4(11, 12, 13, 14), Port: 15}
+	pinnedSecond := &net.UDPAddr{IP: net.IPv4(16, 17, 18, 19), Port: 20}
+	unpinned := &net.UDPAddr{IP: net.IPv4(21, 22, 23, 24), Port: 25}
+	PinServerKey(pinned, public)
+	PinServerKey(pinnedSecond, secondPublic)
+	t.Cleanup(serverKeys.Clear)
+
+	server := func(key ed25519.PrivateKey) *Server {
+		s := &Server{Key: key, nonces: map[string]clientNonce{}}
+		s.takeNonce("sign:"+nonce+" whoami", us)
+		s.takeNonce("sign:0123456789abcdef whoami", them)
+		return s
+	}
+	const answer = "addr:1.2.3.4:5"
+
+	tests := []struct {
+		name   string
+		from   *net.UDPAddr
+		text   string
+		wantOK bool
+	}{
+		{"signed for us", pinned, server(private).sign(us, answer), true},
+		{"unsigned while we know the key", pinned, answer, false},
+		{"unsigned while we don't", unpinned, answer, true},
+		{"signed for someone else's nonce", pinned, server(private).sign(them, answer), false},
+		{"signed with another key", pinned, server(otherKey).sign(us, answer), false},
+		{"signed by another server with its own key", pinnedSecond, server(second).sign(us, answer), true},
+		{"signed by another server with the first's key", pinnedSecond, server(private).sign(us, answer), false},
+		{"changed after signing", pinned, strings.Replace(server(private).sign(us, answer), "5", "6", 1), false},
+		{"garbled signature", pinned, answer + "\nsig:%%%", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, ok := Verify(tt.from, tt.text)
+			if ok != tt.wantOK {
+				t.Fatalf("Verify(%s, %q) = %t, want %t", tt.from, tt.text, ok, tt.wantOK)
+			}
+			if ok && body != answer {
+				t.Errorf("Verify(%s, %q) = %q, want %q", tt.from, tt.text, body, answer)
+			}
+		})
+	}
+}
+
+func TestTakeNonce(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	tests := []struct {
+		name      string
+		request   string
+		want      string
+		wantNonce string
+	}{
+		{"asks for signing", "sign:abc join:r", "join:r", "abc"},
+		{"doesn't ask", "join:r", "join:r", ""},
+		{"nonce too long to keep", "sign:" + strings.Repeat("a", 65) + " join:r", "join:r", ""},
+		{"empty nonce", "sign: join:r", "join:r", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{nonces: map[string]clientNonce{}}
+			if got := s.takeNonce(tt.request, addr); got != tt.want {
+				t.Errorf("takeNonce(%q) = %q, want %q", tt.request, got, tt.want)
+			}
+			if got := s.nonces[addr.String()].nonce; got != tt.wantNonce {
+				t.Errorf("kept nonce %q, want %q", got, tt.wantNonce)
+			}
+		})
+	}
+}
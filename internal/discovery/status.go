@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What the server is doing, for whoever runs it
+type Status struct {
+	Uptime  string       `json:"uptime"`
+	Started time.Time    `json:"started"`
+	Clients []ClientInfo `json:"clients"`
+	Rooms   []RoomInfo   `json:"rooms"`
+	Relay   RelayInfo    `json:"relay"`
+	Letters int64        `json:"letters"`
+}
+
+// A client that's in a room or keeps a session with us
+type ClientInfo struct {
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+	Rooms    []string  `json:"rooms,omitempty"`
+}
+
+type RoomInfo struct {
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+	Banned  int      `json:"banned"` // How many identities and addresses may not join
+}
+
+type RelayInfo struct {
+	Rate        int     `json:"rate"`          // Bytes per second allowed per pair, 0 when not relaying
+	Pairs       int     `json:"pairs"`         // Pairs of members that relayed recently
+	Bytes       int64   `json:"bytes"`         // Relayed since the server started
+	BytesPerSec float64 `json:"bytes_per_sec"` // Relayed per second over the last minute
+	Refused     int64   `json:"refused"`
+}
+
+// How many seconds the relay throughput is averaged over
+const throughputWindow = 60
+
+// How many bytes were relayed in each of the last throughputWindow seconds,
+// for a throughput that follows what's going on now rather than since start
+type throughput struct {
+	seconds [throughputWindow]int64
+	at      [throughputWindow]int64 // Which unix second each slot counts
+}
+
+func (t *throughput) add(n int) {
+	now := time.Now().Unix()
+	i := now % throughputWindow
+	if t.at[i] != now {
+		t.at[i], t.seconds[i] = now, 0
+	}
+	t.seconds[i] += int64(n)
+}
+
+func (t *throughput) perSecond() float64 {
+	now := time.Now().Unix()
+	var total int64
+	for i, at := range t.at {
+		if now-at < throughputWindow {
+			total += t.seconds[i]
+		}
+	}
+	return float64(total) / throughputWindow
+}
+
+// A snapshot of what the server is doing
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := Status{
+		Uptime:  time.Since(s.started).Round(time.Second).String(),
+		Started: s.started,
+		Clients: []ClientInfo{},
+		Rooms:   []RoomInfo{},
+		Relay: RelayInfo{
+			Rate:        s.RelayRate,
+			Pairs:       len(s.budgets),
+			Bytes:       s.Metrics.relayedBytes.Load(),
+			BytesPerSec: s.relayed.perSecond(),
+			Refused:     s.Metrics.relayRefused.Load(),
+		},
+		Letters: s.Metrics.letters.Load(),
+	}
+
+	clients := map[string]*ClientInfo{}
+	client := func(addr string, seen time.Time) *ClientInfo {
+		c, ok := clients[addr]
+		if !ok {
+			c = &ClientInfo{Addr: addr}
+			clients[addr] = c
+		}
+		if seen.After(c.LastSeen) {
+			c.LastSeen = seen
+		}
+		return c
+	}
+	for _, session := range s.sessions {
+		client(session.addr.String(), session.lastSeen)
+	}
+	for name, r := range s.rooms {
+		info := RoomInfo{Name: name, Owner: r.owner, Banned: len(r.banned)}
+		for key, member := range r.members {
+			info.Members = append(info.Members, key)
+			c := client(key, member.lastSeen)
+			c.Rooms = append(c.Rooms, name)
+		}
+		sort.Strings(info.Members)
+		status.Rooms = append(status.Rooms, info)
+	}
+	sort.Slice(status.Rooms, func(i, j int) bool { return status.Rooms[i].Name < status.Rooms[j].Name })
+	for _, c := range clients {
+		sort.Strings(c.Rooms)
+		status.Clients = append(status.Clients, *c)
+	}
+	sort.Slice(status.Clients, func(i, j int) bool { return status.Clients[i].Addr < status.Clients[j].Addr })
+	return status
+}
+
+// Serves the server's status as JSON on /status, in the background, to
+// requests with the token as a bearer token or a token query parameter, as it
+// shows who's using the server
+func ServeStatus(addr, token string, s *Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			given = r.URL.Query().Get("token")
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(s.Status())
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("serving status failed", "addr", addr, "err", err)
+		}
+	}()
+}
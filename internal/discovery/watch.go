@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"p2p/internal/crash"
+	"p2p/internal/transport"
+)
+
+// Clients keep a session with the server under an id only they and it know,
+// so when their NAT maps them to another port or address, which carrier grade
+// NATs do without warning, the server notices on their next refresh and tells
+// them, rather than them finding out when their peers stop hearing from them.
+
+// Where a client's session was last refreshed from
+type session struct {
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+// Refreshes a client's session, and if it's from somewhere new moves the
+// client's room memberships there and tells it where it is now
+func (s *Server) watch(id string, addr *net.UDPAddr) {
+	if id == "" || len(id) > 64 {
+		return
+	}
+	previous, ok := s.sessions[id]
+	s.sessions[id] = session{addr: addr, lastSeen: time.Now()}
+	if !ok || transport.SameAddr(previous.addr, addr) {
+		return
+	}
+	slog.Info("client moved", "from", previous.addr, "to", addr)
+	s.Metrics.moves.Add(1)
+	s.move(previous.addr, addr)
+	s.reply(addr, fmt.Sprintf("moved:%s %s", previous.addr, addr))
+}
+
+// Moves a client's room memberships to its new address, keeping whatever
+// rooms it owns, and tells the other members it left and joined again, which
+// every client understands
+func (s *Server) move(from, to *net.UDPAddr) {
+	for name, r := range s.rooms {
+		member, ok := r.members[from.String()]
+		if !ok {
+			continue
+		}
+		delete(r.members, from.String())
+		if _, ok := r.members[to.String()]; ok {
+			s.Metrics.members.Add(-1)
+		} else {
+			if member.identity == from.String() {
+				member.identity = to.String()
+			}
+			member.addr = to
+			member.lastSeen = time.Now()
+			r.members[to.String()] = member
+		}
+		if r.owner == from.String() {
+			r.owner = to.String()
+		}
+		for key, other := range r.members {
+			if key != to.String() {
+				s.answer(other.addr, Message{Type: Offer, Event: "left", Room: name, Members: []string{from.String()}})
+				s.answer(other.addr, Message{Type: Offer, Event: "joined", Room: name, Members: []string{to.String()}})
+			}
+		}
+	}
+}
+
+// Forgets sessions that stopped being refreshed
+func (s *Server) expireSessions() {
+	for id, c := range s.sessions {
+		if time.Since(c.lastSeen) > MemberTimeout {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// The id we keep our session with the discovery server under, which is the
+// same for the whole process
+var sessionID = func() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// Refreshes our session with whichever discovery server we use until done is
+// closed, so it tells us when our external address changes
+func KeepWatching(conn transport.Conn, servers *Servers, done chan struct{}) {
+	defer crash.Recover()
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		_ = request(conn, servers.Current(), "watch:"+sessionID)
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// The addresses the discovery server saw us move between
+func ParseMoved(text string) (from, to string, ok bool) {
+	rest, ok := strings.CutPrefix(text, "moved:")
+	if !ok {
+		return "", "", false
+	}
+	from, to, ok = strings.Cut(rest, " ")
+	return from, to, ok && from != "" && to != ""
+}
@@ -0,0 +1,63 @@
+// Package history keeps the transcript in a file between sessions, one JSON
+// object per line, shared by the chat and the daemon.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A message as it is kept in the history file
+type Record struct {
+	Time   time.Time `json:"time"`
+	Sender string    `json:"sender"` // How the sender was labelled, without styling
+	Port   int       `json:"port"`
+	Peer   string    `json:"peer,omitempty"`
+	Text   string    `json:"text"`
+	Self   bool      `json:"self,omitempty"` // We sent it
+	Direct bool      `json:"direct,omitempty"`
+	To     string    `json:"to,omitempty"`
+	Via    string    `json:"via,omitempty"`
+	File   string    `json:"file,omitempty"` // Where a file that was sent or received is on disk
+}
+
+// Appends a record to the history file
+func Append(path string, record Record) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(record)
+}
+
+// Reads back the history file, which doesn't have to exist
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// skip lines we can't make sense of
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,68 @@
+// Package hooks runs external commands on received messages, for
+// auto-responders and bots.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p/internal/history"
+)
+
+// How long a hook gets before it's killed
+const Timeout = 30 * time.Second
+
+// A command run for every message from a peer, from the config file's
+// [[hooks]] tables. It gets the message in the environment as P2P_TEXT,
+// P2P_SENDER (ip:port), P2P_DIRECT (true or false) and P2P_VIA (ip:port of
+// the relaying peer, if any).
+type Hook struct {
+	Command string `toml:"command"`
+	Reply   bool   `toml:"reply,omitempty"` // Send whatever the command prints back to everyone
+}
+
+// Runs every hook in the background for a message from a peer, sending back
+// the output of those that reply
+func Run(hooks []Hook, record history.Record, send func(text string)) {
+	for _, hook := range hooks {
+		go hook.run(record, send)
+	}
+}
+
+func (h Hook) run(record history.Record, send func(text string)) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	cmd := shell(ctx, h.Command)
+	cmd.Env = append(os.Environ(),
+		"P2P_TEXT="+record.Text,
+		"P2P_SENDER="+record.Peer,
+		"P2P_DIRECT="+strconv.FormatBool(record.Direct),
+		"P2P_VIA="+record.Via,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		slog.Warn("hook failed", "command", h.Command, "err", err, "stderr", strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	if reply := strings.TrimSpace(stdout.String()); h.Reply && reply != "" {
+		send(reply)
+	}
+}
+
+// The command as the platform's shell would run it
+func shell(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
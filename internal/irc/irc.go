@@ -0,0 +1,177 @@
+// Package irc is just enough of an IRC client to mirror a conversation into
+// a channel and back.
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// How much text goes into one PRIVMSG, leaving room in the 512 byte line for
+// the prefix the server adds when relaying it
+const maxText = 400
+
+// A message someone said in the channel
+type Message struct {
+	Nick string
+	Text string
+}
+
+// A connection to an IRC server, joined to one channel
+type Client struct {
+	conn    net.Conn
+	nick    string
+	channel string
+
+	mu       sync.Mutex // Serializes writes
+	messages chan Message
+}
+
+// Connects and registers as nick, then joins channel. Messages said in the
+// channel arrive on Messages until the connection drops.
+func Dial(addr, nick, channel string, useTLS bool) (*Client, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{conn: conn, nick: nick, channel: channel, messages: make(chan Message, 64)}
+	c.send("NICK %s", nick)
+	c.send("USER %s 0 * :p2p bridge", nick)
+
+	reader := bufio.NewReader(conn)
+	if err := c.register(reader); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.send("JOIN %s", channel)
+	go c.read(reader)
+	return c, nil
+}
+
+// Waits for the server to welcome us, answering pings meanwhile
+func (c *Client) register(reader *bufio.Reader) error {
+	c.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("registering: %w", err)
+		}
+		_, command, params := parse(line)
+		switch command {
+		case "001":
+			return nil
+		case "PING":
+			c.send("PONG :%s", strings.Join(params, " "))
+		case "433":
+			return fmt.Errorf("nick %s is already in use", c.nick)
+		case "ERROR":
+			return fmt.Errorf("server said: %s", strings.Join(params, " "))
+		}
+	}
+}
+
+func (c *Client) read(reader *bufio.Reader) {
+	defer close(c.messages)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			slog.Info("irc connection closed", "err", err)
+			return
+		}
+		prefix, command, params := parse(line)
+		switch command {
+		case "PING":
+			c.send("PONG :%s", strings.Join(params, " "))
+		case "PRIVMSG":
+			if len(params) < 2 || !strings.EqualFold(params[0], c.channel) {
+				continue
+			}
+			nick, _, _ := strings.Cut(prefix, "!")
+			c.messages <- Message{Nick: nick, Text: params[1]}
+		}
+	}
+}
+
+// Messages said in the channel by others. It's closed when the connection drops.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Says text in the channel, a line at a time
+func (c *Client) Say(text string) {
+	// a stray \r would end the line early and let the rest through as a command
+	text = strings.ReplaceAll(text, "\r", "")
+	for _, line := range strings.Split(text, "\n") {
+		for len(line) > maxText {
+			// don't cut a character in half
+			cut := maxText
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			c.send("PRIVMSG %s :%s", c.channel, line[:cut])
+			line = line[cut:]
+		}
+		if line != "" {
+			c.send("PRIVMSG %s :%s", c.channel, line)
+		}
+	}
+}
+
+// Leaves the server
+func (c *Client) Close() error {
+	c.send("QUIT :bye")
+	return c.conn.Close()
+}
+
+func (c *Client) send(format string, a ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", a...); err != nil {
+		slog.Warn("writing to irc failed", "err", err)
+	}
+}
+
+// Splits a line into its prefix, command and parameters, the last of which
+// may contain spaces
+func parse(line string) (prefix, command string, params []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		// skip message tags
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if command == "" {
+			command = strings.ToUpper(param)
+		} else if param != "" {
+			params = append(params, param)
+		}
+	}
+	return prefix, command, params
+}
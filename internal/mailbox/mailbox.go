@@ -0,0 +1,149 @@
+// Package mailbox seals messages for a peer that's offline, for the discovery
+// server to hold until it's back, so that only that peer can read them and it
+// can tell who they're from.
+package mailbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+)
+
+// The most a sealed letter can take, so the server's datagram delivering it
+// doesn't get too big to arrive
+const MaxSealedSize = 2048
+
+// Our mailbox key, which letters to us are sealed with. It's derived from our
+// identity key, so it stays the same across restarts without a file of its
+// own.
+func Key(identity ed25519.PrivateKey) *ecdh.PrivateKey {
+	seed := sha256.Sum256(append([]byte("p2p mailbox key "), identity.Seed()...))
+	key, err := ecdh.X25519().NewPrivateKey(seed[:])
+	if err != nil {
+		// any 32 bytes make an X25519 key
+		panic(err)
+	}
+	return key
+}
+
+// What signing a mailbox key covers, so the signature can't be mistaken for
+// anything else
+func keyMessage(key []byte) []byte {
+	return append([]byte("p2p mailbox key "), key...)
+}
+
+// Signs our mailbox key with our identity, for peers to check it's ours
+func SignKey(identity ed25519.PrivateKey) (key, sig []byte) {
+	key = Key(identity).PublicKey().Bytes()
+	return key, ed25519.Sign(identity, keyMessage(key))
+}
+
+// Whether a mailbox key is signed by the peer with the given identity
+func VerifyKey(identity ed25519.PublicKey, key, sig []byte) bool {
+	return len(identity) == ed25519.PublicKeySize && len(key) == 32 && ed25519.Verify(identity, keyMessage(key), sig)
+}
+
+// A message as sealed in a letter
+type Letter struct {
+	From ed25519.PublicKey `json:"from"`
+	To   ed25519.PublicKey `json:"to"` // So a letter can't be resealed to someone else and pass as theirs
+	ID   string            `json:"id"`
+	Text string            `json:"text"`
+	Sent int64             `json:"sent"` // Unix nanoseconds, by the sender's clock
+	Sig  []byte            `json:"sig,omitempty"`
+}
+
+// What the sender signs, which is the letter without its signature
+func (l Letter) signed() []byte {
+	l.Sig = nil
+	data, _ := json.Marshal(l)
+	return append([]byte("p2p letter "), data...)
+}
+
+// Seals a letter so only the peer with the given identity and mailbox key
+// can open it, signed with our identity
+func Seal(identity ed25519.PrivateKey, letter Letter, mailboxKey []byte) ([]byte, error) {
+	letter.From = identity.Public().(ed25519.PublicKey)
+	letter.Sig = ed25519.Sign(identity, letter.signed())
+	plaintext, err := json.Marshal(letter)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := ecdh.X25519().NewPublicKey(mailboxKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := letterCipher(ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+	// the key is new for every letter, so a zero nonce never repeats
+	sealed := aead.Seal(ephemeral.PublicKey().Bytes(), make([]byte, aead.NonceSize()), plaintext, nil)
+	if len(sealed) > MaxSealedSize {
+		return nil, errors.New("message too long to leave with the server")
+	}
+	return sealed, nil
+}
+
+// Opens a letter sealed for us, checking it's signed by who it says it's
+// from and meant for us
+func Open(identity ed25519.PrivateKey, sealed []byte) (Letter, error) {
+	if len(sealed) < 32 {
+		return Letter{}, errors.New("letter too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return Letter{}, err
+	}
+	key := Key(identity)
+	aead, err := letterCipher(key, ephemeral)
+	if err != nil {
+		return Letter{}, err
+	}
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[32:], nil)
+	if err != nil {
+		return Letter{}, errors.New("letter not sealed for us")
+	}
+
+	var letter Letter
+	if err := json.Unmarshal(plaintext, &letter); err != nil {
+		return Letter{}, err
+	}
+	if !letter.To.Equal(identity.Public()) {
+		return Letter{}, errors.New("letter meant for someone else")
+	}
+	if len(letter.From) != ed25519.PublicKeySize || !ed25519.Verify(letter.From, letter.signed(), letter.Sig) {
+		return Letter{}, errors.New("letter not signed by its sender")
+	}
+	return letter, nil
+}
+
+// AES-GCM keyed with what our key and theirs agree on, which both ends of a
+// letter work out from their own private key and the other's public one
+func letterCipher(private *ecdh.PrivateKey, public *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	// bind the key to both public keys, whichever end we are
+	ours, theirs := private.PublicKey().Bytes(), public.Bytes()
+	if string(ours) > string(theirs) {
+		ours, theirs = theirs, ours
+	}
+	key := sha256.Sum256(append(append(append([]byte("p2p letter key "), shared...), ours...), theirs...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
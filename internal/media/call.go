@@ -0,0 +1,143 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+
+	"p2p/internal/crash"
+)
+
+// The audio side of a call: what the microphone picks up is encoded and
+// handed to send, and frames from the peer are played back in order
+type Call struct {
+	codec    Codec
+	buffer   *jitterBuffer
+	capture  *exec.Cmd
+	playback *exec.Cmd
+	speaker  io.WriteCloser
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// Starts recording and playing. send is called from a background goroutine
+// with every frame we record, numbered from 0, until the call is stopped.
+func Start(send func(seq int64, payload []byte)) (*Call, error) {
+	capture, err := findCommand(captureCommands, settings.Input)
+	if err != nil {
+		return nil, err
+	}
+	playback, err := findCommand(playbackCommands, settings.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	microphone, err := capture.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	speaker, err := playback.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := capture.Start(); err != nil {
+		return nil, fmt.Errorf("recording with %s: %w", capture.Path, err)
+	}
+	if err := playback.Start(); err != nil {
+		capture.Process.Kill()
+		capture.Wait()
+		return nil, fmt.Errorf("playing with %s: %w", playback.Path, err)
+	}
+
+	c := &Call{
+		codec:    Mulaw{},
+		buffer:   newJitterBuffer(),
+		capture:  capture,
+		playback: playback,
+		speaker:  speaker,
+		stop:     make(chan struct{}),
+	}
+	go c.record(microphone, send)
+	go c.play()
+	return c, nil
+}
+
+// Queues a frame from the peer for playback
+func (c *Call) Receive(seq int64, payload []byte) {
+	c.buffer.push(seq, c.codec.Decode(payload), len(payload))
+}
+
+// How the call has sounded since the last time Stats was called
+func (c *Call) Stats() Stats {
+	return c.buffer.stats()
+}
+
+// Stops recording and playing. It's safe to call more than once.
+func (c *Call) Stop() {
+	c.once.Do(func() {
+		close(c.stop)
+		c.capture.Process.Kill()
+		c.speaker.Close()
+		c.playback.Process.Kill()
+		go func() {
+			c.capture.Wait()
+			c.playback.Wait()
+		}()
+	})
+}
+
+func (c *Call) record(microphone io.Reader, send func(seq int64, payload []byte)) {
+	defer crash.Recover()
+
+	raw := make([]byte, FrameSamples*2)
+	pcm := make([]int16, FrameSamples)
+	for seq := int64(0); ; seq++ {
+		if _, err := io.ReadFull(microphone, raw); err != nil {
+			select {
+			case <-c.stop:
+			default:
+				slog.Error("recording stopped", "err", err)
+			}
+			return
+		}
+		for i := range pcm {
+			pcm[i] = int16(binary.LittleEndian.Uint16(raw[2*i:]))
+		}
+		scale(pcm, settings.InputVolume)
+		send(seq, c.codec.Encode(pcm))
+	}
+}
+
+// Feeds the speaker a frame every FrameDuration, silence when the next
+// frame hasn't arrived
+func (c *Call) play() {
+	defer crash.Recover()
+
+	ticker := time.NewTicker(FrameDuration)
+	defer ticker.Stop()
+
+	raw := make([]byte, FrameSamples*2)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		clear(raw)
+		pcm := c.buffer.pop()
+		scale(pcm, settings.OutputVolume)
+		for i, sample := range pcm {
+			if i < FrameSamples {
+				binary.LittleEndian.PutUint16(raw[2*i:], uint16(sample))
+			}
+		}
+		if _, err := c.speaker.Write(raw); err != nil {
+			slog.Error("playing stopped", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Which microphone and speakers to use and how loud, from the config file.
+// Devices are named as /devices lists them, the system's default when empty.
+type Settings struct {
+	Input        string `toml:"input,omitempty"`
+	Output       string `toml:"output,omitempty"`
+	InputVolume  int    `toml:"input_volume,omitempty"`  // Percent, 100 when 0
+	OutputVolume int    `toml:"output_volume,omitempty"` // Percent, 100 when 0
+}
+
+// The settings in use, which Apply sets before any audio starts
+var settings Settings
+
+// Uses these settings for every call and voice note from now on
+func (s Settings) Apply() {
+	settings = s
+}
+
+// The most a volume can be turned up to, in percent
+const maxVolume = 400
+
+// Scales samples by a volume in percent, in place
+func scale(pcm []int16, volume int) {
+	if volume <= 0 || volume == 100 {
+		return
+	}
+	volume = min(volume, maxVolume)
+	for i, sample := range pcm {
+		pcm[i] = int16(max(-32768, min(32767, int(sample)*volume/100)))
+	}
+}
+
+var rate = strconv.Itoa(SampleRate)
+
+// A command that records from a microphone to stdout, or plays stdin on
+// speakers, as raw 16-bit little-endian samples at SampleRate, and how it's
+// told which device to use
+type audioCommand struct {
+	args       []string
+	deviceFlag string // Flag naming the device, if it takes one
+	deviceEnv  string // Environment variable naming the device otherwise
+}
+
+// The first of these that's installed is used
+var (
+	captureCommands = []audioCommand{
+		{args: []string{"arecord", "-q", "-t", "raw", "-f", "S16_LE", "-c", "1", "-r", rate}, deviceFlag: "-D"},
+		{args: []string{"rec", "-q", "-t", "raw", "-e", "signed", "-b", "16", "-c", "1", "-r", rate, "-"}, deviceEnv: "AUDIODEV"},
+	}
+	playbackCommands = []audioCommand{
+		{args: []string{"aplay", "-q", "-t", "raw", "-f", "S16_LE", "-c", "1", "-r", rate}, deviceFlag: "-D"},
+		{args: []string{"play", "-q", "-t", "raw", "-e", "signed", "-b", "16", "-c", "1", "-r", rate, "-"}, deviceEnv: "AUDIODEV"},
+	}
+)
+
+var ErrNoAudio = errors.New("no audio tools found, install alsa-utils or sox")
+
+// The first of the given commands that's installed, using the given device
+// unless it's empty
+func findCommand(commands []audioCommand, device string) (*exec.Cmd, error) {
+	for _, command := range commands {
+		if _, err := exec.LookPath(command.args[0]); err != nil {
+			continue
+		}
+		args := command.args[1:]
+		if device != "" && command.deviceFlag != "" {
+			args = append([]string{command.deviceFlag, device}, args...)
+		}
+		cmd := exec.Command(command.args[0], args...)
+		if device != "" && command.deviceEnv != "" {
+			cmd.Env = append(os.Environ(), command.deviceEnv+"="+device)
+		}
+		return cmd, nil
+	}
+	return nil, ErrNoAudio
+}
+
+// Whether there's something installed to record from a microphone with
+func CanRecord() bool {
+	_, err := findCommand(captureCommands, "")
+	return err == nil
+}
+
+// Whether there's something installed to play on speakers with
+func CanPlay() bool {
+	_, err := findCommand(playbackCommands, "")
+	return err == nil
+}
+
+// A microphone or speakers, as /devices lists them
+type Device struct {
+	Name        string
+	Description string
+	Selected    bool // Whether the settings pick this device
+}
+
+var ErrNoDeviceList = errors.New("listing devices needs alsa-utils, with sox name a device your system knows")
+
+// The microphones and speakers we can use
+func Devices() (inputs, outputs []Device, err error) {
+	if inputs, err = listDevices("arecord", settings.Input); err != nil {
+		return nil, nil, err
+	}
+	if outputs, err = listDevices("aplay", settings.Output); err != nil {
+		return nil, nil, err
+	}
+	return inputs, outputs, nil
+}
+
+// Reads the devices alsa-utils knows, which it lists as a name followed by
+// indented lines describing it
+func listDevices(command, selected string) ([]Device, error) {
+	if _, err := exec.LookPath(command); err != nil {
+		return nil, ErrNoDeviceList
+	}
+	out, err := exec.Command(command, "-L").Output()
+	if err != nil {
+		return nil, err
+	}
+	if selected == "" {
+		selected = "default"
+	}
+
+	var devices []Device
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+		case !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t"):
+			devices = append(devices, Device{Name: line, Selected: line == selected})
+		case len(devices) > 0 && devices[len(devices)-1].Description == "":
+			devices[len(devices)-1].Description = strings.TrimSpace(line)
+		}
+	}
+	return devices, scanner.Err()
+}
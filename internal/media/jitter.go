@@ -0,0 +1,138 @@
+package media
+
+import (
+	"sync"
+	"time"
+)
+
+// How many frames we hold back before playing, so frames arriving unevenly
+// still play smoothly. The depth follows the jitter we measure, between
+// minJitterDepth and maxJitterDepth. We hold jitterFrames at most before
+// dropping the oldest.
+const (
+	minJitterDepth = 2
+	maxJitterDepth = 15
+	jitterFrames   = 50
+)
+
+// How a call sounds from our end, since the last time we looked
+type Stats struct {
+	Loss    float64       // Fraction of the peer's frames that never arrived
+	Jitter  time.Duration // How unevenly they arrive
+	Bitrate int           // Bits a second we receive
+}
+
+// Puts the peer's frames back in order and hands them out one at a time.
+// Frames are pushed by the listener and popped by the player.
+type jitterBuffer struct {
+	mu      sync.Mutex
+	frames  map[int64][]int16
+	next    int64 // The frame to play next
+	playing bool  // Whether we've buffered enough to play, false after running dry
+
+	// jitter estimated like RTP does, from when frames arrive compared to
+	// when they were recorded, which is FrameDuration apart
+	jitter      time.Duration
+	lastArrival time.Time
+	lastSeq     int64
+
+	// counted since the last stats
+	received   int
+	bytes      int
+	highest    int64 // Highest seq seen, -1 before the first frame
+	counted    int64 // highest when the stats were last taken
+	statsSince time.Time
+}
+
+func newJitterBuffer() *jitterBuffer {
+	return &jitterBuffer{frames: map[int64][]int16{}, highest: -1, counted: -1, statsSince: time.Now()}
+}
+
+func (j *jitterBuffer) push(seq int64, pcm []int16, size int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	if !j.lastArrival.IsZero() {
+		transit := now.Sub(j.lastArrival) - time.Duration(seq-j.lastSeq)*FrameDuration
+		j.jitter += (transit.Abs() - j.jitter) / 16
+	}
+	j.lastArrival = now
+	j.lastSeq = seq
+	j.received++
+	j.bytes += size
+	j.highest = max(j.highest, seq)
+
+	if j.playing && seq < j.next {
+		// too late, we played silence in its place
+		return
+	}
+	j.frames[seq] = pcm
+	for len(j.frames) > jitterFrames {
+		delete(j.frames, j.oldest())
+	}
+}
+
+// How many frames to hold back for the jitter we've measured
+func (j *jitterBuffer) depth() int {
+	frames := int(2*j.jitter/FrameDuration) + 1
+	return max(minJitterDepth, min(maxJitterDepth, frames))
+}
+
+// The next frame to play, or nil for silence when it hasn't arrived
+func (j *jitterBuffer) pop() []int16 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	depth := j.depth()
+	if !j.playing {
+		if len(j.frames) < depth {
+			return nil
+		}
+		j.playing = true
+		j.next = j.oldest()
+	}
+	if len(j.frames) == 0 {
+		// ran dry, so buffer up again before carrying on
+		j.playing = false
+		return nil
+	}
+	if len(j.frames) > depth+minJitterDepth {
+		// the jitter calmed down, so skip a frame to catch up
+		delete(j.frames, j.next)
+		j.next++
+	}
+
+	pcm := j.frames[j.next]
+	delete(j.frames, j.next)
+	j.next++
+	return pcm
+}
+
+func (j *jitterBuffer) oldest() int64 {
+	first := true
+	var oldest int64
+	for seq := range j.frames {
+		if first || seq < oldest {
+			oldest = seq
+			first = false
+		}
+	}
+	return oldest
+}
+
+// How the call has sounded since the stats were last taken
+func (j *jitterBuffer) stats() Stats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stats := Stats{Jitter: j.jitter}
+	if expected := j.highest - j.counted; expected > 0 {
+		stats.Loss = max(0, 1-float64(j.received)/float64(expected))
+	}
+	if elapsed := time.Since(j.statsSince); elapsed > 0 {
+		stats.Bitrate = int(float64(j.bytes*8) / elapsed.Seconds())
+	}
+	j.received, j.bytes, j.counted, j.statsSince = 0, 0, j.highest, time.Now()
+	return stats
+}
@@ -0,0 +1,99 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"p2p/internal/crash"
+)
+
+// Voice notes are μ-law, one byte a sample, and stop recording at MaxNote
+const MaxNote = 30 * time.Second
+
+// A voice note being recorded
+type Recording struct {
+	capture *exec.Cmd
+	audio   []byte
+	done    chan struct{}
+}
+
+// Starts recording a voice note from the microphone
+func Record() (*Recording, error) {
+	capture, err := findCommand(captureCommands, settings.Input)
+	if err != nil {
+		return nil, err
+	}
+	microphone, err := capture.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := capture.Start(); err != nil {
+		return nil, fmt.Errorf("recording with %s: %w", capture.Path, err)
+	}
+
+	r := &Recording{capture: capture, done: make(chan struct{})}
+	go r.record(microphone)
+	return r, nil
+}
+
+func (r *Recording) record(microphone io.Reader) {
+	defer crash.Recover()
+	defer close(r.done)
+
+	raw := make([]byte, FrameSamples*2)
+	pcm := make([]int16, FrameSamples)
+	for len(r.audio) < int(MaxNote.Seconds())*SampleRate {
+		if _, err := io.ReadFull(microphone, raw); err != nil {
+			return
+		}
+		for i := range pcm {
+			pcm[i] = int16(binary.LittleEndian.Uint16(raw[2*i:]))
+		}
+		scale(pcm, settings.InputVolume)
+		r.audio = append(r.audio, Mulaw{}.Encode(pcm)...)
+	}
+}
+
+// Stops recording and returns the note
+func (r *Recording) Stop() []byte {
+	r.capture.Process.Kill()
+	<-r.done
+	r.capture.Wait()
+	return r.audio
+}
+
+// How long a voice note plays for
+func NoteDuration(audio []byte) time.Duration {
+	return time.Duration(len(audio)) * time.Second / SampleRate
+}
+
+// Plays a voice note on the speakers, returning once it's done
+func Play(audio []byte) error {
+	playback, err := findCommand(playbackCommands, settings.Output)
+	if err != nil {
+		return err
+	}
+	speaker, err := playback.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := playback.Start(); err != nil {
+		return fmt.Errorf("playing with %s: %w", playback.Path, err)
+	}
+
+	pcm := Mulaw{}.Decode(audio)
+	scale(pcm, settings.OutputVolume)
+	raw := make([]byte, 0, len(audio)*2)
+	for _, sample := range pcm {
+		raw = binary.LittleEndian.AppendUint16(raw, uint16(sample))
+	}
+	_, err = speaker.Write(raw)
+	speaker.Close()
+	if waitErr := playback.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
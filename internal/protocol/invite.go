@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// How an invite starts, to tell it apart from a bare ip:port
+const invitePrefix = "p2p:"
+
+// What one peer hands another to chat instead of its ip:port, written as
+// p2p:ip:port/identity. Along with where to find the peer, it says who the
+// peer is, so someone else who turns up at that address can't pass for them.
+type Invite struct {
+	Addr *net.UDPAddr
+	Key  ed25519.PublicKey // The peer's identity, nil if it has none
+}
+
+func (i Invite) String() string {
+	text := invitePrefix + i.Addr.String()
+	if i.Key != nil {
+		text += "/" + base64.RawURLEncoding.EncodeToString(i.Key)
+	}
+	return text
+}
+
+// Reads an invite, whose address has to be an IP rather than a host name
+func ParseInvite(text string) (Invite, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(text), invitePrefix)
+	if !ok {
+		return Invite{}, false
+	}
+	addr, encodedKey, hasKey := strings.Cut(rest, "/")
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return Invite{}, false
+	}
+	invite := Invite{Addr: net.UDPAddrFromAddrPort(addrPort)}
+	if hasKey {
+		key, err := base64.RawURLEncoding.DecodeString(encodedKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return Invite{}, false
+		}
+		invite.Key = key
+	}
+	return invite, true
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"testing"
+)
+
+func TestParseInvite(t *testing.T) {
+	public, _, _ := ed25519.GenerateKey(nil)
+	key := base64.RawURLEncoding.EncodeToString(public)
+
+	tests := []struct {
+		name     string
+		text     string
+		wantAddr string
+		wantKey  ed25519.PublicKey
+		wantOK   bool
+	}{
+		{"with an identity", "p2p:1.2.3.4:5/" + key, "1.2.3.4:5", public, true},
+		{"without one", "p2p:1.2.3.4:5", "1.2.3.4:5", nil, true},
+		{"IPv6", "p2p:[2001:db8::1]:5/" + key, "[2001:db8::1]:5", public, true},
+		{"pasted with spaces", "  p2p:1.2.3.4:5/" + key + "\n", "1.2.3.4:5", public, true},
+		{"a bare ip:port", "1.2.3.4:5", "", nil, false},
+		{"a host name", "p2p:example.com:5", "", nil, false},
+		{"no port", "p2p:1.2.3.4/" + key, "", nil, false},
+		{"a short key", "p2p:1.2.3.4:5/" + key[:20], "", nil, false},
+		{"a garbled key", "p2p:1.2.3.4:5/%%%", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseInvite(tt.text)
+			if ok != tt.wantOK {
+				t.Fatalf("ParseInvite(%q) ok = %t, want %t", tt.text, ok, tt.wantOK)
+			}
+			if ok && (got.Addr.String() != tt.wantAddr || !bytes.Equal(got.Key, tt.wantKey)) {
+				t.Errorf("ParseInvite(%q) = %s %x, want %s %x", tt.text, got.Addr, got.Key, tt.wantAddr, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestInviteRoundTrip(t *testing.T) {
+	public, _, _ := ed25519.GenerateKey(nil)
+	for _, invite := range []Invite{
+		{Addr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}, Key: public},
+		{Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5}},
+	} {
+		got, ok := ParseInvite(invite.String())
+		if !ok || got.Addr.String() != invite.Addr.String() || !bytes.Equal(got.Key, invite.Key) {
+			t.Errorf("%s came back as %s, %t", invite, got, ok)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package protocol defines the frames peers exchange over UDP.
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// The version of the protocol this build speaks, which goes up whenever
+// frames change in a way older builds can't make sense of, or we'd talk to
+// them differently. Peers tell each other theirs in challenges and proofs.
+// Version 2 acknowledges voice note and file chunks one by one, and version 3
+// takes keepalives of a single byte.
+const Version = 3
+
+// The oldest version we still talk to, speaking it ourselves. Builds from
+// before versioning say nothing, which counts as version 1.
+const MinVersion = 1
+
+// What a build can do, which peers tell each other in challenges and proofs
+// as a bitmap, so nobody is offered what they can't take. Builds that don't
+// say are assumed to be able to do everything.
+const (
+	CanMessage = 1 << iota // Receives messages, which every build does
+	CanFile                // Receives files
+	CanVoice               // Plays voice notes
+	CanCall                // Takes calls, having a microphone and speakers
+	CanScreen              // Shows a shared screen
+	CanFEC                 // Repairs a lost message or chunk from parity frames
+)
+
+// Kinds of frame exchanged between peers
+const (
+	Message  = "msg"
+	Relay    = "relay"    // Asks the receiving peer to forward a frame to a peer we can't reach
+	Ack      = "ack"      // Tells the sender of a message that we received it
+	Echo     = "echo"     // Asks the receiving peer to send the frame straight back, to measure round trip time
+	Reply    = "reply"    // The answer to an echo frame
+	Data     = "data"     // A chunk of the byte stream `p2p pipe` carries, acknowledged by seq
+	Status   = "status"   // Tells peers whether we're online, away or busy, in Text, and what we're up to in Note
+	Nick     = "nick"     // Tells peers the name to show us by, in Text, or that we have none when it's empty
+	Audio    = "audio"    // A frame of a call's audio, numbered by seq
+	Voice    = "voice"    // A chunk of the voice note in ID, numbered by seq, acknowledged once the whole note arrived
+	Screen   = "screen"   // A JPEG tile of the screen shared in ID, from the seq'th capture, or the end of the share with fin
+	File     = "file"     // A chunk of the file in ID, numbered by seq, the first naming it in Text, acknowledged once the whole file arrived
+	ChunkAck = "chunkack" // Acknowledges the seq'th chunk of the voice note or file in ID, pacing its sender
+	Parity   = "parity"   // XOR of the group of message or chunk frames in ID from seq on, to rebuild one that got lost
+
+	Keepalive = "keepalive" // Keeps the hole open, and tells the peer we're still here
+
+	Challenge = "challenge" // Asks the receiving peer to prove its identity by signing the ID
+	Proof     = "proof"     // The answer to a challenge, signed with the sender's identity key
+	Bye       = "bye"       // Says we're leaving, signed like a proof of the receiver's last challenge
+	Mailbox   = "mailbox"   // The key to seal messages to the sender with while it's offline in Key, signed with its identity
+)
+
+// Call signaling, for calls and whatever other media comes to be negotiated
+// the same way. ID is the call's. Every one is acknowledged like a message,
+// with its type in the ack's Text, and resent until it is.
+const (
+	Offer  = "offer"  // Rings a peer, for the media in Text
+	Answer = "answer" // Picks up
+	Busy   = "busy"   // Turns an offer down, as we're in another call
+	Hangup = "hangup" // Ends, declines or gives up on a call
+)
+
+// How long an offer rings before both sides give up on it
+const RingTimeout = 30 * time.Second
+
+// Whether a frame is call signaling
+func IsSignal(frameType string) bool {
+	switch frameType {
+	case Offer, Answer, Busy, Hangup:
+		return true
+	}
+	return false
+}
+
+// What peers send each other. Anything that doesn't decode as a frame is
+// treated as plain text, which is how older builds and the discovery server talk.
+type Frame struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"` // Identifies a message so it can be acknowledged
+	Text   string `json:"text,omitempty"`
+	Note   string `json:"note,omitempty"`   // What the sender says it's up to, in a status frame
+	Direct bool   `json:"direct,omitempty"` // Sent to us alone rather than the whole group
+	To     string `json:"to,omitempty"`     // Where a relay frame should be forwarded
+	From   string `json:"from,omitempty"`   // Who originally sent a relayed frame
+	Frame  *Frame `json:"frame,omitempty"`  // The frame inside a relay frame
+	Sent   int64  `json:"sent,omitempty"`   // When an echo or message frame was sent, in Unix nanoseconds by the sender's clock, and in its reply or ack echoed back
+	Recv   int64  `json:"recv,omitempty"`   // In a reply or ack, when the frame it answers arrived, in Unix nanoseconds by the replier's clock
+	Seq    int64  `json:"seq,omitempty"`    // Position of a data frame, or in its ack the next one expected
+	Data   []byte `json:"data,omitempty"`
+	Fin    bool   `json:"fin,omitempty"` // The data frame ends the stream, the voice or file frame its note or file, or the screen frame the share
+	Key    []byte `json:"key,omitempty"` // The sender's public identity key, in a proof frame, or its mailbox key in a mailbox frame
+	Sig    []byte `json:"sig,omitempty"` // Signature over the challenge, in a proof frame, or over the key in a mailbox frame
+	Tile   *Tile  `json:"tile,omitempty"`
+	Group  int    `json:"group,omitempty"` // How many frames a parity frame covers, or in a chunk how many its parity frames do
+
+	// The newest and oldest protocol versions the sender speaks, in a
+	// challenge or proof frame
+	Version    int `json:"v,omitempty"`
+	MinVersion int `json:"minv,omitempty"`
+	Caps       int `json:"caps,omitempty"`     // What the sender can do, in a challenge or proof frame
+	Interval   int `json:"interval,omitempty"` // How often the sender sends keepalives in milliseconds, in a challenge or proof frame
+}
+
+// The version we talk to a peer in, given the versions its challenge or
+// proof said it speaks, and whether there's one we both speak at all
+func Negotiate(version, minVersion int) (int, bool) {
+	if version == 0 {
+		version = 1
+	}
+	if minVersion == 0 {
+		minVersion = version
+	}
+	agreed := min(Version, version)
+	return agreed, agreed >= MinVersion && agreed >= minVersion
+}
+
+// Where a screen frame's tile goes in the shared picture
+type Tile struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"w"` // Of the whole picture, not the tile
+	Height int `json:"h"`
+}
+
+// A random ID for a new message
+func NewMessageID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func Encode(f Frame) []byte {
+	data, _ := json.Marshal(f)
+	return data
+}
+
+func Decode(data []byte) (Frame, bool) {
+	var f Frame
+	if len(data) == 0 || data[0] != '{' {
+		return f, false
+	}
+	if err := json.Unmarshal(data, &f); err != nil || f.Type == "" {
+		return f, false
+	}
+	return f, true
+}
+
+// The peer a frame came from, who relayed it to us from addr if it was relayed
+func (f Frame) Sender(addr string) string {
+	if f.From != "" {
+		return f.From
+	}
+	return addr
+}
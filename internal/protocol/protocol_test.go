@@ -0,0 +1,27 @@
+package protocol
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name                string
+		version, minVersion int
+		want                int
+		wantOK              bool
+	}{
+		{"peer from before versions", 0, 0, 1, true},
+		{"same version", Version, MinVersion, Version, true},
+		{"oldest peer we still speak", MinVersion, MinVersion, MinVersion, true},
+		{"older peer that only speaks its own", MinVersion, 0, MinVersion, true},
+		{"newer peer that still speaks ours", Version + 2, Version, Version, true},
+		{"newer peer that no longer speaks ours", Version + 2, Version + 1, Version, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Negotiate(tt.version, tt.minVersion)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Negotiate(%d, %d) = %d, %t, want %d, %t", tt.version, tt.minVersion, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
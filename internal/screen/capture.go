@@ -0,0 +1,45 @@
+// Package screen shares what's on our screen with peers a picture at a
+// time, and puts a peer's shared screen back together.
+package screen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+)
+
+// Commands that take a screenshot and write it to stdout as a PNG. Every one
+// that's installed is tried in turn, as which works depends on the display
+// server.
+var captureCommands = [][]string{
+	{"grim", "-t", "png", "-"},                          // Wayland
+	{"import", "-silent", "-window", "root", "png:-"},   // X11, with ImageMagick
+	{"screencapture", "-x", "-t", "png", "/dev/stdout"}, // macOS
+}
+
+var ErrNoCapture = errors.New("no screenshot tool found, install grim or ImageMagick")
+
+// Takes a screenshot
+func capture() (image.Image, error) {
+	err := ErrNoCapture
+	for _, command := range captureCommands {
+		if _, lookErr := exec.LookPath(command[0]); lookErr != nil {
+			continue
+		}
+		out, runErr := exec.Command(command[0], command[1:]...).Output()
+		if runErr != nil {
+			err = fmt.Errorf("taking a screenshot with %s: %w", command[0], runErr)
+			continue
+		}
+		img, decodeErr := png.Decode(bytes.NewReader(out))
+		if decodeErr != nil {
+			err = fmt.Errorf("reading the screenshot from %s: %w", command[0], decodeErr)
+			continue
+		}
+		return img, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,177 @@
+package screen
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log/slog"
+	"sync"
+	"time"
+
+	"p2p/internal/crash"
+	"p2p/internal/protocol"
+)
+
+// How often we take a screenshot, how wide the picture peers get is at most
+// and how big the tiles it's sent in are. Only tiles that changed are sent,
+// except every keyframeEvery screenshots, when every tile is, to make up for
+// ones that got lost.
+const (
+	FrameInterval = time.Second
+	maxWidth      = 1280
+	tileSize      = 64
+	keyframeEvery = 10
+)
+
+// A tile's JPEG stays under maxTileBytes, so its frame fits in a datagram,
+// relayed or not. Tiles that don't fit at any of tileQualities are split up.
+const maxTileBytes = 2400
+
+var tileQualities = []int{60, 40, 20}
+
+// How long we wait between tiles, so a keyframe doesn't arrive in one burst
+const tileInterval = 4 * time.Millisecond
+
+// Our screen being shared
+type Share struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+// Starts sharing our screen. send is called from a background goroutine with
+// every tile to send, the seq'th screenshot's, until the share is stopped.
+func Start(send func(seq int64, tile protocol.Tile, jpeg []byte)) (*Share, error) {
+	first, err := capture()
+	if err != nil {
+		return nil, err
+	}
+	s := &Share{stop: make(chan struct{})}
+	go s.share(first, send)
+	return s, nil
+}
+
+// Stops sharing. It's safe to call more than once.
+func (s *Share) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+func (s *Share) share(img image.Image, send func(seq int64, tile protocol.Tile, jpeg []byte)) {
+	defer crash.Recover()
+
+	ticker := time.NewTicker(FrameInterval)
+	defer ticker.Stop()
+
+	var previous *image.RGBA
+	for seq := int64(0); ; seq++ {
+		picture := shrink(img)
+		keyframe := previous == nil || seq%keyframeEvery == 0 || picture.Bounds() != previous.Bounds()
+		size := picture.Bounds().Size()
+		for y := 0; y < size.Y; y += tileSize {
+			for x := 0; x < size.X; x += tileSize {
+				r := image.Rect(x, y, min(x+tileSize, size.X), min(y+tileSize, size.Y))
+				if !keyframe && sameTile(picture, previous, r) {
+					continue
+				}
+				for _, piece := range encodeTile(picture, r) {
+					select {
+					case <-s.stop:
+						return
+					default:
+					}
+					send(seq, protocol.Tile{X: piece.at.X, Y: piece.at.Y, Width: size.X, Height: size.Y}, piece.jpeg)
+					time.Sleep(tileInterval)
+				}
+			}
+		}
+		previous = picture
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		var err error
+		if img, err = capture(); err != nil {
+			slog.Warn("taking a screenshot failed", "err", err)
+			img = previous
+		}
+	}
+}
+
+// The screenshot scaled down to at most maxWidth, by averaging blocks of pixels
+func shrink(img image.Image) *image.RGBA {
+	full := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(full, full.Bounds(), img, img.Bounds().Min, draw.Src)
+	factor := (full.Bounds().Dx() + maxWidth - 1) / maxWidth
+	if factor <= 1 {
+		return full
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, full.Bounds().Dx()/factor, full.Bounds().Dy()/factor))
+	for y := range small.Bounds().Dy() {
+		for x := range small.Bounds().Dx() {
+			var sum [4]int
+			for dy := range factor {
+				row := full.Pix[(y*factor+dy)*full.Stride:]
+				for dx := range factor {
+					for c := range sum {
+						sum[c] += int(row[(x*factor+dx)*4+c])
+					}
+				}
+			}
+			i := small.PixOffset(x, y)
+			for c := range sum {
+				small.Pix[i+c] = uint8(sum[c] / (factor * factor))
+			}
+		}
+	}
+	return small
+}
+
+// Whether a tile looks the same in both pictures
+func sameTile(a, b *image.RGBA, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if !bytes.Equal(a.Pix[a.PixOffset(r.Min.X, y):a.PixOffset(r.Max.X, y)], b.Pix[b.PixOffset(r.Min.X, y):b.PixOffset(r.Max.X, y)]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Part of a tile, as a JPEG, and where it goes
+type piece struct {
+	at   image.Point
+	jpeg []byte
+}
+
+// Encodes a tile as JPEG, in smaller pieces if it doesn't fit in a datagram
+// otherwise
+func encodeTile(img *image.RGBA, r image.Rectangle) []piece {
+	var out bytes.Buffer
+	for _, quality := range tileQualities {
+		out.Reset()
+		if err := jpeg.Encode(&out, img.SubImage(r), &jpeg.Options{Quality: quality}); err != nil {
+			slog.Warn("encoding a tile failed", "err", err)
+			return nil
+		}
+		if out.Len() <= maxTileBytes {
+			return []piece{{at: r.Min, jpeg: bytes.Clone(out.Bytes())}}
+		}
+	}
+	if r.Dx() < 2 || r.Dy() < 2 {
+		return nil
+	}
+
+	mid := image.Pt((r.Min.X+r.Max.X)/2, (r.Min.Y+r.Max.Y)/2)
+	var pieces []piece
+	for _, quarter := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, mid.X, mid.Y),
+		image.Rect(mid.X, r.Min.Y, r.Max.X, mid.Y),
+		image.Rect(r.Min.X, mid.Y, mid.X, r.Max.Y),
+		image.Rect(mid.X, mid.Y, r.Max.X, r.Max.Y),
+	} {
+		pieces = append(pieces, encodeTile(img, quarter)...)
+	}
+	return pieces
+}
@@ -0,0 +1,115 @@
+package screen
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p/internal/crash"
+	"p2p/internal/protocol"
+)
+
+// Where a peer's shared screen is kept for an image viewer to show, e.g.
+// ~/.cache/p2p/screen-1.2.3.4_5000.jpg
+func ViewerPath(peer string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "p2p", "screen-"+strings.NewReplacer(":", "_", "[", "", "]", "").Replace(peer)+".jpg")
+}
+
+// Puts a peer's shared screen back together from its tiles, writing it to a
+// file whenever it changed
+type Viewer struct {
+	path string
+
+	mu      sync.Mutex
+	picture *image.RGBA
+	dirty   bool
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewViewer(path string) *Viewer {
+	v := &Viewer{path: path, stop: make(chan struct{})}
+	go v.write()
+	return v
+}
+
+// Draws a tile from the peer
+func (v *Viewer) Add(tile protocol.Tile, data []byte) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		slog.Debug("ignoring broken screen tile", "err", err)
+		return
+	}
+	if tile.Width <= 0 || tile.Height <= 0 || tile.Width > 8*maxWidth || tile.Height > 8*maxWidth {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.picture == nil || v.picture.Bounds().Dx() != tile.Width || v.picture.Bounds().Dy() != tile.Height {
+		v.picture = image.NewRGBA(image.Rect(0, 0, tile.Width, tile.Height))
+	}
+	at := image.Pt(tile.X, tile.Y)
+	draw.Draw(v.picture, img.Bounds().Sub(img.Bounds().Min).Add(at), img, img.Bounds().Min, draw.Src)
+	v.dirty = true
+}
+
+// Stops writing the picture. It's safe to call more than once.
+func (v *Viewer) Close() {
+	v.once.Do(func() { close(v.stop) })
+}
+
+// Writes the picture out every half a FrameInterval that it changed, in one
+// go so a viewer never shows half a file
+func (v *Viewer) write() {
+	defer crash.Recover()
+
+	ticker := time.NewTicker(FrameInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+		}
+
+		v.mu.Lock()
+		var out bytes.Buffer
+		if v.dirty {
+			if err := jpeg.Encode(&out, v.picture, &jpeg.Options{Quality: 90}); err != nil {
+				slog.Warn("encoding shared screen failed", "err", err)
+			}
+			v.dirty = false
+		}
+		v.mu.Unlock()
+		if out.Len() == 0 {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(v.path), 0o755); err != nil {
+			slog.Warn("writing shared screen failed", "err", err)
+			continue
+		}
+		tmp := v.path + ".tmp"
+		if err := os.WriteFile(tmp, out.Bytes(), 0o600); err != nil {
+			slog.Warn("writing shared screen failed", "err", err)
+			continue
+		}
+		if err := os.Rename(tmp, v.path); err != nil {
+			slog.Warn("writing shared screen failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"p2p/internal/protocol"
+)
+
+// Big enough for any datagram peers send, relayed frames included
+const MaxDatagram = 4096
+
+// What peers send to keep the hole open, encoded once as it goes out so
+// often. It's a frame so nothing a user types can be mistaken for one. It's
+// never written to.
+var keepalive = protocol.Encode(protocol.Frame{Type: protocol.Keepalive})
+
+// The keepalive peers that speak compactKeepaliveVersion get instead, for
+// metered connections: a single byte, which can't be typed or start a frame
+var compactKeepalive = []byte{0}
+
+const compactKeepaliveVersion = 3
+
+// Whether a datagram is a keepalive, without turning it into a string
+func IsKeepalive(data []byte) bool {
+	return bytes.Equal(data, keepalive) || bytes.Equal(data, compactKeepalive)
+}
+
+// Sends a keepalive to a peer, in the form every version understands
+func SendKeepalive(conn Conn, addr *net.UDPAddr) error {
+	_, err := conn.WriteToUDP(keepalive, addr)
+	return err
+}
+
+// Sends the smallest keepalive a peer on the roster understands
+func sendKeepalive(conn Conn, peer *rosterEntry, addr *net.UDPAddr) error {
+	if !peer.compact.Load() {
+		return SendKeepalive(conn, addr)
+	}
+	_, err := conn.WriteToUDP(compactKeepalive, addr)
+	return err
+}
+
+// Datagram sized buffers, reused rather than allocated for every read or
+// delayed write
+var buffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, MaxDatagram)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	buffers.Put(b)
+}
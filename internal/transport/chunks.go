@@ -0,0 +1,172 @@
+package transport
+
+import (
+	"bytes"
+	"time"
+
+	"p2p/internal/protocol"
+)
+
+// Voice notes and files go out in chunks of Chunk bytes, which stays under a
+// typical MTU once encoded. We give up on one whose chunks stop coming for
+// chunkTimeout, and refuse voice notes of more than maxNoteChunks and files
+// of more than MaxFile bytes. Each sender gets maxPartials in flight at once,
+// and all of them together maxBuffered bytes, so a peer sending the start of
+// file after file can't use up our memory.
+const (
+	Chunk         = 960
+	chunkTimeout  = 30 * time.Second
+	maxNoteChunks = 1024
+	maxFileChunks = 16384
+	MaxFile       = Chunk * maxFileChunks
+	maxPartials   = 4
+	maxBuffered   = 4 * MaxFile
+)
+
+// A voice note or file we've only had some chunks of
+type partial struct {
+	chunks  map[int64][]byte
+	last    int64  // The final chunk's seq, -1 until it arrives
+	name    string // A file's name, which its first chunk carries
+	sender  string
+	size    int // Bytes of chunks kept
+	updated time.Time
+}
+
+// Puts voice notes and files back together from their chunks, by sender and
+// ID. Only the listener goroutine touches it.
+type reassembly struct {
+	partials map[string]*partial
+	buffered int // Bytes of chunks kept across every partial
+}
+
+// Reports whether there's room for a chunk, which isn't the case when it
+// would start one voice note or file too many for its sender, or take us past
+// maxBuffered. A chunk that doesn't fit isn't acknowledged, so it comes again.
+func (r *reassembly) fits(sender string, f protocol.Frame) bool {
+	r.expire()
+	p, ok := r.partials[r.key(sender, f)]
+	if !ok {
+		if r.count(sender) >= maxPartials {
+			return false
+		}
+		return r.buffered+len(f.Data) <= maxBuffered
+	}
+	return r.buffered-len(p.chunks[f.Seq])+len(f.Data) <= maxBuffered
+}
+
+// Adds a chunk, returning the whole voice note or file and its name once
+// every chunk arrived
+func (r *reassembly) add(sender string, f protocol.Frame) ([]byte, string, bool) {
+	r.expire()
+	limit := int64(maxNoteChunks)
+	if f.Type == protocol.File {
+		limit = maxFileChunks
+	}
+	if f.Seq < 0 || f.Seq >= limit {
+		return nil, "", false
+	}
+
+	key := r.key(sender, f)
+	p, ok := r.partials[key]
+	if !ok {
+		if r.partials == nil {
+			r.partials = map[string]*partial{}
+		}
+		p = &partial{chunks: map[int64][]byte{}, last: -1, sender: sender}
+		r.partials[key] = p
+	}
+	if p.last >= 0 && (f.Seq > p.last || f.Fin && f.Seq != p.last) {
+		// past the end, or claiming another one
+		return nil, "", false
+	}
+	r.keep(p, f.Seq, f.Data)
+	p.updated = time.Now()
+	if f.Text != "" {
+		p.name = f.Text
+	}
+	if f.Fin {
+		p.last = f.Seq
+		for seq := range p.chunks {
+			if seq > p.last {
+				r.forget(p, seq)
+			}
+		}
+	}
+	// with nothing past the end kept, as many chunks as seqs up to it means
+	// none is missing
+	if p.last < 0 || int64(len(p.chunks)) != p.last+1 {
+		return nil, "", false
+	}
+
+	r.drop(key)
+	var whole bytes.Buffer
+	for seq := range p.last + 1 {
+		whole.Write(p.chunks[seq])
+	}
+	return whole.Bytes(), p.name, true
+}
+
+// Puts data in p as the chunk seq, keeping count of the bytes kept
+func (r *reassembly) keep(p *partial, seq int64, data []byte) {
+	r.forget(p, seq)
+	p.chunks[seq] = data
+	p.size += len(data)
+	r.buffered += len(data)
+}
+
+// Forgets p's chunk seq, if it had it
+func (r *reassembly) forget(p *partial, seq int64) {
+	p.size -= len(p.chunks[seq])
+	r.buffered -= len(p.chunks[seq])
+	delete(p.chunks, seq)
+}
+
+// Forgets a voice note or file along with the bytes it kept
+func (r *reassembly) drop(key string) {
+	r.buffered -= r.partials[key].size
+	delete(r.partials, key)
+}
+
+// Forgets the voice notes and files whose chunks stopped coming
+func (r *reassembly) expire() {
+	for key, p := range r.partials {
+		if time.Since(p.updated) > chunkTimeout {
+			r.drop(key)
+		}
+	}
+}
+
+// How many voice notes and files sender is in the middle of sending us
+func (r *reassembly) count(sender string) int {
+	n := 0
+	for _, p := range r.partials {
+		if p.sender == sender {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *reassembly) key(sender string, f protocol.Frame) string {
+	return sender + " " + f.Type + " " + f.ID
+}
+
+// Splits a voice note or file into the frames that carry it, each like f.
+// Only the first keeps f's Text, which names a file.
+func Chunks(f protocol.Frame, data []byte) []protocol.Frame {
+	var frames []protocol.Frame
+	for seq := int64(0); ; seq++ {
+		chunk := data[:min(Chunk, len(data))]
+		data = data[len(chunk):]
+		frame := f
+		frame.Seq, frame.Data, frame.Fin = seq, chunk, len(data) == 0
+		if seq > 0 {
+			frame.Text = ""
+		}
+		frames = append(frames, frame)
+		if len(data) == 0 {
+			return frames
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+
+	"p2p/internal/protocol"
+)
+
+// A chunk of a file whose chunks are each the seq they are, repeated
+func chunk(seq int64, fin bool) protocol.Frame {
+	f := protocol.Frame{Type: protocol.File, ID: "f", Seq: seq, Fin: fin, Data: bytes.Repeat([]byte{byte(seq)}, 4)}
+	if seq == 0 {
+		f.Text = "notes.txt"
+	}
+	return f
+}
+
+func TestReassembly(t *testing.T) {
+	whole := func(last int64) []byte {
+		var data []byte
+		for seq := range last + 1 {
+			data = append(data, bytes.Repeat([]byte{byte(seq)}, 4)...)
+		}
+		return data
+	}
+	tests := []struct {
+		name   string
+		frames []protocol.Frame
+		want   []byte // What the last frame completes, nil when nothing completes
+	}{
+		{"in order", []protocol.Frame{chunk(0, false), chunk(1, false), chunk(2, true)}, whole(2)},
+		{"out of order", []protocol.Frame{chunk(2, true), chunk(0, false), chunk(1, false)}, whole(2)},
+		{"single chunk", []protocol.Frame{chunk(0, true)}, whole(0)},
+		{"missing one", []protocol.Frame{chunk(0, false), chunk(2, true)}, nil},
+		{"duplicates don't fill a hole", []protocol.Frame{chunk(0, false), chunk(0, false), chunk(0, false), chunk(2, true)}, nil},
+		{"strays past the end don't fill a hole", []protocol.Frame{chunk(0, false), chunk(5, false), chunk(6, false), chunk(2, true)}, nil},
+		{"strays after the end don't fill a hole", []protocol.Frame{chunk(2, true), chunk(0, false), chunk(5, false)}, nil},
+		{"a second end is ignored", []protocol.Frame{chunk(0, false), chunk(2, true), chunk(1, true)}, nil},
+		{"the real chunk after a second end", []protocol.Frame{chunk(0, false), chunk(2, true), chunk(1, true), chunk(1, false)}, whole(2)},
+		{"the hole filled at last", []protocol.Frame{chunk(0, false), chunk(5, false), chunk(2, true), chunk(1, false)}, whole(2)},
+		{"negative seq", []protocol.Frame{chunk(-1, true)}, nil},
+		{"too many chunks", []protocol.Frame{chunk(maxFileChunks, true)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := reassembly{}
+			for i, f := range tt.frames {
+				data, name, ok := r.add("1.2.3.4:5", f)
+				if i < len(tt.frames)-1 {
+					if ok {
+						t.Fatalf("frame %d (seq %d) completed it early", i, f.Seq)
+					}
+					continue
+				}
+				if ok != (tt.want != nil) {
+					t.Fatalf("completed = %t, want %t", ok, tt.want != nil)
+				}
+				if ok && (!bytes.Equal(data, tt.want) || name != "notes.txt") {
+					t.Errorf("got %v named %q, want %v named notes.txt", data, name, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestChunksReassemble(t *testing.T) {
+	for _, size := range []int{1, Chunk - 1, Chunk, Chunk + 1, 5*Chunk + 17} {
+		data := bytes.Repeat([]byte("abcdefg"), size/7+1)[:size]
+		frames := Chunks(protocol.Frame{Type: protocol.File, ID: "f", Text: "name"}, data)
+		r := reassembly{}
+		var got []byte
+		var ok bool
+		// backwards, so the end isn't what completes it
+		for i := len(frames) - 1; i >= 0; i-- {
+			got, _, ok = r.add("1.2.3.4:5", frames[i])
+		}
+		if !ok || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes in %d chunks came back as %d bytes, complete %t", size, len(frames), len(got), ok)
+		}
+	}
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	// a chunk of file id from sender, and whether there should be room for it
+	type step struct {
+		sender string
+		id     string
+		seq    int64
+		fin    bool
+		fits   bool
+	}
+	a, b := "1.2.3.4:5", "6.7.8.9:10"
+	tests := []struct {
+		name  string
+		other int // Bytes other transfers have buffered already
+		steps []step
+	}{
+		{"one sender's transfers", 0, []step{{a, "1", 0, false, true}, {a, "2", 0, false, true}, {a, "3", 0, false, true}, {a, "4", 0, false, true}, {a, "5", 0, false, false}, {a, "4", 1, false, true}}},
+		{"another sender's", 0, []step{{a, "1", 0, false, true}, {a, "2", 0, false, true}, {a, "3", 0, false, true}, {a, "4", 0, false, true}, {b, "5", 0, false, true}}},
+		{"room once one finishes", 0, []step{{a, "1", 0, false, true}, {a, "2", 0, false, true}, {a, "3", 0, false, true}, {a, "4", 0, true, true}, {a, "5", 0, false, true}}},
+		{"nearly full", maxBuffered - 6, []step{{a, "1", 0, false, true}, {a, "1", 1, false, false}, {b, "2", 0, false, false}}},
+		{"a chunk again when full", maxBuffered - 4, []step{{a, "1", 0, false, true}, {a, "1", 0, false, true}}},
+		{"room once one finishes when full", maxBuffered - 4, []step{{a, "1", 0, true, true}, {b, "2", 0, false, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := reassembly{buffered: tt.other}
+			for i, s := range tt.steps {
+				f := chunk(s.seq, s.fin)
+				f.ID = s.id
+				fits := r.fits(s.sender, f)
+				if fits != s.fits {
+					t.Fatalf("step %d: fits = %t, want %t", i, fits, s.fits)
+				}
+				if fits {
+					r.add(s.sender, f)
+				}
+			}
+			kept := tt.other
+			for _, p := range r.partials {
+				for _, data := range p.chunks {
+					kept += len(data)
+				}
+			}
+			if r.buffered != kept {
+				t.Errorf("counted %d bytes buffered, but %d are", r.buffered, kept)
+			}
+		})
+	}
+}
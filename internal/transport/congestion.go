@@ -0,0 +1,318 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"p2p/internal/protocol"
+)
+
+// Voice notes and files go out no faster than the path to each peer takes
+// them. A window of chunks may be in flight at once, growing by one a round
+// trip while chunks are acknowledged and halving when one is lost, like TCP.
+// It also halves once round trips grow queueDelay past the shortest we've
+// seen, like LEDBAT, so a transfer backs off before it fills the uplink's
+// queue and chat and keepalives, which skip the window, aren't stuck behind
+// it. Chunks never go out faster than maxChunkRate either, leaving room
+// under what peers take from one address for everything else.
+const (
+	initialWindow = 4
+	minWindow     = 2
+	maxWindow     = 256
+	queueDelay    = 100 * time.Millisecond
+	initialRTO    = time.Second
+	minRTO        = 50 * time.Millisecond // Leeway on top of the round trip before a chunk counts as lost
+	maxRTO        = 5 * time.Second
+	stallTimeout  = 10 * time.Second // We give up on a peer that acknowledges nothing for this long
+)
+
+var maxChunkRate = InboundRate / 2
+
+// The pace chunks go out at to peers from before protocol version 2, which
+// don't acknowledge them one by one
+const ChunkInterval = 10 * time.Millisecond
+
+// The first protocol version that acknowledges every chunk
+const chunkAckVersion = 2
+
+var errStalled = errors.New("peer stopped acknowledging chunks")
+
+// Transfers in flight, by peer and ID, for the listener to hand their chunk
+// acks to
+var transfers sync.Map // string -> chan chunkAck
+
+// A chunk's ack, and when it arrived, as the sender may be busy sending when
+// it does
+type chunkAck struct {
+	seq int64
+	at  time.Time
+}
+
+func transferKey(peer, id string) string {
+	return peer + " " + id
+}
+
+// Whether we're still sending a voice note or file to a peer, so there's no
+// point sending it again yet
+func Transferring(addr *net.UDPAddr, id string) bool {
+	_, ok := transfers.Load(transferKey(addr.String(), id))
+	return ok
+}
+
+// Hands a chunk ack to the transfer it's for, if it's still going
+func chunkAcked(peer string, f protocol.Frame) {
+	if acks, ok := transfers.Load(transferKey(peer, f.ID)); ok {
+		select {
+		case acks.(chan chunkAck) <- chunkAck{seq: f.Seq, at: time.Now()}:
+		default:
+		}
+	}
+}
+
+// The congestion window and round trip estimates for one transfer
+type window struct {
+	size, threshold float64
+	srtt, rttvar    time.Duration
+	baseRTT         time.Duration // The shortest round trip seen, without any queueing
+	backoff         time.Duration // How much longer than usual we wait for acks, after timeouts
+	lastDecrease    time.Time
+}
+
+func newWindow() *window {
+	return &window{size: initialWindow, threshold: maxWindow, backoff: 1}
+}
+
+// How long an ack can take before we count its chunk as lost
+func (w *window) rto() time.Duration {
+	if w.srtt == 0 {
+		return min(maxRTO, initialRTO*w.backoff)
+	}
+	return min(maxRTO, (w.srtt+max(minRTO, 4*w.rttvar))*w.backoff)
+}
+
+// Grows the window for an acknowledged chunk, with its round trip unless it
+// was resent, as then we can't tell which copy the ack is for. It only grows
+// while at least half of it is in use, as otherwise it's the pace or the
+// data running out that holds us back rather than the window.
+func (w *window) acked(rtt time.Duration, inUse int) {
+	w.backoff = 1
+	if rtt > 0 {
+		if w.srtt == 0 {
+			w.srtt, w.rttvar = rtt, rtt/2
+		} else {
+			w.rttvar = (3*w.rttvar + (w.srtt - rtt).Abs()) / 4
+			w.srtt = (7*w.srtt + rtt) / 8
+		}
+		if w.baseRTT == 0 || rtt < w.baseRTT {
+			w.baseRTT = rtt
+		}
+		if w.srtt > w.baseRTT+queueDelay {
+			w.shrink()
+			return
+		}
+	}
+	if float64(inUse) < w.size/2 {
+		return
+	}
+	if w.size < w.threshold {
+		w.size++
+	} else {
+		w.size += 1 / w.size
+	}
+	w.size = min(w.size, maxWindow)
+}
+
+// Halves the window as a chunk got lost or round trips grew, at most once a
+// round trip so a burst of losses counts once
+func (w *window) shrink() {
+	if time.Since(w.lastDecrease) < max(w.srtt, minRTO) {
+		return
+	}
+	w.lastDecrease = time.Now()
+	w.threshold = max(w.size/2, minWindow)
+	w.size = w.threshold
+}
+
+// Starts over from the smallest window after nothing was acknowledged for
+// a whole timeout, waiting twice as long for the next
+func (w *window) timedOut() {
+	w.lastDecrease = time.Now()
+	w.threshold = max(w.size/2, minWindow)
+	w.size = minWindow
+	w.backoff = min(2*w.backoff, 64)
+}
+
+// How long to wait between chunks, spreading the window over a round trip
+func (w *window) gap() time.Duration {
+	gap := time.Duration(float64(time.Second) / maxChunkRate)
+	if w.srtt > 0 {
+		gap = max(gap, time.Duration(float64(w.srtt)/w.size))
+	}
+	return gap
+}
+
+// How many chunks sent after one have to be acknowledged before we count it
+// as lost, rather than overtaken. It also counts as lost once a chunk sent
+// after it is acknowledged more than a round trip, and a little leeway, after
+// it went out, for when too few chunks are in flight for three to overtake it.
+const reorderThreshold = 3
+
+// A chunk on its way to the peer
+type inFlight struct {
+	sent    time.Time
+	covered time.Time // When the last frame that could get it there went out: itself, or its group's parity
+	resent  bool      // Whether it's a resend, whose round trip can't be told apart from the original's
+	passed  int       // How many chunks sent after it were acknowledged first
+}
+
+// Sends a voice note's or file's chunks to a peer, resending any that go
+// unacknowledged, and returns once the peer has every one, reporting that it
+// does. Peers that don't acknowledge chunks get them at ChunkInterval
+// instead, and have to ask for the whole thing again if any get lost. With
+// FEC, a chunk only counts as lost once its group's parity couldn't rebuild
+// it either.
+func SendChunks(conn Conn, peers *Roster, addr *net.UDPAddr, frames []protocol.Frame) (bool, error) {
+	if len(frames) == 0 {
+		return false, nil
+	}
+	if peers.Version(addr) < chunkAckVersion {
+		for _, f := range frames {
+			if err := SendFrame(conn, peers, addr, f); err != nil {
+				return false, err
+			}
+			time.Sleep(ChunkInterval)
+		}
+		return false, nil
+	}
+
+	key := transferKey(addr.String(), frames[0].ID)
+	acks := make(chan chunkAck, maxWindow)
+	transfers.Store(key, acks)
+	defer transfers.Delete(key)
+
+	protect := protecting(peers, addr)
+	if protect {
+		frames = slices.Clone(frames)
+		for i := range frames {
+			frames[i].Group = FECGroup
+		}
+	}
+
+	w := newWindow()
+	var parity []protocol.Frame
+	flying := map[int64]*inFlight{}
+	acked := map[int64]bool{}
+	var lost []int64
+	next := int64(0)
+	nextSend := time.Now()
+	lastAck := time.Now()
+	for len(acked) < len(frames) {
+		// the next chunk goes out once the window has room and it's time,
+		// lost chunks first, with parity frames skipping the window
+		var pace <-chan time.Time
+		if len(parity) > 0 || (len(flying) < int(w.size) && (len(lost) > 0 || next < int64(len(frames)))) {
+			pace = time.After(time.Until(nextSend))
+		}
+		oldest := time.Now()
+		for _, chunk := range flying {
+			if chunk.sent.Before(oldest) {
+				oldest = chunk.sent
+			}
+		}
+		var timeout <-chan time.Time
+		if len(flying) > 0 {
+			timeout = time.After(time.Until(oldest.Add(w.rto())))
+		}
+
+		select {
+		case <-pace:
+			nextSend = time.Now().Add(w.gap())
+			if len(parity) > 0 {
+				group := parity[0]
+				parity = parity[1:]
+				if err := SendFrame(conn, peers, addr, group); err != nil {
+					return false, err
+				}
+				for seq := group.Seq; seq < group.Seq+int64(group.Group); seq++ {
+					if chunk, ok := flying[seq]; ok && chunk.covered.IsZero() {
+						chunk.covered = time.Now()
+					}
+				}
+				continue
+			}
+
+			seq, resent := next, len(lost) > 0
+			if resent {
+				seq, lost = lost[0], lost[1:]
+			} else {
+				next++
+			}
+			f := frames[seq]
+			if resent {
+				// on its own, its group's parity having come and gone
+				f.Group = 0
+			}
+			if err := SendFrame(conn, peers, addr, f); err != nil {
+				return false, err
+			}
+			chunk := &inFlight{sent: time.Now(), resent: resent}
+			if !protect || resent {
+				chunk.covered = chunk.sent
+			} else if (seq+1)%FECGroup == 0 || seq == int64(len(frames))-1 {
+				parity = append(parity, parityFrame(frames[seq-seq%FECGroup:seq+1]))
+			}
+			flying[seq] = chunk
+		case ack := <-acks:
+			if ack.seq < 0 || ack.seq >= int64(len(frames)) || acked[ack.seq] {
+				continue
+			}
+			acked[ack.seq] = true
+			lastAck = ack.at
+			lost = slices.DeleteFunc(lost, func(seq int64) bool { return seq == ack.seq })
+			chunk, ok := flying[ack.seq]
+			delete(flying, ack.seq)
+			if !ok || chunk.resent {
+				w.acked(0, len(flying)+1)
+				continue
+			}
+			w.acked(ack.at.Sub(chunk.sent), len(flying)+1)
+
+			// chunks sent before this one that still aren't acknowledged
+			// were most likely lost
+			for seq, other := range flying {
+				if !other.covered.IsZero() && other.covered.Before(chunk.sent) {
+					other.passed++
+					if other.passed >= reorderThreshold || ack.at.Sub(other.covered) > w.srtt+w.baseRTT/4 {
+						delete(flying, seq)
+						lost = append(lost, seq)
+						w.shrink()
+					}
+				}
+			}
+			slices.Sort(lost)
+		case <-timeout:
+			if time.Since(lastAck) > stallTimeout {
+				return false, errStalled
+			}
+			rto := w.rto()
+			for seq, chunk := range flying {
+				if time.Since(chunk.sent) >= rto {
+					delete(flying, seq)
+					lost = append(lost, seq)
+				}
+			}
+			slices.Sort(lost)
+			// while other chunks still get there it's a loss like any
+			// other, too few chunks were behind it to tell sooner
+			if time.Since(lastAck) < rto {
+				w.shrink()
+			} else {
+				w.timedOut()
+			}
+		}
+	}
+	return true, nil
+}
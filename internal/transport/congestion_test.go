@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	const rtt = 50 * time.Millisecond
+	tests := []struct {
+		name string
+		run  func(w *window)
+		want float64
+	}{
+		{"grows by one an ack while slow starting", func(w *window) {
+			w.acked(rtt, initialWindow)
+			w.acked(rtt, initialWindow)
+		}, initialWindow + 2},
+		{"doesn't grow while mostly unused", func(w *window) {
+			w.acked(rtt, 1)
+		}, initialWindow},
+		{"grows by a fraction past the threshold", func(w *window) {
+			w.threshold = initialWindow
+			w.acked(rtt, initialWindow)
+		}, initialWindow + 1.0/initialWindow},
+		{"stops at the largest", func(w *window) {
+			w.size = maxWindow
+			w.acked(rtt, maxWindow)
+		}, maxWindow},
+		{"halves on a loss", func(w *window) {
+			w.size = 20
+			w.shrink()
+		}, 10},
+		{"halves once for losses in the same round trip", func(w *window) {
+			w.acked(rtt, initialWindow)
+			w.size = 20
+			w.shrink()
+			w.shrink()
+		}, 10},
+		{"never halves below the smallest", func(w *window) {
+			w.size = minWindow + 1
+			w.shrink()
+		}, minWindow},
+		{"halves as round trips grow past the queueing delay", func(w *window) {
+			w.acked(rtt, initialWindow)
+			w.srtt, w.size = rtt+2*queueDelay, 20
+			w.acked(rtt+2*queueDelay, 20)
+		}, 10},
+		{"keeps growing while round trips stay under the queueing delay", func(w *window) {
+			w.acked(rtt, initialWindow)
+			w.acked(rtt+queueDelay/2, initialWindow+1)
+		}, initialWindow + 2},
+		{"starts over after a timeout", func(w *window) {
+			w.size = 20
+			w.timedOut()
+		}, minWindow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWindow()
+			tt.run(w)
+			if w.size != tt.want {
+				t.Errorf("window is %.2f, want %.2f", w.size, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowBackoff(t *testing.T) {
+	w := newWindow()
+	if got := w.rto(); got != initialRTO {
+		t.Fatalf("first rto = %s, want %s", got, initialRTO)
+	}
+	w.timedOut()
+	w.timedOut()
+	if got := w.rto(); got != 4*initialRTO {
+		t.Errorf("rto after two timeouts = %s, want %s", got, 4*initialRTO)
+	}
+	w.acked(100*time.Millisecond, 0)
+	if got, want := w.rto(), 100*time.Millisecond+4*50*time.Millisecond; got != want {
+		t.Errorf("rto after an ack = %s, want %s", got, want)
+	}
+}
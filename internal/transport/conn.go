@@ -0,0 +1,69 @@
+// Package transport owns the UDP socket: punching holes to peers, keeping
+// track of which of them we can reach, and relaying frames through them.
+package transport
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"time"
+
+	"p2p/internal/protocol"
+)
+
+// What we need from the UDP socket, so it can be wrapped, e.g. for tracing
+type Conn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	SetReadDeadline(t time.Time) error
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// A socket that logs every datagram going through it, for -trace
+type Traced struct {
+	Conn
+}
+
+func (c Traced) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	n, addr, err := c.Conn.ReadFromUDP(b)
+	if err == nil {
+		traceDatagram("in", addr, b[:n])
+	}
+	return n, addr, err
+}
+
+func (c Traced) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, err := c.Conn.WriteToUDP(b, addr)
+	traceDatagram("out", addr, b)
+	if err != nil {
+		slog.Info("trace", "dir", "out", "addr", addr, "err", err)
+	}
+	return n, err
+}
+
+func traceDatagram(direction string, addr *net.UDPAddr, data []byte) {
+	slog.Info("trace",
+		"dir", direction,
+		"addr", addr,
+		"size", len(data),
+		"type", datagramType(data),
+		"head", hex.EncodeToString(data[:min(len(data), 16)]),
+	)
+}
+
+// A short description of what a datagram is, for the trace
+func datagramType(data []byte) string {
+	if IsKeepalive(data) {
+		return protocol.Keepalive
+	}
+	if f, ok := protocol.Decode(data); ok {
+		return f.Type
+	}
+	switch text := string(data); {
+	case text == "whoami":
+		return text
+	default:
+		return "text"
+	}
+}
@@ -0,0 +1,30 @@
+package transport
+
+// How many message IDs we remember to spot a message that was resent because
+// our ack got lost
+const recentMessages = 1024
+
+// The messages delivered lately, by sender and ID. Only the listener
+// goroutine touches it.
+type recentIDs struct {
+	seen  map[string]bool
+	order []string
+	next  int
+}
+
+func newRecentIDs() *recentIDs {
+	return &recentIDs{seen: map[string]bool{}, order: make([]string, recentMessages)}
+}
+
+// Records a message, reporting whether it had been delivered already
+func (r *recentIDs) repeat(sender, id string) bool {
+	key := sender + " " + id
+	if r.seen[key] {
+		return true
+	}
+	delete(r.seen, r.order[r.next])
+	r.order[r.next] = key
+	r.next = (r.next + 1) % len(r.order)
+	r.seen[key] = true
+	return false
+}
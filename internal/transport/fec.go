@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	"p2p/internal/protocol"
+)
+
+// With forward error correction on, every FECGroup chunks of a voice note or
+// file are followed by a parity frame, the XOR of their encodings, from which
+// a peer can rebuild any one of them that got lost without it being resent.
+// A message is a group of its own, so its parity frame amounts to a copy.
+// It costs an eighth more for transfers and double for messages, which is
+// worth it on lossy Wi-Fi and mobile links but not on most others.
+var FEC bool
+
+// How many chunks a parity frame covers
+const FECGroup = 8
+
+// The most frames we take a peer's parity frame to cover, which bounds how
+// many we keep waiting for it
+const maxFECGroup = 64
+
+// Whether we send parity frames to a peer, which only those that say they
+// can use them get
+func protecting(peers *Roster, addr *net.UDPAddr) bool {
+	return FEC && peers.Can(addr, protocol.CanFEC)
+}
+
+// A frame as parity covers it: its encoding, as it left the sender, after
+// its length so the frame rebuilt from it comes out the right size
+func parityMember(f protocol.Frame) []byte {
+	f.From = ""
+	encoded := protocol.Encode(f)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(encoded))), encoded...)
+}
+
+// XORs b into a, growing a as needed
+func xorInto(a, b []byte) []byte {
+	if len(b) > len(a) {
+		a = append(a, make([]byte, len(b)-len(a))...)
+	}
+	for i := range b {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+// The parity frame covering a group of frames
+func parityFrame(group []protocol.Frame) protocol.Frame {
+	var data []byte
+	for _, f := range group {
+		data = xorInto(data, parityMember(f))
+	}
+	return protocol.Frame{Type: protocol.Parity, ID: group[0].ID, Seq: group[0].Seq, Group: len(group), Data: data}
+}
+
+// Sends a frame to a peer, followed by its parity frame when it's a message
+// and we're protecting what we send it
+func SendMessage(conn Conn, peers *Roster, addr *net.UDPAddr, f protocol.Frame) error {
+	if err := SendFrame(conn, peers, addr, f); err != nil {
+		return err
+	}
+	if f.Type != protocol.Message || !protecting(peers, addr) {
+		return nil
+	}
+	return SendFrame(conn, peers, addr, parityFrame([]protocol.Frame{f}))
+}
+
+// Chunks we got, kept until their group's parity frame arrives in case one of
+// the others got lost, by sender, ID and the group's first seq
+type repairs map[string]*repairGroup
+
+type repairGroup struct {
+	members map[int64][]byte
+	updated time.Time
+}
+
+func repairKey(sender, id string, start int64) string {
+	return sender + " " + id + " " + strconv.FormatInt(start, 10)
+}
+
+// Keeps a chunk that parity frames cover
+func (r repairs) add(sender string, f protocol.Frame) {
+	if f.Group <= 1 || f.Group > maxFECGroup || f.Seq < 0 {
+		return
+	}
+	for key, g := range r {
+		if time.Since(g.updated) > chunkTimeout {
+			delete(r, key)
+		}
+	}
+	key := repairKey(sender, f.ID, f.Seq-f.Seq%int64(f.Group))
+	g, ok := r[key]
+	if !ok {
+		g = &repairGroup{members: map[int64][]byte{}}
+		r[key] = g
+	}
+	g.members[f.Seq] = parityMember(f)
+	g.updated = time.Now()
+}
+
+// Rebuilds the frame a parity frame's group is missing, if it's missing
+// exactly one
+func (r repairs) repair(sender string, parity protocol.Frame) (protocol.Frame, bool) {
+	if parity.Group < 1 || parity.Group > maxFECGroup {
+		return protocol.Frame{}, false
+	}
+	key := repairKey(sender, parity.ID, parity.Seq)
+	var members map[int64][]byte
+	if g, ok := r[key]; ok {
+		members = g.members
+		delete(r, key)
+	}
+
+	missing := int64(-1)
+	data := append([]byte(nil), parity.Data...)
+	for seq := parity.Seq; seq < parity.Seq+int64(parity.Group); seq++ {
+		member, ok := members[seq]
+		if ok {
+			data = xorInto(data, member)
+			continue
+		}
+		if missing >= 0 {
+			return protocol.Frame{}, false
+		}
+		missing = seq
+	}
+	if missing < 0 || len(data) < 2 {
+		return protocol.Frame{}, false
+	}
+
+	size := int(binary.BigEndian.Uint16(data))
+	if size > len(data)-2 {
+		return protocol.Frame{}, false
+	}
+	f, ok := protocol.Decode(data[2 : 2+size])
+	if !ok || f.ID != parity.ID || f.Seq != missing {
+		return protocol.Frame{}, false
+	}
+	switch f.Type {
+	case protocol.Message, protocol.Voice, protocol.File:
+	default:
+		return protocol.Frame{}, false
+	}
+	f.From = parity.From
+	return f, true
+}
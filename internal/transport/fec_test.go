@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"p2p/internal/protocol"
+)
+
+func TestRepair(t *testing.T) {
+	// a group of chunks as SendChunks sends them under FEC
+	var group []protocol.Frame
+	for seq := range int64(FECGroup) {
+		group = append(group, protocol.Frame{Type: protocol.File, ID: "f", Seq: seq, Group: FECGroup, Data: bytes.Repeat([]byte{byte(seq)}, 10+int(seq))})
+	}
+	message := protocol.Frame{Type: protocol.Message, ID: "m", Text: "hello"}
+
+	tests := []struct {
+		name     string
+		received []protocol.Frame
+		parity   protocol.Frame
+		want     *protocol.Frame // What's rebuilt, if anything is
+	}{
+		{"first missing", group[1:], parityFrame(group), &group[0]},
+		{"last missing", group[:FECGroup-1], parityFrame(group), &group[FECGroup-1]},
+		{"middle missing", append(append([]protocol.Frame{}, group[:3]...), group[4:]...), parityFrame(group), &group[3]},
+		{"two missing", group[2:], parityFrame(group), nil},
+		{"none missing", group, parityFrame(group), nil},
+		{"message that's its own group", nil, parityFrame([]protocol.Frame{message}), &message},
+		{"group too big", group[1:], protocol.Frame{Type: protocol.Parity, ID: "f", Group: maxFECGroup + 1}, nil},
+		{"garbled parity", group[1:], protocol.Frame{Type: protocol.Parity, ID: "f", Group: FECGroup, Data: []byte("garbled")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := repairs{}
+			for _, f := range tt.received {
+				r.add("1.2.3.4:5", f)
+			}
+			got, ok := r.repair("1.2.3.4:5", tt.parity)
+			if ok != (tt.want != nil) {
+				t.Fatalf("repaired = %t, want %t", ok, tt.want != nil)
+			}
+			if ok && !reflect.DeepEqual(got, *tt.want) {
+				t.Errorf("rebuilt %+v, want %+v", got, *tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"strings"
+
+	"p2p/internal/mailbox"
+	"p2p/internal/protocol"
+)
+
+// Makes challenges that only work from the address they were sent to, so we
+// don't have to remember them and an overheard proof can't be replayed from
+// anywhere else
+var challengeSecret = func() []byte {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret
+}()
+
+func challengeFor(addr *net.UDPAddr) string {
+	mac := hmac.New(sha256.New, challengeSecret)
+	mac.Write([]byte(addr.String()))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// What a proof signs, so a signature can't be mistaken for anything else
+func proofMessage(challenge string) []byte {
+	return []byte("p2p identity proof " + challenge)
+}
+
+// Asks whoever is at addr to prove who they are
+func sendChallenge(conn Conn, addr *net.UDPAddr, caps int) {
+	if _, err := conn.WriteToUDP(protocol.Encode(protocol.Frame{
+		Type:       protocol.Challenge,
+		ID:         challengeFor(addr),
+		Version:    protocol.Version,
+		MinVersion: protocol.MinVersion,
+		Caps:       caps,
+		Interval:   int(PunchInterval.Milliseconds()),
+	}), addr); err != nil {
+		slog.Debug("sending challenge failed", "peer", addr, "err", err)
+	}
+}
+
+// Signs a peer's challenge with our identity
+func answerChallenge(conn Conn, addr *net.UDPAddr, f protocol.Frame, identity ed25519.PrivateKey, caps int) {
+	proof := protocol.Frame{
+		Type: protocol.Proof,
+		ID:   f.ID,
+		Key:  identity.Public().(ed25519.PublicKey),
+		Sig:  ed25519.Sign(identity, proofMessage(f.ID)),
+
+		Version:    protocol.Version,
+		MinVersion: protocol.MinVersion,
+		Caps:       caps,
+		Interval:   int(PunchInterval.Milliseconds()),
+	}
+	if _, err := conn.WriteToUDP(protocol.Encode(proof), addr); err != nil {
+		slog.Debug("sending proof failed", "peer", addr, "err", err)
+	}
+}
+
+// Tells a peer that challenged us the key to seal messages to us with while
+// we're offline, after the proof it checks the key's signature against
+func sendMailboxKey(conn Conn, addr *net.UDPAddr, identity ed25519.PrivateKey) {
+	key, sig := mailbox.SignKey(identity)
+	if _, err := conn.WriteToUDP(protocol.Encode(protocol.Frame{Type: protocol.Mailbox, Key: key, Sig: sig}), addr); err != nil {
+		slog.Debug("sending mailbox key failed", "peer", addr, "err", err)
+	}
+}
+
+// The identity a proof from addr shows, or nil if it doesn't check out
+func verifyProof(addr *net.UDPAddr, f protocol.Frame) ed25519.PublicKey {
+	if f.From != "" || f.ID != challengeFor(addr) || len(f.Key) != ed25519.PublicKeySize {
+		return nil
+	}
+	if !ed25519.Verify(f.Key, proofMessage(f.ID), f.Sig) {
+		return nil
+	}
+	return f.Key
+}
+
+// Handles a datagram from a stranger, which may be a quiet peer whose NAT
+// gave it a new port. We challenge it, and move the peer over to its new
+// address once it proves who it is, returning the old one.
+func rebind(conn Conn, peers *Roster, addr *net.UDPAddr, data []byte, done <-chan struct{}, caps int) *net.UDPAddr {
+	if !peers.Quiet() {
+		return nil
+	}
+	f, ok := protocol.Decode(data)
+	if !ok || f.Type != protocol.Proof {
+		sendChallenge(conn, addr, caps)
+		return nil
+	}
+	key := verifyProof(addr, f)
+	if key == nil {
+		return nil
+	}
+	return peers.Move(conn, key, addr, done)
+}
+
+// What a goodbye signs, which mustn't pass for a proof
+func byeMessage(challenge string) []byte {
+	return []byte("p2p bye " + challenge)
+}
+
+// Tells every peer that challenged us that we're leaving, signed so nobody
+// else can make us look gone. Peers we never proved ourselves to have to
+// notice we stopped sending keepalives instead.
+func SayGoodbye(conn Conn, peers *Roster, identity ed25519.PrivateKey) {
+	if identity == nil {
+		return
+	}
+	for addr, challenge := range peers.Challenges() {
+		bye := protocol.Frame{
+			Type: protocol.Bye,
+			ID:   challenge,
+			Key:  identity.Public().(ed25519.PublicKey),
+			Sig:  ed25519.Sign(identity, byeMessage(challenge)),
+		}
+		if _, err := conn.WriteToUDP(protocol.Encode(bye), addr); err != nil {
+			slog.Debug("saying goodbye failed", "peer", addr, "err", err)
+		}
+	}
+}
+
+// Whether a goodbye from addr is really from the peer that proved itself there
+func verifyBye(peers *Roster, addr *net.UDPAddr, f protocol.Frame) bool {
+	return f.From == "" && f.ID == challengeFor(addr) && len(f.Key) == ed25519.PublicKeySize &&
+		peers.HasKey(addr, f.Key) && ed25519.Verify(f.Key, byeMessage(f.ID), f.Sig)
+}
+
+// A short, human comparable form of a public key, like 1a:2b:3c:4d:5e:6f:7a:8b
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	parts := make([]string, 8)
+	for i := range parts {
+		parts[i] = hex.EncodeToString(sum[i : i+1])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// How many datagrams a second we take from any one address, and how many it
+// can send in a burst. Peers send a keepalive every PunchInterval plus
+// whatever they type or relay, which is nowhere near this.
+var (
+	InboundRate  = 200.0
+	InboundBurst = 400.0
+)
+
+// A token bucket per source address, so someone spamming our port can't flood
+// the transcript or keep us busy. It's only used by the listener's goroutine.
+type limiter struct {
+	buckets   map[netip.AddrPort]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time // When tokens was last topped up
+	dropped bool      // Whether we dropped any since the bucket was last full, to only log it once
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: map[netip.AddrPort]*bucket{}, lastSweep: time.Now()}
+}
+
+// Whether to take a datagram from addr rather than drop it
+func (l *limiter) allow(addr *net.UDPAddr) bool {
+	now := time.Now()
+	l.sweep(now)
+
+	key := addr.AddrPort()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: InboundBurst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(InboundBurst, b.tokens+now.Sub(b.last).Seconds()*InboundRate)
+	b.last = now
+	if b.tokens == InboundBurst {
+		b.dropped = false
+	}
+
+	if b.tokens < 1 {
+		if !b.dropped {
+			slog.Warn("dropping datagrams from a source sending too fast", "addr", addr)
+			b.dropped = true
+		}
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Forgets sources whose buckets have filled up again, which are no different
+// from ones we've never heard from, so spoofed addresses can't grow the map
+// forever
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(InboundBurst / InboundRate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
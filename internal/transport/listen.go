@@ -0,0 +1,355 @@
+package transport
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"p2p/internal/crash"
+	"p2p/internal/mailbox"
+	"p2p/internal/protocol"
+)
+
+// What Listen hands on to whoever is listening. Acks for messages, answers to
+// echoes and relaying for other peers are taken care of by Listen itself.
+// Every field is optional.
+type Handler struct {
+	// A stranger sent us something. Return true to hear them out, after
+	// adding them to the roster.
+	Stranger func(addr *net.UDPAddr, data []byte) bool
+
+	Keepalive func(addr *net.UDPAddr)
+	// A peer's State changed, from the listener when it's heard from and
+	// from a background goroutine as it goes quiet. Goodbyes go to Bye
+	// instead.
+	Presence func(addr *net.UDPAddr, state State)
+	// A quiet peer came back from a new address, e.g. after its NAT gave it
+	// a new port, and proved it's who it was. The roster already has the new
+	// address.
+	Moved func(from, to *net.UDPAddr)
+	// A peer said goodbye, and is unreachable until it's back
+	Bye func(addr *net.UDPAddr)
+	// A message frame, already acknowledged. addr is who sent it to us, which
+	// is the relaying peer for relayed frames. Messages resent after their ack
+	// got lost are only delivered once.
+	Message func(addr *net.UDPAddr, f protocol.Frame)
+	// A whole voice note, in Data, already acknowledged. addr is who sent
+	// its last chunk to us, like for messages.
+	Voice func(addr *net.UDPAddr, f protocol.Frame)
+	// A whole file, in Data and named in Text, already acknowledged like a
+	// voice note
+	File   func(addr *net.UDPAddr, f protocol.Frame)
+	Ack    func(peer string, f protocol.Frame)
+	Reply  func(peer string, f protocol.Frame)
+	Status func(peer string, f protocol.Frame)
+	Nick   func(peer string, f protocol.Frame)
+	// Call signaling, already acknowledged and only delivered once however
+	// often it's resent
+	Signal func(peer string, f protocol.Frame)
+	// A frame of a call's audio, which only ever comes straight from the peer
+	Audio func(addr *net.UDPAddr, f protocol.Frame)
+	// A tile of a peer's shared screen, or the end of the share
+	Screen func(peer string, f protocol.Frame)
+	// A peer turned out to speak no protocol version we do, in version and
+	// older down to minVersion. Nothing it sends is handed on from then on,
+	// but for goodbyes.
+	Incompatible func(addr *net.UDPAddr, version, minVersion int)
+	// A peer we'd handshaken with handshook again speaking another protocol
+	// version or able to do other things, having restarted as another build.
+	// Frames we send it from then on go by what it says now.
+	Renegotiated func(addr *net.UDPAddr, oldCaps, caps int)
+	// Plain text, which is how older builds and the discovery server talk
+	Text func(addr *net.UDPAddr, text string)
+	// Reading from the socket failed, for any reason but it being closed
+	Error func(err error)
+
+	// Who we are, to prove to peers that ask, e.g. after our own NAT gave us
+	// a new port. Peers that ask aren't answered without it.
+	Identity ed25519.PrivateKey
+	// What we can do, from protocol's Can constants, to tell peers along
+	// with our protocol version
+	Caps int
+}
+
+// Reads datagrams from our peers and the discovery server until done is
+// closed, which closes conn, or conn is closed. Strangers are ignored.
+// isDiscovery tells the discovery servers we were given apart from them, and
+// may be nil.
+func Listen(conn Conn, peers *Roster, isDiscovery func(addr *net.UDPAddr) bool, done <-chan struct{}, h Handler) {
+	fromDiscovery := func(addr *net.UDPAddr) bool {
+		return isDiscovery != nil && isDiscovery(addr)
+	}
+
+	// closing the socket is the only way to interrupt a blocked read
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-done:
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	if h.Presence != nil {
+		go watchPresence(peers, stopped, h.Presence)
+	}
+
+	// whatever deadline an earlier exchange on this socket left behind
+	conn.SetReadDeadline(time.Time{})
+
+	limits := newLimiter()
+	delivered := newRecentIDs()
+	partials := reassembly{}
+	repaired := repairs{}
+	b := getBuffer()
+	defer putBuffer(b)
+	buffer := *b
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// e.g. an ICMP port unreachable from a peer that isn't up yet
+			slog.Error("reading from socket failed", "err", err)
+			if h.Error != nil {
+				h.Error(err)
+			}
+			continue
+		}
+		if !limits.allow(addr) {
+			continue
+		}
+
+		// ignore strangers, unless they're a peer that moved
+		if !peers.Has(addr) && !fromDiscovery(addr) && (h.Stranger == nil || !h.Stranger(addr, buffer[:n])) {
+			if from := rebind(conn, peers, addr, buffer[:n], done, h.Caps); from != nil {
+				slog.Info("peer moved", "from", from, "to", addr)
+				if h.Moved != nil {
+					h.Moved(from, addr)
+				}
+				continue
+			}
+			slog.Debug("ignoring datagram from stranger", "addr", addr, "size", n)
+			continue
+		}
+		if fromDiscovery(addr) && slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+			slog.Debug("discovery server replied", "text", string(buffer[:n]))
+		}
+		if previous, changed := peers.Seen(addr); changed {
+			if previous != Degraded {
+				// find out who they are, to know them if they come back
+				// from somewhere else
+				sendChallenge(conn, addr, h.Caps)
+			}
+			if h.Presence != nil {
+				h.Presence(addr, Connected)
+			}
+		}
+
+		if IsKeepalive(buffer[:n]) {
+			if h.Keepalive != nil {
+				h.Keepalive(addr)
+			}
+			continue
+		}
+
+		f, ok := protocol.Decode(buffer[:n])
+		if ok && f.From != "" && !relayedFrom(peers, addr, f.From, fromDiscovery(addr)) {
+			slog.Debug("ignoring frame passed on from someone it can't be from", "type", f.Type, "addr", addr, "from", f.From)
+			continue
+		}
+		if ok && f.From == "" && (f.Type == protocol.Challenge || f.Type == protocol.Proof) {
+			handshake(peers, addr, f, h)
+		}
+		if peers.Refused(addr) && (!ok || f.Type != protocol.Bye) {
+			// it would only show up as garbage
+			continue
+		}
+		if ok && f.Type == protocol.Parity {
+			// carry on as if the frame it rebuilds had arrived
+			if f, ok = repaired.repair(f.Sender(addr.String()), f); !ok {
+				continue
+			}
+			slog.Debug("rebuilt frame from parity", "type", f.Type, "id", f.ID, "seq", f.Seq, "peer", f.Sender(addr.String()))
+		} else if ok && (f.Type == protocol.Voice || f.Type == protocol.File) {
+			repaired.add(f.Sender(addr.String()), f)
+		}
+
+		switch {
+		case !ok:
+			if h.Text != nil {
+				h.Text(addr, string(buffer[:n]))
+			}
+		case f.Type == protocol.Message:
+			if f.ID != "" {
+				// ack resent messages too, as it's our ack that got lost
+				Reply(conn, addr, f, protocol.Frame{Type: protocol.Ack, ID: f.ID, Sent: f.Sent, Recv: received(f)})
+				if delivered.repeat(f.Sender(addr.String()), f.ID) {
+					continue
+				}
+			}
+			if h.Message != nil {
+				h.Message(addr, f)
+			}
+		case f.Type == protocol.Voice || f.Type == protocol.File:
+			sender := f.Sender(addr.String())
+			if !partials.fits(sender, f) {
+				slog.Debug("no room for the chunk", "sender", sender, "id", f.ID, "seq", f.Seq)
+				continue
+			}
+			Reply(conn, addr, f, protocol.Frame{Type: protocol.ChunkAck, ID: f.ID, Seq: f.Seq})
+			data, name, complete := partials.add(sender, f)
+			if !complete {
+				continue
+			}
+			Reply(conn, addr, f, protocol.Frame{Type: protocol.Ack, ID: f.ID})
+			if delivered.repeat(sender, f.ID) {
+				continue
+			}
+			f.Data, f.Text = data, name
+			if f.Type == protocol.Voice && h.Voice != nil {
+				h.Voice(addr, f)
+			} else if f.Type == protocol.File && h.File != nil {
+				h.File(addr, f)
+			}
+		case f.Type == protocol.Ack:
+			if h.Ack != nil {
+				h.Ack(f.Sender(addr.String()), f)
+			}
+		case f.Type == protocol.ChunkAck:
+			chunkAcked(f.Sender(addr.String()), f)
+		case f.Type == protocol.Echo:
+			Reply(conn, addr, f, protocol.Frame{Type: protocol.Reply, ID: f.ID, Sent: f.Sent, Recv: received(f)})
+		case f.Type == protocol.Reply:
+			if h.Reply != nil {
+				h.Reply(f.Sender(addr.String()), f)
+			}
+		case f.Type == protocol.Status:
+			if h.Status != nil {
+				h.Status(f.Sender(addr.String()), f)
+			}
+		case f.Type == protocol.Nick:
+			if h.Nick != nil {
+				h.Nick(f.Sender(addr.String()), f)
+			}
+		case protocol.IsSignal(f.Type):
+			sender := f.Sender(addr.String())
+			Reply(conn, addr, f, protocol.Frame{Type: protocol.Ack, ID: f.ID, Text: f.Type})
+			if delivered.repeat(sender, f.Type+" "+f.ID) {
+				continue
+			}
+			if h.Signal != nil {
+				h.Signal(sender, f)
+			}
+		case f.Type == protocol.Audio:
+			if h.Audio != nil && f.From == "" {
+				h.Audio(addr, f)
+			}
+		case f.Type == protocol.Screen:
+			if h.Screen != nil {
+				h.Screen(f.Sender(addr.String()), f)
+			}
+		case f.Type == protocol.Challenge:
+			if h.Identity != nil && f.From == "" {
+				if peers.SetChallenge(addr, f.ID) {
+					// it restarted, maybe as another build or with another
+					// identity, so hear it out again too
+					slog.Info("peer restarted, handshaking again", "peer", addr)
+					sendChallenge(conn, addr, h.Caps)
+				}
+				answerChallenge(conn, addr, f, h.Identity, h.Caps)
+				sendMailboxKey(conn, addr, h.Identity)
+			}
+		case f.Type == protocol.Bye:
+			if verifyBye(peers, addr, f) && peers.Left(addr) && h.Bye != nil {
+				h.Bye(addr)
+			}
+		case f.Type == protocol.Proof:
+			if key := verifyProof(addr, f); key != nil && !peers.SetKey(addr, key) {
+				slog.Warn("peer proved another identity than its invite's", "peer", addr, "fingerprint", Fingerprint(key))
+			}
+		case f.Type == protocol.Mailbox:
+			if identity, _ := peers.Mailbox(addr); f.From == "" && mailbox.VerifyKey(identity, f.Key, f.Sig) {
+				peers.SetMailbox(addr, f.Key)
+			}
+		case f.Type == protocol.Relay:
+			RelayFrame(conn, peers, addr, f)
+		}
+	}
+}
+
+// Whether a frame addr passed on to us can be from the peer it says. The
+// discovery server only relays between members of a room, but any peer could
+// say it's passing on someone else's frame, so we only take a peer's word for
+// one from a peer we can't hear from ourselves, which is when it would need
+// relaying.
+func relayedFrom(peers *Roster, addr *net.UDPAddr, from string, fromServer bool) bool {
+	sender, err := netip.ParseAddrPort(from)
+	if err != nil {
+		return false
+	}
+	senderAddr := net.UDPAddrFromAddrPort(sender)
+	if SameAddr(senderAddr, addr) || !peers.Has(senderAddr) {
+		return false
+	}
+	return fromServer || !peers.Reachable(senderAddr)
+}
+
+// Records the protocol versions, capabilities and keepalive interval a peer's
+// challenge or proof says it has
+func handshake(peers *Roster, addr *net.UDPAddr, f protocol.Frame, h Handler) {
+	version, caps := peers.Handshake(addr)
+	if f.Caps != 0 {
+		peers.SetCaps(addr, f.Caps)
+	}
+	if f.Interval > 0 {
+		peers.SetInterval(addr, time.Duration(f.Interval)*time.Millisecond)
+	}
+	if peers.SetVersion(addr, f.Version, f.MinVersion) {
+		slog.Warn("peer speaks an incompatible protocol version", "peer", addr, "version", f.Version, "min_version", f.MinVersion)
+		if h.Incompatible != nil {
+			h.Incompatible(addr, f.Version, f.MinVersion)
+		}
+		return
+	}
+	if newVersion, newCaps := peers.Handshake(addr); version != 0 && (newVersion != version || newCaps != caps) {
+		slog.Info("peer renegotiated", "peer", addr, "version", newVersion, "caps", newCaps, "was_version", version, "was_caps", caps)
+		if h.Renegotiated != nil {
+			h.Renegotiated(addr, caps, newCaps)
+		}
+	}
+}
+
+// Reports peers that go quiet until stopped is closed
+func watchPresence(peers *Roster, stopped <-chan struct{}, presence func(addr *net.UDPAddr, state State)) {
+	defer crash.Recover()
+
+	ticker := time.NewTicker(PunchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+			for _, change := range peers.Expire() {
+				presence(change.Addr, change.State)
+			}
+		}
+	}
+}
+
+// When we got f, for its reply or ack to tell the sender, which only those
+// that said when they sent it want
+func received(f protocol.Frame) int64 {
+	if f.Sent == 0 {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
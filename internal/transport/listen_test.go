@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayedFrom(t *testing.T) {
+	relay := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	heard := &net.UDPAddr{IP: net.IPv4(6, 7, 8, 9), Port: 10}
+	quiet := &net.UDPAddr{IP: net.IPv4(11, 12, 13, 14), Port: 15}
+	peers := &Roster{}
+	for _, addr := range []*net.UDPAddr{relay, heard, quiet} {
+		peers.peers = append(peers.peers, &rosterEntry{addr: addr})
+	}
+	peers.Seen(relay)
+	peers.Seen(heard)
+	peers.peers[2].lastSeen.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	tests := []struct {
+		name       string
+		from       string
+		fromServer bool
+		want       bool
+	}{
+		{"a peer we can't hear", quiet.String(), false, true},
+		{"a peer we hear ourselves", heard.String(), false, false},
+		{"the relay itself", relay.String(), false, false},
+		{"a stranger", "21.22.23.24:25", false, false},
+		{"not an address", "somewhere", false, false},
+		{"a host name", "localhost:10", false, false},
+		{"through the server, a peer we can't hear", quiet.String(), true, true},
+		{"through the server, a peer we hear", heard.String(), true, true},
+		{"through the server, a stranger", "21.22.23.24:25", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relayedFrom(peers, relay, tt.from, tt.fromServer); got != tt.want {
+				t.Errorf("relayedFrom(%q) = %t, want %t", tt.from, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// A socket that also writes every datagram through it to a pcap file, for -pcap
+type Pcap struct {
+	Conn
+	mu     sync.Mutex
+	file   *os.File
+	writer *pcapgo.Writer
+}
+
+func NewPcap(conn Conn, path string) (*Pcap, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Pcap{Conn: conn, file: file, writer: writer}, nil
+}
+
+func (c *Pcap) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	n, addr, err := c.Conn.ReadFromUDP(b)
+	if err == nil {
+		c.capture(addr, b[:n], false)
+	}
+	return n, addr, err
+}
+
+func (c *Pcap) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, err := c.Conn.WriteToUDP(b, addr)
+	if err == nil {
+		c.capture(addr, b, true)
+	}
+	return n, err
+}
+
+func (c *Pcap) Close() error {
+	c.mu.Lock()
+	c.file.Close()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// Wraps the datagram in made up IP and UDP headers and appends it to the file
+func (c *Pcap) capture(remote *net.UDPAddr, payload []byte, outgoing bool) {
+	local := c.Conn.LocalAddr().(*net.UDPAddr)
+	src, dst := remote, local
+	if outgoing {
+		src, dst = local, remote
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port), DstPort: layers.UDPPort(dst.Port)}
+
+	// our side takes the remote side's address family
+	var ip gopacket.SerializableLayer
+	if remote.IP.To4() != nil {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: captureIP(src.IP, true), DstIP: captureIP(dst.IP, true)}
+		_ = udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: captureIP(src.IP, false), DstIP: captureIP(dst.IP, false)}
+		_ = udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload(payload)); err != nil {
+		slog.Warn("capturing datagram failed", "err", err)
+		return
+	}
+
+	data := buffer.Bytes()
+	info := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writer.WritePacket(info, data); err != nil {
+		slog.Warn("capturing datagram failed", "err", err)
+	}
+}
+
+// Our side is usually bound to the unspecified address, which is written as
+// all zeroes of whichever family the packet is
+func captureIP(ip net.IP, v4 bool) net.IP {
+	if !v4 {
+		if ip.To4() != nil || ip == nil {
+			return net.IPv6unspecified
+		}
+		return ip
+	}
+	if ip4 := ip.To4(); ip4 != nil && !ip4.IsUnspecified() {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"p2p/internal/protocol"
+)
+
+// How urgently a datagram has to go out, most urgent first
+type priority int
+
+const (
+	controlPriority priority = iota // Keepalives, handshakes, echoes and calls, which break things when late
+	chatPriority                    // Messages, statuses and nicks, which someone is waiting to see
+	receiptPriority                 // Acks, which only hold up resends
+	bulkPriority                    // Voice notes, files, screen shares and pipes, which can always wait a little
+)
+
+// The priority of a datagram, going by its frame's type. Relayed frames go
+// by the frame inside.
+func priorityOf(b []byte) priority {
+	if IsKeepalive(b) {
+		return controlPriority
+	}
+	frameType := typeOf(b)
+	if frameType == protocol.Relay {
+		if i := bytes.Index(b, []byte(`"frame":`)); i >= 0 {
+			frameType = typeOf(b[i+len(`"frame":`):])
+		}
+	}
+	switch frameType {
+	case protocol.Message, protocol.Status, protocol.Nick, protocol.Relay:
+		return chatPriority
+	case protocol.Ack, protocol.ChunkAck:
+		return receiptPriority
+	case protocol.Voice, protocol.File, protocol.Screen, protocol.Parity, protocol.Data:
+		return bulkPriority
+	}
+	// handshakes, echoes, calls and plain text to the discovery server
+	return controlPriority
+}
+
+// A frame's type without decoding all of it, which for a file chunk would
+// mean decoding the chunk too. protocol.Encode always puts it first.
+func typeOf(b []byte) string {
+	prefix := []byte(`{"type":"`)
+	if !bytes.HasPrefix(b, prefix) {
+		return ""
+	}
+	b = b[len(prefix):]
+	end := bytes.IndexByte(b, '"')
+	if end < 0 {
+		return ""
+	}
+	return string(b[:end])
+}
+
+// A socket whose writes go out most urgent first. Writes only queue up when
+// the socket's send buffer is full, e.g. during a screen share or a transfer
+// to a fast peer, and then keepalives and chat jump ahead of the chunks and
+// tiles still waiting rather than going out after them.
+type Prioritized struct {
+	Conn
+	mu     sync.Mutex
+	queues [bulkPriority + 1][]*queuedWrite
+	closed bool
+	ready  chan struct{}
+	done   chan struct{}
+}
+
+type queuedWrite struct {
+	b    []byte
+	addr *net.UDPAddr
+	n    int
+	err  error
+	sent chan struct{}
+}
+
+func NewPrioritized(conn Conn) *Prioritized {
+	p := &Prioritized{Conn: conn, ready: make(chan struct{}, 1), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+// Queues a datagram behind any more urgent ones and returns once it's
+// written, so b can be reused as with any other socket
+func (p *Prioritized) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	w := &queuedWrite{b: b, addr: addr, sent: make(chan struct{})}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	level := priorityOf(b)
+	p.queues[level] = append(p.queues[level], w)
+	p.mu.Unlock()
+
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+	<-w.sent
+	return w.n, w.err
+}
+
+// The most urgent write waiting, if any
+func (p *Prioritized) next() *queuedWrite {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for level, queue := range p.queues {
+		if len(queue) > 0 {
+			p.queues[level] = queue[1:]
+			return queue[0]
+		}
+	}
+	return nil
+}
+
+// Writes whatever's queued, most urgent first, until closed
+func (p *Prioritized) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.ready:
+		}
+		for w := p.next(); w != nil; w = p.next() {
+			w.n, w.err = p.Conn.WriteToUDP(w.b, w.addr)
+			close(w.sent)
+		}
+	}
+}
+
+// Closes the socket, failing writes still waiting to go out
+func (p *Prioritized) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+		for level, queue := range p.queues {
+			for _, w := range queue {
+				w.err = net.ErrClosed
+				close(w.sent)
+			}
+			p.queues[level] = nil
+		}
+	}
+	p.mu.Unlock()
+	return p.Conn.Close()
+}
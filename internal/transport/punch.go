@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"p2p/internal/crash"
+	"p2p/internal/protocol"
+)
+
+// How often we send keepalives to each peer, keeping our NAT's mapping open
+var PunchInterval = 500 * time.Millisecond
+
+// The longest we go between keepalives to a peer that stopped answering,
+// backing off from PunchInterval. It's short enough to keep our own NAT's
+// mapping open for when the peer comes back.
+var MaxPunchInterval = 8 * time.Second
+
+// The range SetPunchInterval takes. Much more often only eats into what the
+// peer's rate limit allows, and much less risks NATs forgetting the mapping,
+// which some do after 30 seconds of quiet.
+const (
+	MinPunchIntervalSetting = 100 * time.Millisecond
+	MaxPunchIntervalSetting = 15 * time.Second
+)
+
+// Changes how often we send keepalives, e.g. less often to save data and
+// battery, along with how long peers can be quiet before they count as
+// degraded or lost, as that's measured in missed keepalives. It has to be
+// called before any peer is added.
+func SetPunchInterval(interval time.Duration) error {
+	if interval < MinPunchIntervalSetting || interval > MaxPunchIntervalSetting {
+		return fmt.Errorf("the punch interval has to be between %v and %v", MinPunchIntervalSetting, MaxPunchIntervalSetting)
+	}
+	PunchInterval = interval
+	MaxPunchInterval = max(MaxPunchInterval, interval)
+	ReachableTimeout = 3 * interval
+	DegradedTimeout = 2 * interval
+	return nil
+}
+
+func punchHoles(conn Conn, peer *rosterEntry, remoteAddr *net.UDPAddr, done <-chan struct{}, stop chan struct{}) {
+	defer crash.Recover()
+
+	interval := PunchInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		hurried := false
+		select {
+		case <-done:
+			return
+		case <-stop:
+			return
+		case <-timer.C:
+		case <-peer.hurry:
+			hurried = true
+			timer.Stop()
+		}
+
+		if err := sendKeepalive(conn, peer, remoteAddr); err != nil {
+			// keep punching, the error may well be temporary
+			slog.Warn("keepalive failed", "peer", remoteAddr, "err", err)
+		}
+		if hurried || peer.seenWithin(peer.lostAfter()) {
+			interval = PunchInterval
+		} else {
+			interval = min(2*interval, MaxPunchInterval)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// How many keepalives a coordinated punch sends, and how far apart, so some
+// cross the peer's even if its start is a little off ours
+const (
+	punchBurst    = 5
+	punchBurstGap = 50 * time.Millisecond
+)
+
+// Punches towards a peer after delay, when the discovery server told it to
+// punch towards us too, with a burst of keepalives rather than one
+func (r *Roster) PunchAfter(conn Conn, addr *net.UDPAddr, delay time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if !SameAddr(peer.addr, addr) {
+			continue
+		}
+		to, stop := peer.addr, peer.stop
+		go func() {
+			defer crash.Recover()
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			for range punchBurst {
+				select {
+				case <-stop:
+					return
+				case <-timer.C:
+				}
+				if err := sendKeepalive(conn, peer, to); err != nil {
+					slog.Warn("keepalive failed", "peer", to, "err", err)
+				}
+				timer.Reset(punchBurstGap)
+			}
+		}()
+	}
+}
+
+// Sends a frame to a peer, relaying it through another peer when the peer
+// can't be reached directly
+func SendFrame(conn Conn, peers *Roster, remoteAddr *net.UDPAddr, f protocol.Frame) error {
+	if via := peers.RelayFor(remoteAddr); via != nil {
+		slog.Debug("relaying frame", "type", f.Type, "id", f.ID, "peer", remoteAddr, "via", via)
+		_, err := conn.WriteToUDP(protocol.Encode(protocol.Frame{
+			Type:  protocol.Relay,
+			To:    remoteAddr.String(),
+			Frame: &f,
+		}), via)
+		if err != nil {
+			slog.Error("sending frame failed", "type", f.Type, "peer", remoteAddr, "via", via, "err", err)
+		}
+		return err
+	}
+	_, err := conn.WriteToUDP(protocol.Encode(f), remoteAddr)
+	if err != nil {
+		slog.Error("sending frame failed", "type", f.Type, "peer", remoteAddr, "err", err)
+	}
+	return err
+}
+
+// Forwards a frame one peer asked us to relay to another, as long as both
+// are in our conversation
+func RelayFrame(conn Conn, peers *Roster, from *net.UDPAddr, f protocol.Frame) {
+	to, err := net.ResolveUDPAddr("udp", f.To)
+	if err != nil || f.Frame == nil || !peers.Has(to) {
+		return
+	}
+	relayed := *f.Frame
+	relayed.From = from.String()
+	slog.Debug("relaying frame for peer", "type", relayed.Type, "from", from, "to", to)
+	if _, err := conn.WriteToUDP(protocol.Encode(relayed), to); err != nil {
+		slog.Error("relaying frame failed", "from", from, "to", to, "err", err)
+	}
+}
+
+// Answers a frame, back through the peer that relayed it if it was relayed
+func Reply(conn Conn, addr *net.UDPAddr, request, response protocol.Frame) {
+	data := protocol.Encode(response)
+	if request.From != "" {
+		data = protocol.Encode(protocol.Frame{Type: protocol.Relay, To: request.From, Frame: &response})
+	}
+	if _, err := conn.WriteToUDP(data, addr); err != nil {
+		slog.Error("replying to frame failed", "type", request.Type, "peer", addr, "err", err)
+	}
+}
+
+// The first IPv4 address of the named network interface, or its first IPv6
+// address if it has no IPv4 one
+func InterfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		if fallback == nil {
+			fallback = ipNet.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("no usable address")
+	}
+	return fallback, nil
+}
@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// A socket that can be swapped for a fresh one, e.g. when the old one stopped
+// working while the machine was asleep, without anyone reading or writing it
+// noticing
+type Rebindable struct {
+	mu     sync.RWMutex
+	conn   *net.UDPConn
+	closed bool
+}
+
+func NewRebindable(conn *net.UDPConn) *Rebindable {
+	return &Rebindable{conn: conn}
+}
+
+func (r *Rebindable) current() *net.UDPConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.conn
+}
+
+// Reads from whichever socket is current, carrying on with the new one when
+// a rebind closes the one being read
+func (r *Rebindable) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		conn := r.current()
+		n, addr, err := conn.ReadFromUDP(b)
+		if errors.Is(err, net.ErrClosed) && r.replaced(conn) {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// Whether conn was closed by a rebind rather than by Close
+func (r *Rebindable) replaced(conn *net.UDPConn) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.closed && r.conn != conn
+}
+
+func (r *Rebindable) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return r.current().WriteToUDP(b, addr)
+}
+
+func (r *Rebindable) SetReadDeadline(t time.Time) error {
+	return r.current().SetReadDeadline(t)
+}
+
+func (r *Rebindable) LocalAddr() net.Addr {
+	return r.current().LocalAddr()
+}
+
+func (r *Rebindable) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.conn.Close()
+}
+
+// Closes the socket and binds a new one to the same address, or to any port
+// on the same IP if that's gone, in which case peers find us again once we
+// prove who we are. tune, if given, sets up the new socket.
+func (r *Rebindable) Rebind(tune func(conn *net.UDPConn) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return net.ErrClosed
+	}
+
+	// the old socket is holding the port, so it has to go first
+	old := r.conn.LocalAddr().(*net.UDPAddr)
+	r.conn.Close()
+	conn, err := net.ListenUDP("udp", old)
+	if err != nil {
+		slog.Warn("rebinding to the same port failed, trying any", "addr", old, "err", err)
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: old.IP, Zone: old.Zone})
+	}
+	if err != nil {
+		return err
+	}
+	if tune != nil {
+		if err := tune(conn); err != nil {
+			slog.Warn("setting up the new socket failed", "err", err)
+		}
+	}
+	r.conn = conn
+	slog.Info("rebound socket", "old", old, "new", conn.LocalAddr())
+	return nil
+}
@@ -0,0 +1,558 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p/internal/protocol"
+)
+
+// How long a peer can go quiet before we stop sending to it directly and
+// relay through another peer instead
+var ReachableTimeout = 3 * PunchInterval
+
+// The peers in the conversation. It is shared with the listener goroutine,
+// which only accepts messages from peers on the roster.
+type Roster struct {
+	mu     sync.RWMutex
+	peers  []*rosterEntry
+	server *net.UDPAddr // The discovery server, to relay through when no peer can
+}
+
+type rosterEntry struct {
+	addr      *net.UDPAddr
+	stop      chan struct{}     // Stops punching holes towards this peer
+	hurry     chan struct{}     // Makes the puncher send a keepalive now and stop backing off
+	lastSeen  atomic.Int64      // When we last received anything from this peer, in Unix nanoseconds
+	state     atomic.Int32      // The peer's State when we last checked
+	key       ed25519.PublicKey // The peer's identity once it proved it, nil until then
+	invited   ed25519.PublicKey // The identity the invite we added the peer with says it has, nil if there was none
+	challenge string            // The last challenge the peer sent us, which our goodbye answers
+	version   int               // The protocol version we agreed on, 0 until the peer said which it speaks
+	refused   bool              // The peer speaks no protocol version we do
+	caps      int               // What the peer said it can do, 0 until it did
+	compact   atomic.Bool       // The peer takes compact keepalives, which the puncher checks without the lock
+	interval  atomic.Int64      // How often the peer said it sends keepalives, 0 until it did
+	mailbox   []byte            // The key to seal messages to the peer with while it's offline, nil until it sent one signed with its identity
+}
+
+func (e *rosterEntry) seenWithin(d time.Duration) bool {
+	return time.Since(time.Unix(0, e.lastSeen.Load())) <= d
+}
+
+// How long the peer can be quiet before it's degraded, which is longer when
+// it sends keepalives less often than we do
+func (e *rosterEntry) degradedAfter() time.Duration {
+	return max(DegradedTimeout, 2*time.Duration(e.interval.Load()))
+}
+
+// How long the peer can be quiet before it's lost, like degradedAfter
+func (e *rosterEntry) lostAfter() time.Duration {
+	return max(ReachableTimeout, 3*time.Duration(e.interval.Load()))
+}
+
+// Adds a peer to the conversation and starts punching holes towards it
+func (r *Roster) Add(conn Conn, addr *net.UDPAddr, done chan struct{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return false
+		}
+	}
+	peer := &rosterEntry{addr: addr, stop: make(chan struct{}), hurry: make(chan struct{}, 1)}
+	r.peers = append(r.peers, peer)
+	go punchHoles(conn, peer, addr, done, peer.stop)
+	return true
+}
+
+// Removes a peer from the conversation and stops punching holes towards it
+func (r *Roster) Remove(addr *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			close(peer.stop)
+			r.peers = append(r.peers[:i], r.peers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Removes every peer from the conversation and stops punching holes towards them
+func (r *Roster) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		close(peer.stop)
+	}
+	r.peers = nil
+}
+
+// Sends every peer a keepalive straight away, backing off again from
+// PunchInterval however long they were quiet for
+func (r *Roster) Hurry() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		select {
+		case peer.hurry <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// A snapshot of every peer's address
+func (r *Roster) Addrs() []*net.UDPAddr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	addrs := make([]*net.UDPAddr, len(r.peers))
+	for i, peer := range r.peers {
+		addrs[i] = peer.addr
+	}
+	return addrs
+}
+
+func (r *Roster) Has(addr *net.UDPAddr) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Records that a peer got through to us, which makes it connected, reporting
+// the state it was in before and whether that changed. It's called for every
+// datagram, so it only takes the read lock.
+func (r *Roster) Seen(addr *net.UDPAddr) (State, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			if !peer.seenWithin(peer.lostAfter()) {
+				// stop backing off
+				select {
+				case peer.hurry <- struct{}{}:
+				default:
+				}
+			}
+			peer.lastSeen.Store(time.Now().UnixNano())
+			previous := State(peer.state.Swap(int32(Connected)))
+			return previous, previous != Connected
+		}
+	}
+	return Connected, false
+}
+
+// Moves peers we heard from on to degraded or lost as they go quiet,
+// returning the ones whose state changed
+func (r *Roster) Expire() []StateChange {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var changes []StateChange
+	for _, peer := range r.peers {
+		previous := State(peer.state.Load())
+		if previous == Connecting || previous == Lost {
+			continue
+		}
+		// unless Seen just made it connected again
+		if state := peer.currentState(); state != previous && peer.state.CompareAndSwap(int32(previous), int32(state)) {
+			changes = append(changes, StateChange{Addr: peer.addr, State: state})
+		}
+	}
+	return changes
+}
+
+// How well we're in touch with a peer
+func (r *Roster) State(addr *net.UDPAddr) State {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return State(peer.state.Load())
+		}
+	}
+	return Lost
+}
+
+// When we last heard from a peer, zero if we never have
+func (r *Roster) LastSeen(addr *net.UDPAddr) time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			if seen := peer.lastSeen.Load(); seen != 0 {
+				return time.Unix(0, seen)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// The identity a peer proved it has, nil until it did
+func (r *Roster) Key(addr *net.UDPAddr) ed25519.PublicKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return peer.key
+		}
+	}
+	return nil
+}
+
+// Records the identity a peer proved it has, unless we were invited by a peer
+// with another, reporting whether it did
+func (r *Roster) SetKey(addr *net.UDPAddr, key ed25519.PublicKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			if peer.invited != nil && !peer.invited.Equal(key) {
+				return false
+			}
+			peer.key = key
+			return true
+		}
+	}
+	return false
+}
+
+// Records the identity the invite we added a peer with says it has, which
+// only that identity can then prove, forgetting another it already proved
+func (r *Roster) SetInvited(addr *net.UDPAddr, key ed25519.PublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			peer.invited = key
+			if !key.Equal(peer.key) {
+				peer.key = nil
+			}
+		}
+	}
+}
+
+// The identity the invite we added a peer with says it has, nil if there
+// was none
+func (r *Roster) Invited(addr *net.UDPAddr) ed25519.PublicKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return peer.invited
+		}
+	}
+	return nil
+}
+
+// Remembers a peer's mailbox key, once it checks out against the identity
+// the peer proved
+func (r *Roster) SetMailbox(addr *net.UDPAddr, key []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			peer.mailbox = key
+		}
+	}
+}
+
+// A peer's identity and mailbox key, nil until it proved the one and sent us
+// the other
+func (r *Roster) Mailbox(addr *net.UDPAddr) (ed25519.PublicKey, []byte) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) && peer.key != nil {
+			return peer.key, peer.mailbox
+		}
+	}
+	return nil, nil
+}
+
+// The peer that proved it has an identity, if any
+func (r *Roster) WithKey(key ed25519.PublicKey) *net.UDPAddr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if peer.key != nil && bytes.Equal(peer.key, key) {
+			return peer.addr
+		}
+	}
+	return nil
+}
+
+// Remembers the challenge a peer last sent us, reporting whether it
+// replaces a different one. A peer's challenges to us only change when it
+// restarts, as they're signed with a secret it makes on starting.
+func (r *Roster) SetChallenge(addr *net.UDPAddr, challenge string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			changed = peer.challenge != "" && peer.challenge != challenge
+			peer.challenge = challenge
+		}
+	}
+	return changed
+}
+
+// The challenge each peer last sent us, by address, for peers that sent one
+func (r *Roster) Challenges() map[*net.UDPAddr]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	challenges := map[*net.UDPAddr]string{}
+	for _, peer := range r.peers {
+		if peer.challenge != "" {
+			challenges[peer.addr] = peer.challenge
+		}
+	}
+	return challenges
+}
+
+// Whether a peer proved it has the given identity
+func (r *Roster) HasKey(addr *net.UDPAddr, key ed25519.PublicKey) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return peer.key != nil && bytes.Equal(peer.key, key)
+		}
+	}
+	return false
+}
+
+// Records the protocol versions a peer said it speaks, reporting whether
+// that just made it a peer we can't talk to
+func (r *Roster) SetVersion(addr *net.UDPAddr, version, minVersion int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agreed, ok := protocol.Negotiate(version, minVersion)
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			refused := !ok && !peer.refused
+			peer.version, peer.refused = agreed, !ok
+			peer.compact.Store(ok && agreed >= compactKeepaliveVersion)
+			return refused
+		}
+	}
+	return false
+}
+
+// The protocol version to talk to a peer in, which is ours until it says
+// it's older
+func (r *Roster) Version(addr *net.UDPAddr) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) && peer.version != 0 {
+			return peer.version
+		}
+	}
+	return protocol.Version
+}
+
+// Whether a peer speaks no protocol version we do, so nothing but its
+// handshake can be made sense of
+func (r *Roster) Refused(addr *net.UDPAddr) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return peer.refused
+		}
+	}
+	return false
+}
+
+// The protocol version we agreed on with a peer and what it said it can do,
+// zero for what it hasn't told us yet
+func (r *Roster) Handshake(addr *net.UDPAddr) (version, caps int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return peer.version, peer.caps
+		}
+	}
+	return 0, 0
+}
+
+// Records what a peer said it can do
+func (r *Roster) SetCaps(addr *net.UDPAddr, caps int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			peer.caps = caps
+		}
+	}
+}
+
+// Records how often a peer said it sends keepalives, which it may do less
+// often than we do, so it isn't taken for gone in between. It's capped at
+// the longest interval we'd use ourselves.
+func (r *Roster) SetInterval(addr *net.UDPAddr, interval time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			peer.interval.Store(int64(min(interval, MaxPunchIntervalSetting)))
+		}
+	}
+}
+
+// Whether a peer can do something, from protocol's Can constants. Peers that
+// haven't said what they can do are assumed to be able to.
+func (r *Roster) Can(addr *net.UDPAddr, capability int) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return peer.caps == 0 || peer.caps&capability != 0
+		}
+	}
+	return false
+}
+
+// Records that a peer said goodbye, which makes it lost until we hear from
+// it again, reporting whether it had been reachable
+func (r *Roster) Left(addr *net.UDPAddr) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			peer.lastSeen.Store(0)
+			return State(peer.state.Swap(int32(Lost))).Reachable()
+		}
+	}
+	return false
+}
+
+// Whether any peer whose identity we know has gone quiet, for
+// DegradedTimeout, which is when a stranger may be that peer on a new port
+func (r *Roster) Quiet() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if peer.key != nil && !peer.seenWithin(peer.degradedAfter()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves the quiet peer with the given identity to a new address, punching
+// holes towards that instead, and returns its old address. It returns nil if
+// no such peer has gone quiet.
+func (r *Roster) Move(conn Conn, key ed25519.PublicKey, addr *net.UDPAddr, done <-chan struct{}) *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return nil
+		}
+	}
+	for _, peer := range r.peers {
+		if !bytes.Equal(peer.key, key) || peer.seenWithin(peer.degradedAfter()) {
+			continue
+		}
+		old := peer.addr
+		close(peer.stop)
+		peer.addr = addr
+		peer.stop = make(chan struct{})
+		peer.lastSeen.Store(time.Now().UnixNano())
+		peer.state.Store(int32(Connected))
+		go punchHoles(conn, peer, addr, done, peer.stop)
+		return old
+	}
+	return nil
+}
+
+// Relays through the discovery server when no peer can, which only servers
+// that relay do and only between members of the same room, or stops if addr
+// is nil
+func (r *Roster) SetServerRelay(addr *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.server = addr
+}
+
+// Picks a peer to relay through when we haven't heard from the given peer
+// lately, or else the discovery server if we're relaying through it. It
+// returns nil when the peer can be reached directly, or when nobody else can
+// relay either, in which case we keep trying directly.
+func (r *Roster) RelayFor(addr *net.UDPAddr) *net.UDPAddr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) && peer.seenWithin(peer.lostAfter()) {
+			return nil
+		}
+	}
+	for _, peer := range r.peers {
+		if !SameAddr(peer.addr, addr) && peer.seenWithin(peer.lostAfter()) {
+			return peer.addr
+		}
+	}
+	return r.server
+}
+
+// Whether a peer got through to us directly lately, so nothing it sends us
+// needs relaying
+func (r *Roster) Reachable(addr *net.UDPAddr) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if SameAddr(peer.addr, addr) {
+			return peer.seenWithin(peer.lostAfter())
+		}
+	}
+	return false
+}
+
+func SameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func TestSetKeyInvited(t *testing.T) {
+	invited, _, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+
+	tests := []struct {
+		name    string
+		invite  ed25519.PublicKey // What the invite said, nil when there wasn't one
+		proven  ed25519.PublicKey // What the peer proves
+		early   bool              // It proved it before we knew the invite's
+		want    ed25519.PublicKey // The key we end up believing it has
+		wantSet bool
+	}{
+		{"no invite", nil, other, false, other, true},
+		{"the invite's", invited, invited, false, invited, true},
+		{"another", invited, other, false, nil, false},
+		{"the invite's, proven before we knew it", invited, invited, true, invited, true},
+		{"another, proven before we knew the invite's", invited, other, true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := &Roster{peers: []*rosterEntry{{addr: addr}}}
+			var set bool
+			if tt.early {
+				set = peers.SetKey(addr, tt.proven)
+			}
+			if tt.invite != nil {
+				peers.SetInvited(addr, tt.invite)
+			}
+			if !tt.early {
+				set = peers.SetKey(addr, tt.proven)
+			}
+			if set != tt.wantSet {
+				t.Errorf("SetKey() = %t, want %t", set, tt.wantSet)
+			}
+			if got := peers.Key(addr); !got.Equal(tt.want) {
+				t.Errorf("Key() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
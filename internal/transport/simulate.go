@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// A socket that drops, delays and reorders datagrams on purpose, for trying
+// out a bad network locally with -simulate-loss, -simulate-latency and
+// -simulate-reorder
+type Simulated struct {
+	Conn
+	Loss    float64       // Fraction of datagrams dropped, in either direction
+	Latency time.Duration // Delay added to every datagram we send
+	Reorder float64       // Fraction of sent datagrams held back so later ones overtake them
+}
+
+func (c Simulated) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := c.Conn.ReadFromUDP(b)
+		if err != nil || rand.Float64() >= c.Loss {
+			return n, addr, err
+		}
+		slog.Debug("simulated loss", "dir", "in", "addr", addr, "size", n)
+	}
+}
+
+func (c Simulated) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if rand.Float64() < c.Loss {
+		slog.Debug("simulated loss", "dir", "out", "addr", addr, "size", len(b))
+		return len(b), nil
+	}
+
+	delay := c.Latency
+	if rand.Float64() < c.Reorder {
+		// hold it back long enough for a few later datagrams to overtake it
+		delay += time.Duration(rand.Int64N(int64(50*time.Millisecond))) + max(c.Latency, 20*time.Millisecond)
+	}
+	if delay == 0 {
+		return c.Conn.WriteToUDP(b, addr)
+	}
+
+	// the caller may reuse b once we return
+	data := getBuffer()
+	n := copy(*data, b)
+	time.AfterFunc(delay, func() {
+		defer putBuffer(data)
+		if _, err := c.Conn.WriteToUDP((*data)[:n], addr); err != nil {
+			slog.Warn("delayed write failed", "addr", addr, "err", err)
+		}
+	})
+	return len(b), nil
+}
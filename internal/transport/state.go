@@ -0,0 +1,57 @@
+package transport
+
+import "net"
+
+// How well we're in touch with a peer, going by when we last heard from it.
+// A peer starts out connecting, is connected once we hear from it, degraded
+// once it misses a couple of keepalives and lost once it's been quiet for
+// ReachableTimeout or said goodbye, and is connected again as soon as
+// anything gets through.
+type State int32
+
+const (
+	Connecting State = iota // Punching holes, without having heard from the peer yet
+	Connected               // Heard from within DegradedTimeout
+	Degraded                // Quiet for DegradedTimeout, but not ReachableTimeout yet
+	Lost                    // Quiet for ReachableTimeout, or said goodbye
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Degraded:
+		return "degraded"
+	case Lost:
+		return "lost"
+	}
+	return "unknown"
+}
+
+// Whether we can still count on reaching the peer directly
+func (s State) Reachable() bool {
+	return s == Connected || s == Degraded
+}
+
+// How long a peer can go quiet before its connection counts as degraded
+var DegradedTimeout = 2 * PunchInterval
+
+// A peer's state changing, as Expire reports it
+type StateChange struct {
+	Addr  *net.UDPAddr
+	State State
+}
+
+// The state a peer last heard from at lastSeen is in now, unless it's still
+// connecting
+func (e *rosterEntry) currentState() State {
+	switch {
+	case !e.seenWithin(e.lostAfter()):
+		return Lost
+	case !e.seenWithin(e.degradedAfter()):
+		return Degraded
+	}
+	return Connected
+}
@@ -0,0 +1,61 @@
+package transport
+
+import "time"
+
+// What the timestamps in a peer's replies and acks tell us about the path to
+// it and its clock: the round trip, how much the delay varies and how far its
+// clock is off ours
+type Timing struct {
+	RTT     time.Duration // Smoothed round trip time
+	Jitter  time.Duration // Smoothed variation in one-way delay, as RTP estimates it
+	Offset  time.Duration // How far the peer's clock is ahead of ours
+	synced  bool          // Offset has been estimated, which needs peers that say when they got our frames
+	minRTT  time.Duration
+	transit time.Duration // The last sample's one-way delay plus the offset
+}
+
+// Takes a sample from the answer to a frame we sent at sent, which the peer
+// got at received by its clock, or zero when it's too old to say, and which
+// came back at arrived
+func (t *Timing) Add(sent, received, arrived time.Time) {
+	rtt := arrived.Sub(sent)
+	if rtt < 0 {
+		return
+	}
+	if t.RTT == 0 {
+		t.RTT = rtt
+	} else {
+		t.RTT += (rtt - t.RTT) / 8
+	}
+	if received.IsZero() {
+		return
+	}
+
+	transit := received.Sub(sent)
+	if t.synced {
+		t.Jitter += ((transit - t.transit).Abs() - t.Jitter) / 16
+	}
+	t.transit = transit
+
+	// taking the way there to be half the round trip, which holds best for
+	// the quickest ones as they spent least time queued on either leg
+	offset := transit - rtt/2
+	if t.minRTT == 0 || rtt < t.minRTT {
+		t.minRTT = rtt
+	}
+	switch {
+	case !t.synced:
+		t.Offset, t.synced = offset, true
+	case rtt <= 2*t.minRTT:
+		t.Offset += (offset - t.Offset) / 8
+	}
+}
+
+// When something the peer stamped at sent by its clock happened by ours,
+// if we know the offset
+func (t *Timing) Local(sent time.Time) (time.Time, bool) {
+	if t == nil || !t.synced {
+		return time.Time{}, false
+	}
+	return sent.Add(-t.Offset), true
+}
@@ -0,0 +1,317 @@
+package ui
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/media"
+	"p2p/internal/protocol"
+)
+
+// What our calls carry, as offers name it
+const callMedia = "audio"
+
+// Where our call stands
+const (
+	calling = "calling" // We rang the peer and are waiting for it to pick up
+	ringing = "ringing" // The peer rang us
+	inCall  = "in call"
+)
+
+// A peer offering, answering, turning down or hanging up a call
+type CallSignal struct {
+	peer  string // ip:port
+	id    string
+	kind  string // protocol.Offer, Answer, Busy or Hangup
+	media string // What an offer is for
+}
+
+// The one call we can be in at a time
+type call struct {
+	id      string
+	peer    *net.UDPAddr
+	state   string
+	started time.Time // When the peer picked up
+	audio   *media.Call
+	stats   media.Stats // How the call sounded over the last callStatsInterval
+}
+
+// How often the call quality in the status bar is updated
+const callStatsInterval = time.Second
+
+// Sent every callStatsInterval during a call
+type callStatsTick struct{}
+
+// A command that wakes us up to update the call quality
+func callStatsAfter() tea.Cmd {
+	return tea.Tick(callStatsInterval, func(time.Time) tea.Msg {
+		return callStatsTick{}
+	})
+}
+
+// Takes the call quality for the status bar, for as long as the call lasts
+func (m *Model) updateCallStats() tea.Cmd {
+	if m.call == nil || m.call.audio == nil {
+		return nil
+	}
+	m.call.stats = m.call.audio.Stats()
+	return callStatsAfter()
+}
+
+// The call whose audio the listener hands on, shared with it
+type liveCall struct {
+	id    string
+	peer  string // ip:port
+	audio *media.Call
+}
+
+// Call signaling we sent that hasn't been acknowledged yet
+type pendingSignal struct {
+	to    *net.UDPAddr
+	frame protocol.Frame
+}
+
+// Sent to resend call signaling that wasn't acknowledged
+type signalTick struct {
+	key     string
+	attempt int // How many times it was resent so far
+}
+
+// Sent once an offer has rung for protocol.RingTimeout
+type ringTimeout struct {
+	id string
+}
+
+// A command that waits for call signaling on a channel.
+func waitForCalls(sub <-chan CallSignal) tea.Cmd {
+	return func() tea.Msg {
+		return <-sub
+	}
+}
+
+// Identifies call signaling in acks, which carry the type and the call's ID
+func signalKey(kind, id string) string {
+	return kind + " " + id
+}
+
+// A command that wakes us up to check on call signaling's ack
+func signalAfter(key string, attempt int) tea.Cmd {
+	return tea.Tick(retryInterval<<attempt, func(time.Time) tea.Msg {
+		return signalTick{key: key, attempt: attempt}
+	})
+}
+
+// A command that gives up on an offer that rang for too long
+func ringAfter(id string) tea.Cmd {
+	return tea.Tick(protocol.RingTimeout, func(time.Time) tea.Msg {
+		return ringTimeout{id: id}
+	})
+}
+
+// Sends call signaling to a peer, resending it until it's acknowledged
+func (m *Model) signal(to *net.UDPAddr, kind, id string) tea.Cmd {
+	f := protocol.Frame{Type: kind, ID: id}
+	if kind == protocol.Offer {
+		f.Text = callMedia
+	}
+	key := signalKey(kind, id)
+	m.signals[key] = &pendingSignal{to: to, frame: f}
+	return tea.Batch(sendMessage(m.conn, m.peers, []*net.UDPAddr{to}, f), signalAfter(key, 0))
+}
+
+// Resends call signaling that still wasn't acknowledged, until we run out of
+// retries
+func (m *Model) resendSignal(tick signalTick) tea.Cmd {
+	pending, ok := m.signals[tick.key]
+	if !ok {
+		return nil
+	}
+	if tick.attempt < messageRetries {
+		return tea.Batch(sendMessage(m.conn, m.peers, []*net.UDPAddr{pending.to}, pending.frame), signalAfter(tick.key, tick.attempt+1))
+	}
+
+	slog.Warn("call signaling not acknowledged", "type", pending.frame.Type, "peer", pending.to)
+	delete(m.signals, tick.key)
+	if m.call != nil && m.call.id == pending.frame.ID && pending.frame.Type != protocol.Hangup {
+		m.endCall()
+		m.Notify("Lost touch with %s, the call is over", pending.to)
+	}
+	return nil
+}
+
+// Rings a peer
+func (m *Model) ring(addr *net.UDPAddr) tea.Cmd {
+	if m.call != nil {
+		m.Notify("You're already %s %s, /hangup first", m.call.state, m.call.peer)
+		return nil
+	}
+	if !m.peers.Can(addr, protocol.CanCall) {
+		m.Notify("%s can't take calls, its p2p has no audio tools or is too old", addr)
+		return nil
+	}
+	m.call = &call{id: protocol.NewMessageID(), peer: addr, state: calling}
+	m.Notify("Calling %s, /hangup to give up", addr)
+	return tea.Batch(m.signal(addr, protocol.Offer, m.call.id), ringAfter(m.call.id))
+}
+
+// Picks up the peer that's ringing us
+func (m *Model) accept() tea.Cmd {
+	if m.call == nil || m.call.state != ringing {
+		m.Notify("No one is calling")
+		return nil
+	}
+	if err := m.startAudio(); err != nil {
+		m.Notify("Failed to start the call: %v", err)
+		return m.hangUp()
+	}
+	m.Notify("In a call with %s, /hangup to end it", m.call.peer)
+	return tea.Batch(m.signal(m.call.peer, protocol.Answer, m.call.id), callStatsAfter())
+}
+
+// Ends, declines or gives up on the call we're in
+func (m *Model) hangUp() tea.Cmd {
+	if m.call == nil {
+		m.Notify("You're not in a call")
+		return nil
+	}
+	c := m.call
+	m.endCall()
+	m.Notify("Hung up on %s", c.peer)
+	return m.signal(c.peer, protocol.Hangup, c.id)
+}
+
+// Handles a peer offering, answering, turning down or hanging up a call
+func (m *Model) callSignal(signal CallSignal) tea.Cmd {
+	addr, err := net.ResolveUDPAddr("udp", signal.peer)
+	if err != nil || !m.peers.Has(addr) {
+		return nil
+	}
+	ours := m.call != nil && m.call.id == signal.id && m.call.peer.String() == signal.peer
+
+	switch signal.kind {
+	case protocol.Offer:
+		if signal.media != callMedia {
+			slog.Info("declining call for unknown media", "peer", signal.peer, "media", signal.media)
+			return m.signal(addr, protocol.Hangup, signal.id)
+		}
+		if m.call != nil {
+			m.Notify("%s called while you were busy", signal.peer)
+			return m.signal(addr, protocol.Busy, signal.id)
+		}
+		m.call = &call{id: signal.id, peer: addr, state: ringing}
+		m.Notify("%s is calling, /accept to pick up or /hangup to decline", signal.peer)
+		return ringAfter(signal.id)
+	case protocol.Answer:
+		if !ours || m.call.state != calling {
+			return nil
+		}
+		if err := m.startAudio(); err != nil {
+			m.Notify("Failed to start the call: %v", err)
+			return m.hangUp()
+		}
+		m.Notify("%s picked up, /hangup to end the call", signal.peer)
+		return callStatsAfter()
+	case protocol.Busy:
+		if ours && m.call.state == calling {
+			m.endCall()
+			m.Notify("%s is busy in another call", signal.peer)
+		}
+	case protocol.Hangup:
+		if !ours {
+			return nil
+		}
+		state := m.call.state
+		m.endCall()
+		switch state {
+		case calling:
+			m.Notify("%s declined the call", signal.peer)
+		case ringing:
+			m.Notify("Missed a call from %s", signal.peer)
+		default:
+			m.Notify("%s hung up", signal.peer)
+		}
+	}
+	return nil
+}
+
+// Gives up on an offer nobody picked up
+func (m *Model) ringTimedOut(id string) tea.Cmd {
+	if m.call == nil || m.call.id != id {
+		return nil
+	}
+	c := m.call
+	switch c.state {
+	case calling:
+		m.endCall()
+		m.Notify("%s didn't pick up", c.peer)
+		return m.signal(c.peer, protocol.Hangup, c.id)
+	case ringing:
+		m.endCall()
+		m.Notify("Missed a call from %s", c.peer)
+	}
+	return nil
+}
+
+// Starts sending our audio to the peer we're calling and playing theirs
+func (m *Model) startAudio() error {
+	c := m.call
+	conn := m.conn
+	audio, err := media.Start(func(seq int64, payload []byte) {
+		frame := protocol.Encode(protocol.Frame{Type: protocol.Audio, ID: c.id, Seq: seq, Data: payload})
+		if _, err := conn.WriteToUDP(frame, c.peer); err != nil {
+			slog.Debug("sending audio failed", "peer", c.peer, "err", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("call started", "peer", c.peer, "id", c.id)
+	c.audio = audio
+	c.state = inCall
+	c.started = time.Now()
+	m.live.Store(&liveCall{id: c.id, peer: c.peer.String(), audio: audio})
+	return nil
+}
+
+// Forgets the call, stopping its audio if it had started
+func (m *Model) endCall() {
+	if m.call == nil {
+		return
+	}
+	m.live.Store(nil)
+	if m.call.audio != nil {
+		m.call.audio.Stop()
+		slog.Info("call ended", "peer", m.call.peer, "after", time.Since(m.call.started).Round(time.Second))
+	}
+	m.call = nil
+}
+
+// Hangs up as we quit, sending the hangup once as there's no waiting for its ack
+func (m *Model) hangUpQuitting() tea.Cmd {
+	if m.call == nil {
+		return nil
+	}
+	c := m.call
+	m.endCall()
+	return sendMessage(m.conn, m.peers, []*net.UDPAddr{c.peer}, protocol.Frame{Type: protocol.Hangup, ID: c.id})
+}
+
+// Where our call stands, for the status bar
+func (m *Model) callStatus() string {
+	if m.call == nil {
+		return ""
+	}
+	status := m.call.state
+	if m.call.state == inCall {
+		elapsed := time.Since(m.call.started)
+		stats := m.call.stats
+		status = fmt.Sprintf("%02d:%02d  loss %.0f%%  jitter %dms  %dkbps",
+			int(elapsed.Minutes()), int(elapsed.Seconds())%60,
+			100*stats.Loss, stats.Jitter.Milliseconds(), stats.Bitrate/1000)
+	}
+	return fmt.Sprintf("  %s %s %s", bubblePinkAccentStyle.Render("call"), m.call.peer, status)
+}
@@ -0,0 +1,139 @@
+package ui
+
+import (
+	"net"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+
+	"p2p/internal/media"
+	"p2p/internal/protocol"
+)
+
+// What we tell peers we can do. Calls and voice notes need audio tools.
+func capabilities() int {
+	caps := protocol.CanMessage | protocol.CanFile | protocol.CanScreen | protocol.CanFEC
+	if media.CanPlay() {
+		caps |= protocol.CanVoice
+		if media.CanRecord() {
+			caps |= protocol.CanCall
+		}
+	}
+	return caps
+}
+
+// What each capability lets a peer do, for telling someone what changed
+var capabilityNames = []struct {
+	capability int
+	what       string
+}{
+	{protocol.CanFile, "receive files"},
+	{protocol.CanVoice, "play voice notes"},
+	{protocol.CanCall, "take calls"},
+	{protocol.CanScreen, "show a shared screen"},
+	{protocol.CanFEC, "repair lost messages from parity frames"},
+}
+
+// Says what a peer that restarted as another build can do now that it
+// couldn't before, and the other way round
+func (m *Model) renegotiated(msg Presence) {
+	// peers that never said what they can do can do everything
+	if msg.oldCaps == 0 {
+		msg.oldCaps = ^0
+	}
+	if msg.caps == 0 {
+		msg.caps = ^0
+	}
+	var gained, lost []string
+	for _, name := range capabilityNames {
+		switch {
+		case msg.caps&name.capability != 0 && msg.oldCaps&name.capability == 0:
+			gained = append(gained, name.what)
+		case msg.caps&name.capability == 0 && msg.oldCaps&name.capability != 0:
+			lost = append(lost, name.what)
+		}
+	}
+	switch {
+	case len(gained) > 0 && len(lost) > 0:
+		m.Notify("%s restarted and can now %s, but can no longer %s", msg.peer, strings.Join(gained, ", "), strings.Join(lost, ", "))
+	case len(gained) > 0:
+		m.Notify("%s restarted and can now %s", msg.peer, strings.Join(gained, ", "))
+	case len(lost) > 0:
+		m.Notify("%s restarted and can no longer %s", msg.peer, strings.Join(lost, ", "))
+	default:
+		m.Notify("%s restarted with another version of p2p", msg.peer)
+	}
+}
+
+// What a peer has to be able to do to take a message of ours
+func needs(message Message) (int, string) {
+	switch {
+	case message.file != "":
+		return protocol.CanFile, "receive files"
+	case message.voice != nil:
+		return protocol.CanVoice, "play voice notes"
+	}
+	return protocol.CanMessage, "receive messages"
+}
+
+// The recipients that can do something, with a SYSTEM line naming the ones
+// left out
+func (m *Model) capable(recipients []*net.UDPAddr, capability int, what string) []*net.UDPAddr {
+	var able []*net.UDPAddr
+	var unable []string
+	for _, recipient := range recipients {
+		if m.peers.Can(recipient, capability) {
+			able = append(able, recipient)
+		} else {
+			unable = append(unable, recipient.String())
+		}
+	}
+	if len(unable) > 0 {
+		m.Notify("%s can't %s, leaving them out", strings.Join(unable, ", "), what)
+	}
+	return able
+}
+
+// Commands that need peers to be able to do something, and what
+var commandNeeds = map[string]struct {
+	capability int
+	what       string
+}{
+	"/send":         {protocol.CanFile, "receive files"},
+	"/sendclip":     {protocol.CanFile, "receive files"},
+	"/call":         {protocol.CanCall, "take calls"},
+	"/share-screen": {protocol.CanScreen, "show a shared screen"},
+}
+
+// Which peers can't use the command being typed, shown under the input,
+// which is greyed out when nobody can. Only Update calls it, as it styles
+// the input.
+func (m *Model) commandHint() string {
+	m.textInput.TextStyle = lipgloss.NewStyle()
+	command, arg, _ := strings.Cut(m.textInput.Value(), " ")
+	need, ok := commandNeeds[command]
+	if !ok {
+		return ""
+	}
+	peers := m.peers.Addrs()
+	if addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(arg)); err == nil && m.peers.Has(addr) {
+		peers = []*net.UDPAddr{addr}
+	}
+	var unable []string
+	for _, peer := range peers {
+		if !m.peers.Can(peer, need.capability) {
+			unable = append(unable, peer.String())
+		}
+	}
+	switch {
+	case len(unable) == 0:
+		return ""
+	case len(unable) == len(peers):
+		m.textInput.TextStyle = directStyle
+		if len(peers) == 1 {
+			return directStyle.Render(unable[0] + " can't " + need.what)
+		}
+		return directStyle.Render("No one here can " + need.what)
+	}
+	return directStyle.Render(strings.Join(unable, ", ") + " can't " + need.what)
+}
@@ -0,0 +1,198 @@
+package ui
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atotto/clipboard"
+	"github.com/aymanbagabas/go-osc52/v2"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/charmbracelet/x/term"
+)
+
+// How copied text got to the clipboard
+const (
+	copiedToClipboard = "clipboard" // The system's clipboard, through xclip, pbcopy and the like
+	copiedWithOSC52   = "OSC 52"    // Asking the terminal, which works over SSH too
+)
+
+// Copies text to the clipboard and says how. Over SSH, without a display or
+// without any clipboard tools there's no system clipboard to write to, so
+// then we ask the terminal to copy it with an OSC 52 escape sequence instead,
+// wrapped so tmux and screen pass it on.
+func copyText(text string) string {
+	err := writeClipboard(text)
+	if err == nil {
+		return copiedToClipboard
+	}
+	slog.Debug("system clipboard unavailable, copying with OSC 52", "err", err)
+
+	seq := osc52.New(text)
+	switch multiplexer() {
+	case inTmux:
+		seq = seq.Tmux()
+	case inScreen:
+		seq = seq.Screen()
+	}
+	if _, err := seq.WriteTo(terminal()); err != nil {
+		slog.Warn("copying with OSC 52 failed", "err", err)
+	}
+	return copiedWithOSC52
+}
+
+// On Wayland we talk to wl-clipboard ourselves, as atotto/clipboard only
+// does when both wl-copy and wl-paste are installed and otherwise goes
+// looking for X11 tools, which a Wayland desktop may not have a server for.
+func onWayland(tool string) bool {
+	if os.Getenv("WAYLAND_DISPLAY") == "" {
+		return false
+	}
+	_, err := exec.LookPath(tool)
+	return err == nil
+}
+
+// Puts text on the system's clipboard
+func writeClipboard(text string) error {
+	if onWayland("wl-copy") {
+		cmd := exec.Command("wl-copy", "--type", "text/plain")
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return clipboard.WriteAll(text)
+}
+
+// The text on the system's clipboard
+func readClipboardText() (string, error) {
+	if onWayland("wl-paste") {
+		text, err := exec.Command("wl-paste", "--no-newline", "--type", "text/plain").Output()
+		return string(text), err
+	}
+	return clipboard.ReadAll()
+}
+
+// Where copyText put text, for notices
+func clipboardName(method string) string {
+	if method == copiedWithOSC52 {
+		return "clipboard via OSC 52"
+	}
+	return "clipboard"
+}
+
+// Where escape sequences reach the terminal without going through Bubble
+// Tea's renderer, which owns stdout
+func terminal() io.Writer {
+	if term.IsTerminal(os.Stderr.Fd()) {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Copies the whole conversation as it's shown, for pasting somewhere else
+func (m *Model) copyAll() {
+	text, count := m.transcriptText()
+	if count == 0 {
+		m.Notify("There's nothing to copy yet")
+		return
+	}
+	m.Notify("Copied %d messages to the %s", count, clipboardName(copyText(text)))
+}
+
+// The transcript as plain text, a message a line like
+// [2006-01-02 15:04] sender: text, with muted peers' messages left out as
+// they're collapsed on screen. Also returns how many messages it holds.
+func (m *Model) transcriptText() (string, int) {
+	var b strings.Builder
+	count := 0
+	for _, message := range m.messages {
+		if m.muted[message.peer] {
+			continue
+		}
+		count++
+		fmt.Fprintf(&b, "[%s] %s:%d", message.time.Format("2006-01-02 15:04"), ansi.Strip(message.ip), message.port)
+		if message.to != "" {
+			fmt.Fprintf(&b, " → %s", message.to)
+		} else if message.direct {
+			b.WriteString(" (direct)")
+		}
+		// continuation lines are indented so each message still starts a line
+		fmt.Fprintf(&b, ": %s\n", strings.ReplaceAll(message.text, "\n", "\n    "))
+	}
+	return b.String(), count
+}
+
+// What /sendclip found on the clipboard: an image, saved to a file to send
+// like any other, or else text
+type clipboardContents struct {
+	image string
+	text  string
+	err   error
+}
+
+// Commands that print an image on the clipboard as PNG, and fail when there
+// isn't one. atotto/clipboard only does text.
+var clipboardImageCommands = []struct {
+	env  string // Only worth trying with this set, if anything
+	args []string
+}{
+	{"WAYLAND_DISPLAY", []string{"wl-paste", "--no-newline", "--type", "image/png"}},
+	{"DISPLAY", []string{"xclip", "-selection", "clipboard", "-target", "image/png", "-out"}},
+	{"", []string{"pngpaste", "-"}},
+}
+
+// A command that reads the clipboard for /sendclip
+func readClipboard() tea.Cmd {
+	return func() tea.Msg {
+		if image := clipboardImage(); image != nil {
+			dir, err := os.UserCacheDir()
+			if err != nil {
+				dir = os.TempDir()
+			}
+			path := filepath.Join(dir, "p2p", "clipboard-"+time.Now().Format("20060102-150405")+".png")
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				return clipboardContents{err: err}
+			}
+			return clipboardContents{image: path, err: os.WriteFile(path, image, 0o600)}
+		}
+		text, err := readClipboardText()
+		return clipboardContents{text: text, err: err}
+	}
+}
+
+// The image on the clipboard as PNG, or nil when there isn't one
+func clipboardImage() []byte {
+	for _, command := range clipboardImageCommands {
+		if command.env != "" && os.Getenv(command.env) == "" {
+			continue
+		}
+		if _, err := exec.LookPath(command.args[0]); err != nil {
+			continue
+		}
+		image, err := exec.Command(command.args[0], command.args[1:]...).Output()
+		if err == nil && len(image) > 0 {
+			return image
+		}
+	}
+	return nil
+}
+
+// Sends whatever /sendclip found on the clipboard to everyone
+func (m *Model) sendClipboard(contents clipboardContents) tea.Cmd {
+	switch {
+	case contents.err != nil:
+		m.Notify("Failed to read the clipboard: %v", contents.err)
+		return nil
+	case contents.image != "":
+		return m.sendFile(contents.image)
+	case strings.TrimSpace(contents.text) == "":
+		m.Notify("There's nothing on the clipboard to send")
+		return nil
+	}
+	return m.send(contents.text, nil)
+}
@@ -0,0 +1,38 @@
+package ui
+
+import (
+	"hash/fnv"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+// Whether we render without any styling, for NO_COLOR and -no-color
+var noColor bool
+
+// Strips all styling from everything we render
+func DisableColor() {
+	noColor = true
+	lipgloss.SetColorProfile(termenv.Ascii)
+}
+
+// A button, which falls back to brackets when there's no styling to set it apart
+func button(label string) string {
+	if noColor {
+		return "[" + label + "]"
+	}
+	return buttonStyle.Render(label)
+}
+
+// Colors given out to peers, chosen to stay readable on dark terminals and to
+// not clash with the pink accent
+var peerPalette = []lipgloss.Color{
+	"39", "208", "41", "170", "220", "75", "203", "114", "141", "179", "44", "168",
+}
+
+// The style a peer's name is rendered in, always the same for the same peer
+func peerStyle(peer string) lipgloss.Style {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(peer))
+	return lipgloss.NewStyle().Foreground(peerPalette[h.Sum32()%uint32(len(peerPalette))])
+}
@@ -0,0 +1,301 @@
+package ui
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// A slash command the chat understands itself
+type builtin struct {
+	name        string
+	aliases     []string // Other names it answers to
+	usage       string
+	description string
+	run         func(m *Model, arg string) tea.Cmd // Carries it out with whatever was typed after it
+}
+
+// The chat's own slash commands, in the order /help lists them. Enter runs
+// them from here too, so there's no listing one that doesn't work. /help is
+// one of them and lists them all, so init fills them in.
+var builtins []builtin
+
+func init() {
+	builtins = []builtin{
+		{"/help", nil, "", "Lists these commands", func(m *Model, _ string) tea.Cmd {
+			m.Notify("%s", m.help())
+			return nil
+		}},
+		{"/msg", nil, "ip:port text", "Sends a message to one peer", (*Model).sendDirect},
+		{"/add", nil, "ip:port|invite", "Adds a peer to the conversation", (*Model).addPeer},
+		{"/remove", nil, "ip:port", "Removes a peer from the conversation", (*Model).removePeer},
+		{"/connect", nil, "ip:port|invite", "Drops everyone and starts over with a new peer", (*Model).connect},
+		{"/ping", nil, "[ip:port]", "Measures the round trip to every peer, or one", (*Model).ping},
+		{"/mute", nil, "ip:port", "Collapses a peer's messages", func(m *Model, arg string) tea.Cmd {
+			m.mute(arg, true)
+			return nil
+		}},
+		{"/unmute", nil, "ip:port", "Expands a peer's messages again", func(m *Model, arg string) tea.Cmd {
+			m.mute(arg, false)
+			return nil
+		}},
+		{"/whois", nil, "ip:port|nick", "Shows everything known about a peer", func(m *Model, arg string) tea.Cmd {
+			m.whois(arg)
+			return nil
+		}},
+		{"/nick", nil, "[name]", "Sets the name peers see you by, or shows it", (*Model).setNick},
+		{"/status", nil, "online|away|busy [note] or note", "Tells everyone whether you're around and what you're up to", (*Model).setStatus},
+		{"/retry", nil, "", "Resends your messages no one acknowledged", func(m *Model, _ string) tea.Cmd {
+			return m.retryFailed()
+		}},
+		{"/getaddr", nil, "", "Asks the discovery server for your external address", func(m *Model, _ string) tea.Cmd {
+			m.addrWanted = true
+			return requestAddress(m.conn, m.discoveryAddr)
+		}},
+		{"/invite", nil, "", "Copies an invite peers can /add or /connect with", func(m *Model, _ string) tea.Cmd {
+			m.invite()
+			return nil
+		}},
+		{"/kick", nil, "ip:port", "Removes someone from your room, if you own it", func(m *Model, arg string) tea.Cmd {
+			m.moderateRoom("kick", arg)
+			return nil
+		}},
+		{"/ban", nil, "ip:port", "Removes someone from your room for good, if you own it", func(m *Model, arg string) tea.Cmd {
+			m.moderateRoom("ban", arg)
+			return nil
+		}},
+		{"/send", nil, "[path]", "Sends a file to everyone, picking it when there's no path", func(m *Model, arg string) tea.Cmd {
+			if strings.TrimSpace(arg) == "" {
+				return m.openPicker()
+			}
+			return m.sendFile(strings.TrimSpace(arg))
+		}},
+		{"/sendclip", nil, "", "Sends whatever's on the clipboard", func(*Model, string) tea.Cmd {
+			return readClipboard()
+		}},
+		{"/copyall", nil, "", "Copies the whole conversation", func(m *Model, _ string) tea.Cmd {
+			m.copyAll()
+			return nil
+		}},
+		{"/call", nil, "ip:port", "Rings a peer", (*Model).callPeer},
+		{"/accept", nil, "", "Picks up the peer that's calling", func(m *Model, _ string) tea.Cmd {
+			return m.accept()
+		}},
+		{"/hangup", nil, "", "Ends or declines the call", func(m *Model, _ string) tea.Cmd {
+			return m.hangUp()
+		}},
+		{"/devices", nil, "", "Lists the microphones and speakers calls can use", func(*Model, string) tea.Cmd {
+			return listDevices()
+		}},
+		{"/share-screen", nil, "[ip:port|stop]", "Shares your screen with everyone or one peer, or stops", (*Model).shareScreenCommand},
+		{"/detach", nil, "", "Quits, leaving a daemon to carry on the conversation", func(m *Model, _ string) tea.Cmd {
+			m.detached = true
+			return m.quit()
+		}},
+		{"/quit", []string{"/q", "/exit"}, "", "Quits, also /q and /exit", func(m *Model, _ string) tea.Cmd {
+			return m.quit()
+		}},
+	}
+}
+
+// The chat's own command going by name, or one of its aliases
+func findBuiltin(name string) (builtin, bool) {
+	for _, b := range builtins {
+		if b.name == name || slices.Contains(b.aliases, name) {
+			return b, true
+		}
+	}
+	return builtin{}, false
+}
+
+// Every command with what it does, the chat's own first and then the plugins'
+func (m *Model) help() string {
+	var list strings.Builder
+	list.WriteString("Commands:\n")
+	for _, b := range builtins {
+		fmt.Fprintf(&list, "  %s  %s\n", strings.TrimSpace(b.name+" "+b.usage), b.description)
+	}
+	var names []string
+	for name := range m.commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if len(names) > 0 {
+		list.WriteString("From plugins:\n")
+	}
+	for _, name := range names {
+		fmt.Fprintf(&list, "  %s\n", strings.TrimSpace(name+"  "+m.commands[name].Usage))
+	}
+	list.WriteString("Tab completes commands, peers, files to /send and :emoji:\n")
+	list.WriteString("Start a message with // to send it starting with /")
+	return list.String()
+}
+
+// Sends a message to a single peer, for /msg
+func (m *Model) sendDirect(arg string) tea.Cmd {
+	to, text, _ := strings.Cut(strings.TrimSpace(arg), " ")
+	addr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil || strings.TrimSpace(text) == "" {
+		m.Notify("Usage: /msg ip:port text")
+		return nil
+	}
+	if !m.peers.Has(addr) {
+		m.Notify("%s is not in the conversation", addr)
+		return nil
+	}
+	return m.send(text, addr)
+}
+
+// Copies an invite to us, for /invite
+func (m *Model) invite() {
+	addr, err := net.ResolveUDPAddr("udp", m.externalAddr)
+	if m.externalAddr == "" || err != nil {
+		m.Notify("Don't know our external address yet, /getaddr asks for it")
+		return
+	}
+	invite := protocol.Invite{Addr: addr}
+	if m.identity != nil {
+		invite.Key = m.identity.Public().(ed25519.PublicKey)
+	}
+	m.Notify("Copied %s to the %s, paste it to your peer", invite, clipboardName(copyText(invite.String())))
+}
+
+// The peer an ip:port or invite is for, and the identity an invite says it
+// has
+func parsePeer(arg string) (*net.UDPAddr, ed25519.PublicKey, error) {
+	if invite, ok := protocol.ParseInvite(arg); ok {
+		return invite.Addr, invite.Key, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(arg))
+	return addr, nil, err
+}
+
+// Adds a peer to the conversation, for /add
+func (m *Model) addPeer(arg string) tea.Cmd {
+	addr, key, err := parsePeer(arg)
+	if err != nil {
+		m.Notify("Usage: /add ip:port|invite (%v)", err)
+	} else if m.peers.Add(m.conn, addr, m.done) {
+		if key != nil {
+			m.peers.SetInvited(addr, key)
+		}
+		m.Notify("Added %s", addr)
+	} else {
+		m.Notify("%s is already in the conversation", addr)
+	}
+	return nil
+}
+
+// Removes a peer from the conversation, for /remove
+func (m *Model) removePeer(arg string) tea.Cmd {
+	addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(arg))
+	if err != nil {
+		m.Notify("Usage: /remove ip:port (%v)", err)
+	} else if m.peers.Remove(addr) {
+		delete(m.timings, addr.String())
+		delete(m.connections, addr.String())
+		delete(m.statuses, addr.String())
+		delete(m.notes, addr.String())
+		m.Notify("Removed %s", addr)
+	} else {
+		m.Notify("%s is not in the conversation", addr)
+	}
+	return nil
+}
+
+// Drops everyone and starts over with a new peer, keeping the transcript,
+// for /connect
+func (m *Model) connect(arg string) tea.Cmd {
+	addr, key, err := parsePeer(arg)
+	if err != nil {
+		m.Notify("Usage: /connect ip:port|invite (%v)", err)
+		return nil
+	}
+	m.peers.Clear()
+	m.leaveCurrentRoom()
+	m.endCall()
+	m.muted = map[string]bool{}
+	m.timings = map[string]*transport.Timing{}
+	m.connections = map[string]transport.State{}
+	m.statuses = map[string]string{}
+	m.notes = map[string]string{}
+	m.peers.Add(m.conn, addr, m.done)
+	if key != nil {
+		m.peers.SetInvited(addr, key)
+	}
+	m.Notify("Connecting to %s", addr)
+	return nil
+}
+
+// Measures the round trip time to every peer, or just one, for /ping
+func (m *Model) ping(arg string) tea.Cmd {
+	recipients := m.peers.Addrs()
+	if arg = strings.TrimSpace(arg); arg != "" {
+		addr, err := net.ResolveUDPAddr("udp", arg)
+		if err != nil || !m.peers.Has(addr) {
+			m.Notify("Usage: /ping [ip:port of someone in the conversation]")
+			return nil
+		}
+		recipients = []*net.UDPAddr{addr}
+	}
+	m.manualPing = protocol.NewMessageID()
+	return sendEcho(m.conn, m.peers, recipients, m.manualPing)
+}
+
+// Collapses a peer's messages, or expands them again, for /mute and /unmute
+func (m *Model) mute(arg string, muted bool) {
+	command := "/unmute"
+	if muted {
+		command = "/mute"
+	}
+	addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(arg))
+	if err != nil {
+		m.Notify("Usage: %s ip:port (%v)", command, err)
+	} else if !m.peers.Has(addr) {
+		m.Notify("%s is not in the conversation", addr)
+	} else if muted {
+		m.muted[addr.String()] = true
+		m.Notify("Muted %s", addr)
+	} else {
+		delete(m.muted, addr.String())
+		m.Notify("Unmuted %s", addr)
+	}
+}
+
+// Rings a peer, for /call
+func (m *Model) callPeer(arg string) tea.Cmd {
+	addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(arg))
+	if err != nil {
+		m.Notify("Usage: /call ip:port (%v)", err)
+		return nil
+	}
+	if !m.peers.Has(addr) {
+		m.Notify("%s is not in the conversation", addr)
+		return nil
+	}
+	return m.ring(addr)
+}
+
+// Shares our screen with everyone or one peer, or stops sharing it, for
+// /share-screen
+func (m *Model) shareScreenCommand(arg string) tea.Cmd {
+	switch arg = strings.TrimSpace(arg); arg {
+	case "stop":
+		return m.stopSharing()
+	case "":
+		return m.shareScreen(nil)
+	}
+	addr, err := net.ResolveUDPAddr("udp", arg)
+	if err != nil || !m.peers.Has(addr) {
+		m.Notify("Usage: /share-screen [ip:port of someone in the conversation|stop]")
+		return nil
+	}
+	return m.shareScreen(addr)
+}
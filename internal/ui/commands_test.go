@@ -0,0 +1,167 @@
+package ui
+
+import (
+	"crypto/ed25519"
+	"net"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/discovery"
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// A chat with no one in it whose messages end up in sent instead of going out
+func newTestModel(t *testing.T, sent *[]string) *Model {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		conn.Close()
+	})
+	m, err := New(Config{
+		Conn:      conn,
+		Peers:     &transport.Roster{},
+		Discovery: discovery.NewServers([]*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 1}}),
+		Done:      done,
+		BeforeSend: func(text string) (string, bool) {
+			*sent = append(*sent, text)
+			return text, false
+		},
+		Commands: map[string]Command{"/plugin": {Run: func(string) {}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestFindBuiltin(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"/help", "/help", true},
+		{"/quit", "/quit", true},
+		{"/q", "/quit", true},
+		{"/exit", "/quit", true},
+		{"/share-screen", "/share-screen", true},
+		{"help", "", false},
+		{"/nope", "", false},
+		{"//help", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := findBuiltin(tt.name)
+			if ok != tt.wantOK || b.name != tt.want {
+				t.Errorf("findBuiltin(%q) = %q, %t, want %q, %t", tt.name, b.name, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHelpListsEveryBuiltin(t *testing.T) {
+	var sent []string
+	m := newTestModel(t, &sent)
+	help := m.help()
+	seen := map[string]bool{}
+	for _, b := range builtins {
+		if b.run == nil {
+			t.Errorf("%s does nothing", b.name)
+		}
+		if !strings.Contains(help, "  "+b.name) {
+			t.Errorf("/help doesn't list %s", b.name)
+		}
+		for _, name := range append([]string{b.name}, b.aliases...) {
+			if seen[name] {
+				t.Errorf("%s is taken twice", name)
+			}
+			seen[name] = true
+		}
+	}
+	if !strings.Contains(help, "/plugin") {
+		t.Errorf("/help doesn't list the plugin's command")
+	}
+}
+
+func TestEnter(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		sent   []string // What reaches our peers
+		notice string   // Part of what the chat tells us, if anything
+	}{
+		{"a message", "hello", []string{"hello"}, ""},
+		{"an unknown command", "/nope there", nil, "Unknown command /nope"},
+		{"an escaped slash", "//nope there", []string{"/nope there"}, ""},
+		{"one of ours", "/help", nil, "Commands:"},
+		{"one of ours with an argument", "/add nowhere", nil, "Usage: /add"},
+		{"a plugin's", "/plugin x", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			m := newTestModel(t, &sent)
+			m.textInput.SetValue(tt.input)
+			m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+
+			if strings.Join(sent, "\n") != strings.Join(tt.sent, "\n") {
+				t.Errorf("sent %q, want %q", sent, tt.sent)
+			}
+			var notices []string
+			for _, message := range m.messages {
+				notices = append(notices, message.text)
+			}
+			if tt.notice == "" && len(notices) > 0 {
+				t.Errorf("told us %q, want nothing", notices)
+			}
+			if tt.notice != "" && !strings.Contains(strings.Join(notices, "\n"), tt.notice) {
+				t.Errorf("told us %q, want %q", notices, tt.notice)
+			}
+			if m.textInput.Value() != "" {
+				t.Errorf("left %q in the text input", m.textInput.Value())
+			}
+		})
+	}
+}
+
+func TestAddInvite(t *testing.T) {
+	public, _, _ := ed25519.GenerateKey(nil)
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	invite := protocol.Invite{Addr: peer, Key: public}.String()
+
+	tests := []struct {
+		name    string
+		input   string
+		want    ed25519.PublicKey // The identity the peer has to prove
+		wantAdd bool
+	}{
+		{"/add an invite", "/add " + invite, public, true},
+		{"/connect an invite", "/connect " + invite, public, true},
+		{"/add an invite without an identity", "/add p2p:" + peer.String(), nil, true},
+		{"/add an ip:port", "/add " + peer.String(), nil, true},
+		{"/add a garbled invite", "/add p2p:" + peer.String() + "/%%%", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			m := newTestModel(t, &sent)
+			m.textInput.SetValue(tt.input)
+			m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+
+			if m.peers.Has(peer) != tt.wantAdd {
+				t.Fatalf("added = %t, want %t", m.peers.Has(peer), tt.wantAdd)
+			}
+			if got := m.peers.Invited(peer); !got.Equal(tt.want) {
+				t.Errorf("invited as %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
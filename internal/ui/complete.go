@@ -0,0 +1,193 @@
+package ui
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// How many completions the popup under the input shows at once
+const completionRows = 5
+
+// One way to complete the word being typed
+type option struct {
+	text  string // What replaces the word
+	label string // How the popup shows it
+}
+
+// The completions Tab found for the word before the cursor, which pressing
+// it again cycles through
+type completion struct {
+	head    string // What's typed before the word
+	tail    string // What's typed after the cursor
+	options []option
+	current int // The option in the input, -1 while it holds what they have in common
+}
+
+// Whether there are several completions to pick from
+func (c completion) active() bool {
+	return len(c.options) > 1
+}
+
+// Completes the word before the cursor as far as its completions agree,
+// showing them all when there are several, or puts the next in its place
+func (m *Model) complete() {
+	if c := &m.completion; c.active() {
+		c.current = (c.current + 1) % len(c.options)
+		m.fill(c.options[c.current].text)
+		return
+	}
+
+	runes := []rune(m.textInput.Value())
+	pos := m.textInput.Position()
+	head, word, options := m.completions(string(runes[:pos]))
+	if len(options) == 0 {
+		return
+	}
+	m.completion = completion{head: head, tail: string(runes[pos:]), options: options, current: -1}
+	if len(options) == 1 {
+		m.fill(options[0].text)
+		m.completion = completion{}
+		return
+	}
+	if prefix := commonPrefix(options); len(prefix) > len(word) {
+		m.fill(prefix)
+	}
+}
+
+// Puts text in place of the word being completed
+func (m *Model) fill(text string) {
+	m.textInput.SetValue(m.completion.head + text + m.completion.tail)
+	m.textInput.SetCursor(len([]rune(m.completion.head + text)))
+}
+
+// What's typed before the word being completed, the word, and what it could
+// be: a command, a file to /send, an emoji's :shortcode:, or a peer
+func (m *Model) completions(before string) (string, string, []option) {
+	if path, ok := strings.CutPrefix(before, "/send "); ok {
+		return "/send ", path, pathOptions(path)
+	}
+	i := strings.LastIndex(before, " ") + 1
+	head, word := before[:i], before[i:]
+	command := strings.HasPrefix(head, "/")
+	switch {
+	case head == "" && strings.HasPrefix(word, "/"):
+		return head, word, m.commandOptions(word)
+	case strings.HasPrefix(word, ":") && len(word) > 1:
+		return head, word, emojiOptions(strings.TrimPrefix(word, ":"))
+	case word != "" || command:
+		return head, word, m.peerOptions(word, command)
+	}
+	return head, word, nil
+}
+
+// The chat's and plugins' commands starting with prefix
+func (m *Model) commandOptions(prefix string) []option {
+	var options []option
+	for _, b := range builtins {
+		if strings.HasPrefix(b.name, prefix) {
+			options = append(options, option{b.name + " ", b.name + "  " + directStyle.Render(b.description)})
+		}
+	}
+	for name, extra := range m.commands {
+		if strings.HasPrefix(name, prefix) {
+			options = append(options, option{name + " ", name + "  " + directStyle.Render(extra.Usage)})
+		}
+	}
+	slices.SortFunc(options, func(a, b option) int { return strings.Compare(a.text, b.text) })
+	return options
+}
+
+// Peers whose nick starts with prefix, or for commands, which take
+// addresses, whose address does too
+func (m *Model) peerOptions(prefix string, command bool) []option {
+	var options []option
+	for _, addr := range m.peers.Addrs() {
+		peer, nick := addr.String(), m.nicks[addr.String()]
+		named := nick != "" && strings.HasPrefix(strings.ToLower(nick), strings.ToLower(prefix))
+		switch {
+		case command && (named || strings.HasPrefix(peer, prefix)):
+			options = append(options, option{peer + " ", strings.TrimSpace(peer + "  " + nick)})
+		case !command && named:
+			options = append(options, option{nick + " ", nick})
+		}
+	}
+	return options
+}
+
+// Emoji whose shortcode starts with prefix
+func emojiOptions(prefix string) []option {
+	var options []option
+	for code, e := range emoji {
+		if strings.HasPrefix(code, prefix) {
+			options = append(options, option{e, ":" + code + ":  " + e})
+		}
+	}
+	slices.SortFunc(options, func(a, b option) int { return strings.Compare(a.label, b.label) })
+	return options
+}
+
+// Files and folders starting with path, leaving out hidden ones unless it
+// asks for them. Folders end with a slash, so Tab carries on into them.
+func pathOptions(path string) []option {
+	dir, base := filepath.Split(path)
+	entries, err := os.ReadDir(cmp.Or(dir, "."))
+	if err != nil {
+		return nil
+	}
+	var options []option
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			name += "/"
+		}
+		options = append(options, option{dir + name, name})
+	}
+	return options
+}
+
+// What every option's text starts with
+func commonPrefix(options []option) string {
+	prefix := options[0].text
+	for _, o := range options[1:] {
+		for !strings.HasPrefix(o.text, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// The popup under the input listing the completions, with the one in the
+// input picked out
+func (c completion) view() string {
+	if !c.active() {
+		return ""
+	}
+	var b strings.Builder
+	first := max(0, c.current-completionRows+1)
+	for i := first; i < min(len(c.options), first+completionRows); i++ {
+		if i == c.current {
+			fmt.Fprintf(&b, "%s %s\n", bubblePinkAccentStyle.Render(">"), selectedStyle.Render(c.options[i].label))
+		} else {
+			fmt.Fprintf(&b, "  %s\n", c.options[i].label)
+		}
+	}
+	b.WriteString(directStyle.Render(fmt.Sprintf("%d completions, tab for the next", len(c.options))))
+	return b.String()
+}
+
+// How many rows the popup takes
+func (c completion) height() int {
+	if !c.active() {
+		return 0
+	}
+	return min(len(c.options), completionRows) + 1
+}
@@ -0,0 +1,51 @@
+package ui
+
+// Emoji by the shortcodes Tab completes, like :smile:
+var emoji = map[string]string{
+	"+1":               "👍",
+	"-1":               "👎",
+	"100":              "💯",
+	"angry":            "😠",
+	"blush":            "😊",
+	"broken_heart":     "💔",
+	"clap":             "👏",
+	"coffee":           "☕",
+	"confused":         "😕",
+	"cool":             "😎",
+	"cry":              "😢",
+	"eyes":             "👀",
+	"facepalm":         "🤦",
+	"fire":             "🔥",
+	"grin":             "😁",
+	"heart":            "❤️",
+	"heart_eyes":       "😍",
+	"hugs":             "🤗",
+	"joy":              "😂",
+	"kiss":             "😘",
+	"laughing":         "😆",
+	"ok_hand":          "👌",
+	"party":            "🥳",
+	"pray":             "🙏",
+	"rocket":           "🚀",
+	"rofl":             "🤣",
+	"scream":           "😱",
+	"shrug":            "🤷",
+	"sleeping":         "😴",
+	"slightly_smiling": "🙂",
+	"smile":            "😄",
+	"smirk":            "😏",
+	"sob":              "😭",
+	"sparkles":         "✨",
+	"star":             "⭐",
+	"sunglasses":       "😎",
+	"tada":             "🎉",
+	"thinking":         "🤔",
+	"thumbsdown":       "👎",
+	"thumbsup":         "👍",
+	"upside_down":      "🙃",
+	"wave":             "👋",
+	"wink":             "😉",
+	"x":                "❌",
+	"white_check_mark": "✅",
+	"zzz":              "💤",
+}
@@ -0,0 +1,161 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// How a file we sent or received shows in the transcript
+func fileText(name string, size int64) string {
+	return fmt.Sprintf("📎 %s, %s", name, formatSize(size))
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// Sends a file to everyone
+func (m *Model) sendFile(path string) tea.Cmd {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		m.Notify("Failed to send %s: %v", path, err)
+		return nil
+	}
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		m.Notify("Failed to send %s: %v", path, err)
+		return nil
+	case info.IsDir():
+		m.Notify("%s is a folder, only files can be sent", path)
+		return nil
+	case info.Size() > transport.MaxFile:
+		m.Notify("%s is %s, files can be %s at most", path, formatSize(info.Size()), formatSize(transport.MaxFile))
+		return nil
+	}
+	return m.deliver(Message{text: fileText(info.Name(), info.Size()), file: path, fileSize: info.Size()}, nil)
+}
+
+// A command that reads a file and sends it to the given peers a chunk at a
+// time
+func sendFile(conn transport.Conn, peers *transport.Roster, receiptSub chan<- Receipt, remoteAddrs []*net.UDPAddr, id, path string) tea.Cmd {
+	return func() tea.Msg {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Notice{Text: fmt.Sprintf("Failed to send %s: %v", path, err)}
+		}
+		frames := transport.Chunks(protocol.Frame{Type: protocol.File, ID: id, Text: filepath.Base(path)}, data)
+		return sendChunks(conn, peers, receiptSub, remoteAddrs, frames)()
+	}
+}
+
+// Whether a message is a file that's all there, to open: one we received,
+// or sent and everyone acknowledged
+func fileReady(message Message) bool {
+	return message.file != "" && len(unacknowledged(message)) == 0
+}
+
+// Where received files are saved
+func downloadsDir() string {
+	if dir := os.Getenv("XDG_DOWNLOAD_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return os.TempDir()
+	}
+	return filepath.Join(home, "Downloads")
+}
+
+// Saves a file a peer sent us in downloadsDir, numbering it rather than
+// overwriting a file of the same name, and returns where it went
+func saveFile(name string, data []byte) (string, error) {
+	// only ever the name, never somewhere else the peer picked
+	name = filepath.Base(filepath.Clean("/" + strings.ReplaceAll(name, `\`, "/")))
+	if name == "/" || name == "." {
+		name = "file"
+	}
+	dir := downloadsDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 0; ; n++ {
+		path := filepath.Join(dir, name)
+		if n > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
+
+// A command that opens a file with whatever the desktop opens it with
+func openFile(path string) tea.Cmd {
+	return func() tea.Msg {
+		var cmd *exec.Cmd
+		switch runtime.GOOS {
+		case "darwin":
+			cmd = exec.Command("open", path)
+		case "windows":
+			cmd = exec.Command("cmd", "/c", "start", "", path)
+		default:
+			cmd = exec.Command("xdg-open", path)
+		}
+		if err := cmd.Start(); err != nil {
+			return Notice{Text: fmt.Sprintf("Failed to open %s: %v", path, err)}
+		}
+		go cmd.Wait()
+		return nil
+	}
+}
+
+// A command that shows a file in the desktop's file manager, selected where
+// the file manager can do that
+func revealFile(path string) tea.Cmd {
+	return func() tea.Msg {
+		var cmd *exec.Cmd
+		switch runtime.GOOS {
+		case "darwin":
+			cmd = exec.Command("open", "-R", path)
+		case "windows":
+			cmd = exec.Command("explorer", "/select,"+path)
+		default:
+			cmd = exec.Command("xdg-open", filepath.Dir(path))
+		}
+		if err := cmd.Start(); err != nil {
+			return Notice{Text: fmt.Sprintf("Failed to show %s: %v", path, err)}
+		}
+		go cmd.Wait()
+		return nil
+	}
+}
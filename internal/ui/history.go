@@ -0,0 +1,73 @@
+package ui
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/x/ansi"
+
+	"p2p/internal/history"
+)
+
+// Reads back the history file, oldest first
+func loadHistory(path string) ([]Message, error) {
+	records, err := history.Load(path)
+	var messages []Message
+	for _, record := range records {
+		message := Message{
+			time:   record.Time,
+			ip:     record.Sender,
+			port:   record.Port,
+			peer:   record.Peer,
+			text:   record.Text,
+			direct: record.Direct,
+			to:     record.To,
+			via:    record.Via,
+			file:   record.File,
+		}
+		messages = append(messages, message)
+	}
+	// sessions can overlap when the file is shared, e.g. with the daemon
+	slices.SortStableFunc(messages, func(a, b Message) int {
+		return a.time.Compare(b.time)
+	})
+	return messages, err
+}
+
+// Keeps a message in the history file, if there is one, and tells whoever
+// is watching the transcript about it
+func (m *Model) remember(message Message, self bool) {
+	record := toRecord(message, self)
+	if m.onMessage != nil {
+		m.onMessage(record)
+	}
+	if m.historyPath == "" {
+		return
+	}
+	_ = history.Append(m.historyPath, record)
+}
+
+func toRecord(message Message, self bool) history.Record {
+	return history.Record{
+		Time:   message.time,
+		Sender: ansi.Strip(message.ip),
+		Port:   message.port,
+		Peer:   message.peer,
+		Text:   message.text,
+		Self:   self,
+		Direct: message.direct,
+		To:     message.to,
+		Via:    message.via,
+		File:   message.file,
+	}
+}
+
+// The whole transcript, oldest first. Other goroutines have to send a
+// TranscriptRequest instead.
+func (m *Model) Transcript() []history.Record {
+	records := make([]history.Record, len(m.messages))
+	for i, message := range m.messages {
+		records[i] = toRecord(message, strings.HasPrefix(ansi.Strip(message.ip), "(You)"))
+	}
+	return records
+}
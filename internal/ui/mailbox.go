@@ -0,0 +1,134 @@
+package ui
+
+import (
+	"crypto/ed25519"
+	"log/slog"
+	"net"
+	"time"
+
+	"p2p/internal/discovery"
+	"p2p/internal/mailbox"
+	"p2p/internal/transport"
+)
+
+// A peer's identity and the key to seal letters to it with
+type peerMailbox struct {
+	identity ed25519.PublicKey
+	key      []byte
+}
+
+// Remembers the mailbox of a peer that's leaving our room, so we can leave
+// it letters while it's gone
+func (m *Model) rememberMailbox(addr *net.UDPAddr) {
+	if identity, key := m.peers.Mailbox(addr); key != nil {
+		m.away[addr.String()] = peerMailbox{identity: identity, key: key}
+	}
+}
+
+// The mailboxes of the given peers that sent us one, whether or not they're
+// still in our room
+func (m *Model) mailboxes(addrs []*net.UDPAddr) []peerMailbox {
+	var boxes []peerMailbox
+	for _, addr := range addrs {
+		if identity, key := m.peers.Mailbox(addr); key != nil {
+			boxes = append(boxes, peerMailbox{identity: identity, key: key})
+		} else if box, ok := m.away[addr.String()]; ok {
+			boxes = append(boxes, box)
+		}
+	}
+	return boxes
+}
+
+// The mailboxes of peers that left our room that a message is for
+func (m *Model) awayMailboxes(message Message) []peerMailbox {
+	var boxes []peerMailbox
+	for addr, box := range m.away {
+		if !message.direct || message.to == addr {
+			boxes = append(boxes, box)
+		}
+	}
+	return boxes
+}
+
+// Leaves a message with the discovery server for peers that can't get it
+// now, sealed so only they can read it, for them to get when they're back.
+// Only text goes, through a server we share a room on, as the server only
+// holds letters from members.
+func (m *Model) leaveLetters(message Message, boxes []peerMailbox) {
+	if m.room == "" || m.identity == nil || message.voice != nil || message.file != "" {
+		return
+	}
+	for _, box := range boxes {
+		sealed, err := mailbox.Seal(m.identity, mailbox.Letter{To: box.identity, ID: message.id, Text: message.text, Sent: message.time.UnixNano()}, box.key)
+		if err != nil {
+			slog.Warn("sealing letter failed", "err", err)
+			continue
+		}
+		if err := discovery.LeaveLetter(m.conn, m.discoveryAddr, box.identity, sealed); err != nil {
+			slog.Error("leaving letter failed", "err", err)
+		}
+	}
+}
+
+// Who has an identity, as far as we know, or "" if nobody we know of
+func (m *Model) withKey(identity ed25519.PublicKey) string {
+	if addr := m.peers.WithKey(identity); addr != nil {
+		return addr.String()
+	}
+	for addr, box := range m.away {
+		if box.identity.Equal(identity) {
+			return addr
+		}
+	}
+	return ""
+}
+
+// Handles the discovery server delivering a letter or saying what it did
+// with one of ours, reporting whether the text was one of those
+func (m *Model) handleMail(text string) bool {
+	kind, data, ok := discovery.ParseMail(text)
+	if !ok {
+		return false
+	}
+	switch kind {
+	case "mailed", "mailfull":
+		peer := m.withKey(ed25519.PublicKey(data))
+		if peer == "" {
+			peer = "A peer"
+		}
+		if kind == "mailed" {
+			m.Notify("%s is offline, so the discovery server holds our message for when they're back", peer)
+		} else {
+			m.Notify("%s is offline and the discovery server can't hold any more messages for them", peer)
+		}
+	case "mail":
+		if m.identity == nil {
+			return true
+		}
+		letter, err := mailbox.Open(m.identity, data)
+		if err != nil {
+			slog.Warn("ignoring letter", "err", err)
+			return true
+		}
+		addr := m.peers.WithKey(letter.From)
+		if addr == nil {
+			m.Notify("%s, who we don't know yet, left a message with the discovery server: %s", transport.Fingerprint(letter.From), letter.Text)
+			return true
+		}
+		// by the sender's clock, which we can't correct for, but it can't have
+		// been sent later than now
+		sent := time.Unix(0, letter.Sent)
+		if now := time.Now(); sent.After(now) {
+			sent = now
+		}
+		m.receive(Response{
+			time: sent,
+			ip:   addr.IP.String(),
+			port: addr.Port,
+			peer: addr.String(),
+			text: letter.Text,
+			via:  m.discoveryAddr.String(),
+		})
+	}
+	return true
+}
@@ -0,0 +1,1252 @@
+// Package ui is the chat's terminal interface, built on Bubble Tea.
+package ui
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	// "golang.org/x/sys/windows"
+
+	"p2p/internal/crash"
+	"p2p/internal/discovery"
+	"p2p/internal/history"
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// How many received messages can wait for the UI to catch up before the
+// listener waits for it
+const messageBacklog = 256
+
+// How many messages the transcript keeps in memory unless configured otherwise
+const DefaultMaxMessages = 1000
+
+// How often the status bar's round trip times are refreshed
+var rttInterval = 5 * time.Second
+
+// func pollConsoleSize(p *tea.Program) {
+// 	var lastCols, lastRows int
+// 	for {
+// 		cols, rows := getConsoleSize()
+// 		if cols != lastCols || rows != lastRows {
+// 			p.Send(ResizeMsg{
+// 				cols: cols,
+// 				rows: rows,
+// 			})
+// 			lastCols = cols
+// 			lastRows = rows
+// 		}
+// 		time.Sleep(200 * time.Millisecond) // maybe adjust polling interval
+// 	}
+// }
+
+// func getConsoleSize() (cols, rows int) {
+// 	var info windows.ConsoleScreenBufferInfo
+// 	handle := windows.Handle(os.Stdout.Fd())
+// 	err := windows.GetConsoleScreenBufferInfo(handle, &info)
+// 	if err == nil {
+// 		cols = int(info.Size.X)
+// 		rows = int(info.Size.Y)
+// 	}
+// 	return
+// }
+
+type Message struct {
+	time   time.Time
+	ip     string
+	port   int
+	peer   string // ip:port of the sending peer, empty for our own and system messages
+	text   string
+	direct bool   // Sent to a single peer instead of the whole group
+	to     string // ip:port of the recipient of our own direct messages
+	via    string // ip:port of the peer that relayed the message to us
+
+	id         string          // Identifies our own messages in receipts
+	recipients []string        // ip:port of every peer we sent our own message to
+	receipts   map[string]bool // Recipients that acknowledged our own message
+	voice      []byte          // The audio of a voice note, which text describes
+	file       string          // Where a file we sent or received is on disk, which text describes
+	fileSize   int64           // How big file is, for how long sending it takes
+	failed     bool            // We gave up resending our own message to recipients that never acknowledged it
+	sent       time.Time       // When a peer's message was sent by its clock, zero if it didn't say
+}
+
+type Response Message
+
+// Messages that arrived together
+type Responses []Response
+
+// A peer acknowledging one of our messages
+type Receipt struct {
+	id   string
+	peer string // ip:port of the peer that received the message
+	kind string // The type of frame acknowledged, when it wasn't a message
+}
+
+// Sends a message to everyone as if it was typed, for frontends other than
+// the terminal like the API gateway
+type Outgoing struct {
+	Text string
+}
+
+// Shows a SYSTEM message, for frontends other than the terminal like plugins
+type Notice struct {
+	Text string
+}
+
+// Asks for the whole transcript, oldest first, which is sent on Reply. The
+// model is only ever touched by the Bubble Tea loop, so this is how other
+// goroutines read it.
+type TranscriptRequest struct {
+	Reply chan<- []history.Record
+}
+
+// A slash command that isn't built in, e.g. from a plugin
+type Command struct {
+	Usage string
+	Run   func(args string) // Run in the background with whatever was typed after the command
+}
+
+// A peer's connection changed state, or it came back from a new address
+type Presence struct {
+	peer  string // ip:port
+	state transport.State
+	from  string // ip:port the peer had before it moved, if it did
+	bye   bool   // The peer said goodbye rather than going quiet
+
+	// The protocol versions the peer speaks, when none of them is one we do
+	version, minVersion int
+
+	// What the peer could do and can now, when it handshook again having
+	// restarted as another build
+	renegotiated  bool
+	oldCaps, caps int
+}
+
+// Reading from or writing to the socket failed
+type NetworkError struct {
+	op  string // "send" or "receive"
+	err error
+}
+
+// How long quitting waits for messages still being sent
+const flushTimeout = time.Second
+
+// Sent to ask the discovery server about lost peers again, at growing
+// intervals until they're back
+type reconnectTick struct{}
+
+// Sent periodically to measure our peers' round trip times
+type rttTick struct{}
+
+// A peer answering one of our echo frames
+type RTT struct {
+	id       string
+	peer     string    // ip:port of the peer that answered
+	sent     time.Time // When we sent the frame it answered
+	received time.Time // When the peer got it by its clock, zero if it didn't say
+	arrived  time.Time // When the answer got back
+}
+
+type Model struct {
+	done     chan struct{}  // Signals shutdown to background goroutines
+	outbox   sync.WaitGroup // Messages still being sent, which quitting waits a little for
+	quitting bool
+
+	confirmQuit bool // ctrl+c has to be pressed twice to quit
+	quitAsked   bool // ctrl+c was pressed once, and quits if it's pressed again
+
+	completion completion // What tab can complete the word we're typing with
+	hint       string     // Which peers can't use the command being typed
+	detached   bool       // Quit to let the daemon carry on the conversation
+	quitRoom   string     // The room we were in when we quit
+
+	sub         chan Response // Channel for receiving message notifications
+	presenceSub chan Presence
+	receiptSub  chan Receipt
+	statusSub   chan PeerStatus
+	errorSub    chan NetworkError
+	rttSub      chan RTT
+	callSub     chan CallSignal
+	screenSub   chan ScreenShare
+	timings     map[string]*transport.Timing // Round trip, jitter and clock offset to each peer, by ip:port
+	away        map[string]peerMailbox       // Mailboxes of peers that left our room, by ip:port, to leave letters for while they're gone
+	manualPing  string                       // ID of the echo frames sent by /ping, whose answers are shown
+
+	identity ed25519.PrivateKey // Who we are to our peers, whatever address we come from
+
+	conn          transport.Conn
+	rebind        func() error // Swaps conn's socket for a new one, if it can
+	peers         *transport.Roster
+	localPort     int
+	externalAddr  string             // ip:port the discovery server sees us as, once it told us
+	addrWanted    bool               // /getaddr asked the discovery server for externalAddr
+	discoveryAddr *net.UDPAddr       // The discovery server we use, which only Update changes
+	discovery     *discovery.Servers // Every discovery server we were given
+	room          string             // Room on the discovery server we found our peers through
+	leaveRoom     chan struct{}      // Stops refreshing our room membership
+
+	messages    []Message // The transcript, oldest first
+	maxMessages int       // How many of the latest messages to keep, older ones only live in the history file
+
+	muted map[string]bool // Peers whose messages are collapsed, by ip:port
+
+	status      string                     // Whether we're online, away or busy, as we tell our peers
+	note        string                     // What we tell our peers we're up to, if anything
+	connections map[string]transport.State // How well we're in touch with each peer, by ip:port, connecting until we hear otherwise
+	statuses    map[string]string          // What reachable peers told us they are, if not online, by ip:port
+	notes       map[string]string          // What peers told us they're up to, by ip:port
+
+	awayAfter time.Duration // How long without typing before we're away, never if 0
+	lastInput time.Time
+	autoAway  bool // We're away for being idle, until we type something
+
+	nick     string             // The name we go by, empty to go by our address
+	nicks    map[string]string  // The names peers told us to show them by, by ip:port
+	saveNick func(string) error // Keeps our name for next time
+
+	reconnectDelay time.Duration // How long until we next ask the discovery server about lost peers, 0 if we aren't
+
+	recording *recording // The voice note we're recording, if we are
+	sharing   *sharing   // Our screen being shared, if it is
+
+	call *call                     // The call we're in or being rung for, if any
+	live *atomic.Pointer[liveCall] // The call whose audio the listener plays, once it's started
+
+	signals map[string]*pendingSignal // Call signaling waiting to be acknowledged, by signalKey
+
+	netErrors    map[string]int    // How many sends and receives failed, by op
+	lastNetError map[string]string // The last error for each op, to only show it again when it changes
+
+	hoveredMessageIndex int
+	hoveredMessage      string
+	copied              string // How the hovered message was copied, empty until it is
+	selection           selection
+	picker              picker
+
+	multiplexer string // tmux or screen when we're running inside one
+	resizes     int    // How many times the terminal changed size, to tell the last one apart
+
+	historyPath string               // Where messages are kept between sessions, if anywhere
+	onMessage   func(history.Record) // Told about every message added to the transcript
+	commands    map[string]Command   // Extra slash commands, by name including the slash
+	beforeSend  func(text string) (string, bool)
+	keys        map[string]tea.KeyType // Extra keys from the config file and the keys they stand in for
+
+	textInput textinput.Model
+	height    int // terminal rows, 0 until the first resize
+
+	// rows int
+	// cols int
+}
+
+// type ResizeMsg struct {
+// 	rows int
+// 	cols int
+// }
+
+var (
+	bubblePinkAccentStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
+	directStyle           = lipgloss.NewStyle().Italic(true).Foreground(lipgloss.Color("245"))
+	buttonStyle           = lipgloss.NewStyle().Foreground(lipgloss.Color("#000000")).Background(lipgloss.Color("#00ff00"))
+	width                 = 80
+	inputHeight           = 2 // blank line plus the text input
+	headerHeight          = 2 // our endpoints plus a blank line
+)
+
+// Everything the chat needs from whoever starts it
+type Config struct {
+	Conn         transport.Conn
+	Rebind       func() error // Swaps Conn's socket for a new one when the old one stops working, optional
+	Peers        *transport.Roster
+	LocalPort    int
+	ExternalAddr string             // Already known, e.g. from a preflight, or empty to ask for it
+	Discovery    *discovery.Servers // The discovery servers we were given, and the one we use
+	Room         string             // Room we joined on the discovery server, if any
+	LeaveRoom    chan struct{}      // Closed to stop refreshing our room membership
+	Done         chan struct{}      // Closed when the chat quits, stopping every background goroutine
+	Identity     ed25519.PrivateKey
+	HistoryPath  string                           // Where messages are kept between sessions, if anywhere
+	OnMessage    func(history.Record)             // Called from the UI goroutine for every message added to the transcript, mustn't block
+	Commands     map[string]Command               // Extra slash commands, by name including the slash
+	BeforeSend   func(text string) (string, bool) // Rewrites each message we send, or stops it with false
+	MaxMessages  int                              // How many messages to keep in memory, DefaultMaxMessages if 0
+	Keymap       Keymap
+	Nick         string             // The name we go by, if any
+	AwayAfter    time.Duration      // How long without typing before we're away, DefaultAwayAfter if 0 and never if negative
+	ConfirmQuit  bool               // Ask for ctrl+c again before quitting
+	SaveNick     func(string) error // Keeps the name /nick sets for next time, optional
+}
+
+// A chat model starting from whatever history there is, hovering the text input
+func New(cfg Config) (*Model, error) {
+	messages, err := loadHistory(cfg.HistoryPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = DefaultMaxMessages
+	}
+	messages = messages[max(0, len(messages)-cfg.MaxMessages):]
+
+	m := &Model{
+		done:          cfg.Done,
+		localPort:     cfg.LocalPort,
+		externalAddr:  cfg.ExternalAddr,
+		identity:      cfg.Identity,
+		conn:          cfg.Conn,
+		rebind:        cfg.Rebind,
+		peers:         cfg.Peers,
+		muted:         map[string]bool{},
+		status:        online,
+		connections:   map[string]transport.State{},
+		statuses:      map[string]string{},
+		notes:         map[string]string{},
+		awayAfter:     awayAfter(cfg.AwayAfter),
+		confirmQuit:   cfg.ConfirmQuit,
+		lastInput:     time.Now(),
+		nick:          cfg.Nick,
+		nicks:         map[string]string{},
+		saveNick:      cfg.SaveNick,
+		netErrors:     map[string]int{},
+		lastNetError:  map[string]string{},
+		sub:           make(chan Response, messageBacklog),
+		presenceSub:   make(chan Presence),
+		receiptSub:    make(chan Receipt),
+		statusSub:     make(chan PeerStatus),
+		errorSub:      make(chan NetworkError),
+		rttSub:        make(chan RTT),
+		callSub:       make(chan CallSignal),
+		screenSub:     make(chan ScreenShare),
+		live:          &atomic.Pointer[liveCall]{},
+		signals:       map[string]*pendingSignal{},
+		timings:       map[string]*transport.Timing{},
+		away:          map[string]peerMailbox{},
+		messages:      messages,
+		maxMessages:   cfg.MaxMessages,
+		historyPath:   cfg.HistoryPath,
+		onMessage:     cfg.OnMessage,
+		commands:      cfg.Commands,
+		beforeSend:    cfg.BeforeSend,
+		keys:          cfg.Keymap.bindings(),
+		multiplexer:   multiplexer(),
+		textInput:     NewTextInput(),
+		discoveryAddr: cfg.Discovery.Current(),
+		discovery:     cfg.Discovery,
+		room:          cfg.Room,
+		leaveRoom:     cfg.LeaveRoom,
+	}
+	m.textInput.Placeholder = "Type something..."
+	m.hoveredMessageIndex = len(m.messages)
+	return m, nil
+}
+
+// A text input in our style, shared with the setup wizard
+func NewTextInput() textinput.Model {
+	ti := textinput.New()
+	ti.Focus()
+	ti.CharLimit = 256
+	ti.Width = width
+
+	ti.Cursor.Style = bubblePinkAccentStyle
+	ti.PromptStyle = bubblePinkAccentStyle
+	return ti
+}
+
+// The accent color, for headings outside the chat
+func AccentStyle() lipgloss.Style {
+	return bubblePinkAccentStyle
+}
+
+// A command to send a message to the given remote peers, reporting the
+// first send that failed
+func sendMessage(conn transport.Conn, peers *transport.Roster, remoteAddrs []*net.UDPAddr, message protocol.Frame) tea.Cmd {
+	return func() tea.Msg {
+		var failed tea.Msg
+		for _, remoteAddr := range remoteAddrs {
+			if err := transport.SendMessage(conn, peers, remoteAddr, message); err != nil && failed == nil {
+				failed = NetworkError{op: "send", err: err}
+			}
+		}
+		return failed
+	}
+}
+
+// A message from the peer that sent f, showing relayed messages as coming
+// from whoever wrote them
+func peerMessage(addr *net.UDPAddr, f protocol.Frame) Message {
+	message := Message{
+		time: time.Now(),
+		ip:   addr.IP.String(),
+		port: addr.Port,
+		peer: addr.String(),
+	}
+	if f.Sent != 0 {
+		message.sent = time.Unix(0, f.Sent)
+	}
+	if from, err := net.ResolveUDPAddr("udp", f.From); f.From != "" && err == nil {
+		message.ip = from.IP.String()
+		message.port = from.Port
+		message.peer = from.String()
+		message.via = addr.String()
+	}
+	return message
+}
+
+// The timing of a reply or ack to a frame we stamped when sending
+func replyTiming(peer string, f protocol.Frame) RTT {
+	timing := RTT{id: f.ID, peer: peer, sent: time.Unix(0, f.Sent), arrived: time.Now()}
+	if f.Recv != 0 {
+		timing.received = time.Unix(0, f.Recv)
+	}
+	return timing
+}
+
+// A command to listen for messages on our local port from our peers and the discovery server
+func listenForMessages(sub chan<- Response, presenceSub chan<- Presence, receiptSub chan<- Receipt, statusSub chan<- PeerStatus, errorSub chan<- NetworkError, rttSub chan<- RTT, callSub chan<- CallSignal, screenSub chan<- ScreenShare, live *atomic.Pointer[liveCall], conn transport.Conn, peers *transport.Roster, servers *discovery.Servers, identity ed25519.PrivateKey, done <-chan struct{}) tea.Cmd {
+	return func() tea.Msg {
+		defer crash.Recover()
+
+		screens := screenViewers{}
+		defer screens.close()
+		transport.Listen(conn, peers, servers.Has, done, transport.Handler{
+			Presence: func(addr *net.UDPAddr, state transport.State) {
+				presenceSub <- Presence{peer: addr.String(), state: state}
+			},
+			Moved: func(from, to *net.UDPAddr) {
+				presenceSub <- Presence{peer: to.String(), state: transport.Connected, from: from.String()}
+			},
+			Bye: func(addr *net.UDPAddr) {
+				presenceSub <- Presence{peer: addr.String(), bye: true}
+			},
+			Incompatible: func(addr *net.UDPAddr, version, minVersion int) {
+				presenceSub <- Presence{peer: addr.String(), version: version, minVersion: minVersion}
+			},
+			Renegotiated: func(addr *net.UDPAddr, oldCaps, caps int) {
+				presenceSub <- Presence{peer: addr.String(), renegotiated: true, oldCaps: oldCaps, caps: caps}
+			},
+			Message: func(addr *net.UDPAddr, f protocol.Frame) {
+				message := peerMessage(addr, f)
+				message.text = f.Text
+				message.direct = f.Direct
+				sub <- Response(message)
+			},
+			Voice: func(addr *net.UDPAddr, f protocol.Frame) {
+				message := peerMessage(addr, f)
+				message.text = voiceNoteText(f.Data)
+				message.voice = f.Data
+				sub <- Response(message)
+			},
+			File: func(addr *net.UDPAddr, f protocol.Frame) {
+				message := peerMessage(addr, f)
+				path, err := saveFile(f.Text, f.Data)
+				if err != nil {
+					slog.Error("saving a received file failed", "name", f.Text, "err", err)
+					message.text = fmt.Sprintf("📎 %s, which couldn't be saved: %v", f.Text, err)
+				} else {
+					message.text = fileText(filepath.Base(path), int64(len(f.Data)))
+					message.file, message.fileSize = path, int64(len(f.Data))
+				}
+				sub <- Response(message)
+			},
+			Ack: func(peer string, f protocol.Frame) {
+				receiptSub <- Receipt{id: f.ID, peer: peer, kind: f.Text}
+				if f.Sent != 0 {
+					rttSub <- replyTiming(peer, f)
+				}
+			},
+			Reply: func(peer string, f protocol.Frame) {
+				rttSub <- replyTiming(peer, f)
+			},
+			Status: func(peer string, f protocol.Frame) {
+				statusSub <- PeerStatus{peer: peer, status: f.Text, note: f.Note}
+			},
+			Nick: func(peer string, f protocol.Frame) {
+				statusSub <- PeerStatus{peer: peer, nick: f.Text, named: true}
+			},
+			Screen: func(peer string, f protocol.Frame) {
+				screens.frame(peer, f, screenSub)
+			},
+			Signal: func(peer string, f protocol.Frame) {
+				callSub <- CallSignal{peer: peer, id: f.ID, kind: f.Type, media: f.Text}
+			},
+			Audio: func(addr *net.UDPAddr, f protocol.Frame) {
+				// straight to the speaker, there are far too many to go through the UI
+				if c := live.Load(); c != nil && c.id == f.ID && c.peer == addr.String() {
+					c.audio.Receive(f.Seq, f.Data)
+				}
+			},
+			Text: func(addr *net.UDPAddr, text string) {
+				sub <- Response(Message{
+					time: time.Now(),
+					ip:   addr.IP.String(),
+					port: addr.Port,
+					peer: addr.String(),
+					text: text,
+				})
+			},
+			Error: func(err error) {
+				errorSub <- NetworkError{op: "receive", err: err}
+			},
+			Identity: identity,
+			Caps:     capabilities(),
+		})
+		return nil
+	}
+}
+
+// A command that waits for messages on a channel, taking whatever else has
+// arrived meanwhile too so a flood of messages costs one render rather than
+// one each
+func waitForMessages(sub <-chan Response) tea.Cmd {
+	return func() tea.Msg {
+		batch := Responses{<-sub}
+		for len(batch) < cap(sub) {
+			select {
+			case response := <-sub:
+				batch = append(batch, response)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+}
+
+// A command that waits for receipts on a channel.
+func waitForReceipts(sub <-chan Receipt) tea.Cmd {
+	return func() tea.Msg {
+		return <-sub
+	}
+}
+
+// A command that waits for socket errors on a channel.
+func waitForErrors(sub <-chan NetworkError) tea.Cmd {
+	return func() tea.Msg {
+		return <-sub
+	}
+}
+
+// A command that waits for round trip times on a channel.
+func waitForRTTs(sub <-chan RTT) tea.Cmd {
+	return func() tea.Msg {
+		return <-sub
+	}
+}
+
+// A command that wakes us up to measure our peers' round trip times
+func measureRTT() tea.Cmd {
+	return tea.Tick(rttInterval, func(time.Time) tea.Msg {
+		return rttTick{}
+	})
+}
+
+// A command that sends an echo frame to the given peers
+func sendEcho(conn transport.Conn, peers *transport.Roster, remoteAddrs []*net.UDPAddr, id string) tea.Cmd {
+	return sendMessage(conn, peers, remoteAddrs, protocol.Frame{Type: protocol.Echo, ID: id, Sent: time.Now().UnixNano()})
+}
+
+// A command that waits for peers coming and going on a channel.
+func waitForPresence(sub <-chan Presence) tea.Cmd {
+	return func() tea.Msg {
+		return <-sub
+	}
+}
+
+// A command to request the discovery server for our external address
+func requestAddress(conn transport.Conn, discoveryAddr *net.UDPAddr) tea.Cmd {
+	if err := discovery.RequestAddress(conn, discoveryAddr); err != nil {
+		slog.Error("asking discovery server failed", "server", discoveryAddr, "err", err)
+	}
+	return nil
+}
+
+func (m *Model) Init() tea.Cmd {
+	return tea.Batch(
+		// find out our external address straight away, so we can hand it to peers
+		requestAddress(m.conn, m.discoveryAddr),
+		listenForMessages(m.sub, m.presenceSub, m.receiptSub, m.statusSub, m.errorSub, m.rttSub, m.callSub, m.screenSub, m.live, m.conn, m.peers, m.discovery, m.identity, m.done),
+		waitForMessages(m.sub),
+		waitForPresence(m.presenceSub),
+		waitForReceipts(m.receiptSub),
+		waitForStatuses(m.statusSub),
+		waitForErrors(m.errorSub),
+		waitForRTTs(m.rttSub),
+		waitForCalls(m.callSub),
+		waitForScreens(m.screenSub),
+		measureRTT(),
+		checkWake(),
+		idleAfter(m.awayAfter),
+		m.reselectAfter(),
+	)
+}
+
+// Adds a message to the transcript in time order, which for anything but a
+// clock change means at the end.
+func (m *Model) addMessage(message Message) {
+	i := len(m.messages)
+	for i > 0 && message.time.Before(m.messages[i-1].time) {
+		i--
+	}
+	m.messages = slices.Insert(m.messages, i, message)
+
+	// forget the oldest, keeping the hover on the same message
+	if excess := len(m.messages) - m.maxMessages; excess > 0 {
+		m.messages = slices.Delete(m.messages, 0, excess)
+		m.hoveredMessageIndex = max(0, m.hoveredMessageIndex-excess)
+	}
+}
+
+// Quits, unless we're to ask first and haven't, in which case ctrl+c again
+// quits and anything else stays
+func (m *Model) askQuit() tea.Cmd {
+	if !m.confirmQuit || m.quitAsked {
+		return m.quit()
+	}
+	m.quitAsked = true
+	return nil
+}
+
+// Leaves our room, gives messages still being sent a moment to go out, says
+// goodbye to our peers, then stops the background goroutines and quits
+func (m *Model) quit() tea.Cmd {
+	if m.quitting {
+		return nil
+	}
+	m.quitting = true
+	m.quitRoom = m.room
+	m.leaveCurrentRoom()
+	if m.recording != nil {
+		m.recording.audio.Stop()
+		m.recording = nil
+	}
+	hangingUp := m.hangUpQuitting()
+	var unsharing tea.Cmd
+	if m.sharing != nil {
+		unsharing = m.stopSharing()
+	}
+
+	return func() tea.Msg {
+		if hangingUp != nil {
+			hangingUp()
+		}
+		if unsharing != nil {
+			unsharing()
+		}
+		flushed := make(chan struct{})
+		go func() {
+			m.outbox.Wait()
+			close(flushed)
+		}()
+		select {
+		case <-flushed:
+		case <-time.After(flushTimeout):
+			slog.Warn("quitting with messages still being sent")
+		}
+
+		// the daemon takes over our port, so peers shouldn't think we left
+		if !m.detached {
+			transport.SayGoodbye(m.conn, m.peers, m.identity)
+		}
+		close(m.done)
+		return tea.Quit()
+	}
+}
+
+// Whether we quit with /detach, for the daemon to take over
+func (m *Model) Detached() bool {
+	return m.detached
+}
+
+// The room we were in when we quit, empty if we'd left it or been kicked
+// out, for the daemon to hand back to the chat
+func (m *Model) QuitRoom() string {
+	return m.quitRoom
+}
+
+// Adds our own message to the transcript and sends it, to a single peer if one
+// is given or else to the whole group
+func (m *Model) send(text string, to *net.UDPAddr) tea.Cmd {
+	if m.quitting {
+		return nil
+	}
+	if m.beforeSend != nil {
+		var ok bool
+		if text, ok = m.beforeSend(text); !ok {
+			return nil
+		}
+	}
+	return m.deliver(Message{text: text}, to)
+}
+
+// Adds our own message, text or a voice note, to the transcript and sends it,
+// retrying until every recipient acknowledged it
+func (m *Model) deliver(message Message, to *net.UDPAddr) tea.Cmd {
+	m.hoveredMessageIndex++
+	m.copied = ""
+
+	message.time = time.Now()
+	message.ip = bubblePinkAccentStyle.Render("(You)") + " localhost"
+	message.port = m.localPort
+	message.id = protocol.NewMessageID()
+	message.receipts = map[string]bool{}
+	recipients := m.peers.Addrs()
+	if to != nil {
+		message.direct = true
+		message.to = to.String()
+		recipients = []*net.UDPAddr{to}
+	}
+	capability, what := needs(message)
+	recipients = m.capable(recipients, capability, what)
+	for _, recipient := range recipients {
+		message.recipients = append(message.recipients, recipient.String())
+	}
+
+	m.addMessage(message)
+	m.remember(message, true)
+
+	sending := m.transmit(message, recipients)
+	m.leaveLetters(message, m.awayMailboxes(message))
+	m.outbox.Add(1)
+	return tea.Batch(func() tea.Msg {
+		defer m.outbox.Done()
+		return sending()
+	}, retryAfter(message, 0))
+}
+
+// Adds a message from a peer or the discovery server to the transcript
+func (m *Model) receive(msg Response) {
+	from := &net.UDPAddr{IP: net.ParseIP(msg.ip), Port: msg.port}
+	fromDiscovery := msg.via == "" && transport.SameAddr(from, m.discoveryAddr)
+	if msg.via == "" && !fromDiscovery && m.discovery.Has(from) {
+		slog.Debug("ignoring answer from a discovery server we moved off", "server", from)
+		return
+	}
+	if fromDiscovery {
+		text, ok := discovery.Verify(m.discoveryAddr, msg.text)
+		if !ok {
+			slog.Warn("ignoring an answer from the discovery server it didn't sign", "text", text)
+			return
+		}
+		msg.text = text
+		if token, fresh := discovery.TakeToken(m.discoveryAddr, msg.text); token {
+			if fresh {
+				m.rediscover()
+			}
+			return
+		}
+	}
+	message, typed := discovery.ParseMessage(msg.text)
+	if fromDiscovery && (typed && m.handleRoomUpdate(message) || m.handleMoved(msg.text) || m.handleMail(msg.text)) {
+		return
+	}
+
+	addr, ok := message.Addr, typed && message.Type == discovery.Binding
+	if ok && !fromDiscovery {
+		// only the discovery server gets to tell us where we are
+		slog.Warn("ignoring address from someone other than the discovery server", "from", msg.peer, "via", msg.via, "addr", addr)
+		m.Notify("Warning: ignored an address from %s posing as the discovery server", msg.peer)
+		return
+	}
+
+	m.hoveredMessageIndex++
+
+	// show when the peer sent it rather than when it got here, which can be
+	// much later when it was queued or relayed, but never in the future as a
+	// clock estimate can be off
+	if local, ok := m.timings[msg.peer].Local(msg.sent); ok && local.Before(msg.time) {
+		msg.time = local
+	}
+
+	// the address is only ever wanted to paste to a peer, so copy it for
+	// them, unless it's the one they already had
+	copyAddr := ok && (addr != m.externalAddr || m.addrWanted)
+	if ok {
+		if m.identity != nil && addr != m.externalAddr {
+			// the server only hands letters over to the address we prove we're at
+			if err := discovery.CollectLetters(m.conn, m.discoveryAddr, m.identity, addr); err != nil {
+				slog.Error("collecting letters failed", "err", err)
+			}
+		}
+		m.externalAddr = addr
+		m.addrWanted = false
+		msg = Response{
+			time: msg.time,
+			ip:   bubblePinkAccentStyle.Render("(SYSTEM)") + " " + msg.ip,
+			port: msg.port,
+			text: addr,
+		}
+	}
+
+	m.addMessage(Message(msg))
+	m.remember(Message(msg), false)
+	if copyAddr {
+		m.Notify("Copied %s to the %s, paste it to your peer", addr, clipboardName(copyText(addr)))
+	}
+}
+
+// Adds a SYSTEM message to the transcript that only we can see
+func (m *Model) Notify(format string, a ...any) {
+	m.hoveredMessageIndex++
+
+	message := Message{
+		time: time.Now(),
+		ip:   bubblePinkAccentStyle.Render("(SYSTEM)") + " localhost",
+		port: m.localPort,
+		text: fmt.Sprintf(format, a...),
+	}
+
+	m.addMessage(message)
+	m.remember(message, false)
+}
+
+// Moves the hover cursor, where len(messages) means the text input
+func (m *Model) hover(index int) {
+	if len(m.messages) == 0 {
+		return
+	}
+	m.hoveredMessageIndex = clamp(index, 0, len(m.messages))
+	m.copied = ""
+	if m.hoveredMessageIndex < len(m.messages) {
+		m.hoveredMessage = m.messages[m.hoveredMessageIndex].text
+	} else {
+		m.hoveredMessage = ""
+	}
+}
+
+// How many messages roughly fit on one screen
+func (m *Model) pageSize() int {
+	if m.height == 0 {
+		return 10
+	}
+	// every message takes at least a header, a body and a blank line
+	return max(1, (m.height-headerHeight-inputHeight)/3)
+}
+
+// Handles a message, then works out again what to say under the input, as
+// either what's typed or what peers can do may have changed, so View only
+// has to show it
+func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	model, cmd := m.update(msg)
+	m.hint = m.commandHint()
+	return model, cmd
+}
+
+func (m *Model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		// typing brings us back if we went away for being idle
+		if back := m.active(); back != nil {
+			model, cmd := m.Update(msg)
+			return model, tea.Batch(back, cmd)
+		}
+		if keyType, ok := m.keys[msg.String()]; ok {
+			msg = tea.KeyMsg{Type: keyType}
+		}
+		// anything but ctrl+c again means we're staying
+		if msg.Type != tea.KeyCtrlC {
+			m.quitAsked = false
+		}
+		// and anything but tab again takes the completion we're on
+		if msg.Type != tea.KeyTab {
+			m.completion = completion{}
+		}
+		if m.selection.active {
+			return m.updateSelection(msg)
+		}
+		if m.picker.active {
+			return m.updatePicker(msg)
+		}
+
+		switch msg.Type {
+		case tea.KeyDown:
+			m.hover(m.hoveredMessageIndex + 1)
+			return m, nil
+
+		case tea.KeyUp:
+			m.hover(m.hoveredMessageIndex - 1)
+			return m, nil
+
+		// home and end jump to the oldest and newest messages
+		case tea.KeyHome:
+			m.hover(0)
+			return m, nil
+
+		case tea.KeyEnd:
+			m.hover(len(m.messages) - 1)
+			return m, nil
+
+		// page up and down move a screenful of messages at a time
+		case tea.KeyPgUp:
+			m.hover(m.hoveredMessageIndex - m.pageSize())
+			return m, nil
+
+		case tea.KeyPgDown:
+			m.hover(m.hoveredMessageIndex + m.pageSize())
+			return m, nil
+
+		// tab starts selecting part of the hovered message, or completes what
+		// we're typing
+		case tea.KeyTab:
+			if m.hoveredMessageIndex < len(m.messages) && len(m.messages) > 0 {
+				m.selection = newSelection(m.hoveredMessage, false)
+				m.copied = ""
+			} else {
+				m.complete()
+			}
+			return m, nil
+
+		// ctrl+r records a voice note while held, or until pressed again
+		case tea.KeyCtrlR:
+			return m, m.recordKey()
+
+		// ctrl+o opens the hovered file, and ctrl+g shows it in its folder
+		case tea.KeyCtrlO, tea.KeyCtrlG:
+			if m.hoveredMessageIndex < len(m.messages) && fileReady(m.messages[m.hoveredMessageIndex]) {
+				path := m.messages[m.hoveredMessageIndex].file
+				if msg.Type == tea.KeyCtrlO {
+					return m, openFile(path)
+				}
+				return m, revealFile(path)
+			}
+			return m, nil
+
+		// ctrl+y copies the whole conversation
+		case tea.KeyCtrlY:
+			m.copyAll()
+			return m, nil
+
+		case tea.KeyEnter:
+			// enter plays a voice note
+			if m.hoveredMessageIndex < len(m.messages) && m.messages[m.hoveredMessageIndex].voice != nil {
+				return m, playNote(m.messages[m.hoveredMessageIndex].voice)
+			}
+			// enter only copies to clipboard
+			if m.hoveredMessageIndex < len(m.messages) && len(m.messages) > 0 {
+				m.copied = copyText(m.hoveredMessage)
+				return m, nil
+			}
+
+			// enter does nothing
+			input := m.textInput.Value()
+			if input == "" {
+				return m, nil
+			}
+			// enter runs one of our own commands
+			command, arg, _ := strings.Cut(input, " ")
+			if b, ok := findBuiltin(command); ok {
+				m.textInput.Reset()
+				return m, b.run(m, arg)
+			}
+			// enter sends message to everyone, unless it's a command from a plugin
+			m.textInput.Reset()
+			if extra, ok := m.commands[command]; ok {
+				return m, func() tea.Msg {
+					extra.Run(strings.TrimSpace(arg))
+					return nil
+				}
+			}
+			// a typo'd command shouldn't reach our peers, and // sends a leading /
+			if text, ok := strings.CutPrefix(input, "/"); ok {
+				if !strings.HasPrefix(text, "/") {
+					m.Notify("Unknown command %s, /help lists them", command)
+					return m, nil
+				}
+				input = text
+			}
+			return m, m.send(input, nil)
+
+		case tea.KeyCtrlC:
+			return m, m.askQuit()
+
+		// esc clears what we're typing, or goes back to typing from a hovered message
+		case tea.KeyEsc:
+			if m.textInput.Value() != "" {
+				m.textInput.Reset()
+			} else {
+				m.hover(len(m.messages))
+			}
+			return m, nil
+
+		// Handle regular typing
+		default:
+			var cmd tea.Cmd
+			m.textInput, cmd = m.textInput.Update(msg)
+			return m, cmd
+		}
+
+	// Handle incoming peer messages
+	case Responses:
+		for _, response := range msg {
+			m.receive(response)
+		}
+		return m, waitForMessages(m.sub)
+
+	case Notice:
+		m.Notify("%s", msg.Text)
+		return m, nil
+
+	case pickerFiles:
+		if !m.picker.active {
+			return m, nil
+		}
+		if msg.err != nil {
+			m.picker = picker{}
+			m.Notify("Failed to list files: %v", msg.err)
+			return m, nil
+		}
+		m.picker.files, m.picker.loading = msg.files, false
+		m.picker.filter()
+		return m, nil
+
+	case clipboardContents:
+		return m, m.sendClipboard(msg)
+
+	case TranscriptRequest:
+		msg.Reply <- m.Transcript()
+		return m, nil
+
+	case Outgoing:
+		if msg.Text == "" {
+			return m, nil
+		}
+		return m, m.send(msg.Text, nil)
+
+	case Presence:
+		if msg.version != 0 {
+			m.refuse(msg)
+			return m, waitForPresence(m.presenceSub)
+		}
+		if msg.renegotiated {
+			m.renegotiated(msg)
+			return m, waitForPresence(m.presenceSub)
+		}
+		if msg.bye {
+			// it left rather than getting lost, so there's no reconnecting
+			delete(m.connections, msg.peer)
+			delete(m.statuses, msg.peer)
+			delete(m.notes, msg.peer)
+			delete(m.nicks, msg.peer)
+			slog.Info("peer disconnected", "peer", msg.peer)
+			m.Notify("%s disconnected", msg.peer)
+			if m.call != nil && m.call.peer.String() == msg.peer {
+				m.endCall()
+			}
+			return m, waitForPresence(m.presenceSub)
+		}
+		if msg.from != "" {
+			// what we know about the peer goes with it
+			if m.muted[msg.from] {
+				delete(m.muted, msg.from)
+				m.muted[msg.peer] = true
+			}
+			if status, ok := m.statuses[msg.from]; ok {
+				delete(m.statuses, msg.from)
+				m.statuses[msg.peer] = status
+			}
+			if note, ok := m.notes[msg.from]; ok {
+				delete(m.notes, msg.from)
+				m.notes[msg.peer] = note
+			}
+			if nick, ok := m.nicks[msg.from]; ok {
+				delete(m.nicks, msg.from)
+				m.nicks[msg.peer] = nick
+			}
+			delete(m.connections, msg.from)
+			delete(m.timings, msg.from)
+			m.connections[msg.peer] = transport.Connected
+			m.Notify("%s moved to %s", msg.from, msg.peer)
+			return m, waitForPresence(m.presenceSub)
+		}
+		previous := m.connections[msg.peer]
+		slog.Debug("peer connection changed", "peer", msg.peer, "from", previous, "to", msg.state)
+		if msg.state == transport.Connected && previous == transport.Lost {
+			m.connections[msg.peer] = msg.state
+			slog.Info("peer reconnected", "peer", msg.peer)
+			m.Notify("%s reconnected", msg.peer)
+		} else {
+			m.updatePresence(msg.peer, func() {
+				m.connections[msg.peer] = msg.state
+				if msg.state == transport.Lost {
+					// whatever it said it was may well have changed by the time it's back
+					delete(m.statuses, msg.peer)
+					delete(m.notes, msg.peer)
+				}
+			})
+		}
+		if msg.state == transport.Lost {
+			if m.reconnectDelay == 0 {
+				m.reconnectDelay = 2 * transport.PunchInterval
+				m.rediscover()
+				return m, tea.Batch(reconnectAfter(m.reconnectDelay), waitForPresence(m.presenceSub))
+			}
+			return m, waitForPresence(m.presenceSub)
+		}
+		if msg.state != transport.Connected || previous == transport.Degraded {
+			return m, waitForPresence(m.presenceSub)
+		}
+		// it may have missed us saying we're away, or what we go by
+		addr, err := net.ResolveUDPAddr("udp", msg.peer)
+		if err != nil {
+			return m, waitForPresence(m.presenceSub)
+		}
+		return m, tea.Batch(m.sendStatus([]*net.UDPAddr{addr}), m.sendNick([]*net.UDPAddr{addr}), waitForPresence(m.presenceSub))
+
+	case wakeTick:
+		if slept := sleptSince(msg.since); slept > minSleep {
+			m.resume(slept)
+		}
+		return m, checkWake()
+
+	case idleTick:
+		return m, m.idle()
+
+	case reselectTick:
+		return m, measureServers(m.discovery, m.conn)
+
+	case serversMeasured:
+		m.reselect(msg.rtts)
+		return m, m.reselectAfter()
+
+	case reconnectTick:
+		lost := 0
+		for peer, state := range m.connections {
+			if addr, err := net.ResolveUDPAddr("udp", peer); err != nil || !m.peers.Has(addr) {
+				delete(m.connections, peer)
+			} else if state == transport.Lost {
+				lost++
+			}
+		}
+		if lost == 0 {
+			m.reconnectDelay = 0
+			return m, nil
+		}
+		m.rediscover()
+		m.reconnectDelay = min(2*m.reconnectDelay, transport.MaxPunchInterval)
+		return m, reconnectAfter(m.reconnectDelay)
+
+	case NetworkError:
+		m.netErrors[msg.op]++
+		if text := msg.err.Error(); text != m.lastNetError[msg.op] {
+			m.lastNetError[msg.op] = text
+			m.Notify("Failed to %s: %v", msg.op, msg.err)
+		}
+		if msg.op == "receive" {
+			return m, waitForErrors(m.errorSub)
+		}
+		return m, nil
+
+	case PeerStatus:
+		if msg.named {
+			m.renamed(msg.peer, msg.nick)
+			return m, waitForStatuses(m.statusSub)
+		}
+		if msg.status == online || msg.status == away || msg.status == busy {
+			m.updatePresence(msg.peer, func() {
+				if msg.status == online {
+					delete(m.statuses, msg.peer)
+				} else {
+					m.statuses[msg.peer] = msg.status
+				}
+				if note := printable(msg.note, maxNote); note != "" {
+					m.notes[msg.peer] = note
+				} else {
+					delete(m.notes, msg.peer)
+				}
+			})
+		}
+		return m, waitForStatuses(m.statusSub)
+
+	case Receipt:
+		if msg.kind != "" {
+			slog.Debug("call signaling acknowledged", "type", msg.kind, "id", msg.id, "peer", msg.peer)
+			delete(m.signals, signalKey(msg.kind, msg.id))
+			return m, waitForReceipts(m.receiptSub)
+		}
+		slog.Debug("message acknowledged", "id", msg.id, "peer", msg.peer)
+		for _, message := range m.messages {
+			if msg.id != "" && message.id == msg.id && message.receipts != nil {
+				message.receipts[msg.peer] = true
+			}
+		}
+		return m, waitForReceipts(m.receiptSub)
+
+	case ScreenShare:
+		m.screenShare(msg)
+		return m, waitForScreens(m.screenSub)
+
+	case CallSignal:
+		return m, tea.Batch(m.callSignal(msg), waitForCalls(m.callSub))
+
+	case signalTick:
+		return m, m.resendSignal(msg)
+
+	case callStatsTick:
+		return m, m.updateCallStats()
+
+	case ringTimeout:
+		return m, m.ringTimedOut(msg.id)
+
+	case recordTick:
+		return m, m.stillRecording()
+
+	case retryTick:
+		return m, m.retry(msg)
+
+	case RTT:
+		timing := m.timings[msg.peer]
+		if timing == nil {
+			timing = &transport.Timing{}
+			m.timings[msg.peer] = timing
+		}
+		timing.Add(msg.sent, msg.received, msg.arrived)
+		if msg.id == m.manualPing {
+			reply := fmt.Sprintf("Reply from %s in %s", msg.peer, msg.arrived.Sub(msg.sent).Round(time.Microsecond))
+			if !msg.received.IsZero() {
+				reply += fmt.Sprintf(", jitter %s, clock offset %s", timing.Jitter.Round(time.Microsecond), timing.Offset.Round(time.Millisecond))
+			}
+			m.Notify("%s", reply)
+		}
+		return m, waitForRTTs(m.rttSub)
+
+	case rttTick:
+		return m, tea.Batch(sendEcho(m.conn, m.peers, m.peers.Addrs(), protocol.NewMessageID()), measureRTT())
+
+	case tea.WindowSizeMsg:
+		return m, m.resize(msg)
+
+	case resizeSettled:
+		return m, m.resizeSettled(msg)
+
+	// case ResizeMsg:
+	// 	m.rows = msg.rows
+	// 	m.cols = msg.cols - 3 // -3 because of the "> " prompt
+	// 	m.textInput.Width = m.cols
+	// 	return m, nil
+
+	// Handle any other events
+	default:
+		return m, nil
+	}
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
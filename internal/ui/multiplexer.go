@@ -0,0 +1,63 @@
+package ui
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/term"
+)
+
+// Terminal multiplexers we run inside of
+const (
+	inTmux   = "tmux"
+	inScreen = "screen"
+)
+
+// The multiplexer we're running inside of, if any
+func multiplexer() string {
+	switch {
+	case os.Getenv("TMUX") != "":
+		return inTmux
+	case os.Getenv("STY") != "" || strings.HasPrefix(os.Getenv("TERM"), "screen"):
+		return inScreen
+	}
+	return ""
+}
+
+// tmux and screen tell us about a pane resize before they're done redrawing
+// it, and while it's being dragged the sizes they report lag behind, so we
+// look at the size again once it's been still for resizeSettle and repaint
+// everything
+const resizeSettle = 150 * time.Millisecond
+
+// Sent resizeSettle after the size last changed
+type resizeSettled struct {
+	generation int // Which resize it follows, so only the last one counts
+}
+
+// Handles the terminal changing size
+func (m *Model) resize(msg tea.WindowSizeMsg) tea.Cmd {
+	m.height = msg.Height
+	if m.multiplexer == "" {
+		return nil
+	}
+	m.resizes++
+	generation := m.resizes
+	return tea.Tick(resizeSettle, func(time.Time) tea.Msg {
+		return resizeSettled{generation: generation}
+	})
+}
+
+// Picks up the size the multiplexer settled on and repaints, once it
+// stopped changing
+func (m *Model) resizeSettled(msg resizeSettled) tea.Cmd {
+	if msg.generation != m.resizes {
+		return nil
+	}
+	if _, height, err := term.GetSize(os.Stdout.Fd()); err == nil && height > 0 {
+		m.height = height
+	}
+	return tea.ClearScreen
+}
@@ -0,0 +1,90 @@
+package ui
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"unicode"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/protocol"
+)
+
+// The longest name anyone goes by, in runes
+const maxNick = 32
+
+// Text a peer chose for us to show, as it's safe to show, with anything that
+// isn't printable taken out so it can't smuggle escape codes into our
+// terminal, and cut to at most max runes
+func printable(text string, max int) string {
+	text = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.TrimSpace(text)
+	if runes := []rune(text); len(runes) > max {
+		text = strings.TrimSpace(string(runes[:max]))
+	}
+	return text
+}
+
+// What to show a peer as, its name if it told us one
+func (m *Model) label(peer string) string {
+	if nick := m.nicks[peer]; nick != "" {
+		return nick
+	}
+	return peer
+}
+
+// A command that tells the given peers what to show us by, if we have a name
+func (m *Model) sendNick(remoteAddrs []*net.UDPAddr) tea.Cmd {
+	if m.nick == "" {
+		return nil
+	}
+	return sendMessage(m.conn, m.peers, remoteAddrs, protocol.Frame{Type: protocol.Nick, Text: m.nick})
+}
+
+// Sets the name we go by, telling everyone and keeping it for next time, or
+// says what it is when there's no name
+func (m *Model) setNick(arg string) tea.Cmd {
+	if strings.TrimSpace(arg) == "" {
+		if m.nick == "" {
+			m.Notify("You go by your address, /nick name sets a name")
+		} else {
+			m.Notify("You go by %s", m.nick)
+		}
+		return nil
+	}
+	nick := printable(arg, maxNick)
+	if nick == "" {
+		m.Notify("Usage: /nick name")
+		return nil
+	}
+	m.nick = nick
+	m.Notify("You're now %s", nick)
+	if m.saveNick != nil {
+		if err := m.saveNick(nick); err != nil {
+			slog.Error("saving nick failed", "err", err)
+			m.Notify("Failed to keep %s for next time: %v", nick, err)
+		}
+	}
+	return m.sendNick(m.peers.Addrs())
+}
+
+// A peer told us what to show it by
+func (m *Model) renamed(peer, nick string) {
+	nick = printable(nick, maxNick)
+	before := m.label(peer)
+	if nick == "" {
+		delete(m.nicks, peer)
+	} else {
+		m.nicks[peer] = nick
+	}
+	if after := m.label(peer); after != before {
+		slog.Info("peer renamed", "peer", peer, "nick", nick)
+		m.Notify("%s is now %s", before, after)
+	}
+}
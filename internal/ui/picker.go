@@ -0,0 +1,263 @@
+package ui
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// We stop looking for files to pick from after maxPickerFiles, so a /send in
+// the home directory doesn't walk the whole disk
+const maxPickerFiles = 20000
+
+// The /send file picker, which narrows the files under the current directory
+// down to those fuzzily matching what's typed
+type picker struct {
+	active  bool
+	loading bool
+	files   []string // Relative to the current directory, slash separated
+	query   string
+	matches []string
+	cursor  int
+}
+
+// The files /send can pick from, walked in the background
+type pickerFiles struct {
+	files []string
+	err   error
+}
+
+// Opens the picker, which starts out empty until the files are found
+func (m *Model) openPicker() tea.Cmd {
+	m.picker = picker{active: true, loading: true}
+	return func() tea.Msg {
+		files, err := walkFiles(".")
+		return pickerFiles{files: files, err: err}
+	}
+}
+
+// Handles keys while picking a file to send
+func (m *Model) updatePicker(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	p := &m.picker
+	switch msg.Type {
+	case tea.KeyUp:
+		p.cursor = max(0, p.cursor-1)
+	case tea.KeyDown:
+		p.cursor = clamp(p.cursor+1, 0, max(0, len(p.matches)-1))
+	case tea.KeyBackspace:
+		if p.query != "" {
+			runes := []rune(p.query)
+			p.query = string(runes[:len(runes)-1])
+			p.filter()
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		p.query += string(msg.Runes)
+		p.filter()
+	case tea.KeyEnter:
+		if p.cursor >= len(p.matches) {
+			return m, nil
+		}
+		picked := p.matches[p.cursor]
+		m.picker = picker{}
+		return m, m.sendFile(filepath.FromSlash(picked))
+	case tea.KeyEsc:
+		m.picker = picker{}
+	case tea.KeyCtrlC:
+		return m, m.askQuit()
+	}
+	return m, nil
+}
+
+// Narrows the files down to those matching the query, best first
+func (p *picker) filter() {
+	type match struct {
+		file  string
+		score int
+	}
+	var matches []match
+	for _, file := range p.files {
+		if score := fuzzyScore(p.query, file); score >= 0 {
+			matches = append(matches, match{file, score})
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b match) int {
+		return a.score - b.score
+	})
+	p.matches = p.matches[:0]
+	for _, match := range matches {
+		p.matches = append(p.matches, match.file)
+	}
+	p.cursor = 0
+}
+
+// How well a query matches a path, with its letters in order but not
+// necessarily together, or -1 if it doesn't. Lower is better: every letter
+// skipped between matches costs a point, and a match that ends before the
+// file's name, only matching its folders, costs more.
+func fuzzyScore(query, file string) int {
+	query, lower := strings.ToLower(query), strings.ToLower(file)
+	score, last := 0, -1
+	remaining := []rune(query)
+	for i, r := range lower {
+		if len(remaining) == 0 {
+			break
+		}
+		if r == remaining[0] {
+			if last >= 0 {
+				score += i - last - 1
+			}
+			last = i
+			remaining = remaining[1:]
+		}
+	}
+	if len(remaining) > 0 {
+		return -1
+	}
+	if query != "" && last < strings.LastIndex(lower, "/") {
+		score += 1000
+	}
+	return score
+}
+
+// The picker, in place of the transcript
+func (p picker) view(rows int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n\n", bubblePinkAccentStyle.Render("Send which file?"), p.query+"█")
+	switch {
+	case p.loading:
+		b.WriteString(directStyle.Render("Looking for files...") + "\n")
+		return b.String()
+	case len(p.matches) == 0:
+		b.WriteString(directStyle.Render("No matching files") + "\n")
+		return b.String()
+	}
+
+	// keep the cursor in view
+	rows = max(1, rows-3)
+	first := max(0, p.cursor-rows+1)
+	for i := first; i < min(len(p.matches), first+rows); i++ {
+		if i == p.cursor {
+			fmt.Fprintf(&b, "%s %s\n", bubblePinkAccentStyle.Render(">"), selectedStyle.Render(p.matches[i]))
+		} else {
+			fmt.Fprintf(&b, "  %s\n", p.matches[i])
+		}
+	}
+	fmt.Fprintf(&b, "%s\n", directStyle.Render(fmt.Sprintf("%d/%d, enter to send, esc to cancel", len(p.matches), len(p.files))))
+	return b.String()
+}
+
+// Lists the files under root, leaving out .git and whatever .gitignore files
+// along the way ignore
+func walkFiles(root string) ([]string, error) {
+	var files []string
+	var rules []ignoreRule
+	err := filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// skip what we can't read rather than giving up
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." {
+			if entry.Name() == ".git" || ignored(rules, rel, entry.IsDir()) {
+				if entry.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if entry.IsDir() {
+			rules = append(rules, readGitignore(file, rel)...)
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			files = append(files, rel)
+		}
+		if len(files) >= maxPickerFiles {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return files, err
+}
+
+// A pattern from a .gitignore file, which covers the common part of git's
+// syntax: globs with * and ?, a leading **/, negation with !, directories
+// with a trailing / and anchoring with a leading or inner /
+type ignoreRule struct {
+	dir      string // The .gitignore's directory, relative to the root
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool // Matched against the whole path from dir, not just the name
+}
+
+func readGitignore(dir, rel string) []ignoreRule {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{dir: rel}
+		if rule.negate = strings.HasPrefix(line, "!"); rule.negate {
+			line = line[1:]
+		}
+		if rule.dirOnly = strings.HasSuffix(line, "/"); rule.dirOnly {
+			line = strings.TrimSuffix(line, "/")
+		}
+		line = strings.TrimPrefix(line, "**/")
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Whether the rules ignore a path, the last matching rule winning like in git
+func ignored(rules []ignoreRule, rel string, isDir bool) bool {
+	ignore := false
+	for _, rule := range rules {
+		if rule.matches(rel, isDir) {
+			ignore = !rule.negate
+		}
+	}
+	return ignore
+}
+
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.dir != "." {
+		if !strings.HasPrefix(rel, r.dir+"/") {
+			return false
+		}
+		rel = rel[len(r.dir)+1:]
+	}
+	if !r.anchored {
+		rel = path.Base(rel)
+	}
+	matched, _ := path.Match(r.pattern, rel)
+	return matched
+}
@@ -0,0 +1,243 @@
+package ui
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// How a peer appears to us
+const (
+	online  = "online"
+	away    = "away"
+	busy    = "busy"
+	offline = "offline"
+)
+
+// The longest status note anyone shows, in runes
+const maxNote = 64
+
+// How long without typing before we're away, unless the config says
+const DefaultAwayAfter = 10 * time.Minute
+
+// Sent when we may have been idle long enough to be away
+type idleTick struct{}
+
+// A peer telling us whether it's online, away or busy, or what to call it
+type PeerStatus struct {
+	peer   string // ip:port
+	status string
+	note   string
+	nick   string
+	named  bool // It told us its nick rather than its status
+}
+
+// A command that waits for peers' status frames on a channel.
+func waitForStatuses(sub <-chan PeerStatus) tea.Cmd {
+	return func() tea.Msg {
+		return <-sub
+	}
+}
+
+// A command that tells the given peers whether we're online, away or busy,
+// and what we're up to
+func (m *Model) sendStatus(remoteAddrs []*net.UDPAddr) tea.Cmd {
+	return sendMessage(m.conn, m.peers, remoteAddrs, protocol.Frame{Type: protocol.Status, Text: m.status, Note: m.note})
+}
+
+// A peer is offline unless its connection is up, if degraded, and otherwise
+// whatever it last told us it was
+func (m *Model) presenceOf(peer string) string {
+	if !m.connections[peer].Reachable() {
+		return offline
+	}
+	if status := m.statuses[peer]; status != "" {
+		return status
+	}
+	return online
+}
+
+// A peer's presence with what it says it's up to, if anything
+func (m *Model) describe(peer string) string {
+	presence := m.presenceOf(peer)
+	if note := m.notes[peer]; note != "" && presence != offline {
+		return presence + ", " + note
+	}
+	return presence
+}
+
+// Applies a change to what we know about a peer, with a SYSTEM line if that
+// changes its presence or what it says it's up to
+func (m *Model) updatePresence(peer string, change func()) {
+	before := m.describe(peer)
+	change()
+	if after := m.describe(peer); after != before {
+		slog.Info("peer presence changed", "peer", peer, "from", before, "to", after)
+		m.Notify("%s is %s", m.label(peer), after)
+	}
+}
+
+// Sets whether we're online, away or busy and what we're up to, from
+// "/status state [note]" or "/status note"
+func (m *Model) setStatus(arg string) tea.Cmd {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		m.Notify("You're %s. Usage: /status online|away|busy [note], or /status note", m.describeSelf())
+		return nil
+	}
+	state, note, _ := strings.Cut(arg, " ")
+	switch state {
+	case online, away, busy:
+		m.status = state
+	default:
+		note = arg
+	}
+	m.note = printable(note, maxNote)
+	m.autoAway = false
+	m.Notify("You're %s", m.describeSelf())
+	return m.sendStatus(m.peers.Addrs())
+}
+
+// Our own presence with what we say we're up to
+func (m *Model) describeSelf() string {
+	if m.note != "" {
+		return m.status + ", " + m.note
+	}
+	return m.status
+}
+
+// How long without typing before we're away, going by the config
+func awayAfter(configured time.Duration) time.Duration {
+	switch {
+	case configured == 0:
+		return DefaultAwayAfter
+	case configured < 0:
+		return 0
+	}
+	return configured
+}
+
+// A command that wakes us up once we may have been idle for after, if we go
+// away when idle at all
+func idleAfter(after time.Duration) tea.Cmd {
+	if after <= 0 {
+		return nil
+	}
+	return tea.Tick(after, func(time.Time) tea.Msg {
+		return idleTick{}
+	})
+}
+
+// Goes away once we haven't typed for awayAfter, if we're online, and checks
+// again when we might have been
+func (m *Model) idle() tea.Cmd {
+	idle := time.Since(m.lastInput)
+	if idle < m.awayAfter {
+		return idleAfter(m.awayAfter - idle)
+	}
+	if m.status != online {
+		return idleAfter(m.awayAfter)
+	}
+	m.status, m.autoAway = away, true
+	slog.Info("going away, idle", "for", idle)
+	m.Notify("You're %s, having been idle for %s", m.describeSelf(), idle.Round(time.Second))
+	return m.sendStatus(m.peers.Addrs())
+}
+
+// Notes that we typed something, coming back online if we only went away
+// for being idle
+func (m *Model) active() tea.Cmd {
+	m.lastInput = time.Now()
+	if !m.autoAway {
+		return nil
+	}
+	m.status, m.autoAway = online, false
+	m.Notify("You're back, %s", m.describeSelf())
+	return tea.Batch(m.sendStatus(m.peers.Addrs()), idleAfter(m.awayAfter))
+}
+
+// Shown next to a peer's name, for peers in the conversation
+func (m *Model) presenceMarker(peer string) string {
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil || !m.peers.Has(addr) {
+		return ""
+	}
+	switch m.presenceOf(peer) {
+	case online:
+		return " ●"
+	case away:
+		return directStyle.Render(" ◐")
+	case busy:
+		return directStyle.Render(" ◉")
+	default:
+		return directStyle.Render(" ○")
+	}
+}
+
+// How many peers are online, away, busy and offline for the status bar, how
+// many of the ones that aren't offline have a degraded connection, what they
+// say they're up to, and what we are ourselves
+func (m *Model) presenceStatus() string {
+	counts := map[string]int{}
+	degraded := 0
+	for _, addr := range m.peers.Addrs() {
+		counts[m.presenceOf(addr.String())]++
+		if m.connections[addr.String()] == transport.Degraded {
+			degraded++
+		}
+	}
+
+	var parts []string
+	for _, presence := range []string{online, away, busy, offline} {
+		if counts[presence] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[presence], presence))
+		}
+	}
+	if degraded > 0 {
+		parts = append(parts, directStyle.Render(fmt.Sprintf("%d degraded", degraded)))
+	}
+	var status string
+	if len(parts) > 0 {
+		status += "  " + bubblePinkAccentStyle.Render("peers") + " " + strings.Join(parts, ", ")
+	}
+	for _, addr := range m.peers.Addrs() {
+		if peer := addr.String(); m.notes[peer] != "" && m.presenceOf(peer) != offline {
+			status += "  " + bubblePinkAccentStyle.Render(m.label(peer)) + " " + m.notes[peer]
+		}
+	}
+	if m.status != online || m.note != "" {
+		status += "  " + bubblePinkAccentStyle.Render("you") + " " + m.describeSelf()
+	}
+	return status
+}
+
+// Drops a peer that speaks no protocol version we do, rather than showing
+// whatever it sends as garbage, and says which of us needs updating
+func (m *Model) refuse(msg Presence) {
+	addr, err := net.ResolveUDPAddr("udp", msg.peer)
+	if err != nil {
+		return
+	}
+	if m.call != nil && m.call.peer.String() == msg.peer {
+		m.endCall()
+	}
+	m.peers.Remove(addr)
+	delete(m.timings, msg.peer)
+	delete(m.connections, msg.peer)
+	delete(m.statuses, msg.peer)
+	delete(m.notes, msg.peer)
+
+	who := "Their p2p is too old to talk to, they need to update it"
+	if msg.version > protocol.Version {
+		who = "Our p2p is too old to talk to theirs, update it to talk to them"
+	}
+	m.Notify("Removed %s, which speaks protocol version %d while we speak %d to %d. %s.",
+		msg.peer, msg.version, protocol.MinVersion, protocol.Version, who)
+}
@@ -0,0 +1,113 @@
+package ui
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/transport"
+)
+
+// How many times we resend a message to peers that haven't acknowledged it
+// before marking it failed, and how long we wait for the first ack. The wait
+// doubles after every resend.
+const (
+	messageRetries = 5
+	retryInterval  = 500 * time.Millisecond
+)
+
+// Sent to resend a message to whoever hasn't acknowledged it yet
+type retryTick struct {
+	id      string
+	attempt int // How many times the message was resent so far
+}
+
+// A command that wakes us up to check on a message's acks
+func retryAfter(message Message, attempt int) tea.Cmd {
+	delay := retryInterval << attempt
+	if message.voice != nil {
+		delay += chunksSendTime(len(message.voice))
+	}
+	if message.file != "" {
+		delay += chunksSendTime(int(message.fileSize))
+	}
+	return tea.Tick(delay, func(time.Time) tea.Msg {
+		return retryTick{id: message.id, attempt: attempt}
+	})
+}
+
+// The index of one of our own messages in the transcript, or -1 if it's
+// gone, e.g. after /clear
+func (m *Model) ownMessage(id string) int {
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].id == id && m.messages[i].receipts != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// The recipients of a message that haven't acknowledged it
+func unacknowledged(message Message) []*net.UDPAddr {
+	var waiting []*net.UDPAddr
+	for _, recipient := range message.recipients {
+		if message.receipts[recipient] {
+			continue
+		}
+		if addr, err := net.ResolveUDPAddr("udp", recipient); err == nil {
+			waiting = append(waiting, addr)
+		}
+	}
+	return waiting
+}
+
+// Resends a message to whoever hasn't acknowledged it, or marks it failed
+// once we've run out of retries
+func (m *Model) retry(tick retryTick) tea.Cmd {
+	i := m.ownMessage(tick.id)
+	if i < 0 || m.quitting {
+		return nil
+	}
+	message := m.messages[i]
+	waiting := unacknowledged(message)
+	if len(waiting) == 0 {
+		return nil
+	}
+	// voice notes and files may take longer than we waited to get there
+	waiting = slices.DeleteFunc(waiting, func(addr *net.UDPAddr) bool {
+		return transport.Transferring(addr, message.id)
+	})
+	if len(waiting) == 0 {
+		return retryAfter(message, tick.attempt)
+	}
+	if tick.attempt >= messageRetries {
+		slog.Warn("message not acknowledged", "id", message.id, "waiting", len(waiting))
+		m.messages[i].failed = true
+		m.leaveLetters(message, m.mailboxes(waiting))
+		return nil
+	}
+
+	slog.Debug("resending message", "id", message.id, "attempt", tick.attempt+1, "waiting", len(waiting))
+	return tea.Batch(m.transmit(message, waiting), retryAfter(message, tick.attempt+1))
+}
+
+// Starts resending every failed message to whoever hasn't acknowledged it
+func (m *Model) retryFailed() tea.Cmd {
+	var cmds []tea.Cmd
+	for i, message := range m.messages {
+		if !message.failed || len(unacknowledged(message)) == 0 {
+			continue
+		}
+		m.messages[i].failed = false
+		cmds = append(cmds, m.retry(retryTick{id: message.id}))
+	}
+	if len(cmds) == 0 {
+		m.Notify("No failed messages to retry")
+		return nil
+	}
+	m.Notify("Retrying %d failed message(s)", len(cmds))
+	return tea.Batch(cmds...)
+}
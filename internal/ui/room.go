@@ -0,0 +1,149 @@
+package ui
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/discovery"
+)
+
+// Handles a room update pushed by the discovery server, adding and removing
+// peers as members come and go, and whether it relays for us. It reports
+// whether the message was one of those.
+func (m *Model) handleRoomUpdate(message discovery.Message) bool {
+	if message.Type != discovery.Offer && message.Type != discovery.RelayGrant {
+		return false
+	}
+	if message.Room != m.room {
+		return true
+	}
+
+	if message.Type == discovery.RelayGrant {
+		if message.Rate > 0 {
+			m.peers.SetServerRelay(m.discoveryAddr)
+		} else {
+			m.peers.SetServerRelay(nil)
+		}
+		return true
+	}
+
+	switch message.Event {
+	case "kicked", "banned":
+		m.Notify("You were %s from %s", message.Event, m.room)
+		close(m.leaveRoom)
+		m.peers.SetServerRelay(nil)
+		m.room = ""
+		return true
+	case "denied":
+		m.Notify("Only the owner of %s can kick or ban", m.room)
+		return true
+	case "punch":
+		if delay, ok := message.PunchDelay(); ok {
+			for _, member := range message.Addrs() {
+				m.peers.PunchAfter(m.conn, member, delay)
+			}
+		}
+		return true
+	}
+
+	for _, addr := range message.Addrs() {
+		switch message.Event {
+		case "members":
+			m.peers.Add(m.conn, addr, m.done)
+			delete(m.away, addr.String())
+		case "joined":
+			m.peers.Add(m.conn, addr, m.done)
+			delete(m.away, addr.String())
+			m.Notify("%s joined %s", addr, m.room)
+		case "left":
+			m.rememberMailbox(addr)
+			m.peers.Remove(addr)
+			m.Notify("%s left %s", addr, m.room)
+		}
+	}
+	if message.Event == "members" {
+		m.requestPunch()
+	}
+	return true
+}
+
+// Asks the discovery server to have us punch at the same time as the members
+// of our room we can't reach yet. We ask even when there are none, so the
+// server knows to have us punch with whoever joins later.
+func (m *Model) requestPunch() {
+	var unreached []*net.UDPAddr
+	for _, addr := range m.peers.Addrs() {
+		if !m.connections[addr.String()].Reachable() {
+			unreached = append(unreached, addr)
+		}
+	}
+	if err := discovery.RequestPunch(m.conn, m.discoveryAddr, m.room, unreached); err != nil {
+		slog.Error("asking discovery server failed", "server", m.discoveryAddr, "err", err)
+	}
+}
+
+// Leaves our room on the discovery server, if we're in one
+func (m *Model) leaveCurrentRoom() {
+	if m.room == "" {
+		return
+	}
+	_ = discovery.LeaveRoom(m.conn, m.discoveryAddr, m.room)
+	close(m.leaveRoom)
+	m.peers.SetServerRelay(nil)
+	m.room = ""
+}
+
+// Asks the discovery server where everyone in our room is now, in case a
+// peer we lost came back from a new address, and where we are, in case it
+// was us that moved
+func (m *Model) rediscover() {
+	requestAddress(m.conn, m.discoveryAddr)
+	if m.room == "" {
+		return
+	}
+	if err := discovery.RefreshRoom(m.conn, m.discoveryAddr, m.room, m.identity); err != nil {
+		slog.Error("asking discovery server failed", "server", m.discoveryAddr, "err", err)
+	}
+}
+
+// Handles the discovery server telling us our NAT moved us to a new external
+// address, reporting whether the text was that. Peers still send to the old
+// one, so we get back in touch straight away: they move us over once we prove
+// who we are from the new one, and our room hears where we are now.
+func (m *Model) handleMoved(text string) bool {
+	from, to, ok := discovery.ParseMoved(text)
+	if !ok {
+		return false
+	}
+	slog.Info("external address changed", "from", from, "to", to)
+	m.Notify("Our NAT moved us from %s to %s, getting back in touch with peers", from, to)
+	m.externalAddr = to
+	m.rediscover()
+	m.peers.Hurry()
+	return true
+}
+
+// A command that wakes us up to ask the discovery server about lost peers again
+func reconnectAfter(delay time.Duration) tea.Cmd {
+	return tea.Tick(delay, func(time.Time) tea.Msg {
+		return reconnectTick{}
+	})
+}
+
+// Asks the discovery server to kick or ban a member of our room
+func (m *Model) moderateRoom(command, target string) {
+	if m.room == "" {
+		m.Notify("You are not in a room")
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(target))
+	if err != nil {
+		m.Notify("Usage: /%s ip:port (%v)", command, err)
+		return
+	}
+	_ = discovery.Moderate(m.conn, m.discoveryAddr, command, m.room, addr)
+}
@@ -0,0 +1,138 @@
+package ui
+
+import (
+	"log/slog"
+	"net"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/protocol"
+	"p2p/internal/screen"
+	"p2p/internal/transport"
+)
+
+// A peer started or stopped sharing its screen
+type ScreenShare struct {
+	peer  string // ip:port
+	path  string // Where the shared screen is kept for an image viewer
+	ended bool
+}
+
+// Our screen being shared, and with whom
+type sharing struct {
+	id    string
+	to    []*net.UDPAddr
+	share *screen.Share
+}
+
+// A command that waits for peers starting and stopping screen shares on a
+// channel.
+func waitForScreens(sub <-chan ScreenShare) tea.Cmd {
+	return func() tea.Msg {
+		return <-sub
+	}
+}
+
+// Starts sharing our screen with everyone, or just the given peer
+func (m *Model) shareScreen(to *net.UDPAddr) tea.Cmd {
+	if m.sharing != nil {
+		m.Notify("You're already sharing your screen, /share-screen stop first")
+		return nil
+	}
+	recipients := m.peers.Addrs()
+	if to != nil {
+		recipients = []*net.UDPAddr{to}
+	}
+	if recipients = m.capable(recipients, protocol.CanScreen, "show a shared screen"); len(recipients) == 0 {
+		return nil
+	}
+
+	id := protocol.NewMessageID()
+	conn, peers := m.conn, m.peers
+	share, err := screen.Start(func(seq int64, tile protocol.Tile, jpeg []byte) {
+		f := protocol.Frame{Type: protocol.Screen, ID: id, Seq: seq, Tile: &tile, Data: jpeg}
+		for _, recipient := range recipients {
+			if err := transport.SendFrame(conn, peers, recipient, f); err != nil {
+				slog.Debug("sending screen tile failed", "peer", recipient, "err", err)
+			}
+		}
+	})
+	if err != nil {
+		m.Notify("Failed to share your screen: %v", err)
+		return nil
+	}
+	slog.Info("sharing screen", "peers", len(recipients))
+	m.sharing = &sharing{id: id, to: recipients, share: share}
+	m.Notify("Sharing your screen, /share-screen stop to stop")
+	return nil
+}
+
+// Stops sharing our screen, telling whoever we shared it with
+func (m *Model) stopSharing() tea.Cmd {
+	if m.sharing == nil {
+		m.Notify("You're not sharing your screen")
+		return nil
+	}
+	s := m.sharing
+	m.sharing = nil
+	s.share.Stop()
+	m.Notify("Stopped sharing your screen")
+	return sendMessage(m.conn, m.peers, s.to, protocol.Frame{Type: protocol.Screen, ID: s.id, Fin: true})
+}
+
+// Whether we're sharing our screen, for the status bar
+func (m *Model) screenStatus() string {
+	if m.sharing == nil {
+		return ""
+	}
+	return "  " + bubblePinkAccentStyle.Render("sharing screen")
+}
+
+// The screens peers are sharing with us, by ip:port. Only the listener
+// goroutine touches them.
+type screenViewers map[string]*screenViewer
+
+type screenViewer struct {
+	id     string
+	viewer *screen.Viewer
+}
+
+// Hands a screen frame from a peer to its viewer, starting one for a new share
+func (v screenViewers) frame(peer string, f protocol.Frame, sub chan<- ScreenShare) {
+	current, ok := v[peer]
+	if f.Fin {
+		if ok && current.id == f.ID {
+			current.viewer.Close()
+			delete(v, peer)
+			sub <- ScreenShare{peer: peer, ended: true}
+		}
+		return
+	}
+	if !ok || current.id != f.ID {
+		if ok {
+			current.viewer.Close()
+		}
+		path := screen.ViewerPath(peer)
+		current = &screenViewer{id: f.ID, viewer: screen.NewViewer(path)}
+		v[peer] = current
+		sub <- ScreenShare{peer: peer, path: path}
+	}
+	if f.Tile != nil {
+		current.viewer.Add(*f.Tile, f.Data)
+	}
+}
+
+func (v screenViewers) close() {
+	for _, current := range v {
+		current.viewer.Close()
+	}
+}
+
+// Says a peer started or stopped sharing its screen
+func (m *Model) screenShare(msg ScreenShare) {
+	if msg.ended {
+		m.Notify("%s stopped sharing their screen", msg.peer)
+		return
+	}
+	m.Notify("%s is sharing their screen, open %s in an image viewer to watch", msg.peer, msg.path)
+}
@@ -0,0 +1,118 @@
+package ui
+
+import (
+	"regexp"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	selectedStyle = lipgloss.NewStyle().Reverse(true)
+	wordPattern   = regexp.MustCompile(`\S+`)
+)
+
+// A sub-range of the hovered message, measured in words or lines
+type selection struct {
+	active bool
+	byLine bool
+	text   string
+	spans  [][]int // byte offsets [start, end) of every word or line in text
+	start  int     // first selected span
+	end    int     // last selected span
+}
+
+// Splits the text into the spans the selection moves across
+func selectionSpans(text string, byLine bool) [][]int {
+	if !byLine {
+		return wordPattern.FindAllStringIndex(text, -1)
+	}
+
+	var spans [][]int
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimSuffix(line, "\n")
+		if trimmed != "" {
+			spans = append(spans, []int{offset, offset + len(trimmed)})
+		}
+		offset += len(line)
+	}
+	return spans
+}
+
+func newSelection(text string, byLine bool) selection {
+	spans := selectionSpans(text, byLine)
+	return selection{
+		active: len(spans) > 0,
+		byLine: byLine,
+		text:   text,
+		spans:  spans,
+		start:  0,
+		end:    len(spans) - 1,
+	}
+}
+
+// The selected part of the message, exactly as it was received
+func (s selection) value() string {
+	if !s.active {
+		return ""
+	}
+	return s.text[s.spans[s.start][0]:s.spans[s.end][1]]
+}
+
+// The message text with the selected part highlighted
+func (s selection) render() string {
+	if !s.active {
+		return s.text
+	}
+	from, to := s.spans[s.start][0], s.spans[s.end][1]
+	selected := selectedStyle.Render(s.text[from:to])
+	if noColor {
+		selected = "[" + s.text[from:to] + "]"
+	}
+	return s.text[:from] + selected + s.text[to:]
+}
+
+func (s selection) unit() string {
+	if s.byLine {
+		return "line"
+	}
+	return "word"
+}
+
+// Handles keys while selecting part of the hovered message
+func (m *Model) updateSelection(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	s := &m.selection
+	last := len(s.spans) - 1
+
+	switch msg.Type {
+	// move the end of the selection
+	case tea.KeyLeft:
+		s.end = clamp(s.end-1, s.start, last)
+	case tea.KeyRight:
+		s.end = clamp(s.end+1, s.start, last)
+
+	// move the start of the selection
+	case tea.KeyShiftLeft:
+		s.start = clamp(s.start-1, 0, s.end)
+	case tea.KeyShiftRight:
+		s.start = clamp(s.start+1, 0, s.end)
+
+	// switch between selecting words and lines
+	case tea.KeyTab:
+		*s = newSelection(s.text, !s.byLine)
+
+	case tea.KeyEnter:
+		m.copied = copyText(s.value())
+		m.selection = selection{}
+
+	case tea.KeyEsc:
+		m.selection = selection{}
+
+	case tea.KeyCtrlC:
+		return m, m.askQuit()
+	}
+
+	return m, nil
+}
@@ -0,0 +1,75 @@
+package ui
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/crash"
+	"p2p/internal/discovery"
+	"p2p/internal/transport"
+)
+
+// How often we check whether another of the discovery servers we were given
+// is closer than the one we use, and how long we give them to answer
+const (
+	reselectInterval = 5 * time.Minute
+	measureTimeout   = 2 * time.Second
+)
+
+// Sent to measure the round trip to every discovery server again
+type reselectTick struct{}
+
+// The round trip to each discovery server, 0 where it didn't answer
+type serversMeasured struct {
+	rtts []time.Duration
+}
+
+// A command that wakes us up to measure the discovery servers again, if we
+// were given more than one
+func (m *Model) reselectAfter() tea.Cmd {
+	if len(m.discovery.All()) < 2 {
+		return nil
+	}
+	return tea.Tick(reselectInterval, func(time.Time) tea.Msg {
+		return reselectTick{}
+	})
+}
+
+// A command that measures the round trip to every discovery server, off the
+// chat's socket but from its IP, so -bind and -iface hold
+func measureServers(servers *discovery.Servers, conn transport.Conn) tea.Cmd {
+	var ip net.IP
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		ip = local.IP
+	}
+	return func() tea.Msg {
+		defer crash.Recover()
+		return serversMeasured{rtts: discovery.Measure(servers.All(), ip, measureTimeout)}
+	}
+}
+
+// Moves to a discovery server that turned out closer than ours, leaving our
+// room on the old one and joining it on the new, whose relay our room uses
+// once it grants us one
+func (m *Model) reselect(rtts []time.Duration) {
+	addr, rtt, ok := m.discovery.Better(rtts)
+	if !ok {
+		return
+	}
+	slog.Info("moving to a closer discovery server", "from", m.discoveryAddr, "to", addr, "rtt", rtt)
+	if m.room != "" {
+		if err := discovery.LeaveRoom(m.conn, m.discoveryAddr, m.room); err != nil {
+			slog.Error("leaving room failed", "server", m.discoveryAddr, "err", err)
+		}
+		// the old one stops relaying for us, and the new one hasn't
+		// started
+		m.peers.SetServerRelay(nil)
+	}
+	m.discovery.Use(addr)
+	m.discoveryAddr = addr
+	m.Notify("Moved to discovery server %s, %s away", addr, rtt.Round(time.Millisecond))
+	m.rediscover()
+}
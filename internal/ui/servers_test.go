@@ -0,0 +1,46 @@
+package ui
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"p2p/internal/discovery"
+	"p2p/internal/transport"
+)
+
+func TestReselectWaitsForRelayGrant(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	old := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	closer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3}
+	m, err := New(Config{
+		Conn:      conn,
+		Peers:     &transport.Roster{},
+		Discovery: discovery.NewServers([]*net.UDPAddr{old, closer}),
+		Room:      "r",
+		LeaveRoom: make(chan struct{}),
+		Done:      make(chan struct{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.peers.SetServerRelay(old)
+
+	m.reselect([]time.Duration{100 * time.Millisecond, 10 * time.Millisecond})
+	if m.discoveryAddr != closer {
+		t.Fatalf("moved to %s, want %s", m.discoveryAddr, closer)
+	}
+	if via := m.peers.RelayFor(peer); via != nil {
+		t.Errorf("relaying through %s before the new server granted it", via)
+	}
+
+	m.handleRoomUpdate(discovery.Message{Type: discovery.RelayGrant, Room: "r", Rate: 1000})
+	if via := m.peers.RelayFor(peer); via != closer {
+		t.Errorf("relaying through %v once granted, want %s", via, closer)
+	}
+}
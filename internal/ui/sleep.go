@@ -0,0 +1,61 @@
+package ui
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/discovery"
+)
+
+// How often we check whether the machine just woke up, and how much time has
+// to go missing in between to count as having slept
+const (
+	wakeCheckInterval = 2 * time.Second
+	minSleep          = 10 * time.Second
+)
+
+// Sent every wakeCheckInterval, with when the previous one was scheduled
+type wakeTick struct {
+	since time.Time
+}
+
+// A command that wakes us up to check whether the machine slept
+func checkWake() tea.Cmd {
+	since := time.Now()
+	return tea.Tick(wakeCheckInterval, func(time.Time) tea.Msg {
+		return wakeTick{since: since}
+	})
+}
+
+// How long the machine was asleep since the given time, if it was. The
+// monotonic clock stops during sleep on most systems while the wall clock
+// doesn't, and where it doesn't stop the tick is just late.
+func sleptSince(since time.Time) time.Duration {
+	now := time.Now()
+	elapsed := max(now.Sub(since), now.Round(0).Sub(since.Round(0)))
+	return elapsed - wakeCheckInterval
+}
+
+// Picks up where we left off after the machine slept: the socket may be dead,
+// our NAT mapping has likely expired and peers may have moved
+func (m *Model) resume(slept time.Duration) {
+	slog.Info("woke up from sleep", "slept", slept.Round(time.Second))
+	m.Notify("Woke up after %s asleep, reconnecting", slept.Round(time.Second))
+
+	if err := discovery.RequestAddress(m.conn, m.discoveryAddr); err != nil && m.rebind != nil {
+		slog.Warn("socket stopped working while asleep", "err", err)
+		if err := m.rebind(); err != nil {
+			m.Notify("Failed to open a new socket: %v", err)
+			return
+		}
+		if port := m.conn.LocalAddr().(*net.UDPAddr).Port; port != m.localPort {
+			m.localPort = port
+			m.Notify("Now on port %d, peers find us again by our identity", port)
+		}
+	}
+	m.rediscover()
+	m.peers.Hurry()
+}
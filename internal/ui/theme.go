@@ -0,0 +1,70 @@
+package ui
+
+import (
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Colors used by the TUI, as ANSI numbers or hex codes
+type Theme struct {
+	Accent           string `toml:"accent,omitempty"`
+	ButtonForeground string `toml:"button_foreground,omitempty"`
+	ButtonBackground string `toml:"button_background,omitempty"`
+	Muted            string `toml:"muted,omitempty"`
+}
+
+// Extra keys for each action, on top of the defaults, e.g. up = ["ctrl+p"]
+type Keymap struct {
+	Up       []string `toml:"up,omitempty"`
+	Down     []string `toml:"down,omitempty"`
+	Oldest   []string `toml:"oldest,omitempty"`
+	Newest   []string `toml:"newest,omitempty"`
+	PageUp   []string `toml:"page_up,omitempty"`
+	PageDown []string `toml:"page_down,omitempty"`
+	Select   []string `toml:"select,omitempty"`
+	Quit     []string `toml:"quit,omitempty"`
+	Record   []string `toml:"record,omitempty"`
+	CopyAll  []string `toml:"copy_all,omitempty"`
+	Open     []string `toml:"open,omitempty"`
+	Reveal   []string `toml:"reveal,omitempty"`
+}
+
+// Restyles the TUI with the theme's colors
+func (t Theme) Apply() {
+	if t.Accent != "" {
+		bubblePinkAccentStyle = bubblePinkAccentStyle.Foreground(lipgloss.Color(t.Accent))
+	}
+	if t.ButtonForeground != "" {
+		buttonStyle = buttonStyle.Foreground(lipgloss.Color(t.ButtonForeground))
+	}
+	if t.ButtonBackground != "" {
+		buttonStyle = buttonStyle.Background(lipgloss.Color(t.ButtonBackground))
+	}
+	if t.Muted != "" {
+		directStyle = directStyle.Foreground(lipgloss.Color(t.Muted))
+	}
+}
+
+// Maps every extra key to the default key it stands in for
+func (k Keymap) bindings() map[string]tea.KeyType {
+	bindings := map[string]tea.KeyType{}
+	for keyType, keys := range map[tea.KeyType][]string{
+		tea.KeyUp:     k.Up,
+		tea.KeyDown:   k.Down,
+		tea.KeyHome:   k.Oldest,
+		tea.KeyEnd:    k.Newest,
+		tea.KeyPgUp:   k.PageUp,
+		tea.KeyPgDown: k.PageDown,
+		tea.KeyTab:    k.Select,
+		tea.KeyCtrlC:  k.Quit,
+		tea.KeyCtrlR:  k.Record,
+		tea.KeyCtrlY:  k.CopyAll,
+		tea.KeyCtrlO:  k.Open,
+		tea.KeyCtrlG:  k.Reveal,
+	} {
+		for _, key := range keys {
+			bindings[key] = keyType
+		}
+	}
+	return bindings
+}
@@ -0,0 +1,252 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/muesli/reflow/wrap"
+)
+
+func (m *Model) View() string {
+	var output string
+
+	// debug
+	// output += "currentMessageIndex: " + strconv.Itoa(m.hoveredMessageIndex)
+	// output += "\nhoveredMessage: " + m.hoveredMessage
+	// output += "\ncopied: " + m.copied
+	// output += "\ntextInput.Value(): " + m.textInput.Value()
+	// output += fmt.Sprintf("\nrows:%d cols:%d", m.rows, m.cols)
+	// output += fmt.Sprintf("\nlast ping: %v", m.lastPingTime)
+	// output += "\n\n"
+
+	var copyButton string
+	switch m.copied {
+	case "":
+		copyButton = button("Copy")
+	case copiedToClipboard:
+		copyButton = button("Copied to clipboard!")
+	default:
+		copyButton = button("Copied via " + m.copied + "!")
+	}
+
+	// show where peers can reach us
+	external := m.externalAddr
+	if external == "" {
+		external = "asking discovery server..."
+	}
+	output += fmt.Sprintf("%s %s  %s %s%s%s%s%s%s\n\n",
+		bubblePinkAccentStyle.Render("local"),
+		m.conn.LocalAddr(),
+		bubblePinkAccentStyle.Render("external"),
+		external,
+		m.rttStatus(),
+		m.presenceStatus(),
+		m.errorStatus(),
+		m.callStatus(),
+		m.screenStatus(),
+	)
+
+	if m.picker.active {
+		output += m.picker.view(m.transcriptRows())
+	} else {
+		output += m.visible(func(i int) string { return m.block(i, copyButton) })
+	}
+
+	hint := m.hint
+	if m.quitAsked {
+		hint = directStyle.Render("Press ctrl+c again to quit, anything else to stay")
+	} else if popup := m.completion.view(); popup != "" {
+		hint = popup
+	}
+	output += fmt.Sprintf("\n%s", m.textInput.View())
+	if hint != "" {
+		output += "\n" + hint
+	}
+
+	return output
+}
+
+// Formats a message like ip:port [timestamp] then its text
+func (m *Model) block(i int, copyButton string) string {
+	message := m.messages[i]
+	var block string
+	// block += fmt.Sprintf("%s%s%s %s:%d%s %s",
+	// 	bubblePinkAccentStyle.Render("["),
+	// 	message.time.Format("15:04:05"),
+	// 	bubblePinkAccentStyle.Render("]"),
+	// 	message.ip,
+	// 	message.port,
+	// 	bubblePinkAccentStyle.Render(">"),
+	// 	message.text,
+	// )
+	sender := fmt.Sprintf("%s:%d", message.ip, message.port)
+	if message.peer != "" {
+		sender = peerStyle(message.peer).Render(m.label(message.peer)) + m.presenceMarker(message.peer)
+	} else if m.nick != "" && strings.HasPrefix(ansi.Strip(message.ip), "(You)") {
+		sender = bubblePinkAccentStyle.Render("(You)") + " " + m.nick
+	}
+	block += fmt.Sprintf("%s %s%s%s",
+		sender,
+		bubblePinkAccentStyle.Render("["),
+		message.time.Format("15:04"),
+		bubblePinkAccentStyle.Render("]"),
+	)
+	if message.to != "" {
+		block += directStyle.Render(" → " + message.to)
+	} else if message.direct {
+		block += directStyle.Render(" (direct)")
+	}
+	if message.via != "" {
+		block += directStyle.Render(" via " + message.via)
+	}
+	block += deliveryState(message, i == m.hoveredMessageIndex)
+	// muted peers' messages stay collapsed unless hovered
+	if m.muted[message.peer] && i != m.hoveredMessageIndex {
+		return block + directStyle.Render(" (muted)") + "\n\n"
+	}
+	text := message.text
+	if i == m.hoveredMessageIndex && m.selection.active {
+		block += fmt.Sprintf(" %s\n", button("Select ("+m.selection.unit()+")"))
+		text = m.selection.render()
+	} else if i == m.hoveredMessageIndex && message.voice != nil {
+		block += fmt.Sprintf(" %s\n", button("Play"))
+	} else if i == m.hoveredMessageIndex && fileReady(message) {
+		block += fmt.Sprintf(" %s %s %s\n", copyButton, button("Open ctrl+o"), button("Reveal in folder ctrl+g"))
+	} else if i == m.hoveredMessageIndex {
+		block += fmt.Sprintf(" %s\n", copyButton)
+	} else {
+		block += "\n"
+	}
+	block += wrap.String(fmt.Sprintf("%s %s\n\n", bubblePinkAccentStyle.Render("|"), text), width)
+	return block
+}
+
+// The round trip times for the status bar, as a range when there are several peers
+func (m *Model) rttStatus() string {
+	if len(m.timings) == 0 {
+		return ""
+	}
+	var lowest, highest time.Duration
+	for _, timing := range m.timings {
+		rtt := timing.RTT
+		if lowest == 0 || rtt < lowest {
+			lowest = rtt
+		}
+		highest = max(highest, rtt)
+	}
+
+	status := "  " + bubblePinkAccentStyle.Render("rtt") + " " + lowest.Round(time.Millisecond).String()
+	if highest.Round(time.Millisecond) != lowest.Round(time.Millisecond) {
+		status += "–" + highest.Round(time.Millisecond).String()
+	}
+	return status
+}
+
+// How many sends and receives failed, for the status bar
+func (m *Model) errorStatus() string {
+	var counts []string
+	for _, op := range []string{"send", "receive"} {
+		if n := m.netErrors[op]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, op))
+		}
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+	return "  " + bubblePinkAccentStyle.Render("errors") + " " + strings.Join(counts, ", ")
+}
+
+// How many of its recipients acknowledged one of our messages, with who we're
+// still waiting on when it's hovered
+func deliveryState(message Message, hovered bool) string {
+	var waiting []string
+	for _, recipient := range message.recipients {
+		if !message.receipts[recipient] {
+			waiting = append(waiting, recipient)
+		}
+	}
+
+	delivered := len(message.recipients) - len(waiting)
+	switch {
+	case message.failed && len(waiting) > 0:
+		state := bubblePinkAccentStyle.Render(" ✗ failed")
+		if len(message.recipients) > 1 {
+			state += fmt.Sprintf(" delivered to %d/%d", delivered, len(message.recipients))
+		}
+		if hovered {
+			state += directStyle.Render(" no ack from " + strings.Join(waiting, ", ") + ", /retry to resend")
+		}
+		return state
+	case delivered == 0:
+		return ""
+	case len(message.recipients) == 1:
+		return " ✓✓"
+	}
+
+	state := fmt.Sprintf(" ✓✓ delivered to %d/%d", delivered, len(message.recipients))
+	if hovered && len(waiting) > 0 {
+		state += directStyle.Render(" waiting on " + strings.Join(waiting, ", "))
+	}
+	return state
+}
+
+// How many rows there are between the header and the text input, leaving
+// room under the input for whichever of the quit prompt, the completions or
+// the hint View shows there
+func (m *Model) transcriptRows() int {
+	height := m.height
+	if height == 0 {
+		// until the terminal tells us its size
+		height = 24
+	}
+	rows := height - headerHeight - inputHeight
+	switch {
+	case m.quitAsked:
+		rows--
+	case m.completion.active():
+		rows -= m.completion.height()
+	case m.hint != "":
+		rows--
+	}
+	return rows
+}
+
+// Joins as many message blocks as fit on screen, keeping the hovered one in
+// view. Only the blocks that end up on screen, plus the one either side that
+// didn't fit, are ever formatted, however long the transcript is.
+func (m *Model) visible(block func(i int) string) string {
+	if len(m.messages) == 0 {
+		return ""
+	}
+
+	rows := m.transcriptRows()
+	last := min(m.hoveredMessageIndex, len(m.messages)-1)
+
+	// walk back from the hovered message, then fill any space left after it
+	blocks := []string{block(last)}
+	first := last
+	used := lipgloss.Height(blocks[0]) - 1
+	for first > 0 {
+		previous := block(first - 1)
+		if used+lipgloss.Height(previous)-1 > rows {
+			break
+		}
+		blocks = append([]string{previous}, blocks...)
+		first--
+		used += lipgloss.Height(previous) - 1
+	}
+	for last < len(m.messages)-1 {
+		next := block(last + 1)
+		if used+lipgloss.Height(next)-1 > rows {
+			break
+		}
+		blocks = append(blocks, next)
+		last++
+		used += lipgloss.Height(next) - 1
+	}
+
+	return strings.Join(blocks, "")
+}
@@ -0,0 +1,80 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDeliveryState(t *testing.T) {
+	// A message of ours to recipients, of which acked acknowledged it
+	message := func(recipients, acked []string, failed bool) Message {
+		receipts := map[string]bool{}
+		for _, peer := range acked {
+			receipts[peer] = true
+		}
+		return Message{recipients: recipients, receipts: receipts, failed: failed}
+	}
+	one := []string{"1.2.3.4:5"}
+	three := []string{"1.2.3.4:5", "6.7.8.9:10", "11.12.13.14:15"}
+
+	tests := []struct {
+		name    string
+		message Message
+		hovered bool
+		want    string
+	}{
+		{"no one yet", message(one, nil, false), true, ""},
+		{"to one", message(one, one, false), false, " ✓✓"},
+		{"to one of three", message(three, three[:1], false), false, " ✓✓ delivered to 1/3"},
+		{"to one of three, hovered", message(three, three[:1], false), true, " ✓✓ delivered to 1/3 waiting on 6.7.8.9:10, 11.12.13.14:15"},
+		{"to all three, hovered", message(three, three, false), true, " ✓✓ delivered to 3/3"},
+		{"failed", message(one, nil, true), false, " ✗ failed"},
+		{"failed, hovered", message(one, nil, true), true, " ✗ failed no ack from 1.2.3.4:5, /retry to resend"},
+		{"failed for some", message(three, three[:2], true), false, " ✗ failed delivered to 2/3"},
+		{"failed but acknowledged since", message(three, three, true), false, " ✓✓ delivered to 3/3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deliveryState(tt.message, tt.hovered); got != tt.want {
+				t.Errorf("deliveryState() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestViewFits(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(m *Model)
+	}{
+		{"nothing under the input", func(*Model) {}},
+		{"a hint", func(m *Model) { m.hint = "not everyone can use /call" }},
+		{"asking to quit", func(m *Model) { m.quitAsked = true }},
+		{"completions", func(m *Model) {
+			m.completion = completion{options: []option{{"/call", "/call"}, {"/clear", "/clear"}, {"/connect", "/connect"}}, current: -1}
+		}},
+		{"asking to quit over completions", func(m *Model) {
+			m.quitAsked = true
+			m.completion = completion{options: []option{{"/call", "/call"}, {"/clear", "/clear"}}, current: -1}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			m := newTestModel(t, &sent)
+			for i := range 50 {
+				m.addMessage(Message{ip: "1.2.3.4", port: 5, text: fmt.Sprint("message ", i)})
+			}
+			m.hoveredMessageIndex = len(m.messages) - 1
+			tt.setup(m)
+			// messages take several rows, so only some heights leave none spare
+			for height := 20; height < 30; height++ {
+				m.height = height
+				if rows := strings.Count(m.View(), "\n") + 1; rows > height {
+					t.Errorf("View takes %d rows of %d", rows, height)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package ui
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"p2p/internal/crash"
+	"p2p/internal/media"
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// Terminals don't tell us when a key is let go, only repeat it while it's
+// held. The record key counts as held once it repeats within repeatWindow,
+// and as let go once it stops repeating for releaseGap. Pressed once, it
+// starts recording until it's pressed again instead.
+const (
+	repeatWindow = time.Second
+	releaseGap   = 300 * time.Millisecond
+)
+
+// A voice note we're recording
+type recording struct {
+	audio   *media.Recording
+	started time.Time
+	lastKey time.Time // When the record key was last pressed or repeated
+	held    bool      // Whether the key is being held down rather than pressed once
+}
+
+// Sent while recording, to notice the record key was let go
+type recordTick struct{}
+
+// A command that wakes us up to check on the record key
+func checkRecording() tea.Cmd {
+	return tea.Tick(releaseGap/2, func(time.Time) tea.Msg {
+		return recordTick{}
+	})
+}
+
+// What a voice note shows as in the transcript
+func voiceNoteText(audio []byte) string {
+	return fmt.Sprintf("🎤 voice note, %s", media.NoteDuration(audio).Round(100*time.Millisecond))
+}
+
+// Handles the record key, starting a voice note or sending it
+func (m *Model) recordKey() tea.Cmd {
+	now := time.Now()
+	if m.recording == nil {
+		audio, err := media.Record()
+		if err != nil {
+			m.Notify("Failed to record a voice note: %v", err)
+			return nil
+		}
+		m.recording = &recording{audio: audio, started: now, lastKey: now}
+		return checkRecording()
+	}
+	if m.recording.held || now.Sub(m.recording.lastKey) < repeatWindow {
+		m.recording.held = true
+		m.recording.lastKey = now
+		return nil
+	}
+	return m.stopRecording()
+}
+
+// Sends the voice note once the record key was let go or it's as long as it gets
+func (m *Model) stillRecording() tea.Cmd {
+	if m.recording == nil {
+		return nil
+	}
+	if m.recording.held && time.Since(m.recording.lastKey) > releaseGap || time.Since(m.recording.started) > media.MaxNote {
+		return m.stopRecording()
+	}
+	return checkRecording()
+}
+
+// Stops recording and sends the voice note to everyone
+func (m *Model) stopRecording() tea.Cmd {
+	audio := m.recording.audio.Stop()
+	m.recording = nil
+	if len(audio) == 0 {
+		m.Notify("The voice note was empty")
+		return nil
+	}
+	slog.Info("recorded voice note", "duration", media.NoteDuration(audio))
+	return m.deliver(Message{text: voiceNoteText(audio), voice: audio}, nil)
+}
+
+// A command that sends a voice note or file to the given peers a chunk at a
+// time, to each as fast as the way there takes it, reporting the first send
+// that failed. A peer that acknowledged every chunk has it all, so that
+// counts as its receipt even if the ack for the whole thing gets lost.
+func sendChunks(conn transport.Conn, peers *transport.Roster, receiptSub chan<- Receipt, remoteAddrs []*net.UDPAddr, frames []protocol.Frame) tea.Cmd {
+	return func() tea.Msg {
+		errs := make([]error, len(remoteAddrs))
+		var wg sync.WaitGroup
+		for i, remoteAddr := range remoteAddrs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer crash.Recover()
+				var acknowledged bool
+				acknowledged, errs[i] = transport.SendChunks(conn, peers, remoteAddr, frames)
+				if acknowledged {
+					receiptSub <- Receipt{id: frames[0].ID, peer: remoteAddr.String()}
+				}
+			}()
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				slog.Warn("sending chunks failed", "peer", remoteAddrs[i], "id", frames[0].ID, "err", err)
+				return NetworkError{op: "send", err: err}
+			}
+		}
+		return nil
+	}
+}
+
+// How long sending a voice note or file of the given size takes at least,
+// which its acks can't come before
+func chunksSendTime(size int) time.Duration {
+	chunks := (size + transport.Chunk - 1) / transport.Chunk
+	return time.Duration(chunks) * transport.ChunkInterval
+}
+
+// A command that sends one of our messages, whether text, a voice note or a
+// file, to the given peers
+func (m *Model) transmit(message Message, recipients []*net.UDPAddr) tea.Cmd {
+	if message.voice != nil {
+		return sendChunks(m.conn, m.peers, m.receiptSub, recipients, transport.Chunks(protocol.Frame{Type: protocol.Voice, ID: message.id}, message.voice))
+	}
+	if message.file != "" {
+		return sendFile(m.conn, m.peers, m.receiptSub, recipients, message.id, message.file)
+	}
+	return sendMessage(m.conn, m.peers, recipients, protocol.Frame{
+		Type:   protocol.Message,
+		ID:     message.id,
+		Text:   message.text,
+		Direct: message.direct,
+		Sent:   time.Now().UnixNano(),
+	})
+}
+
+// A command that lists the microphones and speakers calls and voice notes
+// can use, marking the ones in use
+func listDevices() tea.Cmd {
+	return func() tea.Msg {
+		inputs, outputs, err := media.Devices()
+		if err != nil {
+			return Notice{Text: fmt.Sprintf("Failed to list audio devices: %v", err)}
+		}
+		var list strings.Builder
+		for _, group := range []struct {
+			heading string
+			devices []media.Device
+		}{{"Microphones", inputs}, {"Speakers", outputs}} {
+			fmt.Fprintf(&list, "%s:\n", group.heading)
+			for _, device := range group.devices {
+				marker := " "
+				if device.Selected {
+					marker = "*"
+				}
+				fmt.Fprintf(&list, "%s %s  %s\n", marker, device.Name, device.Description)
+			}
+		}
+		list.WriteString("Pick them with input and output under [audio] in the config file")
+		return Notice{Text: list.String()}
+	}
+}
+
+// A command that plays a voice note, saying so if it can't
+func playNote(audio []byte) tea.Cmd {
+	return func() tea.Msg {
+		if err := media.Play(audio); err != nil {
+			return Notice{Text: fmt.Sprintf("Failed to play the voice note: %v", err)}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+package ui
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"p2p/internal/transport"
+)
+
+// The peer in the conversation at an ip:port or going by a nick
+func (m *Model) findPeer(who string) (*net.UDPAddr, bool) {
+	if addr, err := net.ResolveUDPAddr("udp", who); err == nil && m.peers.Has(addr) {
+		return addr, true
+	}
+	for _, addr := range m.peers.Addrs() {
+		if strings.EqualFold(m.nicks[addr.String()], who) {
+			return addr, true
+		}
+	}
+	return nil, false
+}
+
+// Everything we know about a peer, for /whois
+func (m *Model) whois(who string) {
+	who = strings.TrimSpace(who)
+	addr, ok := m.findPeer(who)
+	if who == "" || !ok {
+		m.Notify("Usage: /whois ip:port or nick of someone in the conversation")
+		return
+	}
+	peer := addr.String()
+
+	var info strings.Builder
+	fmt.Fprintf(&info, "%s:\n", m.label(peer))
+	fmt.Fprintf(&info, "  address   %s\n", peer)
+	if nick := m.nicks[peer]; nick != "" {
+		fmt.Fprintf(&info, "  nick      %s\n", nick)
+	}
+	if key := m.peers.Key(addr); key != nil {
+		fmt.Fprintf(&info, "  identity  %s, verified\n", transport.Fingerprint(key))
+	} else if invited := m.peers.Invited(addr); invited != nil {
+		fmt.Fprintf(&info, "  identity  not proven yet, the invite says %s\n", transport.Fingerprint(invited))
+	} else {
+		info.WriteString("  identity  not proven yet\n")
+	}
+	fmt.Fprintf(&info, "  presence  %s\n", m.describe(peer))
+
+	switch relay := m.peers.RelayFor(addr); {
+	case relay == nil:
+		info.WriteString("  path      direct\n")
+	case m.discovery.Has(relay):
+		fmt.Fprintf(&info, "  path      relayed through the discovery server %s\n", relay)
+	default:
+		fmt.Fprintf(&info, "  path      relayed through %s\n", m.label(relay.String()))
+	}
+	if timing := m.timings[peer]; timing != nil {
+		fmt.Fprintf(&info, "  rtt       %s, jitter %s\n", timing.RTT.Round(time.Millisecond), timing.Jitter.Round(time.Millisecond))
+	}
+
+	version, caps := m.peers.Handshake(addr)
+	if version != 0 {
+		fmt.Fprintf(&info, "  protocol  version %d\n", version)
+	}
+	if caps == 0 {
+		info.WriteString("  can       everything, it didn't say otherwise\n")
+	} else {
+		can := []string{"receive messages"}
+		for _, name := range capabilityNames {
+			if caps&name.capability != 0 {
+				can = append(can, name.what)
+			}
+		}
+		fmt.Fprintf(&info, "  can       %s\n", strings.Join(can, ", "))
+	}
+
+	if seen := m.peers.LastSeen(addr); seen.IsZero() {
+		info.WriteString("  last seen never")
+	} else {
+		fmt.Fprintf(&info, "  last seen %s, %s ago", seen.Format("15:04:05"), time.Since(seen).Round(time.Second))
+	}
+	m.Notify("%s", info.String())
+}
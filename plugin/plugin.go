@@ -0,0 +1,51 @@
+// Package plugin is what chat plugins are written against. A plugin is a Go
+// plugin (go build -buildmode=plugin) in the plugins directory that exports
+//
+//	func New() plugin.Plugin
+//
+// It has to be built with the same Go version and module versions as p2p
+// itself, which in practice means building it from within this module.
+// Plugins only load on platforms Go supports plugins on, Linux and macOS.
+package plugin
+
+import "time"
+
+// A message from a peer
+type Message struct {
+	From   string // ip:port of whoever wrote it
+	Via    string // ip:port of the peer that relayed it, if it was relayed
+	Text   string
+	Direct bool // Sent to us alone rather than to the whole group
+	Time   time.Time
+}
+
+// What the chat lets plugins do. Its methods don't block and are safe to
+// call from any goroutine.
+type Host interface {
+	// Sends a message to everyone in the conversation, as if it was typed
+	Send(text string)
+	// Shows a SYSTEM message only we can see
+	Notify(text string)
+	// Adds a slash command, e.g. "/weather", run in the background with
+	// whatever was typed after it. Only call it from Init.
+	RegisterCommand(name, usage string, run func(args string))
+}
+
+// A chat plugin. The callbacks are called from the chat's UI, so they should
+// be quick and hand anything slow to a goroutine.
+type Plugin interface {
+	// Called once at startup
+	Init(host Host) error
+	// Called for every message from a peer
+	OnMessageReceived(message Message)
+	// Called for every message we're about to send, returning the text to send
+	// instead, or false to not send it at all
+	OnBeforeSend(text string) (string, bool)
+}
+
+// A Plugin that does nothing, to embed and override only what's needed
+type Base struct{}
+
+func (Base) Init(Host) error                         { return nil }
+func (Base) OnMessageReceived(Message)               {}
+func (Base) OnBeforeSend(text string) (string, bool) { return text, true }
@@ -0,0 +1,309 @@
+// Package p2p is a hole-punched UDP channel between peers, for Go programs
+// that want to talk to p2p chat users, or to each other, without the TUI.
+//
+//	s, err := p2p.Dial(ctx, ":4000", "203.0.113.7:4000")
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//	s.Send("hello")
+//	for m := range s.Receive() {
+//		fmt.Println(m.From, m.Text)
+//	}
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"p2p/internal/protocol"
+	"p2p/internal/transport"
+)
+
+// How reachable a peer is
+type PeerState int
+
+const (
+	// Punching holes towards the peer, without having heard from it yet
+	PeerConnecting PeerState = iota
+	// Heard from the peer lately
+	PeerConnected
+	// The peer missed a couple of keepalives
+	PeerDegraded
+	// The peer stopped sending keepalives, or said goodbye
+	PeerUnreachable
+	// The peer speaks no protocol version we do, so it was removed from the
+	// conversation
+	PeerIncompatible
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerDegraded:
+		return "degraded"
+	case PeerUnreachable:
+		return "unreachable"
+	case PeerIncompatible:
+		return "incompatible"
+	}
+	return "unknown"
+}
+
+// A message from a peer
+type Message struct {
+	From   *net.UDPAddr
+	Via    *net.UDPAddr // The peer that relayed the message, if it was relayed
+	Text   string
+	Direct bool // Sent to us alone rather than to everyone the sender talks to
+	Time   time.Time
+}
+
+// A conversation with one or more peers over a single UDP socket
+type Session struct {
+	conn     *net.UDPConn
+	peers    *transport.Roster
+	done     chan struct{}
+	messages chan Message
+
+	mu        sync.Mutex
+	states    map[string]PeerState
+	onChange  func(peer *net.UDPAddr, state PeerState)
+	connected chan struct{} // Closed once the first peer is connected
+	accepting bool          // Whether the next stranger to send a keepalive becomes our peer
+	closeOnce sync.Once
+}
+
+// Binds localAddr, e.g. ":4000", and punches a hole to the peer at
+// remoteAddr, returning once the peer answers or ctx is done. The peer has to
+// do the same towards us, with Dial or the chat.
+func Dial(ctx context.Context, localAddr, remoteAddr string) (*Session, error) {
+	raddr, err := net.ResolveUDPAddr("udp", remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := listen(localAddr, false)
+	if err != nil {
+		return nil, err
+	}
+	s.addPeer(raddr)
+	return s, s.waitConnected(ctx)
+}
+
+// Binds localAddr, e.g. ":4000", and waits for the first peer to punch
+// through to it, returning once that peer is connected or ctx is done. This
+// only works when our NAT lets in packets from addresses we never sent to, or
+// when there is no NAT; otherwise use Dial on both sides.
+func Accept(ctx context.Context, localAddr string) (*Session, error) {
+	s, err := listen(localAddr, true)
+	if err != nil {
+		return nil, err
+	}
+	return s, s.waitConnected(ctx)
+}
+
+// Binds localAddr, e.g. ":4000", without waiting for anyone. Add peers to
+// talk to with AddPeer.
+func Listen(localAddr string) (*Session, error) {
+	return listen(localAddr, false)
+}
+
+func listen(localAddr string, accepting bool) (*Session, error) {
+	laddr, err := net.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		conn:      conn,
+		peers:     &transport.Roster{},
+		done:      make(chan struct{}),
+		messages:  make(chan Message, 64),
+		states:    map[string]PeerState{},
+		connected: make(chan struct{}),
+		accepting: accepting,
+	}
+	go func() {
+		transport.Listen(conn, s.peers, nil, s.done, transport.Handler{
+			Stranger: s.stranger,
+			Presence: s.presence,
+			Message:  s.message,
+			Bye:      s.left,
+
+			Incompatible: s.incompatible,
+			Caps:         protocol.CanMessage | protocol.CanFEC,
+		})
+		close(s.messages)
+	}()
+	return s, nil
+}
+
+// Closes the session if ctx is done before a peer connects
+func (s *Session) waitConnected(ctx context.Context) error {
+	select {
+	case <-s.connected:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Accepts the first stranger that sends a keepalive, while accepting
+func (s *Session) stranger(addr *net.UDPAddr, data []byte) bool {
+	s.mu.Lock()
+	accept := s.accepting && transport.IsKeepalive(data)
+	s.accepting = false
+	s.mu.Unlock()
+
+	if accept {
+		s.addPeer(addr)
+	}
+	return accept
+}
+
+func (s *Session) addPeer(addr *net.UDPAddr) {
+	if s.peers.Add(s.conn, addr, s.done) {
+		s.setState(addr, PeerConnecting)
+	}
+}
+
+// How the states of the connections the listener keeps track of show to
+// users of the package
+var peerStates = map[transport.State]PeerState{
+	transport.Connecting: PeerConnecting,
+	transport.Connected:  PeerConnected,
+	transport.Degraded:   PeerDegraded,
+	transport.Lost:       PeerUnreachable,
+}
+
+// Follows a peer's connection as it's heard from and goes quiet
+func (s *Session) presence(addr *net.UDPAddr, state transport.State) {
+	s.setState(addr, peerStates[state])
+}
+
+// Marks a peer unreachable straight away when it says goodbye
+func (s *Session) left(addr *net.UDPAddr) {
+	s.setState(addr, PeerUnreachable)
+}
+
+// Drops a peer we can't talk to, as it runs a build too old or too new
+func (s *Session) incompatible(addr *net.UDPAddr, version, minVersion int) {
+	s.peers.Remove(addr)
+	s.setState(addr, PeerIncompatible)
+}
+
+func (s *Session) message(addr *net.UDPAddr, f protocol.Frame) {
+	message := Message{From: addr, Text: f.Text, Direct: f.Direct, Time: time.Now()}
+	if from, err := net.ResolveUDPAddr("udp", f.From); f.From != "" && err == nil {
+		message.From, message.Via = from, addr
+	}
+
+	select {
+	case s.messages <- message:
+	case <-s.done:
+	}
+}
+
+func (s *Session) setState(addr *net.UDPAddr, state PeerState) {
+	s.mu.Lock()
+	previous, known := s.states[addr.String()]
+	s.states[addr.String()] = state
+	onChange := s.onChange
+	if state == PeerConnected {
+		select {
+		case <-s.connected:
+		default:
+			close(s.connected)
+		}
+	}
+	s.mu.Unlock()
+
+	if onChange != nil && (!known || previous != state) {
+		onChange(addr, state)
+	}
+}
+
+// Sends a message to every peer, relaying it through another peer for any
+// we can't reach directly. Peers acknowledge it, but Send doesn't wait.
+func (s *Session) Send(text string) error {
+	select {
+	case <-s.done:
+		return net.ErrClosed
+	default:
+	}
+	f := protocol.Frame{Type: protocol.Message, ID: protocol.NewMessageID(), Text: text, Sent: time.Now().UnixNano()}
+	var errs []error
+	for _, addr := range s.peers.Addrs() {
+		if err := transport.SendMessage(s.conn, s.peers, addr, f); err != nil {
+			errs = append(errs, fmt.Errorf("sending to %s: %w", addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Messages from our peers. It's closed by Close, and has to be drained, or
+// keepalives back up behind it.
+func (s *Session) Receive() <-chan Message {
+	return s.messages
+}
+
+// Calls fn from a background goroutine whenever a peer connects, goes quiet
+// or comes back
+func (s *Session) OnPeerStateChange(fn func(peer *net.UDPAddr, state PeerState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// Adds another peer to the conversation
+func (s *Session) AddPeer(remoteAddr string) error {
+	addr, err := net.ResolveUDPAddr("udp", remoteAddr)
+	if err != nil {
+		return err
+	}
+	s.addPeer(addr)
+	return nil
+}
+
+// Every peer in the conversation
+func (s *Session) Peers() []*net.UDPAddr {
+	return s.peers.Addrs()
+}
+
+// How reachable a peer in the conversation is
+func (s *Session) PeerState(peer *net.UDPAddr) PeerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[peer.String()]
+}
+
+func (s *Session) LocalAddr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Stops punching holes and closes the socket
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.peers.Clear()
+		// closing done has the listener close it too, and whichever of us
+		// is second finds it closed
+		if err = s.conn.Close(); errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	})
+	return err
+}
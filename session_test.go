@@ -0,0 +1,20 @@
+package p2p
+
+import "testing"
+
+func TestSessionClose(t *testing.T) {
+	// the listener closes the socket too, so whichever gets there first
+	// varies from one session to the next
+	for range 5000 {
+		s, err := Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close() again = %v", err)
+		}
+	}
+}